@@ -6,10 +6,12 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/kokaq/core/internals/logger"
+	"github.com/kokaq/server/internals"
 	"github.com/kokaq/server/internals/control"
 	"github.com/kokaq/server/internals/shard"
 )
@@ -23,6 +25,32 @@ func main() {
 	// Define flags
 	paddr := flag.String("port", "", "Primary server port")
 	pshadress := flag.String("shardManagerAddress", "", "Secondary server port")
+	pshardRootDir := flag.String("shardRootDir", "", "Shard manager state directory")
+	preplicas := flag.Int("replicas", -1, "Followers allocated per shard")
+	papiKeys := flag.String("apiKeys", "", "JSON file of accepted API keys")
+	pjwks := flag.String("jwks", "", "JWKS file verifying bearer tokens")
+	pissuer := flag.String("issuer", "", "Required issuer of bearer tokens")
+	paudience := flag.String("audience", "", "Required audience of bearer tokens")
+	pclusterKey := flag.String("clusterKey", "", "Shared key nodes authenticate to each other with")
+	ppolicy := flag.String("policy", "", "JSON file of RBAC roles and bindings")
+	ptlsCert := flag.String("tlsCert", "", "PEM certificate served and presented to other nodes")
+	ptlsKey := flag.String("tlsKey", "", "PEM private key of tlsCert")
+	ptlsCA := flag.String("tlsCA", "", "PEM CA verifying peer certificates")
+	ptlsClientAuth := flag.String("tlsClientAuth", "", "Client certificates: none, request or require")
+	prequestTimeout := flag.Duration("requestTimeout", 0, "Default RPC timeout")
+	ptimeoutOverrides := flag.String("timeoutOverrides", "", "Per-method RPC timeouts, e.g. Dequeue=60s,Peek=2s")
+	ptracing := flag.String("tracing", "", "Trace exporter: none, otlp, console or file")
+	ptracingEndpoint := flag.String("tracingEndpoint", "", "OTLP collector address for the otlp exporter")
+	ptracingFile := flag.String("tracingFile", "", "File the file exporter appends spans to")
+	ptelemetry := flag.String("telemetry", "", "Telemetry event sinks: any of console, file and otlp, comma separated")
+	ptelemetryFile := flag.String("telemetryFile", "", "JSON lines file of the file telemetry sink")
+	ptelemetryEndpoint := flag.String("telemetryEndpoint", "", "OTLP collector address of the otlp telemetry sink")
+	ptelemetrySampling := flag.String("telemetrySampling", "", "Fraction of telemetry events kept, e.g. health_check_requested=0.01,*=1")
+	pmetricsPort := flag.String("metricsPort", "", "HTTP port serving control plane /metrics, none when empty")
+	prestPort := flag.String("restPort", "", "HTTP port serving the REST gateway, none when empty")
+	pamqpPort := flag.String("amqpPort", "", "Port accepting AMQP 0-9-1 clients, none when empty")
+	psqsPort := flag.String("sqsPort", "", "HTTP port serving the SQS-compatible API, none when empty")
+	pshardMetricsPort := flag.String("shardMetricsPort", "", "HTTP port serving shard manager /metrics, none when empty")
 	flag.Parse()
 
 	// Fallback to env vars if flags are not set
@@ -42,12 +70,158 @@ func main() {
 		port2 = "8999" // default fallback
 	}
 
+	shardRootDir := *pshardRootDir
+	if shardRootDir == "" {
+		shardRootDir = os.Getenv("SHARD_ROOT_DIRECTORY")
+	}
+
+	replicas := *preplicas
+	if replicas < 0 {
+		if v, err := strconv.Atoi(os.Getenv("SHARD_REPLICAS")); err == nil {
+			replicas = v
+		}
+	}
+	if replicas < 0 {
+		replicas = 0 // default fallback
+	}
+
+	metricsPort := *pmetricsPort
+	if metricsPort == "" {
+		metricsPort = os.Getenv("METRICS_PORT")
+	}
+
+	shardMetricsPort := *pshardMetricsPort
+	if shardMetricsPort == "" {
+		shardMetricsPort = os.Getenv("SHARD_METRICS_PORT")
+	}
+	restPort := *prestPort
+	if restPort == "" {
+		restPort = os.Getenv("REST_PORT")
+	}
+	restAddress := ""
+	if restPort != "" {
+		restAddress = ":" + restPort
+	}
+	amqpPort := *pamqpPort
+	if amqpPort == "" {
+		amqpPort = os.Getenv("AMQP_PORT")
+	}
+	amqpAddress := ""
+	if amqpPort != "" {
+		amqpAddress = ":" + amqpPort
+	}
+	sqsPort := *psqsPort
+	if sqsPort == "" {
+		sqsPort = os.Getenv("SQS_PORT")
+	}
+	sqsAddress := ""
+	if sqsPort != "" {
+		sqsAddress = ":" + sqsPort
+	}
+	metricsAddress := ""
+	if metricsPort != "" {
+		metricsAddress = ":" + metricsPort
+	}
+	shardMetricsAddress := ""
+	if shardMetricsPort != "" {
+		shardMetricsAddress = ":" + shardMetricsPort
+	}
+
+	security := internals.SecurityConfig{
+		Auth: internals.AuthConfig{
+			APIKeysFile: *papiKeys,
+			JWKSFile:    *pjwks,
+			Issuer:      *pissuer,
+			Audience:    *paudience,
+			ClusterKey:  *pclusterKey,
+			PolicyFile:  *ppolicy,
+		},
+		TLS: internals.TLSConfig{
+			CertFile:   *ptlsCert,
+			KeyFile:    *ptlsKey,
+			CAFile:     *ptlsCA,
+			ClientAuth: *ptlsClientAuth,
+		},
+	}.WithEnvDefaults()
+	if err := internals.UseClientSecurity(security); err != nil {
+		logger.ConsoleLog("ERROR", "Failed to load client certificate: %v", err)
+		return
+	}
+
+	overrides, err := internals.ParseTimeoutOverrides(*ptimeoutOverrides)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "%v", err)
+		return
+	}
+	timeouts, err := internals.TimeoutConfig{Default: *prequestTimeout, Overrides: overrides}.WithEnvDefaults()
+	if err != nil {
+		logger.ConsoleLog("ERROR", "%v", err)
+		return
+	}
+
+	tracing := internals.TracingConfig{
+		Exporter: *ptracing,
+		Endpoint: *ptracingEndpoint,
+		File:     *ptracingFile,
+	}.WithEnvDefaults()
+	if tracing.ServiceName == "" {
+		tracing.ServiceName = "kokaq-control-plane"
+	}
+	shutdownTracing, err := internals.StartTracing(context.Background(), tracing)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "%v", err)
+		return
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.ConsoleLog("WARN", "Failed to flush traces: %v", err)
+		}
+	}()
+
+	sampling, err := internals.ParseTelemetrySampling(*ptelemetrySampling)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "%v", err)
+		return
+	}
+	telemetry, err := internals.TelemetryConfig{
+		Sinks:       *ptelemetry,
+		File:        *ptelemetryFile,
+		Endpoint:    *ptelemetryEndpoint,
+		Sampling:    sampling,
+		ServiceName: tracing.ServiceName,
+	}.WithEnvDefaults()
+	if err != nil {
+		logger.ConsoleLog("ERROR", "%v", err)
+		return
+	}
+	telemetryLogger, err := internals.NewTelemetryLogger(context.Background(), telemetry)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "%v", err)
+		return
+	}
+	defer func() {
+		if err := telemetryLogger.Close(); err != nil {
+			logger.ConsoleLog("WARN", "Failed to flush telemetry: %v", err)
+		}
+	}()
+
 	logger.ConsoleLog("INFO", "Starting with Shard Port=%s as a child resource of PORT2=%s", port1, port2)
 
 	logger.ConsoleLog("INFO", "Kokaq Control Plane")
 	logger.ConsoleLog("INFO", "────────────────────────────────────────────")
 	logger.ConsoleLog("INFO", "   Listening on   : 0.0.0.0:%s", port1)
 	logger.ConsoleLog("INFO", "   Protocol       : gRPC v1.74.2")
+	if restPort != "" {
+		logger.ConsoleLog("INFO", "   REST Gateway   : 0.0.0.0:%s", restPort)
+	}
+	if amqpPort != "" {
+		logger.ConsoleLog("INFO", "   AMQP 0-9-1     : 0.0.0.0:%s", amqpPort)
+	}
+	if sqsPort != "" {
+		logger.ConsoleLog("INFO", "   SQS API        : 0.0.0.0:%s", sqsPort)
+	}
 	logger.ConsoleLog("INFO", "   Message Store  : Disk-backed Heap (Primary | Invisibility | DLQ)")
 	logger.ConsoleLog("INFO", "   Queue Capacity : Dynamic")
 	logger.ConsoleLog("INFO", "   Node Role      : Control Plane + Shard Manager")
@@ -82,9 +256,12 @@ func main() {
 	// logger.ConsoleLog("INFO", "   Total Messages    : %d", totalMessages)
 
 	logger.ConsoleLog("INFO", "────────────────────────────────────────────")
-	logger.ConsoleLog("INFO", "  Telemetry      : Enabled")
-	// logger.ConsoleLog("INFO", "  Tracing        : Jaeger [http://localhost:16686]")
-	// logger.ConsoleLog("INFO", "  Auth Mode      : Token-based")
+	logger.ConsoleLog("INFO", "  Telemetry      : %s", telemetry.Mode())
+	logger.ConsoleLog("INFO", "  Tracing        : %s", tracing.Mode())
+	logger.ConsoleLog("INFO", "  Metrics        : %s", metricsMode(metricsPort))
+	logger.ConsoleLog("INFO", "  Shard Metrics  : %s", metricsMode(shardMetricsPort))
+	logger.ConsoleLog("INFO", "  Auth Mode      : %s", security.Auth.Mode())
+	logger.ConsoleLog("INFO", "  Transport      : %s", security.TLS.Mode())
 	logger.ConsoleLog("INFO", "────────────────────────────────────────────")
 	logger.ConsoleLog("INFO", "")
 	logger.ConsoleLog("INFO", "Data Shard is up and humming... awaiting RPCs.")
@@ -93,12 +270,19 @@ func main() {
 	defer stop()
 
 	go func() {
-		shard.StartShardManager(":" + port2)
+		shard.StartShardManager(":"+port2, shardRootDir, replicas, security, timeouts, shardMetricsAddress, telemetryLogger)
 	}()
 
 	go func() {
-		control.StartControlServer(":"+port1, ":"+port2)
+		control.StartControlServer(":"+port1, ":"+port2, security, timeouts, metricsAddress, restAddress, amqpAddress, sqsAddress, telemetryLogger)
 	}()
 
 	<-ctx.Done()
 }
+
+func metricsMode(port string) string {
+	if port == "" {
+		return "Disabled"
+	}
+	return "http://0.0.0.0:" + port + "/metrics"
+}
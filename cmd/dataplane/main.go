@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
 	"runtime"
+	"time"
 
 	"github.com/kokaq/core/internals/logger"
+	"github.com/kokaq/server/internals"
 	"github.com/kokaq/server/internals/data"
 )
 
@@ -15,6 +18,27 @@ func main() {
 	addr := flag.String("port", "", "Primary server port")
 	prootDir := flag.String("rootDir", "", "Root Directory")
 	shadress := flag.String("shardManagerAddress", "", "Secondary server port")
+	preplicationAck := flag.String("replicationAck", "", "Replication ack mode: leader or quorum")
+	papiKeys := flag.String("apiKeys", "", "JSON file of accepted API keys")
+	pjwks := flag.String("jwks", "", "JWKS file verifying bearer tokens")
+	pissuer := flag.String("issuer", "", "Required issuer of bearer tokens")
+	paudience := flag.String("audience", "", "Required audience of bearer tokens")
+	pclusterKey := flag.String("clusterKey", "", "Shared key nodes authenticate to each other with")
+	ppolicy := flag.String("policy", "", "JSON file of RBAC roles and bindings")
+	ptlsCert := flag.String("tlsCert", "", "PEM certificate served and presented to other nodes")
+	ptlsKey := flag.String("tlsKey", "", "PEM private key of tlsCert")
+	ptlsCA := flag.String("tlsCA", "", "PEM CA verifying peer certificates")
+	ptlsClientAuth := flag.String("tlsClientAuth", "", "Client certificates: none, request or require")
+	prequestTimeout := flag.Duration("requestTimeout", 0, "Default RPC timeout")
+	ptimeoutOverrides := flag.String("timeoutOverrides", "", "Per-method RPC timeouts, e.g. Dequeue=60s,Peek=2s")
+	ptracing := flag.String("tracing", "", "Trace exporter: none, otlp, console or file")
+	ptracingEndpoint := flag.String("tracingEndpoint", "", "OTLP collector address for the otlp exporter")
+	ptracingFile := flag.String("tracingFile", "", "File the file exporter appends spans to")
+	ptelemetry := flag.String("telemetry", "", "Telemetry event sinks: any of console, file and otlp, comma separated")
+	ptelemetryFile := flag.String("telemetryFile", "", "JSON lines file of the file telemetry sink")
+	ptelemetryEndpoint := flag.String("telemetryEndpoint", "", "OTLP collector address of the otlp telemetry sink")
+	ptelemetrySampling := flag.String("telemetrySampling", "", "Fraction of telemetry events kept, e.g. health_check_requested=0.01,*=1")
+	pmetricsPort := flag.String("metricsPort", "", "HTTP port serving /metrics, none when empty")
 	flag.Parse()
 
 	// Fallback to env vars if flags are not set
@@ -42,6 +66,105 @@ func main() {
 		rootDir = "C://code/kokaq/bin" // default fallback
 	}
 
+	replicationAck := *preplicationAck
+	if replicationAck == "" {
+		replicationAck = os.Getenv("REPLICATION_ACK")
+	}
+	ackMode, err := data.ParseAckMode(replicationAck)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "%v", err)
+		return
+	}
+
+	metricsPort := *pmetricsPort
+	if metricsPort == "" {
+		metricsPort = os.Getenv("METRICS_PORT")
+	}
+	metricsAddress := ""
+	if metricsPort != "" {
+		metricsAddress = ":" + metricsPort
+	}
+
+	security := internals.SecurityConfig{
+		Auth: internals.AuthConfig{
+			APIKeysFile: *papiKeys,
+			JWKSFile:    *pjwks,
+			Issuer:      *pissuer,
+			Audience:    *paudience,
+			ClusterKey:  *pclusterKey,
+			PolicyFile:  *ppolicy,
+		},
+		TLS: internals.TLSConfig{
+			CertFile:   *ptlsCert,
+			KeyFile:    *ptlsKey,
+			CAFile:     *ptlsCA,
+			ClientAuth: *ptlsClientAuth,
+		},
+	}.WithEnvDefaults()
+	if err := internals.UseClientSecurity(security); err != nil {
+		logger.ConsoleLog("ERROR", "Failed to load client certificate: %v", err)
+		return
+	}
+
+	overrides, err := internals.ParseTimeoutOverrides(*ptimeoutOverrides)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "%v", err)
+		return
+	}
+	timeouts, err := internals.TimeoutConfig{Default: *prequestTimeout, Overrides: overrides}.WithEnvDefaults()
+	if err != nil {
+		logger.ConsoleLog("ERROR", "%v", err)
+		return
+	}
+
+	tracing := internals.TracingConfig{
+		Exporter: *ptracing,
+		Endpoint: *ptracingEndpoint,
+		File:     *ptracingFile,
+	}.WithEnvDefaults()
+	if tracing.ServiceName == "" {
+		tracing.ServiceName = "kokaq-data-plane"
+	}
+	shutdownTracing, err := internals.StartTracing(context.Background(), tracing)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "%v", err)
+		return
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.ConsoleLog("WARN", "Failed to flush traces: %v", err)
+		}
+	}()
+
+	sampling, err := internals.ParseTelemetrySampling(*ptelemetrySampling)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "%v", err)
+		return
+	}
+	telemetry, err := internals.TelemetryConfig{
+		Sinks:       *ptelemetry,
+		File:        *ptelemetryFile,
+		Endpoint:    *ptelemetryEndpoint,
+		Sampling:    sampling,
+		ServiceName: tracing.ServiceName,
+	}.WithEnvDefaults()
+	if err != nil {
+		logger.ConsoleLog("ERROR", "%v", err)
+		return
+	}
+	telemetryLogger, err := internals.NewTelemetryLogger(context.Background(), telemetry)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "%v", err)
+		return
+	}
+	defer func() {
+		if err := telemetryLogger.Close(); err != nil {
+			logger.ConsoleLog("WARN", "Failed to flush telemetry: %v", err)
+		}
+	}()
+
 	logger.ConsoleLog("INFO", "Starting with Shard Port=%s as a child resource of PORT2=%s", shardAddress, shardManagerAddress)
 
 	logger.ConsoleLog("INFO", "Kokaq Data Shard - gRPC Node")
@@ -51,6 +174,9 @@ func main() {
 	logger.ConsoleLog("INFO", "   Message Store  : Disk-backed Heap (Primary | Invisibility | DLQ)")
 	logger.ConsoleLog("INFO", "   Queue Capacity : Dynamic")
 	logger.ConsoleLog("INFO", "   Node Role      : Data Plane (Shard)")
+	logger.ConsoleLog("INFO", "   Replication    : %s ack", ackMode)
+	logger.ConsoleLog("INFO", "   Auth Mode      : %s", security.Auth.Mode())
+	logger.ConsoleLog("INFO", "   Transport      : %s", security.TLS.Mode())
 	logger.ConsoleLog("INFO", "")
 	logger.ConsoleLog("INFO", "────────────────────────────────────────────")
 	logger.ConsoleLog("INFO", "  System Info")
@@ -83,14 +209,20 @@ func main() {
 	// logger.ConsoleLog("INFO", "   Total Messages    : %d", totalMessages)
 
 	logger.ConsoleLog("INFO", "────────────────────────────────────────────")
-	logger.ConsoleLog("INFO", "  Telemetry      : Enabled")
-	// logger.ConsoleLog("INFO", "  Tracing        : Jaeger [http://localhost:16686]")
+	logger.ConsoleLog("INFO", "  Telemetry      : %s", telemetry.Mode())
+	logger.ConsoleLog("INFO", "  Tracing        : %s", tracing.Mode())
+	logger.ConsoleLog("INFO", "  Metrics        : %s", metricsMode(metricsPort))
 	// logger.ConsoleLog("INFO", "  Auth Mode      : Token-based")
 	logger.ConsoleLog("INFO", "────────────────────────────────────────────")
 	logger.ConsoleLog("INFO", "")
 	logger.ConsoleLog("INFO", "Data Shard is up and humming... awaiting RPCs.")
 
-	data.RegisterNode(shardManagerAddress, ":"+shardAddress, "data-plane:"+shardAddress)
-	data.StartNode(rootDir, ":"+shardAddress)
-	data.UnregisterNode(shardManagerAddress, ":"+shardAddress, "data-plane:"+shardAddress)
+	data.StartNode(rootDir, ":"+shardAddress, shardManagerAddress, "data-plane:"+shardAddress, ackMode, security, timeouts, metricsAddress, telemetryLogger)
+}
+
+func metricsMode(port string) string {
+	if port == "" {
+		return "Disabled"
+	}
+	return "http://0.0.0.0:" + port + "/metrics"
 }
@@ -0,0 +1,1343 @@
+package internals
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/internals/logger"
+	"github.com/kokaq/protocol/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// AMQP reply codes.
+const (
+	amqpNoRoute            = 312
+	amqpConnectionForced   = 320
+	amqpAccessRefused      = 403
+	amqpNotFound           = 404
+	amqpPreconditionFailed = 406
+	amqpFrameError         = 501
+	amqpSyntaxError        = 502
+	amqpCommandInvalid     = 503
+	amqpChannelError       = 504
+	amqpUnexpectedFrame    = 505
+	amqpNotAllowed         = 530
+	amqpNotImplemented     = 540
+	amqpInternalError      = 541
+)
+
+// AMQP methods the server speaks, class id in the high and method id in the
+// low 16 bits.
+const (
+	amqpConnectionStart   = 10<<16 | 10
+	amqpConnectionStartOk = 10<<16 | 11
+	amqpConnectionTune    = 10<<16 | 30
+	amqpConnectionTuneOk  = 10<<16 | 31
+	amqpConnectionOpen    = 10<<16 | 40
+	amqpConnectionOpenOk  = 10<<16 | 41
+	amqpConnectionClose   = 10<<16 | 50
+	amqpConnectionCloseOk = 10<<16 | 51
+	amqpChannelOpen       = 20<<16 | 10
+	amqpChannelOpenOk     = 20<<16 | 11
+	amqpChannelFlow       = 20<<16 | 20
+	amqpChannelFlowOk     = 20<<16 | 21
+	amqpChannelClose      = 20<<16 | 40
+	amqpChannelCloseOk    = 20<<16 | 41
+	amqpQueueDeclare      = 50<<16 | 10
+	amqpQueueDeclareOk    = 50<<16 | 11
+	amqpQueuePurge        = 50<<16 | 30
+	amqpQueuePurgeOk      = 50<<16 | 31
+	amqpQueueDelete       = 50<<16 | 40
+	amqpQueueDeleteOk     = 50<<16 | 41
+	amqpBasicQos          = 60<<16 | 10
+	amqpBasicQosOk        = 60<<16 | 11
+	amqpBasicConsume      = 60<<16 | 20
+	amqpBasicConsumeOk    = 60<<16 | 21
+	amqpBasicCancel       = 60<<16 | 30
+	amqpBasicCancelOk     = 60<<16 | 31
+	amqpBasicPublish      = 60<<16 | 40
+	amqpBasicReturn       = 60<<16 | 50
+	amqpBasicDeliver      = 60<<16 | 60
+	amqpBasicGet          = 60<<16 | 70
+	amqpBasicGetOk        = 60<<16 | 71
+	amqpBasicGetEmpty     = 60<<16 | 72
+	amqpBasicAck          = 60<<16 | 80
+	amqpBasicReject       = 60<<16 | 90
+	amqpBasicRecoverAsync = 60<<16 | 100
+	amqpBasicRecover      = 60<<16 | 110
+	amqpBasicRecoverOk    = 60<<16 | 111
+	amqpBasicNack         = 60<<16 | 120
+	amqpConfirmSelect     = 85<<16 | 10
+	amqpConfirmSelectOk   = 85<<16 | 11
+
+	amqpClassBasic = 60
+)
+
+const (
+	amqpChannelMax = 2047
+	amqpHeartbeat  = 60 * time.Second
+	// amqpMaxBody matches the default gRPC message limit the body has to
+	// fit in on its way to the data plane.
+	amqpMaxBody      = 4 << 20
+	amqpHandshake    = 10 * time.Second
+	amqpPollInterval = 100 * time.Millisecond
+	amqpPollMax      = time.Second
+)
+
+// Prefix of the attributes that carry AMQP properties kokaq messages have no
+// field for.
+const amqpAttributePrefix = "amqp."
+
+var errAMQPClosed = errors.New("amqp: connection closed")
+
+// AMQPBroker carries out what AMQP clients ask of an AMQPServer. vhost is
+// the virtual host the connection opened and ctx carries the credentials the
+// client logged in with. Errors are gRPC statuses; NotFound means the virtual
+// host or queue does not exist.
+type AMQPBroker interface {
+	OpenVirtualHost(ctx context.Context, vhost string) error
+	// DeclareQueue creates queue unless passive or it exists, and returns
+	// the number of messages ready in it.
+	DeclareQueue(ctx context.Context, vhost string, queue string, passive bool) (uint32, error)
+	PurgeQueue(ctx context.Context, vhost string, queue string) (uint32, error)
+	DeleteQueue(ctx context.Context, vhost string, queue string) (uint32, error)
+	Publish(ctx context.Context, vhost string, message *proto.KokaqMessageRequest) error
+	// Receive locks the next message of queue, or removes it when autoAck is
+	// set. It returns nil when the queue is empty.
+	Receive(ctx context.Context, vhost string, queue string, autoAck bool) (*proto.LockedMessage, error)
+	Ack(ctx context.Context, vhost string, queue string, message *proto.LockedMessage) error
+	// Reject hands a locked message back to the queue when requeue is set,
+	// and dead-letters or drops it otherwise.
+	Reject(ctx context.Context, vhost string, queue string, message *proto.LockedMessage, requeue bool) error
+}
+
+// AMQPServer lets AMQP 0-9-1 clients publish to and consume from kokaq
+// queues through an AMQPBroker. Only the default exchange is supported, so
+// messages are published straight to the queue named by their routing key.
+type AMQPServer struct {
+	broker   AMQPBroker
+	certs    *certReloader
+	listener net.Listener
+	mutex    sync.Mutex
+	conns    map[*amqpConnection]struct{}
+	wg       sync.WaitGroup
+}
+
+// NewAMQPServer creates a server accepting AMQPS with the certificates of
+// config when TLS is configured, plain AMQP otherwise.
+func NewAMQPServer(broker AMQPBroker, config TLSConfig) (*AMQPServer, error) {
+	s := &AMQPServer{broker: broker, conns: make(map[*amqpConnection]struct{})}
+	if config.Enabled() {
+		certs, err := newCertReloader(config)
+		if err != nil {
+			return nil, err
+		}
+		s.certs = certs
+	}
+	return s, nil
+}
+
+func (s *AMQPServer) Start(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	if s.certs != nil {
+		config, err := s.certs.serverConfig()
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, config)
+		logger.ConsoleLog("INFO", "AMQP listening with %s on %s", s.certs.config.Mode(), address)
+	} else {
+		logger.ConsoleLog("INFO", "AMQP listening without TLS on %s", address)
+	}
+	s.listener = listener
+	s.wg.Add(1)
+	go s.accept()
+	return nil
+}
+
+func (s *AMQPServer) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.ConsoleLog("ERROR", "AMQP listener stopped with error: %v", err)
+			}
+			return
+		}
+		c := newAMQPConnection(s, conn)
+		s.mutex.Lock()
+		s.conns[c] = struct{}{}
+		s.mutex.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			c.serve()
+			s.mutex.Lock()
+			delete(s.conns, c)
+			s.mutex.Unlock()
+		}()
+	}
+}
+
+// Stop closes the listener and every open connection, telling clients the
+// broker is going away, and waits for their messages to be requeued.
+func (s *AMQPServer) Stop(ctx context.Context) error {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mutex.Lock()
+	for c := range s.conns {
+		c.shutdown(&amqpError{code: amqpConnectionForced, text: "CONNECTION_FORCED - broker shutting down"})
+	}
+	s.mutex.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if s.certs != nil {
+		s.certs.Close()
+	}
+	return err
+}
+
+// amqpError is an AMQP exception. Hard errors close the connection, soft
+// ones only the channel.
+type amqpError struct {
+	code   uint16
+	text   string
+	method uint32
+}
+
+func (e *amqpError) Error() string {
+	return fmt.Sprintf("amqp %d: %s", e.code, e.text)
+}
+
+func (e *amqpError) hard() bool {
+	return e.code == amqpConnectionForced || e.code >= amqpFrameError
+}
+
+// amqpBackendError turns a failed broker call into the AMQP exception
+// closest to its gRPC status.
+func amqpBackendError(err error, method uint32) *amqpError {
+	st := status.Convert(err)
+	switch st.Code() {
+	case codes.NotFound:
+		return &amqpError{code: amqpNotFound, text: "NOT_FOUND - " + st.Message(), method: method}
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return &amqpError{code: amqpAccessRefused, text: "ACCESS_REFUSED - " + st.Message(), method: method}
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.AlreadyExists, codes.OutOfRange, codes.ResourceExhausted:
+		return &amqpError{code: amqpPreconditionFailed, text: "PRECONDITION_FAILED - " + st.Message(), method: method}
+	}
+	return &amqpError{code: amqpInternalError, text: "INTERNAL_ERROR - " + st.Message(), method: method}
+}
+
+type amqpConnection struct {
+	server       *AMQPServer
+	conn         net.Conn
+	reader       *bufio.Reader
+	writeMutex   sync.Mutex
+	writer       *bufio.Writer
+	closed       bool
+	frameMax     uint32
+	channelMax   uint16
+	heartbeat    time.Duration
+	cancelNotify bool
+	vhost        string
+	ctx          context.Context
+	cancel       context.CancelFunc
+	// channels is only used by the goroutine reading frames.
+	channels map[uint16]*amqpChannel
+}
+
+func newAMQPConnection(server *AMQPServer, conn net.Conn) *amqpConnection {
+	return &amqpConnection{
+		server:     server,
+		conn:       conn,
+		reader:     bufio.NewReader(conn),
+		writer:     bufio.NewWriter(conn),
+		frameMax:   amqpFrameMax,
+		channelMax: amqpChannelMax,
+		channels:   make(map[uint16]*amqpChannel),
+	}
+}
+
+func (c *amqpConnection) serve() {
+	defer c.conn.Close()
+	if err := c.handshake(); err != nil {
+		var e *amqpError
+		if errors.As(err, &e) {
+			c.shutdown(e)
+		}
+		logger.ConsoleLog("WARN", "AMQP handshake with %s failed: %v", c.conn.RemoteAddr(), err)
+		return
+	}
+	defer c.cancel()
+	defer c.closeChannels()
+	logger.ConsoleLog("INFO", "AMQP connection from %s opened virtual host %s", c.conn.RemoteAddr(), c.vhost)
+	if c.heartbeat > 0 {
+		go c.beat()
+	}
+	for {
+		if c.heartbeat > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(2 * c.heartbeat))
+		}
+		frame, err := readAMQPFrame(c.reader, c.frameMax)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logger.ConsoleLog("WARN", "AMQP connection from %s failed: %v", c.conn.RemoteAddr(), err)
+				c.shutdown(&amqpError{code: amqpFrameError, text: "FRAME_ERROR - " + err.Error()})
+			}
+			return
+		}
+		err = c.dispatch(frame)
+		var e *amqpError
+		switch {
+		case errors.Is(err, errAMQPClosed):
+			logger.ConsoleLog("INFO", "AMQP connection from %s closed", c.conn.RemoteAddr())
+			return
+		case errors.As(err, &e):
+			logger.ConsoleLog("WARN", "AMQP connection from %s closed with %v", c.conn.RemoteAddr(), e)
+			c.shutdown(e)
+			return
+		case err != nil:
+			logger.ConsoleLog("WARN", "AMQP connection from %s failed: %v", c.conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// handshake negotiates the connection up to connection.open-ok, logging the
+// client in with SASL PLAIN. The password is sent to the cluster as an API
+// key, or as a bearer token when the user name is "bearer".
+func (c *amqpConnection) handshake() error {
+	c.conn.SetDeadline(time.Now().Add(amqpHandshake))
+	defer c.conn.SetDeadline(time.Time{})
+	header := make([]byte, len(amqpProtocolHeader))
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return err
+	}
+	if string(header) != string(amqpProtocolHeader) {
+		c.conn.Write(amqpProtocolHeader)
+		return fmt.Errorf("unsupported protocol header %q", header)
+	}
+
+	start := amqpMethod(amqpConnectionStart)
+	start.octet(0)
+	start.octet(9)
+	start.table(amqpTable{
+		"product":  "kokaq",
+		"platform": "Go",
+		"capabilities": amqpTable{
+			"publisher_confirms":     true,
+			"basic.nack":             true,
+			"consumer_cancel_notify": true,
+			"per_consumer_qos":       false,
+		},
+	})
+	start.longstr("PLAIN")
+	start.longstr("en_US")
+	if err := c.send(0, start); err != nil {
+		return err
+	}
+	r, err := c.expect(amqpConnectionStartOk)
+	if err != nil {
+		return err
+	}
+	properties := r.table()
+	mechanism := r.shortstr()
+	response := r.longstr()
+	r.shortstr() // locale
+	if r.err != nil {
+		return &amqpError{code: amqpSyntaxError, text: "SYNTAX_ERROR - " + r.err.Error(), method: amqpConnectionStartOk}
+	}
+	if capabilities, ok := properties["capabilities"].(amqpTable); ok {
+		c.cancelNotify, _ = capabilities["consumer_cancel_notify"].(bool)
+	}
+	credentials := strings.Split(response, "\x00")
+	if mechanism != "PLAIN" || len(credentials) != 3 {
+		return &amqpError{code: amqpAccessRefused, text: "ACCESS_REFUSED - only the PLAIN mechanism is supported", method: amqpConnectionStartOk}
+	}
+	c.ctx, c.cancel = context.WithCancel(amqpCredentials(credentials[1], credentials[2]))
+
+	tune := amqpMethod(amqpConnectionTune)
+	tune.short(amqpChannelMax)
+	tune.long(amqpFrameMax)
+	tune.short(uint16(amqpHeartbeat / time.Second))
+	if err := c.send(0, tune); err != nil {
+		return err
+	}
+	if r, err = c.expect(amqpConnectionTuneOk); err != nil {
+		return err
+	}
+	channelMax, frameMax, heartbeat := r.short(), r.long(), r.short()
+	if r.err != nil {
+		return &amqpError{code: amqpSyntaxError, text: "SYNTAX_ERROR - " + r.err.Error(), method: amqpConnectionTuneOk}
+	}
+	if channelMax > 0 && channelMax < c.channelMax {
+		c.channelMax = channelMax
+	}
+	if frameMax > 0 && frameMax < c.frameMax {
+		c.frameMax = max(frameMax, amqpFrameMin)
+	}
+	c.heartbeat = time.Duration(heartbeat) * time.Second
+
+	if r, err = c.expect(amqpConnectionOpen); err != nil {
+		return err
+	}
+	vhost := r.shortstr()
+	if r.err != nil {
+		return &amqpError{code: amqpSyntaxError, text: "SYNTAX_ERROR - " + r.err.Error(), method: amqpConnectionOpen}
+	}
+	if err := c.server.broker.OpenVirtualHost(c.ctx, vhost); err != nil {
+		e := amqpBackendError(err, amqpConnectionOpen)
+		if e.code != amqpAccessRefused {
+			e = &amqpError{code: amqpNotAllowed, text: fmt.Sprintf("NOT_ALLOWED - cannot open virtual host %q: %s", vhost, status.Convert(err).Message()), method: amqpConnectionOpen}
+		}
+		return e
+	}
+	c.vhost = vhost
+	openOk := amqpMethod(amqpConnectionOpenOk)
+	openOk.shortstr("")
+	return c.send(0, openOk)
+}
+
+// amqpCredentials carries the credentials of a PLAIN login the way gRPC
+// clients send them.
+func amqpCredentials(username string, password string) context.Context {
+	md := metadata.MD{}
+	switch {
+	case password == "":
+	case strings.EqualFold(username, "bearer"):
+		md.Set(authorizationHeader, "Bearer "+password)
+	default:
+		md.Set(apiKeyHeader, password)
+	}
+	return metadata.NewOutgoingContext(context.Background(), md)
+}
+
+// expect reads the next method during the handshake, which must be id.
+func (c *amqpConnection) expect(id uint32) (*amqpReader, error) {
+	for {
+		frame, err := readAMQPFrame(c.reader, c.frameMax)
+		if err != nil {
+			return nil, err
+		}
+		if frame.kind == amqpFrameHeartbeat {
+			continue
+		}
+		r := newAMQPReader(frame.payload)
+		if got := r.long(); frame.kind != amqpFrameMethod || frame.channel != 0 || got != id {
+			return nil, &amqpError{code: amqpCommandInvalid, text: fmt.Sprintf("COMMAND_INVALID - expected method %d.%d", id>>16, id&0xFFFF), method: got}
+		}
+		return r, nil
+	}
+}
+
+func (c *amqpConnection) beat() {
+	ticker := time.NewTicker(c.heartbeat / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.writeMutex.Lock()
+			err := writeAMQPFrame(c.writer, amqpFrameHeartbeat, 0, nil)
+			if err == nil {
+				err = c.writer.Flush()
+			}
+			c.writeMutex.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *amqpConnection) send(channel uint16, method *amqpWriter) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.closed {
+		return errAMQPClosed
+	}
+	if err := writeAMQPFrame(c.writer, amqpFrameMethod, channel, method.buf.Bytes()); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+// sendContent writes a method carrying content, its header and its body
+// frames without other frames in between.
+func (c *amqpConnection) sendContent(channel uint16, method *amqpWriter, props amqpProperties, body []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.closed {
+		return errAMQPClosed
+	}
+	if err := writeAMQPFrame(c.writer, amqpFrameMethod, channel, method.buf.Bytes()); err != nil {
+		return err
+	}
+	if err := writeAMQPFrame(c.writer, amqpFrameHeader, channel, amqpContentHeader(amqpClassBasic, uint64(len(body)), props)); err != nil {
+		return err
+	}
+	chunk := int(c.frameMax) - 8
+	for len(body) > 0 {
+		n := min(chunk, len(body))
+		if err := writeAMQPFrame(c.writer, amqpFrameBody, channel, body[:n]); err != nil {
+			return err
+		}
+		body = body[n:]
+	}
+	return c.writer.Flush()
+}
+
+// shutdown sends connection.close for e and closes the socket. The client's
+// close-ok is not waited for.
+func (c *amqpConnection) shutdown(e *amqpError) {
+	closeMethod := amqpMethod(amqpConnectionClose)
+	closeMethod.short(e.code)
+	closeMethod.shortstr(e.text)
+	closeMethod.short(uint16(e.method >> 16))
+	closeMethod.short(uint16(e.method))
+	c.send(0, closeMethod)
+	c.writeMutex.Lock()
+	c.closed = true
+	c.writeMutex.Unlock()
+	c.conn.Close()
+}
+
+func (c *amqpConnection) dispatch(frame amqpFrame) error {
+	if frame.kind == amqpFrameHeartbeat {
+		return nil
+	}
+	if frame.channel == 0 {
+		if frame.kind != amqpFrameMethod {
+			return &amqpError{code: amqpUnexpectedFrame, text: "UNEXPECTED_FRAME - content on channel 0"}
+		}
+		switch id := newAMQPReader(frame.payload).long(); id {
+		case amqpConnectionClose:
+			c.send(0, amqpMethod(amqpConnectionCloseOk))
+			return errAMQPClosed
+		case amqpConnectionCloseOk:
+			return errAMQPClosed
+		default:
+			return &amqpError{code: amqpCommandInvalid, text: "COMMAND_INVALID - unexpected method on channel 0", method: id}
+		}
+	}
+	ch, open := c.channels[frame.channel]
+	if !open {
+		id := newAMQPReader(frame.payload).long()
+		if frame.kind != amqpFrameMethod || id != amqpChannelOpen {
+			return &amqpError{code: amqpChannelError, text: fmt.Sprintf("CHANNEL_ERROR - channel %d is not open", frame.channel), method: id}
+		}
+		if frame.channel > c.channelMax {
+			return &amqpError{code: amqpChannelError, text: fmt.Sprintf("CHANNEL_ERROR - channel %d exceeds the maximum of %d", frame.channel, c.channelMax), method: id}
+		}
+		c.channels[frame.channel] = newAMQPChannel(c, frame.channel)
+		openOk := amqpMethod(amqpChannelOpenOk)
+		openOk.longstr("")
+		return c.send(frame.channel, openOk)
+	}
+	return ch.handle(frame)
+}
+
+// closeChannels stops the consumers of every channel and requeues what they
+// left unacknowledged.
+func (c *amqpConnection) closeChannels() {
+	for id, ch := range c.channels {
+		ch.close()
+		delete(c.channels, id)
+	}
+}
+
+// amqpDelivery is a message delivered on a channel and not yet acknowledged.
+type amqpDelivery struct {
+	queue   string
+	message *proto.LockedMessage
+}
+
+type amqpConsumer struct {
+	tag     string
+	queue   string
+	autoAck bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// amqpPublish is a message being published, between basic.publish and its
+// last body frame.
+type amqpPublish struct {
+	exchange   string
+	routingKey string
+	mandatory  bool
+	header     bool
+	size       uint64
+	props      amqpProperties
+	body       []byte
+}
+
+type amqpChannel struct {
+	conn *amqpConnection
+	id   uint16
+
+	// Used only by the goroutine reading frames.
+	closing   bool
+	publish   *amqpPublish
+	confirm   bool
+	confirms  uint64
+	lastQueue string
+
+	// deliverMutex keeps deliveries on the wire in delivery tag order.
+	deliverMutex sync.Mutex
+	mutex        sync.Mutex
+	tag          uint64
+	unacked      map[uint64]*amqpDelivery
+	reserved     int
+	prefetch     int
+	paused       bool
+	wake         chan struct{}
+	consumers    map[string]*amqpConsumer
+}
+
+func newAMQPChannel(conn *amqpConnection, id uint16) *amqpChannel {
+	return &amqpChannel{
+		conn:      conn,
+		id:        id,
+		unacked:   make(map[uint64]*amqpDelivery),
+		wake:      make(chan struct{}),
+		consumers: make(map[string]*amqpConsumer),
+	}
+}
+
+// handle processes a frame for the channel. Soft errors close the channel and
+// are not returned; what is returned closes the connection.
+func (ch *amqpChannel) handle(frame amqpFrame) error {
+	var err error
+	switch {
+	case ch.closing:
+		return ch.handleClosing(frame)
+	case frame.kind == amqpFrameMethod && ch.publish == nil:
+		r := newAMQPReader(frame.payload)
+		err = ch.method(r.long(), r)
+	case frame.kind == amqpFrameHeader && ch.publish != nil && !ch.publish.header:
+		err = ch.contentHeader(frame.payload)
+	case frame.kind == amqpFrameBody && ch.publish != nil && ch.publish.header:
+		err = ch.contentBody(frame.payload)
+	default:
+		return &amqpError{code: amqpUnexpectedFrame, text: fmt.Sprintf("UNEXPECTED_FRAME - frame type %d on channel %d", frame.kind, ch.id)}
+	}
+	var e *amqpError
+	if errors.As(err, &e) && !e.hard() {
+		return ch.fail(e)
+	}
+	return err
+}
+
+// handleClosing waits for the client to acknowledge a channel.close the
+// server sent, dropping anything else it sends meanwhile.
+func (ch *amqpChannel) handleClosing(frame amqpFrame) error {
+	if frame.kind != amqpFrameMethod {
+		return nil
+	}
+	switch newAMQPReader(frame.payload).long() {
+	case amqpChannelClose:
+		if err := ch.conn.send(ch.id, amqpMethod(amqpChannelCloseOk)); err != nil {
+			return err
+		}
+		delete(ch.conn.channels, ch.id)
+	case amqpChannelCloseOk:
+		delete(ch.conn.channels, ch.id)
+	}
+	return nil
+}
+
+// fail closes the channel with a soft error.
+func (ch *amqpChannel) fail(e *amqpError) error {
+	logger.ConsoleLog("WARN", "AMQP channel %d from %s closed with %v", ch.id, ch.conn.conn.RemoteAddr(), e)
+	ch.close()
+	ch.closing = true
+	ch.publish = nil
+	closeMethod := amqpMethod(amqpChannelClose)
+	closeMethod.short(e.code)
+	closeMethod.shortstr(e.text)
+	closeMethod.short(uint16(e.method >> 16))
+	closeMethod.short(uint16(e.method))
+	return ch.conn.send(ch.id, closeMethod)
+}
+
+// close stops the consumers of the channel and requeues the messages
+// delivered on it that were not acknowledged.
+func (ch *amqpChannel) close() {
+	ch.mutex.Lock()
+	consumers := ch.consumers
+	ch.consumers = make(map[string]*amqpConsumer)
+	ch.mutex.Unlock()
+	for _, consumer := range consumers {
+		consumer.cancel()
+		<-consumer.done
+	}
+	ch.mutex.Lock()
+	unacked := ch.unacked
+	ch.unacked = make(map[uint64]*amqpDelivery)
+	ch.mutex.Unlock()
+	ch.requeue(unacked)
+}
+
+func (ch *amqpChannel) requeue(deliveries map[uint64]*amqpDelivery) {
+	if len(deliveries) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ch.conn.ctx), amqpHandshake)
+	defer cancel()
+	for _, delivery := range deliveries {
+		if err := ch.conn.server.broker.Reject(ctx, ch.conn.vhost, delivery.queue, delivery.message, true); err != nil {
+			logger.ConsoleLog("WARN", "AMQP could not requeue message %s of %s: %v", delivery.message.GetMessage().GetMessage().GetMessageId(), delivery.queue, err)
+		}
+	}
+}
+
+// syntax reports a method whose arguments could not be decoded.
+func syntax(r *amqpReader, id uint32) error {
+	if r.err != nil {
+		return &amqpError{code: amqpSyntaxError, text: "SYNTAX_ERROR - " + r.err.Error(), method: id}
+	}
+	return nil
+}
+
+func (ch *amqpChannel) method(id uint32, r *amqpReader) error {
+	c := ch.conn
+	broker := c.server.broker
+	switch id {
+	case amqpChannelClose:
+		ch.close()
+		delete(c.channels, ch.id)
+		return c.send(ch.id, amqpMethod(amqpChannelCloseOk))
+
+	case amqpChannelFlow:
+		active := r.bit()
+		if err := syntax(r, id); err != nil {
+			return err
+		}
+		ch.mutex.Lock()
+		ch.paused = !active
+		ch.signal()
+		ch.mutex.Unlock()
+		flowOk := amqpMethod(amqpChannelFlowOk)
+		flowOk.bit(active)
+		return c.send(ch.id, flowOk)
+
+	case amqpQueueDeclare:
+		r.short()
+		queue := r.shortstr()
+		passive := r.bit()
+		r.bit() // durable: kokaq queues always are
+		r.bit() // exclusive
+		r.bit() // auto-delete
+		noWait := r.bit()
+		r.table()
+		if err := syntax(r, id); err != nil {
+			return err
+		}
+		if queue == "" {
+			queue = "amq.gen-" + uuid.NewString()
+		}
+		count, err := broker.DeclareQueue(c.ctx, c.vhost, queue, passive)
+		if err != nil {
+			return amqpBackendError(err, id)
+		}
+		ch.lastQueue = queue
+		if noWait {
+			return nil
+		}
+		declareOk := amqpMethod(amqpQueueDeclareOk)
+		declareOk.shortstr(queue)
+		declareOk.long(count)
+		declareOk.long(0)
+		return c.send(ch.id, declareOk)
+
+	case amqpQueuePurge:
+		r.short()
+		queue := ch.queue(r.shortstr())
+		noWait := r.bit()
+		if err := syntax(r, id); err != nil {
+			return err
+		}
+		count, err := broker.PurgeQueue(c.ctx, c.vhost, queue)
+		if err != nil {
+			return amqpBackendError(err, id)
+		}
+		if noWait {
+			return nil
+		}
+		purgeOk := amqpMethod(amqpQueuePurgeOk)
+		purgeOk.long(count)
+		return c.send(ch.id, purgeOk)
+
+	case amqpQueueDelete:
+		r.short()
+		queue := ch.queue(r.shortstr())
+		r.bit() // if-unused
+		ifEmpty := r.bit()
+		noWait := r.bit()
+		if err := syntax(r, id); err != nil {
+			return err
+		}
+		if ifEmpty {
+			count, err := broker.DeclareQueue(c.ctx, c.vhost, queue, true)
+			if err != nil {
+				return amqpBackendError(err, id)
+			}
+			if count > 0 {
+				return &amqpError{code: amqpPreconditionFailed, text: fmt.Sprintf("PRECONDITION_FAILED - queue %q in vhost %q not empty", queue, c.vhost), method: id}
+			}
+		}
+		count, err := broker.DeleteQueue(c.ctx, c.vhost, queue)
+		if err != nil {
+			return amqpBackendError(err, id)
+		}
+		if noWait {
+			return nil
+		}
+		deleteOk := amqpMethod(amqpQueueDeleteOk)
+		deleteOk.long(count)
+		return c.send(ch.id, deleteOk)
+
+	case amqpBasicQos:
+		r.long() // prefetch-size
+		prefetch := r.short()
+		r.bit() // global: the limit always applies to the whole channel
+		if err := syntax(r, id); err != nil {
+			return err
+		}
+		ch.mutex.Lock()
+		ch.prefetch = int(prefetch)
+		ch.signal()
+		ch.mutex.Unlock()
+		return c.send(ch.id, amqpMethod(amqpBasicQosOk))
+
+	case amqpBasicConsume:
+		r.short()
+		queue := ch.queue(r.shortstr())
+		tag := r.shortstr()
+		r.bit() // no-local
+		noAck := r.bit()
+		r.bit() // exclusive
+		noWait := r.bit()
+		r.table()
+		if err := syntax(r, id); err != nil {
+			return err
+		}
+		if _, err := broker.DeclareQueue(c.ctx, c.vhost, queue, true); err != nil {
+			return amqpBackendError(err, id)
+		}
+		if tag == "" {
+			tag = "amq.ctag-" + uuid.NewString()
+		}
+		ctx, cancel := context.WithCancel(c.ctx)
+		consumer := &amqpConsumer{tag: tag, queue: queue, autoAck: noAck, cancel: cancel, done: make(chan struct{})}
+		ch.mutex.Lock()
+		_, exist := ch.consumers[tag]
+		if !exist {
+			ch.consumers[tag] = consumer
+		}
+		ch.mutex.Unlock()
+		if exist {
+			cancel()
+			return &amqpError{code: amqpNotAllowed, text: fmt.Sprintf("NOT_ALLOWED - attempt to reuse consumer tag %q", tag), method: id}
+		}
+		if !noWait {
+			consumeOk := amqpMethod(amqpBasicConsumeOk)
+			consumeOk.shortstr(tag)
+			if err := c.send(ch.id, consumeOk); err != nil {
+				cancel()
+				return err
+			}
+		}
+		go ch.consume(ctx, consumer)
+		return nil
+
+	case amqpBasicCancel:
+		tag := r.shortstr()
+		noWait := r.bit()
+		if err := syntax(r, id); err != nil {
+			return err
+		}
+		ch.mutex.Lock()
+		consumer, exist := ch.consumers[tag]
+		delete(ch.consumers, tag)
+		ch.mutex.Unlock()
+		if exist {
+			consumer.cancel()
+			<-consumer.done
+		}
+		if noWait {
+			return nil
+		}
+		cancelOk := amqpMethod(amqpBasicCancelOk)
+		cancelOk.shortstr(tag)
+		return c.send(ch.id, cancelOk)
+
+	case amqpBasicPublish:
+		r.short()
+		exchange := r.shortstr()
+		routingKey := r.shortstr()
+		mandatory := r.bit()
+		r.bit() // immediate
+		if err := syntax(r, id); err != nil {
+			return err
+		}
+		ch.publish = &amqpPublish{exchange: exchange, routingKey: routingKey, mandatory: mandatory}
+		return nil
+
+	case amqpBasicGet:
+		r.short()
+		queue := ch.queue(r.shortstr())
+		noAck := r.bit()
+		if err := syntax(r, id); err != nil {
+			return err
+		}
+		message, err := broker.Receive(c.ctx, c.vhost, queue, noAck)
+		if err != nil {
+			return amqpBackendError(err, id)
+		}
+		if message == nil {
+			getEmpty := amqpMethod(amqpBasicGetEmpty)
+			getEmpty.shortstr("")
+			return c.send(ch.id, getEmpty)
+		}
+		count, err := broker.DeclareQueue(c.ctx, c.vhost, queue, true)
+		if err != nil {
+			logger.ConsoleLog("WARN", "AMQP could not count messages of %s: %v", queue, err)
+		}
+		return ch.deliver(queue, message, noAck, false, func(tag uint64) *amqpWriter {
+			getOk := amqpMethod(amqpBasicGetOk)
+			getOk.longlong(tag)
+			getOk.bit(message.GetMessage().GetRetryCount() > 0)
+			getOk.shortstr("")
+			getOk.shortstr(queue)
+			getOk.long(count)
+			return getOk
+		})
+
+	case amqpBasicAck:
+		tag := r.longlong()
+		multiple := r.bit()
+		if err := syntax(r, id); err != nil {
+			return err
+		}
+		deliveries, err := ch.settle(id, tag, multiple)
+		if err != nil {
+			return err
+		}
+		for _, delivery := range deliveries {
+			if err := broker.Ack(c.ctx, c.vhost, delivery.queue, delivery.message); err != nil {
+				logger.ConsoleLog("WARN", "AMQP could not acknowledge message %s of %s: %v", delivery.message.GetMessage().GetMessage().GetMessageId(), delivery.queue, err)
+			}
+		}
+		return nil
+
+	case amqpBasicReject, amqpBasicNack:
+		tag := r.longlong()
+		multiple := false
+		if id == amqpBasicNack {
+			multiple = r.bit()
+		}
+		requeue := r.bit()
+		if err := syntax(r, id); err != nil {
+			return err
+		}
+		deliveries, err := ch.settle(id, tag, multiple)
+		if err != nil {
+			return err
+		}
+		for _, delivery := range deliveries {
+			if err := broker.Reject(c.ctx, c.vhost, delivery.queue, delivery.message, requeue); err != nil {
+				logger.ConsoleLog("WARN", "AMQP could not reject message %s of %s: %v", delivery.message.GetMessage().GetMessage().GetMessageId(), delivery.queue, err)
+			}
+		}
+		return nil
+
+	case amqpBasicRecover, amqpBasicRecoverAsync:
+		// Unacknowledged messages always go back to the queue, whatever
+		// requeue says, and are redelivered from there.
+		r.bit()
+		if err := syntax(r, id); err != nil {
+			return err
+		}
+		ch.mutex.Lock()
+		unacked := ch.unacked
+		ch.unacked = make(map[uint64]*amqpDelivery)
+		ch.signal()
+		ch.mutex.Unlock()
+		ch.requeue(unacked)
+		if id == amqpBasicRecoverAsync {
+			return nil
+		}
+		return c.send(ch.id, amqpMethod(amqpBasicRecoverOk))
+
+	case amqpConfirmSelect:
+		noWait := r.bit()
+		if err := syntax(r, id); err != nil {
+			return err
+		}
+		ch.confirm = true
+		if noWait {
+			return nil
+		}
+		return c.send(ch.id, amqpMethod(amqpConfirmSelectOk))
+	}
+	return &amqpError{code: amqpNotImplemented, text: fmt.Sprintf("NOT_IMPLEMENTED - method %d.%d is not supported, kokaq only has the default exchange", id>>16, id&0xFFFF), method: id}
+}
+
+// queue resolves the empty queue name to the queue last declared on the
+// channel.
+func (ch *amqpChannel) queue(name string) string {
+	if name == "" {
+		return ch.lastQueue
+	}
+	return name
+}
+
+func (ch *amqpChannel) contentHeader(payload []byte) error {
+	size, props, err := readAMQPContentHeader(payload)
+	if err != nil {
+		return &amqpError{code: amqpSyntaxError, text: "SYNTAX_ERROR - " + err.Error(), method: amqpBasicPublish}
+	}
+	if size > amqpMaxBody {
+		return &amqpError{code: amqpPreconditionFailed, text: fmt.Sprintf("PRECONDITION_FAILED - message size %d is larger than the maximum of %d", size, amqpMaxBody), method: amqpBasicPublish}
+	}
+	ch.publish.header = true
+	ch.publish.size = size
+	ch.publish.props = props
+	ch.publish.body = make([]byte, 0, size)
+	if size == 0 {
+		return ch.published()
+	}
+	return nil
+}
+
+func (ch *amqpChannel) contentBody(payload []byte) error {
+	ch.publish.body = append(ch.publish.body, payload...)
+	if uint64(len(ch.publish.body)) > ch.publish.size {
+		return &amqpError{code: amqpFrameError, text: "FRAME_ERROR - body is larger than its content header says", method: amqpBasicPublish}
+	}
+	if uint64(len(ch.publish.body)) == ch.publish.size {
+		return ch.published()
+	}
+	return nil
+}
+
+// published enqueues a message whose content has fully arrived. Messages for
+// queues that do not exist are returned when mandatory and dropped
+// otherwise, as the default exchange does.
+func (ch *amqpChannel) published() error {
+	c := ch.conn
+	p := ch.publish
+	ch.publish = nil
+	if p.exchange != "" {
+		return &amqpError{code: amqpNotFound, text: fmt.Sprintf("NOT_FOUND - no exchange %q in vhost %q", p.exchange, c.vhost), method: amqpBasicPublish}
+	}
+	err := c.server.broker.Publish(c.ctx, c.vhost, kokaqMessage(p.routingKey, p.props, p.body))
+	if status.Code(err) == codes.NotFound {
+		err = nil
+		if p.mandatory {
+			basicReturn := amqpMethod(amqpBasicReturn)
+			basicReturn.short(amqpNoRoute)
+			basicReturn.shortstr("NO_ROUTE")
+			basicReturn.shortstr(p.exchange)
+			basicReturn.shortstr(p.routingKey)
+			if err := c.sendContent(ch.id, basicReturn, p.props, p.body); err != nil {
+				return err
+			}
+		}
+	}
+	if !ch.confirm {
+		if err != nil {
+			return amqpBackendError(err, amqpBasicPublish)
+		}
+		return nil
+	}
+	ch.confirms++
+	confirm := amqpMethod(amqpBasicAck)
+	if err != nil {
+		logger.ConsoleLog("WARN", "AMQP could not publish to %s: %v", p.routingKey, err)
+		confirm = amqpMethod(amqpBasicNack)
+	}
+	confirm.longlong(ch.confirms)
+	confirm.bit(false)
+	if err != nil {
+		confirm.bit(false)
+	}
+	return c.send(ch.id, confirm)
+}
+
+// settle takes the deliveries an ack, nack or reject of tag refers to off
+// the channel. Unknown delivery tags are a channel error.
+func (ch *amqpChannel) settle(id uint32, tag uint64, multiple bool) ([]*amqpDelivery, error) {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	var deliveries []*amqpDelivery
+	if multiple {
+		for t, delivery := range ch.unacked {
+			if t <= tag || tag == 0 {
+				deliveries = append(deliveries, delivery)
+				delete(ch.unacked, t)
+			}
+		}
+	} else if delivery, exist := ch.unacked[tag]; exist {
+		deliveries = append(deliveries, delivery)
+		delete(ch.unacked, tag)
+	}
+	if len(deliveries) == 0 && !(multiple && tag == 0) {
+		return nil, &amqpError{code: amqpPreconditionFailed, text: fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", tag), method: id}
+	}
+	ch.signal()
+	return deliveries, nil
+}
+
+// signal wakes consumers waiting for room to deliver. The caller holds
+// ch.mutex.
+func (ch *amqpChannel) signal() {
+	close(ch.wake)
+	ch.wake = make(chan struct{})
+}
+
+// reserve claims room for one more unacknowledged delivery under the
+// channel's prefetch limit. When there is none it returns a channel closed
+// once there may be.
+func (ch *amqpChannel) reserve() <-chan struct{} {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if ch.paused || (ch.prefetch > 0 && len(ch.unacked)+ch.reserved >= ch.prefetch) {
+		return ch.wake
+	}
+	ch.reserved++
+	return nil
+}
+
+func (ch *amqpChannel) unreserve() {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	ch.reserved--
+	ch.signal()
+}
+
+// deliver sends message with the method built by method for its delivery
+// tag, tracking it until acknowledged unless autoAck is set.
+func (ch *amqpChannel) deliver(queue string, message *proto.LockedMessage, autoAck bool, reserved bool, method func(tag uint64) *amqpWriter) error {
+	ch.deliverMutex.Lock()
+	defer ch.deliverMutex.Unlock()
+	ch.mutex.Lock()
+	if reserved {
+		ch.reserved--
+	}
+	ch.tag++
+	tag := ch.tag
+	if !autoAck {
+		ch.unacked[tag] = &amqpDelivery{queue: queue, message: message}
+	}
+	ch.mutex.Unlock()
+	props, body := amqpMessage(message.GetMessage())
+	return ch.conn.sendContent(ch.id, method(tag), props, body)
+}
+
+// consume delivers messages from the consumer's queue until it is
+// cancelled, polling the queue while it is empty.
+func (ch *amqpChannel) consume(ctx context.Context, consumer *amqpConsumer) {
+	defer close(consumer.done)
+	broker := ch.conn.server.broker
+	delay := amqpPollInterval
+	for {
+		if !consumer.autoAck {
+			if wait := ch.reserve(); wait != nil {
+				select {
+				case <-wait:
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		message, err := broker.Receive(ctx, ch.conn.vhost, consumer.queue, consumer.autoAck)
+		if message != nil {
+			// A message received as the consumer is cancelled is still
+			// delivered; cancel-ok only follows once it is.
+			err := ch.deliver(consumer.queue, message, consumer.autoAck, !consumer.autoAck, func(tag uint64) *amqpWriter {
+				deliver := amqpMethod(amqpBasicDeliver)
+				deliver.shortstr(consumer.tag)
+				deliver.longlong(tag)
+				deliver.bit(message.GetMessage().GetRetryCount() > 0)
+				deliver.shortstr("")
+				deliver.shortstr(consumer.queue)
+				return deliver
+			})
+			if err != nil {
+				return
+			}
+			delay = amqpPollInterval
+			continue
+		}
+		if !consumer.autoAck {
+			ch.unreserve()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if status.Code(err) == codes.NotFound {
+			ch.cancelled(consumer)
+			return
+		}
+		if err != nil {
+			logger.ConsoleLog("WARN", "AMQP consumer %s could not receive from %s: %v", consumer.tag, consumer.queue, err)
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		delay = min(2*delay, amqpPollMax)
+	}
+}
+
+// cancelled drops a consumer whose queue went away, telling clients that
+// understand consumer cancellation.
+func (ch *amqpChannel) cancelled(consumer *amqpConsumer) {
+	ch.mutex.Lock()
+	current, exist := ch.consumers[consumer.tag]
+	if exist && current == consumer {
+		delete(ch.consumers, consumer.tag)
+	}
+	ch.mutex.Unlock()
+	if !exist || current != consumer {
+		return
+	}
+	logger.ConsoleLog("WARN", "AMQP consumer %s cancelled, queue %s no longer exists", consumer.tag, consumer.queue)
+	if ch.conn.cancelNotify {
+		cancel := amqpMethod(amqpBasicCancel)
+		cancel.shortstr(consumer.tag)
+		cancel.bit(true)
+		ch.conn.send(ch.id, cancel)
+	}
+}
+
+// kokaqMessage carries a published AMQP message into kokaq. Priorities move
+// up by one since kokaq reserves priority 0. Content type, correlation id
+// and app id map onto message headers, the message id onto the kokaq one,
+// other properties onto attributes prefixed "amqp." and AMQP headers onto
+// attributes of the same name, as strings.
+func kokaqMessage(queue string, props amqpProperties, body []byte) *proto.KokaqMessageRequest {
+	attributes := make(map[string]string)
+	for name, value := range props.Headers {
+		switch v := value.(type) {
+		case string:
+			attributes[name] = v
+		case []byte:
+			attributes[name] = string(v)
+		default:
+			attributes[name] = fmt.Sprint(v)
+		}
+	}
+	set := func(name string, value string) {
+		if value != "" {
+			attributes[amqpAttributePrefix+name] = value
+		}
+	}
+	set("content-encoding", props.ContentEncoding)
+	set("reply-to", props.ReplyTo)
+	set("expiration", props.Expiration)
+	set("type", props.Type)
+	set("user-id", props.UserId)
+	if props.DeliveryMode != 0 {
+		set("delivery-mode", strconv.Itoa(int(props.DeliveryMode)))
+	}
+	if !props.Timestamp.IsZero() {
+		set("timestamp", strconv.FormatInt(props.Timestamp.Unix(), 10))
+	}
+	message := &proto.KokaqMessageRequest{
+		MessageId:  props.MessageId,
+		Queue:      queue,
+		Priority:   uint64(props.Priority) + 1,
+		Payload:    body,
+		Attributes: attributes,
+	}
+	if props.ContentType != "" || props.CorrelationId != "" || props.AppId != "" {
+		message.Headers = &proto.KokaqMessageHeaders{
+			ContentType:   props.ContentType,
+			CorrelationId: props.CorrelationId,
+			Source:        props.AppId,
+		}
+	}
+	return message
+}
+
+// amqpMessage is the reverse of kokaqMessage. Messages enqueued through
+// other APIs get the message id kokaq gave them and their enqueue time as
+// timestamp.
+func amqpMessage(message *proto.KokaqMessageResponse) (amqpProperties, []byte) {
+	m := message.GetMessage()
+	props := amqpProperties{
+		ContentType:   m.GetHeaders().GetContentType(),
+		CorrelationId: m.GetHeaders().GetCorrelationId(),
+		AppId:         m.GetHeaders().GetSource(),
+		MessageId:     m.GetMessageId(),
+		Priority:      uint8(min(max(m.GetPriority(), 1)-1, 255)),
+	}
+	if message.GetCreatedOn() != nil {
+		props.Timestamp = message.GetCreatedOn().AsTime()
+	}
+	for name, value := range m.GetAttributes() {
+		property, isProperty := strings.CutPrefix(name, amqpAttributePrefix)
+		if !isProperty {
+			if props.Headers == nil {
+				props.Headers = amqpTable{}
+			}
+			props.Headers[name] = value
+			continue
+		}
+		switch property {
+		case "content-encoding":
+			props.ContentEncoding = value
+		case "reply-to":
+			props.ReplyTo = value
+		case "expiration":
+			props.Expiration = value
+		case "type":
+			props.Type = value
+		case "user-id":
+			props.UserId = value
+		case "delivery-mode":
+			if mode, err := strconv.ParseUint(value, 10, 8); err == nil {
+				props.DeliveryMode = uint8(mode)
+			}
+		case "timestamp":
+			if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+				props.Timestamp = time.Unix(seconds, 0)
+			}
+		}
+	}
+	return props, m.GetPayload()
+}
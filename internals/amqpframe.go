@@ -0,0 +1,491 @@
+package internals
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// AMQP 0-9-1 wire format: frames, the field types methods are made of and
+// the properties of basic class content.
+
+const (
+	amqpFrameMethod    = 1
+	amqpFrameHeader    = 2
+	amqpFrameBody      = 3
+	amqpFrameHeartbeat = 8
+	amqpFrameEnd       = 0xCE
+
+	// amqpFrameMax is the largest frame the server offers; clients may ask
+	// for less, never below amqpFrameMin.
+	amqpFrameMax = 128 << 10
+	amqpFrameMin = 4096
+)
+
+var amqpProtocolHeader = []byte{'A', 'M', 'Q', 'P', 0, 0, 9, 1}
+
+var errAMQPShortPayload = errors.New("amqp: payload ends before its fields")
+
+// amqpTable is an AMQP field table. Values are bool, int8, uint8, int16,
+// uint16, int32, uint32, int64, float32, float64, amqpDecimal, string,
+// []byte, time.Time, []interface{}, amqpTable or nil.
+type amqpTable map[string]interface{}
+
+type amqpDecimal struct {
+	Scale uint8
+	Value int32
+}
+
+type amqpFrame struct {
+	kind    byte
+	channel uint16
+	payload []byte
+}
+
+func readAMQPFrame(r *bufio.Reader, frameMax uint32) (amqpFrame, error) {
+	var header [7]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return amqpFrame{}, err
+	}
+	size := binary.BigEndian.Uint32(header[3:])
+	if size > frameMax-8 {
+		return amqpFrame{}, fmt.Errorf("amqp: frame of %d bytes exceeds the negotiated maximum of %d", size+8, frameMax)
+	}
+	payload := make([]byte, size+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return amqpFrame{}, err
+	}
+	if payload[size] != amqpFrameEnd {
+		return amqpFrame{}, fmt.Errorf("amqp: frame does not end with %#x", amqpFrameEnd)
+	}
+	return amqpFrame{kind: header[0], channel: binary.BigEndian.Uint16(header[1:]), payload: payload[:size]}, nil
+}
+
+func writeAMQPFrame(w io.Writer, kind byte, channel uint16, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+8)
+	frame = append(frame, kind)
+	frame = binary.BigEndian.AppendUint16(frame, channel)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	frame = append(frame, payload...)
+	frame = append(frame, amqpFrameEnd)
+	_, err := w.Write(frame)
+	return err
+}
+
+// amqpReader decodes method arguments and content headers. The first error
+// sticks; later reads return zero values and err reports it.
+type amqpReader struct {
+	data   []byte
+	bits   byte
+	bitPos uint
+	err    error
+}
+
+func newAMQPReader(data []byte) *amqpReader {
+	return &amqpReader{data: data, bitPos: 8}
+}
+
+func (r *amqpReader) take(n int) []byte {
+	r.bitPos = 8
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = errAMQPShortPayload
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *amqpReader) octet() uint8 {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *amqpReader) short() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *amqpReader) long() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *amqpReader) longlong() uint64 {
+	if b := r.take(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *amqpReader) shortstr() string {
+	return string(r.take(int(r.octet())))
+}
+
+func (r *amqpReader) longstr() string {
+	return string(r.take(int(r.long())))
+}
+
+// bit reads the next of consecutive bit fields, which share octets.
+func (r *amqpReader) bit() bool {
+	if r.bitPos >= 8 {
+		r.bits = r.octet()
+		r.bitPos = 0
+	}
+	set := r.bits&(1<<r.bitPos) != 0
+	r.bitPos++
+	return set
+}
+
+func (r *amqpReader) table() amqpTable {
+	fields := newAMQPReader(r.take(int(r.long())))
+	table := amqpTable{}
+	for len(fields.data) > 0 && fields.err == nil {
+		name := fields.shortstr()
+		table[name] = fields.value()
+	}
+	if fields.err != nil && r.err == nil {
+		r.err = fields.err
+	}
+	return table
+}
+
+func (r *amqpReader) value() interface{} {
+	switch kind := r.octet(); kind {
+	case 't':
+		return r.octet() != 0
+	case 'b':
+		return int8(r.octet())
+	case 'B':
+		return r.octet()
+	case 's':
+		return int16(r.short())
+	case 'u':
+		return r.short()
+	case 'I':
+		return int32(r.long())
+	case 'i':
+		return r.long()
+	case 'l':
+		return int64(r.longlong())
+	case 'f':
+		return math.Float32frombits(r.long())
+	case 'd':
+		return math.Float64frombits(r.longlong())
+	case 'D':
+		return amqpDecimal{Scale: r.octet(), Value: int32(r.long())}
+	case 'S':
+		return r.longstr()
+	case 'x':
+		return []byte(r.longstr())
+	case 'T':
+		return time.Unix(int64(r.longlong()), 0)
+	case 'F':
+		return r.table()
+	case 'A':
+		items := newAMQPReader(r.take(int(r.long())))
+		var array []interface{}
+		for len(items.data) > 0 && items.err == nil {
+			array = append(array, items.value())
+		}
+		if items.err != nil && r.err == nil {
+			r.err = items.err
+		}
+		return array
+	case 'V':
+		return nil
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("amqp: unknown field type %q", kind)
+		}
+		return nil
+	}
+}
+
+// amqpWriter encodes method arguments and content headers.
+type amqpWriter struct {
+	buf    bytes.Buffer
+	bitPos uint
+	bitAt  int
+}
+
+func newAMQPWriter() *amqpWriter {
+	return &amqpWriter{bitPos: 8}
+}
+
+func (w *amqpWriter) octet(v uint8) {
+	w.bitPos = 8
+	w.buf.WriteByte(v)
+}
+
+func (w *amqpWriter) short(v uint16) {
+	w.bitPos = 8
+	w.buf.Write(binary.BigEndian.AppendUint16(nil, v))
+}
+
+func (w *amqpWriter) long(v uint32) {
+	w.bitPos = 8
+	w.buf.Write(binary.BigEndian.AppendUint32(nil, v))
+}
+
+func (w *amqpWriter) longlong(v uint64) {
+	w.bitPos = 8
+	w.buf.Write(binary.BigEndian.AppendUint64(nil, v))
+}
+
+func (w *amqpWriter) shortstr(v string) {
+	if len(v) > math.MaxUint8 {
+		v = v[:math.MaxUint8]
+	}
+	w.octet(uint8(len(v)))
+	w.buf.WriteString(v)
+}
+
+func (w *amqpWriter) longstr(v string) {
+	w.long(uint32(len(v)))
+	w.buf.WriteString(v)
+}
+
+func (w *amqpWriter) bit(set bool) {
+	if w.bitPos >= 8 {
+		w.bitAt = w.buf.Len()
+		w.buf.WriteByte(0)
+		w.bitPos = 0
+	}
+	if set {
+		w.buf.Bytes()[w.bitAt] |= 1 << w.bitPos
+	}
+	w.bitPos++
+}
+
+func (w *amqpWriter) table(table amqpTable) {
+	fields := newAMQPWriter()
+	for name, value := range table {
+		fields.shortstr(name)
+		fields.value(value)
+	}
+	w.longstr(fields.buf.String())
+}
+
+func (w *amqpWriter) value(value interface{}) {
+	switch v := value.(type) {
+	case bool:
+		w.octet('t')
+		if v {
+			w.octet(1)
+		} else {
+			w.octet(0)
+		}
+	case int8:
+		w.octet('b')
+		w.octet(uint8(v))
+	case uint8:
+		w.octet('B')
+		w.octet(v)
+	case int16:
+		w.octet('s')
+		w.short(uint16(v))
+	case uint16:
+		w.octet('u')
+		w.short(v)
+	case int32:
+		w.octet('I')
+		w.long(uint32(v))
+	case uint32:
+		w.octet('i')
+		w.long(v)
+	case int:
+		w.octet('l')
+		w.longlong(uint64(v))
+	case int64:
+		w.octet('l')
+		w.longlong(uint64(v))
+	case float32:
+		w.octet('f')
+		w.long(math.Float32bits(v))
+	case float64:
+		w.octet('d')
+		w.longlong(math.Float64bits(v))
+	case amqpDecimal:
+		w.octet('D')
+		w.octet(v.Scale)
+		w.long(uint32(v.Value))
+	case string:
+		w.octet('S')
+		w.longstr(v)
+	case []byte:
+		w.octet('x')
+		w.longstr(string(v))
+	case time.Time:
+		w.octet('T')
+		w.longlong(uint64(v.Unix()))
+	case amqpTable:
+		w.octet('F')
+		w.table(v)
+	case []interface{}:
+		items := newAMQPWriter()
+		for _, item := range v {
+			items.value(item)
+		}
+		w.octet('A')
+		w.longstr(items.buf.String())
+	default:
+		w.octet('V')
+	}
+}
+
+// amqpMethod starts the payload of a method frame. Method ids are the class
+// id in the high and the method id in the low 16 bits.
+func amqpMethod(id uint32) *amqpWriter {
+	w := newAMQPWriter()
+	w.long(id)
+	return w
+}
+
+// amqpProperties are the properties of basic class content.
+type amqpProperties struct {
+	ContentType     string
+	ContentEncoding string
+	Headers         amqpTable
+	DeliveryMode    uint8
+	Priority        uint8
+	CorrelationId   string
+	ReplyTo         string
+	Expiration      string
+	MessageId       string
+	Timestamp       time.Time
+	Type            string
+	UserId          string
+	AppId           string
+}
+
+// Property flags, most significant bit first in the order properties are
+// encoded.
+const (
+	amqpFlagContentType     = 1 << 15
+	amqpFlagContentEncoding = 1 << 14
+	amqpFlagHeaders         = 1 << 13
+	amqpFlagDeliveryMode    = 1 << 12
+	amqpFlagPriority        = 1 << 11
+	amqpFlagCorrelationId   = 1 << 10
+	amqpFlagReplyTo         = 1 << 9
+	amqpFlagExpiration      = 1 << 8
+	amqpFlagMessageId       = 1 << 7
+	amqpFlagTimestamp       = 1 << 6
+	amqpFlagType            = 1 << 5
+	amqpFlagUserId          = 1 << 4
+	amqpFlagAppId           = 1 << 3
+	amqpFlagClusterId       = 1 << 2
+)
+
+// readAMQPContentHeader decodes a content header frame into the size of the
+// body that follows and its properties.
+func readAMQPContentHeader(payload []byte) (uint64, amqpProperties, error) {
+	r := newAMQPReader(payload)
+	r.short() // class
+	r.short() // weight
+	size := r.longlong()
+	flags := r.short()
+	var props amqpProperties
+	if flags&amqpFlagContentType != 0 {
+		props.ContentType = r.shortstr()
+	}
+	if flags&amqpFlagContentEncoding != 0 {
+		props.ContentEncoding = r.shortstr()
+	}
+	if flags&amqpFlagHeaders != 0 {
+		props.Headers = r.table()
+	}
+	if flags&amqpFlagDeliveryMode != 0 {
+		props.DeliveryMode = r.octet()
+	}
+	if flags&amqpFlagPriority != 0 {
+		props.Priority = r.octet()
+	}
+	if flags&amqpFlagCorrelationId != 0 {
+		props.CorrelationId = r.shortstr()
+	}
+	if flags&amqpFlagReplyTo != 0 {
+		props.ReplyTo = r.shortstr()
+	}
+	if flags&amqpFlagExpiration != 0 {
+		props.Expiration = r.shortstr()
+	}
+	if flags&amqpFlagMessageId != 0 {
+		props.MessageId = r.shortstr()
+	}
+	if flags&amqpFlagTimestamp != 0 {
+		props.Timestamp = time.Unix(int64(r.longlong()), 0)
+	}
+	if flags&amqpFlagType != 0 {
+		props.Type = r.shortstr()
+	}
+	if flags&amqpFlagUserId != 0 {
+		props.UserId = r.shortstr()
+	}
+	if flags&amqpFlagAppId != 0 {
+		props.AppId = r.shortstr()
+	}
+	if flags&amqpFlagClusterId != 0 {
+		r.shortstr()
+	}
+	return size, props, r.err
+}
+
+func amqpContentHeader(class uint16, size uint64, props amqpProperties) []byte {
+	var flags uint16
+	w := newAMQPWriter()
+	shortstr := func(flag uint16, v string) {
+		if v != "" {
+			flags |= flag
+			w.shortstr(v)
+		}
+	}
+	shortstr(amqpFlagContentType, props.ContentType)
+	shortstr(amqpFlagContentEncoding, props.ContentEncoding)
+	if len(props.Headers) > 0 {
+		flags |= amqpFlagHeaders
+		w.table(props.Headers)
+	}
+	if props.DeliveryMode != 0 {
+		flags |= amqpFlagDeliveryMode
+		w.octet(props.DeliveryMode)
+	}
+	if props.Priority != 0 {
+		flags |= amqpFlagPriority
+		w.octet(props.Priority)
+	}
+	shortstr(amqpFlagCorrelationId, props.CorrelationId)
+	shortstr(amqpFlagReplyTo, props.ReplyTo)
+	shortstr(amqpFlagExpiration, props.Expiration)
+	shortstr(amqpFlagMessageId, props.MessageId)
+	if !props.Timestamp.IsZero() {
+		flags |= amqpFlagTimestamp
+		w.longlong(uint64(props.Timestamp.Unix()))
+	}
+	shortstr(amqpFlagType, props.Type)
+	shortstr(amqpFlagUserId, props.UserId)
+	shortstr(amqpFlagAppId, props.AppId)
+
+	header := newAMQPWriter()
+	header.short(class)
+	header.short(0)
+	header.longlong(size)
+	header.short(flags)
+	header.buf.Write(w.buf.Bytes())
+	return header.buf.Bytes()
+}
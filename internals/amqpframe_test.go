@@ -0,0 +1,187 @@
+package internals
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAMQPFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		kind    byte
+		channel uint16
+		payload []byte
+	}{
+		{"heartbeat", amqpFrameHeartbeat, 0, nil},
+		{"method", amqpFrameMethod, 1, amqpMethod(0x000A000A).buf.Bytes()},
+		{"body on a high channel", amqpFrameBody, 65535, []byte("hello")},
+		{"largest payload", amqpFrameBody, 7, bytes.Repeat([]byte{amqpFrameEnd}, amqpFrameMin-8)},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := writeAMQPFrame(&buf, tt.kind, tt.channel, tt.payload); err != nil {
+			t.Fatalf("%s: writeAMQPFrame() error = %v", tt.name, err)
+		}
+		frame, err := readAMQPFrame(bufio.NewReader(&buf), amqpFrameMin)
+		if err != nil {
+			t.Errorf("%s: readAMQPFrame() error = %v", tt.name, err)
+			continue
+		}
+		if frame.kind != tt.kind || frame.channel != tt.channel || !bytes.Equal(frame.payload, tt.payload) {
+			t.Errorf("%s: readAMQPFrame() = kind %d, channel %d, %d bytes; want kind %d, channel %d, %d bytes",
+				tt.name, frame.kind, frame.channel, len(frame.payload), tt.kind, tt.channel, len(tt.payload))
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%s: %d bytes left after the frame", tt.name, buf.Len())
+		}
+	}
+}
+
+func TestReadAMQPFrameRejects(t *testing.T) {
+	frame := func(size uint32, payload []byte, end byte) []byte {
+		data := []byte{amqpFrameBody, 0, 1}
+		data = binary.BigEndian.AppendUint32(data, size)
+		data = append(data, payload...)
+		return append(data, end)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"oversize", frame(amqpFrameMin-7, nil, amqpFrameEnd), "exceeds the negotiated maximum"},
+		{"oversize length overflowing", frame(0xFFFFFFFF, nil, amqpFrameEnd), "exceeds the negotiated maximum"},
+		{"wrong end marker", frame(3, []byte("abc"), 0), "does not end with"},
+		{"truncated header", []byte{amqpFrameBody, 0}, io.ErrUnexpectedEOF.Error()},
+		{"truncated payload", frame(10, []byte("abc"), amqpFrameEnd), io.ErrUnexpectedEOF.Error()},
+	}
+	for _, tt := range tests {
+		_, err := readAMQPFrame(bufio.NewReader(bytes.NewReader(tt.data)), amqpFrameMin)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: readAMQPFrame() error = %v; want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestAMQPFieldRoundTrip(t *testing.T) {
+	stamp := time.Unix(1700000000, 0)
+	tests := []struct {
+		name  string
+		value interface{}
+		want  interface{}
+	}{
+		{"bool", true, true},
+		{"int8", int8(-5), int8(-5)},
+		{"uint8", uint8(250), uint8(250)},
+		{"int16", int16(-300), int16(-300)},
+		{"uint16", uint16(60000), uint16(60000)},
+		{"int32", int32(-70000), int32(-70000)},
+		{"uint32", uint32(4000000000), uint32(4000000000)},
+		{"int", 42, int64(42)},
+		{"int64", int64(-1 << 40), int64(-1 << 40)},
+		{"float32", float32(1.5), float32(1.5)},
+		{"float64", 2.25, 2.25},
+		{"decimal", amqpDecimal{Scale: 2, Value: -1234}, amqpDecimal{Scale: 2, Value: -1234}},
+		{"string", "héllo", "héllo"},
+		{"bytes", []byte{0, 1, 2}, []byte{0, 1, 2}},
+		{"timestamp", stamp, stamp},
+		{"table", amqpTable{"a": int32(1), "b": amqpTable{"c": "d"}}, amqpTable{"a": int32(1), "b": amqpTable{"c": "d"}}},
+		{"array", []interface{}{"x", int32(2), nil}, []interface{}{"x", int32(2), nil}},
+		{"void", nil, nil},
+	}
+	for _, tt := range tests {
+		w := newAMQPWriter()
+		w.value(tt.value)
+		r := newAMQPReader(w.buf.Bytes())
+		got := r.value()
+		if r.err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: value round trip = %#v, %v; want %#v", tt.name, got, r.err, tt.want)
+		}
+		if len(r.data) != 0 {
+			t.Errorf("%s: %d bytes left after the value", tt.name, len(r.data))
+		}
+	}
+}
+
+func TestAMQPBitsRoundTrip(t *testing.T) {
+	tests := [][]bool{
+		{true},
+		{false, true, false},
+		{true, true, true, true, true, true, true, true, true},
+	}
+	for _, bits := range tests {
+		w := newAMQPWriter()
+		for _, bit := range bits {
+			w.bit(bit)
+		}
+		w.octet(7)
+		r := newAMQPReader(w.buf.Bytes())
+		for i, want := range bits {
+			if got := r.bit(); got != want {
+				t.Errorf("%v: bit %d = %v; want %v", bits, i, got, want)
+			}
+		}
+		if got := r.octet(); got != 7 || r.err != nil {
+			t.Errorf("%v: octet after the bits = %d, %v; want 7", bits, got, r.err)
+		}
+	}
+}
+
+func TestAMQPReaderShortPayload(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		read func(r *amqpReader)
+	}{
+		{"long", []byte{0, 0, 1}, func(r *amqpReader) { r.long() }},
+		{"shortstr", []byte{5, 'a', 'b'}, func(r *amqpReader) { r.shortstr() }},
+		{"longstr", []byte{0, 0, 0, 9, 'a'}, func(r *amqpReader) { r.longstr() }},
+		{"table", []byte{0, 0, 0, 4, 1, 'a', 'S', 0}, func(r *amqpReader) { r.table() }},
+	}
+	for _, tt := range tests {
+		r := newAMQPReader(tt.data)
+		tt.read(r)
+		if !errors.Is(r.err, errAMQPShortPayload) {
+			t.Errorf("%s: reading %v error = %v; want %v", tt.name, tt.data, r.err, errAMQPShortPayload)
+		}
+	}
+}
+
+func TestAMQPContentHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  uint64
+		props amqpProperties
+	}{
+		{"no properties", 0, amqpProperties{}},
+		{"every property", 1 << 33, amqpProperties{
+			ContentType:     "application/json",
+			ContentEncoding: "gzip",
+			Headers:         amqpTable{"x-retry": int32(3)},
+			DeliveryMode:    2,
+			Priority:        9,
+			CorrelationId:   "correlation",
+			ReplyTo:         "replies",
+			Expiration:      "60000",
+			MessageId:       "message-1",
+			Timestamp:       time.Unix(1700000000, 0),
+			Type:            "order",
+			UserId:          "guest",
+			AppId:           "shop",
+		}},
+		{"some properties", 5, amqpProperties{MessageId: "message-2", Priority: 1}},
+	}
+	for _, tt := range tests {
+		size, props, err := readAMQPContentHeader(amqpContentHeader(60, tt.size, tt.props))
+		if err != nil || size != tt.size || !reflect.DeepEqual(props, tt.props) {
+			t.Errorf("%s: content header round trip = %d, %+v, %v; want %d, %+v", tt.name, size, props, err, tt.size, tt.props)
+		}
+	}
+}
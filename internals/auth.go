@@ -0,0 +1,389 @@
+package internals
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/kokaq/core/internals/logger"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	AuthMethodAPIKey = "api_key"
+	AuthMethodJWT    = "jwt"
+
+	// ClusterSubject is the principal of requests nodes send each other
+	// with the cluster key.
+	ClusterSubject = "kokaq-cluster"
+
+	apiKeyHeader        = "x-api-key"
+	authorizationHeader = "authorization"
+)
+
+var (
+	// ErrNoCredentials is returned by an Authenticator when the request
+	// carries no credentials it understands.
+	ErrNoCredentials = errors.New("no credentials")
+
+	errInvalidAPIKey = errors.New("invalid api key")
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Subject string
+	Method  string
+	Roles   []string
+}
+
+type principalKey struct{}
+
+// PrincipalFromContext returns the caller attached by the auth interceptor.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok
+}
+
+func contextWithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// Authenticator resolves the caller of a request from its metadata.
+type Authenticator interface {
+	Authenticate(ctx context.Context, md metadata.MD) (*Principal, error)
+}
+
+// AuthConfig selects the credentials a server accepts and the policy it
+// enforces. Servers with no API keys, JWKS or cluster key configured run
+// without authentication.
+type AuthConfig struct {
+	APIKeysFile string
+	JWKSFile    string
+	Issuer      string
+	Audience    string
+	ClusterKey  string
+	PolicyFile  string
+}
+
+// WithEnvDefaults fills the fields left empty from the AUTH_API_KEYS_FILE,
+// AUTH_JWKS_FILE, AUTH_ISSUER, AUTH_AUDIENCE, CLUSTER_KEY and
+// AUTH_POLICY_FILE environment variables.
+func (config AuthConfig) WithEnvDefaults() AuthConfig {
+	fields := []struct {
+		value *string
+		env   string
+	}{
+		{&config.APIKeysFile, "AUTH_API_KEYS_FILE"},
+		{&config.JWKSFile, "AUTH_JWKS_FILE"},
+		{&config.Issuer, "AUTH_ISSUER"},
+		{&config.Audience, "AUTH_AUDIENCE"},
+		{&config.ClusterKey, "CLUSTER_KEY"},
+		{&config.PolicyFile, "AUTH_POLICY_FILE"},
+	}
+	for _, field := range fields {
+		if *field.value == "" {
+			*field.value = os.Getenv(field.env)
+		}
+	}
+	return config
+}
+
+// Mode describes the accepted credentials for startup banners.
+func (config AuthConfig) Mode() string {
+	modes := make([]string, 0, 3)
+	if config.APIKeysFile != "" {
+		modes = append(modes, "API key")
+	}
+	if config.JWKSFile != "" {
+		modes = append(modes, "JWT")
+	}
+	if config.ClusterKey != "" {
+		modes = append(modes, "cluster key")
+	}
+	if len(modes) == 0 {
+		return "Disabled"
+	}
+	mode := strings.Join(modes, " + ")
+	if config.PolicyFile != "" {
+		mode += ", RBAC"
+	}
+	return mode
+}
+
+// NewAuthenticator builds the authenticator described by config, or returns
+// nil when config enables no credentials.
+func NewAuthenticator(config AuthConfig) (Authenticator, error) {
+	chain := make(authenticatorChain, 0, 2)
+	if config.APIKeysFile != "" || config.ClusterKey != "" {
+		apiKeys := &APIKeyAuthenticator{principals: make(map[string]*Principal)}
+		if config.APIKeysFile != "" {
+			loaded, err := LoadAPIKeys(config.APIKeysFile)
+			if err != nil {
+				return nil, err
+			}
+			apiKeys = loaded
+		}
+		if config.ClusterKey != "" {
+			apiKeys.principals[apiKeyDigest(config.ClusterKey)] = &Principal{
+				Subject: ClusterSubject,
+				Method:  AuthMethodAPIKey,
+				Roles:   []string{"cluster"},
+			}
+		}
+		chain = append(chain, apiKeys)
+	}
+	if config.JWKSFile != "" {
+		tokens, err := LoadJWTAuthenticator(config.JWKSFile, config.Issuer, config.Audience)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, tokens)
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	return chain, nil
+}
+
+// authenticatorChain tries each authenticator in turn until one finds
+// credentials in the request.
+type authenticatorChain []Authenticator
+
+func (c authenticatorChain) Authenticate(ctx context.Context, md metadata.MD) (*Principal, error) {
+	for _, authenticator := range c {
+		principal, err := authenticator.Authenticate(ctx, md)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return principal, err
+	}
+	return nil, ErrNoCredentials
+}
+
+type apiKeyEntry struct {
+	Key     string   `json:"key"`
+	Subject string   `json:"subject"`
+	Roles   []string `json:"roles"`
+}
+
+// APIKeyAuthenticator accepts static keys sent in the x-api-key header. Keys
+// are held by their SHA-256 digest only.
+type APIKeyAuthenticator struct {
+	principals map[string]*Principal
+}
+
+// LoadAPIKeys reads a JSON array of {"key", "subject", "roles"} entries.
+func LoadAPIKeys(path string) (*APIKeyAuthenticator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read api keys from %s: %v", path, err)
+	}
+	var entries []apiKeyEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse api keys from %s: %v", path, err)
+	}
+	a := &APIKeyAuthenticator{principals: make(map[string]*Principal, len(entries))}
+	for _, entry := range entries {
+		if entry.Key == "" || entry.Subject == "" {
+			return nil, fmt.Errorf("api key entries in %s need a key and a subject", path)
+		}
+		if entry.Subject == ClusterSubject {
+			return nil, fmt.Errorf("api keys in %s may not use the reserved subject %s", path, ClusterSubject)
+		}
+		a.principals[apiKeyDigest(entry.Key)] = &Principal{
+			Subject: entry.Subject,
+			Method:  AuthMethodAPIKey,
+			Roles:   entry.Roles,
+		}
+	}
+	logger.ConsoleLog("INFO", "Loaded %d api keys from %s", len(a.principals), path)
+	return a, nil
+}
+
+func (a *APIKeyAuthenticator) Authenticate(ctx context.Context, md metadata.MD) (*Principal, error) {
+	keys := md.Get(apiKeyHeader)
+	if len(keys) == 0 {
+		return nil, ErrNoCredentials
+	}
+	principal, ok := a.principals[apiKeyDigest(keys[0])]
+	if !ok {
+		return nil, errInvalidAPIKey
+	}
+	return principal, nil
+}
+
+func apiKeyDigest(key string) string {
+	digest := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(digest[:])
+}
+
+// tokenClaims are the claims read from a bearer token besides the
+// registered ones.
+type tokenClaims struct {
+	jwt.Claims
+	Roles []string `json:"roles"`
+	Scope string   `json:"scope"`
+}
+
+// JWTAuthenticator accepts bearer tokens signed by a key of a local JWKS and
+// issued by the configured issuer for the configured audience.
+type JWTAuthenticator struct {
+	keys     jose.JSONWebKeySet
+	issuer   string
+	audience string
+}
+
+var jwtAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+func LoadJWTAuthenticator(jwksPath string, issuer string, audience string) (*JWTAuthenticator, error) {
+	data, err := os.ReadFile(jwksPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwks from %s: %v", jwksPath, err)
+	}
+	a := &JWTAuthenticator{issuer: issuer, audience: audience}
+	if err := json.Unmarshal(data, &a.keys); err != nil {
+		return nil, fmt.Errorf("failed to parse jwks from %s: %v", jwksPath, err)
+	}
+	if len(a.keys.Keys) == 0 {
+		return nil, fmt.Errorf("jwks %s holds no keys", jwksPath)
+	}
+	logger.ConsoleLog("INFO", "Loaded %d signing keys from %s for issuer %q", len(a.keys.Keys), jwksPath, issuer)
+	return a, nil
+}
+
+func (a *JWTAuthenticator) Authenticate(ctx context.Context, md metadata.MD) (*Principal, error) {
+	values := md.Get(authorizationHeader)
+	if len(values) == 0 {
+		return nil, ErrNoCredentials
+	}
+	raw, found := strings.CutPrefix(values[0], "Bearer ")
+	if !found {
+		return nil, ErrNoCredentials
+	}
+	token, err := jwt.ParseSigned(strings.TrimSpace(raw), jwtAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token: %v", err)
+	}
+	var claims tokenClaims
+	if err := token.Claims(a.keys, &claims); err != nil {
+		return nil, fmt.Errorf("token signature: %v", err)
+	}
+	expected := jwt.Expected{Issuer: a.issuer, Time: time.Now()}
+	if a.audience != "" {
+		expected.AnyAudience = jwt.Audience{a.audience}
+	}
+	if err := claims.ValidateWithLeeway(expected, jwt.DefaultLeeway); err != nil {
+		return nil, fmt.Errorf("token claims: %v", err)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("token has no subject")
+	}
+	roles := claims.Roles
+	if len(roles) == 0 && claims.Scope != "" {
+		roles = strings.Fields(claims.Scope)
+	}
+	return &Principal{Subject: claims.Subject, Method: AuthMethodJWT, Roles: roles}, nil
+}
+
+// authExempt lists methods served without credentials, so probes keep
+// working on authenticated servers.
+func authExempt(fullMethod string) bool {
+	return strings.HasPrefix(fullMethod, "/grpc.health.v1.Health/")
+}
+
+// authenticate resolves the caller of a request and reports failures to
+// telemetry.
+func authenticate(ctx context.Context, authenticator Authenticator, fullMethod string, telemetryLogger TelemetryLogger) (context.Context, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		logAuthFailure(telemetryLogger, EventAuthFailedNoMetadata, fullMethod, "", ErrNoCredentials)
+		return ctx, status.Error(codes.Unauthenticated, "missing credentials")
+	}
+	principal, err := authenticator.Authenticate(ctx, md)
+	switch {
+	case err == nil:
+		return contextWithPrincipal(ctx, principal), nil
+	case errors.Is(err, ErrNoCredentials):
+		logAuthFailure(telemetryLogger, EventAuthFailedNoMetadata, fullMethod, "", err)
+		return ctx, status.Error(codes.Unauthenticated, "missing credentials")
+	case len(md.Get(apiKeyHeader)) > 0:
+		logAuthFailure(telemetryLogger, EventAuthFailedInvalidCreds, fullMethod, AuthMethodAPIKey, err)
+		return ctx, status.Error(codes.Unauthenticated, "invalid credentials")
+	default:
+		logAuthFailure(telemetryLogger, EventAuthFailedInvalidOIDC, fullMethod, AuthMethodJWT, err)
+		return ctx, status.Error(codes.Unauthenticated, "invalid token")
+	}
+}
+
+func logAuthFailure(telemetryLogger TelemetryLogger, event string, fullMethod string, method string, err error) {
+	logger.ConsoleLog("WARN", "Rejected %s: %v", fullMethod, err)
+	if telemetryLogger != nil {
+		telemetryLogger.LogEvent(event, map[string]interface{}{
+			"method":      fullMethod,
+			"auth_method": method,
+			"error":       err.Error(),
+		})
+	}
+}
+
+func authUnaryInterceptor(authenticator Authenticator, telemetryLogger TelemetryLogger) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if authExempt(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		ctx, err := authenticate(ctx, authenticator, info.FullMethod, telemetryLogger)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func authStreamInterceptor(authenticator Authenticator, telemetryLogger TelemetryLogger) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		if authExempt(info.FullMethod) {
+			return handler(srv, stream)
+		}
+		ctx, err := authenticate(stream.Context(), authenticator, info.FullMethod, telemetryLogger)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &contextStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// contextStream overrides the context of a server stream.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,241 @@
+package internals
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	testIssuer   = "https://issuer.example"
+	testAudience = "kokaq"
+)
+
+func newTestSigningKey(t *testing.T, keyId string) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key %s: %v", keyId, err)
+	}
+	return key
+}
+
+func signTestToken(t *testing.T, key *ecdsa.PrivateKey, keyId string, claims interface{}) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: jose.JSONWebKey{Key: key, KeyID: keyId}}, nil)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return token
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	key := newTestSigningKey(t, "current")
+	other := newTestSigningKey(t, "other")
+	jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &key.PublicKey, KeyID: "current", Algorithm: string(jose.ES256), Use: "sig"},
+	}})
+	if err != nil {
+		t.Fatalf("failed to encode jwks: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0644); err != nil {
+		t.Fatalf("failed to write jwks: %v", err)
+	}
+	authenticator, err := LoadJWTAuthenticator(path, testIssuer, testAudience)
+	if err != nil {
+		t.Fatalf("LoadJWTAuthenticator() error = %v", err)
+	}
+
+	now := time.Now()
+	claims := func(edit func(c *tokenClaims)) *tokenClaims {
+		c := &tokenClaims{
+			Claims: jwt.Claims{
+				Issuer:   testIssuer,
+				Subject:  "alice",
+				Audience: jwt.Audience{testAudience},
+				IssuedAt: jwt.NewNumericDate(now),
+				Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+			},
+			Roles: []string{"producer"},
+		}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+	bearer := func(token string) string { return "Bearer " + token }
+	tests := []struct {
+		name          string
+		authorization string
+		roles         []string
+		err           string
+	}{
+		{
+			name:          "valid",
+			authorization: bearer(signTestToken(t, key, "current", claims(nil))),
+			roles:         []string{"producer"},
+		},
+		{
+			name: "roles from scope",
+			authorization: bearer(signTestToken(t, key, "current", claims(func(c *tokenClaims) {
+				c.Roles, c.Scope = nil, "consumer admin"
+			}))),
+			roles: []string{"consumer", "admin"},
+		},
+		{
+			name: "audience among several",
+			authorization: bearer(signTestToken(t, key, "current", claims(func(c *tokenClaims) {
+				c.Audience = jwt.Audience{"other", testAudience}
+			}))),
+			roles: []string{"producer"},
+		},
+		{
+			name: "expired within leeway",
+			authorization: bearer(signTestToken(t, key, "current", claims(func(c *tokenClaims) {
+				c.Expiry = jwt.NewNumericDate(now.Add(-jwt.DefaultLeeway / 2))
+			}))),
+			roles: []string{"producer"},
+		},
+		{
+			name: "expired",
+			authorization: bearer(signTestToken(t, key, "current", claims(func(c *tokenClaims) {
+				c.Expiry = jwt.NewNumericDate(now.Add(-time.Hour))
+			}))),
+			err: "token claims",
+		},
+		{
+			name: "not valid yet",
+			authorization: bearer(signTestToken(t, key, "current", claims(func(c *tokenClaims) {
+				c.NotBefore = jwt.NewNumericDate(now.Add(time.Hour))
+			}))),
+			err: "token claims",
+		},
+		{
+			name: "wrong audience",
+			authorization: bearer(signTestToken(t, key, "current", claims(func(c *tokenClaims) {
+				c.Audience = jwt.Audience{"other"}
+			}))),
+			err: "token claims",
+		},
+		{
+			name: "no audience",
+			authorization: bearer(signTestToken(t, key, "current", claims(func(c *tokenClaims) {
+				c.Audience = nil
+			}))),
+			err: "token claims",
+		},
+		{
+			name: "wrong issuer",
+			authorization: bearer(signTestToken(t, key, "current", claims(func(c *tokenClaims) {
+				c.Issuer = "https://other.example"
+			}))),
+			err: "token claims",
+		},
+		{
+			name: "no subject",
+			authorization: bearer(signTestToken(t, key, "current", claims(func(c *tokenClaims) {
+				c.Subject = ""
+			}))),
+			err: "no subject",
+		},
+		{
+			name:          "unknown key",
+			authorization: bearer(signTestToken(t, other, "other", claims(nil))),
+			err:           "token signature",
+		},
+		{
+			name:          "known key id, other key",
+			authorization: bearer(signTestToken(t, other, "current", claims(nil))),
+			err:           "token signature",
+		},
+		{
+			name:          "malformed",
+			authorization: bearer("not.a.token"),
+			err:           "malformed token",
+		},
+		{
+			name:          "not a bearer token",
+			authorization: "Basic YWxpY2U6c2VjcmV0",
+			err:           ErrNoCredentials.Error(),
+		},
+		{
+			name: "no authorization",
+			err:  ErrNoCredentials.Error(),
+		},
+	}
+	for _, tt := range tests {
+		md := metadata.MD{}
+		if tt.authorization != "" {
+			md.Set(authorizationHeader, tt.authorization)
+		}
+		principal, err := authenticator.Authenticate(context.Background(), md)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: Authenticate() = %+v, %v; want error %q", tt.name, principal, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Authenticate() error = %v", tt.name, err)
+			continue
+		}
+		want := &Principal{Subject: "alice", Method: AuthMethodJWT, Roles: tt.roles}
+		if !reflect.DeepEqual(principal, want) {
+			t.Errorf("%s: Authenticate() = %+v; want %+v", tt.name, principal, want)
+		}
+	}
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	keys := `[{"key": "secret-1", "subject": "alice", "roles": ["producer"]}]`
+	if err := os.WriteFile(path, []byte(keys), 0644); err != nil {
+		t.Fatalf("failed to write api keys: %v", err)
+	}
+	authenticator, err := LoadAPIKeys(path)
+	if err != nil {
+		t.Fatalf("LoadAPIKeys() error = %v", err)
+	}
+	tests := []struct {
+		name    string
+		key     string
+		subject string
+		err     error
+	}{
+		{"known key", "secret-1", "alice", nil},
+		{"unknown key", "secret-2", "", errInvalidAPIKey},
+		{"no key", "", "", ErrNoCredentials},
+	}
+	for _, tt := range tests {
+		md := metadata.MD{}
+		if tt.key != "" {
+			md.Set(apiKeyHeader, tt.key)
+		}
+		principal, err := authenticator.Authenticate(context.Background(), md)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: Authenticate() error = %v; want %v", tt.name, err, tt.err)
+			continue
+		}
+		if tt.err == nil && principal.Subject != tt.subject {
+			t.Errorf("%s: Authenticate() subject = %q; want %q", tt.name, principal.Subject, tt.subject)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package internals
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+var (
+	clientMutex sync.RWMutex
+	clusterKey  string
+	clientCerts *certReloader
+)
+
+// UseClientSecurity makes every connection from DialOptions authenticate as
+// the cluster with the cluster key and, when TLS is configured, dial with
+// the node certificate. It is set once at startup.
+func UseClientSecurity(config SecurityConfig) error {
+	var certs *certReloader
+	if config.TLS.Enabled() {
+		var err error
+		if certs, err = newCertReloader(config.TLS); err != nil {
+			return err
+		}
+	}
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+	if clientCerts != nil {
+		clientCerts.Close()
+	}
+	clusterKey = config.Auth.ClusterKey
+	clientCerts = certs
+	return nil
+}
+
+// DialOptions returns the options nodes use to connect to each other.
+func DialOptions() []grpc.DialOption {
+	return dialOptions(true)
+}
+
+// GatewayDialOptions returns the options of connections carrying calls made
+// on behalf of gateway clients. They use the node's transport security but
+// not the cluster key, so calls run with the caller's own credentials.
+func GatewayDialOptions() []grpc.DialOption {
+	return dialOptions(false)
+}
+
+func dialOptions(asCluster bool) []grpc.DialOption {
+	clientMutex.RLock()
+	defer clientMutex.RUnlock()
+	options := []grpc.DialOption{grpc.WithStatsHandler(otelgrpc.NewClientHandler())}
+	if clientCerts != nil {
+		options = append(options, grpc.WithTransportCredentials(clientCerts.clientCredentials()))
+	} else {
+		options = append(options, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+	if asCluster && clusterKey != "" {
+		options = append(options, grpc.WithPerRPCCredentials(apiKeyCredentials(clusterKey)))
+	}
+	return options
+}
+
+// apiKeyCredentials sends an API key with every RPC.
+type apiKeyCredentials string
+
+func (c apiKeyCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{apiKeyHeader: string(c)}, nil
+}
+
+func (c apiKeyCredentials) RequireTransportSecurity() bool {
+	return false
+}
@@ -0,0 +1,158 @@
+package control
+
+import (
+	"context"
+	"math"
+	"strings"
+
+	"github.com/kokaq/protocol/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// amqpBroker maps AMQP onto the cluster for the AMQP listener. A virtual
+// host is the namespace named like it without the leading slash, "/" alone
+// being the namespace "default", and AMQP queues are the queues of that
+// namespace. Like the REST gateway it goes through the gRPC servers, so the
+// client's credentials are checked there.
+type amqpBroker struct {
+	gateway *gateway
+}
+
+func amqpNamespace(vhost string) string {
+	if namespace := strings.Trim(vhost, "/"); namespace != "" {
+		return namespace
+	}
+	return "default"
+}
+
+// OpenVirtualHost checks the namespace exists by looking up the queue every
+// namespace is created with.
+func (b *amqpBroker) OpenVirtualHost(ctx context.Context, vhost string) error {
+	namespace := amqpNamespace(vhost)
+	_, err := b.gateway.control.GetQueue(ctx, &proto.KokaqQueueRequest{Namespace: namespace, Queue: namespaceQueue})
+	if status.Code(err) == codes.NotFound {
+		return status.Errorf(codes.NotFound, "namespace %s does not exist", namespace)
+	}
+	return err
+}
+
+func (b *amqpBroker) DeclareQueue(ctx context.Context, vhost string, queue string, passive bool) (uint32, error) {
+	request := &proto.KokaqQueueRequest{Namespace: amqpNamespace(vhost), Queue: queue}
+	_, err := b.gateway.control.GetQueue(ctx, request)
+	if status.Code(err) == codes.NotFound && !passive {
+		_, err = b.gateway.control.AddQueue(ctx, request)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return b.depth(ctx, request.Namespace, queue)
+}
+
+func (b *amqpBroker) PurgeQueue(ctx context.Context, vhost string, queue string) (uint32, error) {
+	request := &proto.KokaqQueueRequest{Namespace: amqpNamespace(vhost), Queue: queue}
+	count, err := b.depth(ctx, request.Namespace, queue)
+	if err != nil {
+		return 0, err
+	}
+	_, err = b.gateway.control.ClearQueue(ctx, request)
+	return count, err
+}
+
+func (b *amqpBroker) DeleteQueue(ctx context.Context, vhost string, queue string) (uint32, error) {
+	request := &proto.KokaqQueueRequest{Namespace: amqpNamespace(vhost), Queue: queue}
+	count, err := b.depth(ctx, request.Namespace, queue)
+	if err != nil {
+		return 0, err
+	}
+	_, err = b.gateway.control.DeleteQueue(ctx, request)
+	return count, err
+}
+
+// depth counts the messages of a queue ready for delivery.
+func (b *amqpBroker) depth(ctx context.Context, namespace string, queue string) (uint32, error) {
+	data, err := b.gateway.dataPlane(ctx, namespace, queue)
+	if err != nil {
+		return 0, err
+	}
+	stats, err := data.GetStats(ctx, &proto.KokaqQueueRequest{Namespace: namespace, Queue: queue})
+	if err != nil {
+		return 0, err
+	}
+	return uint32(min(stats.GetStats()["depth"], math.MaxUint32)), nil
+}
+
+func (b *amqpBroker) Publish(ctx context.Context, vhost string, message *proto.KokaqMessageRequest) error {
+	message.Namespace = amqpNamespace(vhost)
+	data, err := b.gateway.dataPlane(ctx, message.Namespace, message.Queue)
+	if err != nil {
+		return err
+	}
+	_, err = data.Enqueue(ctx, &proto.EnqueueRequest{Message: message})
+	return err
+}
+
+func (b *amqpBroker) Receive(ctx context.Context, vhost string, queue string, autoAck bool) (*proto.LockedMessage, error) {
+	namespace := amqpNamespace(vhost)
+	data, err := b.gateway.dataPlane(ctx, namespace, queue)
+	if err != nil {
+		return nil, err
+	}
+	if autoAck {
+		resp, err := data.Dequeue(ctx, &proto.DequeueRequest{Namespace: namespace, Queue: queue, MaxCount: 1})
+		if err != nil || len(resp.GetMessages()) == 0 {
+			return nil, err
+		}
+		return &proto.LockedMessage{Message: resp.GetMessages()[0]}, nil
+	}
+	resp, err := data.PeekLock(ctx, &proto.PeekLockRequest{Namespace: namespace, Queue: queue})
+	if err != nil || len(resp.GetLocked()) == 0 {
+		return nil, err
+	}
+	return resp.GetLocked()[0], nil
+}
+
+func (b *amqpBroker) Ack(ctx context.Context, vhost string, queue string, message *proto.LockedMessage) error {
+	namespace := amqpNamespace(vhost)
+	data, err := b.gateway.dataPlane(ctx, namespace, queue)
+	if err != nil {
+		return err
+	}
+	_, err = data.Ack(ctx, &proto.AckRequest{
+		Namespace: namespace,
+		Queue:     queue,
+		MessageId: message.GetMessage().GetMessage().GetMessageId(),
+		LockId:    message.GetLockId(),
+	})
+	return err
+}
+
+// Reject nacks the message when requeue is set. Otherwise it goes to the
+// dead-letter queue, or is dropped when the queue has none.
+func (b *amqpBroker) Reject(ctx context.Context, vhost string, queue string, message *proto.LockedMessage, requeue bool) error {
+	namespace := amqpNamespace(vhost)
+	data, err := b.gateway.dataPlane(ctx, namespace, queue)
+	if err != nil {
+		return err
+	}
+	if requeue {
+		_, err = data.Nack(ctx, &proto.NackRequest{
+			Namespace:          namespace,
+			Queue:              queue,
+			MessageId:          message.GetMessage().GetMessage().GetMessageId(),
+			LockId:             message.GetLockId(),
+			RequeueImmediately: true,
+		})
+		return err
+	}
+	_, err = data.MoveToDLQ(ctx, &proto.MoveToDLQRequest{
+		Namespace:     namespace,
+		Queue:         queue,
+		LockId:        message.GetLockId(),
+		FailureReason: proto.FailureReason_PROCESSING_ERROR,
+	})
+	if status.Code(err) == codes.FailedPrecondition {
+		return b.Ack(ctx, vhost, queue, message)
+	}
+	return err
+}
@@ -0,0 +1,312 @@
+package control
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/kokaq/protocol/proto"
+	"github.com/kokaq/server/internals"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// gateway serves the REST API of the cluster and backs the AMQP listener.
+// Namespace and queue management goes to the control plane it runs next to;
+// messages go straight to the data node owning the queue. Either way the
+// caller's credentials are checked by the gRPC server handling the call.
+type gateway struct {
+	store   *ControlStore
+	control proto.KokaqControlPlaneClient
+	conn    *grpc.ClientConn
+	mutex   sync.Mutex
+	nodes   map[string]*grpc.ClientConn
+}
+
+func newGateway(store *ControlStore, controlAddress string) (*gateway, error) {
+	conn, err := grpc.NewClient(controlAddress, internals.GatewayDialOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	return &gateway{
+		store:   store,
+		control: proto.NewKokaqControlPlaneClient(conn),
+		conn:    conn,
+		nodes:   make(map[string]*grpc.ClientConn),
+	}, nil
+}
+
+func (g *gateway) Close() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.conn.Close()
+	for _, conn := range g.nodes {
+		conn.Close()
+	}
+}
+
+// dataPlane connects to the data node owning namespace/queue, reusing
+// connections across requests.
+func (g *gateway) dataPlane(ctx context.Context, namespace string, queue string) (proto.KokaqDataPlaneClient, error) {
+	_, address, found := g.store.GetDataPlaneAddress(ctx, namespace, queue)
+	if !found {
+		return nil, status.Errorf(codes.NotFound, "queue %s/%s does not exist", namespace, queue)
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if conn, exist := g.nodes[address]; exist {
+		return proto.NewKokaqDataPlaneClient(conn), nil
+	}
+	conn, err := grpc.NewClient(address, internals.GatewayDialOptions()...)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "cannot reach data plane of %s/%s: %v", namespace, queue, err)
+	}
+	g.nodes[address] = conn
+	return proto.NewKokaqDataPlaneClient(conn), nil
+}
+
+// register adds the routes of the REST API to server.
+func (g *gateway) register(server *internals.Gateway) {
+	const namespace = "/namespaces/{namespace}"
+	const queue = namespace + "/queues/{queue}"
+
+	server.Handle("GET "+namespace, internals.GatewayRoute(http.StatusOK,
+		func(ctx context.Context, r *http.Request, req *proto.KokaqNamespaceRequest) (*proto.KokaqNamespaceResponse, error) {
+			req.Namespace = r.PathValue("namespace")
+			return g.control.GetNamespace(ctx, req)
+		}))
+	server.Handle("PUT "+namespace, internals.GatewayRoute(http.StatusOK,
+		func(ctx context.Context, r *http.Request, req *proto.KokaqNamespaceRequest) (*proto.KokaqNamespaceResponse, error) {
+			req.Namespace = r.PathValue("namespace")
+			return g.control.AddNamespace(ctx, req)
+		}))
+	server.Handle("DELETE "+namespace, internals.GatewayRoute(http.StatusOK,
+		func(ctx context.Context, r *http.Request, req *proto.KokaqNamespaceRequest) (*proto.StatusResponse, error) {
+			req.Namespace = r.PathValue("namespace")
+			return g.control.DeleteNamespace(ctx, req)
+		}))
+	server.Handle("GET "+namespace+"/stats", internals.GatewayRoute(http.StatusOK,
+		func(ctx context.Context, r *http.Request, req *proto.KokaqNamespaceRequest) (*proto.KokaqStatsResponse, error) {
+			req.Namespace = r.PathValue("namespace")
+			return g.control.GetStats(ctx, req)
+		}))
+
+	server.Handle("GET "+queue, internals.GatewayRoute(http.StatusOK,
+		func(ctx context.Context, r *http.Request, req *proto.KokaqQueueRequest) (*proto.KokaqQueueResponse, error) {
+			req.Namespace, req.Queue = r.PathValue("namespace"), r.PathValue("queue")
+			return g.control.GetQueue(ctx, req)
+		}))
+	server.Handle("PUT "+queue, internals.GatewayRoute(http.StatusOK,
+		func(ctx context.Context, r *http.Request, req *proto.KokaqQueueRequest) (*proto.KokaqQueueResponse, error) {
+			req.Namespace, req.Queue = r.PathValue("namespace"), r.PathValue("queue")
+			return g.control.AddQueue(ctx, req)
+		}))
+	server.Handle("DELETE "+queue, internals.GatewayRoute(http.StatusOK,
+		func(ctx context.Context, r *http.Request, req *proto.KokaqQueueRequest) (*proto.StatusResponse, error) {
+			req.Namespace, req.Queue = r.PathValue("namespace"), r.PathValue("queue")
+			return g.control.DeleteQueue(ctx, req)
+		}))
+	server.Handle("POST "+queue, internals.GatewayCustomMethods("queue", map[string]http.Handler{
+		"clear": internals.GatewayRoute(http.StatusOK,
+			func(ctx context.Context, r *http.Request, req *proto.KokaqQueueRequest) (*proto.StatusResponse, error) {
+				req.Namespace, req.Queue = r.PathValue("namespace"), r.PathValue("queue")
+				return g.control.ClearQueue(ctx, req)
+			}),
+	}))
+	server.Handle("GET "+queue+"/stats", internals.GatewayRoute(http.StatusOK,
+		func(ctx context.Context, r *http.Request, req *proto.KokaqQueueRequest) (*proto.KokaqStatsResponse, error) {
+			req.Namespace, req.Queue = r.PathValue("namespace"), r.PathValue("queue")
+			data, err := g.dataPlane(ctx, req.Namespace, req.Queue)
+			if err != nil {
+				return nil, err
+			}
+			return data.GetStats(ctx, req)
+		}))
+
+	server.Handle("POST "+queue+"/messages", internals.GatewayRoute(http.StatusCreated,
+		func(ctx context.Context, r *http.Request, req *proto.KokaqMessageRequest) (*proto.EnqueueResponse, error) {
+			req.Namespace, req.Queue = r.PathValue("namespace"), r.PathValue("queue")
+			data, err := g.dataPlane(ctx, req.Namespace, req.Queue)
+			if err != nil {
+				return nil, err
+			}
+			return data.Enqueue(ctx, &proto.EnqueueRequest{Message: req})
+		}))
+	server.Handle("POST "+queue+"/messages:batchEnqueue", internals.GatewayRoute(http.StatusCreated,
+		func(ctx context.Context, r *http.Request, req *proto.EnqueueBatchRequest) (*proto.EnqueueBatchResponse, error) {
+			req.Namespace, req.Queue = r.PathValue("namespace"), r.PathValue("queue")
+			data, err := g.dataPlane(ctx, req.Namespace, req.Queue)
+			if err != nil {
+				return nil, err
+			}
+			return data.EnqueueBatch(ctx, req)
+		}))
+	server.Handle("GET "+queue+"/messages", internals.GatewayRoute(http.StatusOK,
+		func(ctx context.Context, r *http.Request, req *proto.PeekRequest) (*proto.PeekResponse, error) {
+			req.Namespace, req.Queue = r.PathValue("namespace"), r.PathValue("queue")
+			data, err := g.dataPlane(ctx, req.Namespace, req.Queue)
+			if err != nil {
+				return nil, err
+			}
+			return data.Peek(ctx, req)
+		}))
+	server.Handle("POST "+queue+"/messages:dequeue", internals.GatewayRoute(http.StatusOK,
+		func(ctx context.Context, r *http.Request, req *proto.DequeueRequest) (*proto.DequeueResponse, error) {
+			req.Namespace, req.Queue = r.PathValue("namespace"), r.PathValue("queue")
+			data, err := g.dataPlane(ctx, req.Namespace, req.Queue)
+			if err != nil {
+				return nil, err
+			}
+			return data.Dequeue(ctx, req)
+		}))
+	server.Handle("POST "+queue+"/messages:peekLock", internals.GatewayRoute(http.StatusOK,
+		func(ctx context.Context, r *http.Request, req *proto.PeekLockRequest) (*proto.PeekLockResponse, error) {
+			req.Namespace, req.Queue = r.PathValue("namespace"), r.PathValue("queue")
+			data, err := g.dataPlane(ctx, req.Namespace, req.Queue)
+			if err != nil {
+				return nil, err
+			}
+			return data.PeekLock(ctx, req)
+		}))
+	server.Handle("POST "+queue+"/messages/{message}", internals.GatewayCustomMethods("message", map[string]http.Handler{
+		"cancelScheduled": internals.GatewayRoute(http.StatusOK,
+			func(ctx context.Context, r *http.Request, req *proto.CancelScheduledRequest) (*proto.StatusResponse, error) {
+				req.Namespace, req.Queue, req.MessageId = r.PathValue("namespace"), r.PathValue("queue"), r.PathValue("message")
+				data, err := g.dataPlane(ctx, req.Namespace, req.Queue)
+				if err != nil {
+					return nil, err
+				}
+				return data.CancelScheduled(ctx, req)
+			}),
+		"ack": internals.GatewayRoute(http.StatusOK,
+			func(ctx context.Context, r *http.Request, req *proto.AckRequest) (*proto.AckResponse, error) {
+				req.Namespace, req.Queue, req.MessageId = r.PathValue("namespace"), r.PathValue("queue"), r.PathValue("message")
+				data, err := g.dataPlane(ctx, req.Namespace, req.Queue)
+				if err != nil {
+					return nil, err
+				}
+				return data.Ack(ctx, req)
+			}),
+		"nack": internals.GatewayRoute(http.StatusOK,
+			func(ctx context.Context, r *http.Request, req *proto.NackRequest) (*proto.NackResponse, error) {
+				req.Namespace, req.Queue, req.MessageId = r.PathValue("namespace"), r.PathValue("queue"), r.PathValue("message")
+				data, err := g.dataPlane(ctx, req.Namespace, req.Queue)
+				if err != nil {
+					return nil, err
+				}
+				return data.Nack(ctx, req)
+			}),
+		"extendVisibility": internals.GatewayRoute(http.StatusOK,
+			func(ctx context.Context, r *http.Request, req *proto.ExtendVisibilityTimeoutRequest) (*proto.VisibilityTimeoutResponse, error) {
+				req.Namespace, req.Queue, req.MessageId = r.PathValue("namespace"), r.PathValue("queue"), r.PathValue("message")
+				data, err := g.dataPlane(ctx, req.Namespace, req.Queue)
+				if err != nil {
+					return nil, err
+				}
+				return data.Extend(ctx, req)
+			}),
+		"setVisibility": internals.GatewayRoute(http.StatusOK,
+			func(ctx context.Context, r *http.Request, req *proto.SetVisibilityTimeoutRequest) (*proto.VisibilityTimeoutResponse, error) {
+				req.Namespace, req.Queue, req.MessageId = r.PathValue("namespace"), r.PathValue("queue"), r.PathValue("message")
+				data, err := g.dataPlane(ctx, req.Namespace, req.Queue)
+				if err != nil {
+					return nil, err
+				}
+				return data.SetVisibilityTimeout(ctx, req)
+			}),
+		"refreshVisibility": internals.GatewayRoute(http.StatusOK,
+			func(ctx context.Context, r *http.Request, req *proto.RefreshVisibilityTimeoutRequest) (*proto.VisibilityTimeoutResponse, error) {
+				req.Namespace, req.Queue, req.MessageId = r.PathValue("namespace"), r.PathValue("queue"), r.PathValue("message")
+				data, err := g.dataPlane(ctx, req.Namespace, req.Queue)
+				if err != nil {
+					return nil, err
+				}
+				return data.RefreshVisibilityTimeout(ctx, req)
+			}),
+	}))
+	server.Handle("POST "+queue+"/locks:batchAck", internals.GatewayRoute(http.StatusOK,
+		func(ctx context.Context, r *http.Request, req *proto.AckBatchRequest) (*proto.LockBatchResponse, error) {
+			req.Namespace, req.Queue = r.PathValue("namespace"), r.PathValue("queue")
+			data, err := g.dataPlane(ctx, req.Namespace, req.Queue)
+			if err != nil {
+				return nil, err
+			}
+			return data.AckBatch(ctx, req)
+		}))
+	server.Handle("POST "+queue+"/locks:batchNack", internals.GatewayRoute(http.StatusOK,
+		func(ctx context.Context, r *http.Request, req *proto.NackBatchRequest) (*proto.LockBatchResponse, error) {
+			req.Namespace, req.Queue = r.PathValue("namespace"), r.PathValue("queue")
+			data, err := g.dataPlane(ctx, req.Namespace, req.Queue)
+			if err != nil {
+				return nil, err
+			}
+			return data.NackBatch(ctx, req)
+		}))
+	server.Handle("POST "+queue+"/locks:batchExtend", internals.GatewayRoute(http.StatusOK,
+		func(ctx context.Context, r *http.Request, req *proto.ExtendBatchRequest) (*proto.LockBatchResponse, error) {
+			req.Namespace, req.Queue = r.PathValue("namespace"), r.PathValue("queue")
+			data, err := g.dataPlane(ctx, req.Namespace, req.Queue)
+			if err != nil {
+				return nil, err
+			}
+			return data.ExtendBatch(ctx, req)
+		}))
+	server.Handle("DELETE "+queue+"/locks/{lock}", internals.GatewayRoute(http.StatusOK,
+		func(ctx context.Context, r *http.Request, req *proto.ReleaseLockRequest) (*proto.ReleaseLockResponse, error) {
+			req.Namespace, req.Queue, req.LockId = r.PathValue("namespace"), r.PathValue("queue"), r.PathValue("lock")
+			data, err := g.dataPlane(ctx, req.Namespace, req.Queue)
+			if err != nil {
+				return nil, err
+			}
+			return data.ReleaseLock(ctx, req)
+		}))
+	server.Handle("POST "+queue+"/locks/{lock}", internals.GatewayCustomMethods("lock", map[string]http.Handler{
+		"deadLetter": internals.GatewayRoute(http.StatusOK,
+			func(ctx context.Context, r *http.Request, req *proto.MoveToDLQRequest) (*proto.MoveToDLQResponse, error) {
+				req.Namespace, req.Queue, req.LockId = r.PathValue("namespace"), r.PathValue("queue"), r.PathValue("lock")
+				data, err := g.dataPlane(ctx, req.Namespace, req.Queue)
+				if err != nil {
+					return nil, err
+				}
+				return data.MoveToDLQ(ctx, req)
+			}),
+	}))
+
+	server.Handle("GET "+queue+"/deadLetters", internals.GatewayRoute(http.StatusOK,
+		func(ctx context.Context, r *http.Request, req *proto.DLQRequest) (*proto.DLQMessagesResponse, error) {
+			req.Namespace, req.Queue = r.PathValue("namespace"), r.PathValue("queue")
+			data, err := g.dataPlane(ctx, req.Namespace, req.Queue)
+			if err != nil {
+				return nil, err
+			}
+			return data.ListDLQMessages(ctx, req)
+		}))
+	server.Handle("POST "+queue+"/deadLetters:dequeue", internals.GatewayRoute(http.StatusOK,
+		func(ctx context.Context, r *http.Request, req *proto.DLQRequest) (*proto.DLQMessagesResponse, error) {
+			req.Namespace, req.Queue = r.PathValue("namespace"), r.PathValue("queue")
+			data, err := g.dataPlane(ctx, req.Namespace, req.Queue)
+			if err != nil {
+				return nil, err
+			}
+			return data.DequeueDLQ(ctx, req)
+		}))
+	server.Handle("POST "+queue+"/deadLetters:redrive", internals.GatewayRoute(http.StatusOK,
+		func(ctx context.Context, r *http.Request, req *proto.MoveFromDLQRequest) (*proto.MoveFromDLQResponse, error) {
+			req.Namespace, req.Queue = r.PathValue("namespace"), r.PathValue("queue")
+			data, err := g.dataPlane(ctx, req.Namespace, req.Queue)
+			if err != nil {
+				return nil, err
+			}
+			return data.MoveFromDLQ(ctx, req)
+		}))
+	server.Handle("DELETE "+queue+"/deadLetters", internals.GatewayRoute(http.StatusOK,
+		func(ctx context.Context, r *http.Request, req *proto.DLQRequest) (*proto.StatusResponse, error) {
+			req.Namespace, req.Queue = r.PathValue("namespace"), r.PathValue("queue")
+			data, err := g.dataPlane(ctx, req.Namespace, req.Queue)
+			if err != nil {
+				return nil, err
+			}
+			return data.ClearDLQ(ctx, req)
+		}))
+}
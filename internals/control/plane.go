@@ -3,15 +3,22 @@ package control
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/kokaq/core/internals/logger"
 	"github.com/kokaq/protocol/proto"
+	"github.com/kokaq/server/internals"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+// namespaceQueue is the queue a namespace is created with; the namespace
+// exists as long as it does.
+const namespaceQueue = ".Default"
+
 type ControlPlane struct {
 	proto.UnimplementedKokaqControlPlaneServer
 	RootDir string
@@ -28,7 +35,7 @@ func NewControlPlane(rootDirectory string, shardManagerAddress string) (*Control
 func (d *ControlPlane) AddNamespace(c context.Context, p *proto.KokaqNamespaceRequest) (*proto.KokaqNamespaceResponse, error) {
 	q, err := d.AddQueue(c, &proto.KokaqQueueRequest{
 		Namespace: p.Namespace,
-		Queue:     ".Default",
+		Queue:     namespaceQueue,
 		CreatedOn: timestamppb.Now(),
 	})
 	return &proto.KokaqNamespaceResponse{
@@ -41,7 +48,7 @@ func (d *ControlPlane) AddNamespace(c context.Context, p *proto.KokaqNamespaceRe
 func (d *ControlPlane) GetDataplane(c context.Context, p *proto.GetDataplaneRequest) (*proto.GetDataplaneResponse, error) {
 	logger.ConsoleLog("INFO", "Received GetDataplane request: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
 
-	address, _, found := d.store.GetDataPlaneAddress(p.Namespace, p.Queue)
+	address, _, found := d.store.GetDataPlaneAddress(c, p.Namespace, p.Queue)
 	if !found {
 		logger.ConsoleLog("ERROR", "Failed to get shard address for Namespace=%s, Queue=%s", p.Namespace, p.Queue)
 		return &proto.GetDataplaneResponse{
@@ -64,40 +71,45 @@ func (d *ControlPlane) GetDataplane(c context.Context, p *proto.GetDataplaneRequ
 func (d *ControlPlane) GetQueue(c context.Context, p *proto.KokaqQueueRequest) (*proto.KokaqQueueResponse, error) {
 	logger.ConsoleLog("INFO", "Fetching queue: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
 
-	_, internalAddress, found := d.store.GetDataPlaneAddress(p.Namespace, p.Queue)
+	_, internalAddress, found := d.store.GetDataPlaneAddress(c, p.Namespace, p.Queue)
 	if !found {
 		logger.ConsoleLog("ERROR", "Failed to get shard address for Namespace=%s, Queue=%s", p.Namespace, p.Queue)
-		return nil, fmt.Errorf("failed to get queue for namespace=%s, queue=%s", p.Namespace, p.Queue)
+		return nil, status.Errorf(codes.NotFound, "failed to get queue for namespace=%s, queue=%s", p.Namespace, p.Queue)
 	}
 
-	return d.getQueueFromShard(internalAddress, p.Namespace, p.Queue)
+	res, err := d.getQueueFromShard(c, internalAddress, p.Namespace, p.Queue)
+	if err != nil {
+		d.store.ForgetDataPlaneAddress(p.Namespace, p.Queue)
+	}
+	return res, err
 }
 
 // AddQueue creates a new queue by requesting a shard assignment and sending a creation RPC.
 func (d *ControlPlane) AddQueue(c context.Context, p *proto.KokaqQueueRequest) (*proto.KokaqQueueResponse, error) {
 	logger.ConsoleLog("INFO", "Creating new queue: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
 
-	_, internalAddress, success, newCreated, shardId := d.store.GetOrAddDataPlaneAddress(p.Namespace, p.Queue)
+	_, internalAddress, success, newCreated, shardId := d.store.GetOrAddDataPlaneAddress(c, p.Namespace, p.Queue)
 	if !newCreated || !success {
 		logger.ConsoleLog("ERROR", "Failed to create shard address for Namespace=%s, Queue=%s", p.Namespace, p.Queue)
 		return nil, fmt.Errorf("failed to create queue for namespace=%s, queue=%s", p.Namespace, p.Queue)
 	}
 
-	return d.newQueueFromShard(internalAddress, p.Namespace, p.Queue, shardId)
+	return d.newQueueFromShard(c, internalAddress, p, shardId)
 }
 
 // ClearQueue removes all messages from the specified queue on the shard.
 func (d *ControlPlane) ClearQueue(c context.Context, p *proto.KokaqQueueRequest) (*proto.StatusResponse, error) {
 	logger.ConsoleLog("INFO", "Clearing queue: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
 
-	_, internalAddress, found := d.store.GetDataPlaneAddress(p.Namespace, p.Queue)
+	_, internalAddress, found := d.store.GetDataPlaneAddress(c, p.Namespace, p.Queue)
 	if !found {
 		logger.ConsoleLog("ERROR", "Failed to get shard address for Namespace=%s, Queue=%s", p.Namespace, p.Queue)
-		return nil, fmt.Errorf("failed to get queue for namespace=%s, queue=%s", p.Namespace, p.Queue)
+		return nil, status.Errorf(codes.NotFound, "failed to get queue for namespace=%s, queue=%s", p.Namespace, p.Queue)
 	}
 
-	if cleared, err := d.clearQueueFromShards(internalAddress, p.Namespace, p.Queue); !cleared || err != nil {
+	if cleared, err := d.clearQueueFromShards(c, internalAddress, p.Namespace, p.Queue); !cleared || err != nil {
 		logger.ConsoleLog("ERROR", "Clear operation failed: %v", err)
+		d.store.ForgetDataPlaneAddress(p.Namespace, p.Queue)
 		return nil, fmt.Errorf("cannot clear queue")
 	}
 
@@ -108,33 +120,102 @@ func (d *ControlPlane) ClearQueue(c context.Context, p *proto.KokaqQueueRequest)
 func (d *ControlPlane) DeleteQueue(c context.Context, p *proto.KokaqQueueRequest) (*proto.StatusResponse, error) {
 	logger.ConsoleLog("INFO", "Deleting queue: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
 
-	_, internalAddress, found := d.store.GetDataPlaneAddress(p.Namespace, p.Queue)
+	_, internalAddress, found := d.store.GetDataPlaneAddress(c, p.Namespace, p.Queue)
 	if !found {
 		logger.ConsoleLog("ERROR", "Failed to get shard address for Namespace=%s, Queue=%s", p.Namespace, p.Queue)
-		return nil, fmt.Errorf("failed to get queue for namespace=%s, queue=%s", p.Namespace, p.Queue)
+		return nil, status.Errorf(codes.NotFound, "failed to get queue for namespace=%s, queue=%s", p.Namespace, p.Queue)
 	}
 
-	if deleted, err := d.deleteQueueFromShards(internalAddress, p.Namespace, p.Queue); !deleted || err != nil {
+	if deleted, err := d.deleteQueueFromShards(c, internalAddress, p.Namespace, p.Queue); !deleted || err != nil {
 		logger.ConsoleLog("ERROR", "Delete operation failed: %v", err)
+		d.store.ForgetDataPlaneAddress(p.Namespace, p.Queue)
 		return nil, fmt.Errorf("cannot delete queue")
 	}
 
-	if d.store.RemoveDataPlaneAddress(p.Namespace, p.Queue) {
+	if d.store.RemoveDataPlaneAddress(c, p.Namespace, p.Queue) {
 		return &proto.StatusResponse{Success: true}, nil
 	} else {
 		return &proto.StatusResponse{Success: false}, nil
 	}
 }
 
-// GetStats returns basic stats about the namespace (currently unimplemented).
+// GetStats rolls the stats of every queue in the namespace up into one set.
+// Counts and rates are summed and the oldest message age is the maximum over
+// all queues. Queues whose shard cannot be reached are counted in
+// unreachable_queue_count rather than failing the whole call.
 func (d *ControlPlane) GetStats(c context.Context, p *proto.KokaqNamespaceRequest) (*proto.KokaqStatsResponse, error) {
-	logger.ConsoleLog("WARN", "Stats not implemented for Namespace=%s", p.Namespace)
-	return nil, fmt.Errorf("failed to connect to shard manager")
+	logger.ConsoleLog("INFO", "Collecting stats: Namespace=%s", p.Namespace)
+
+	queues, err := d.store.ListQueues(c, p.Namespace)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "Failed to list queues for Namespace=%s: %v", p.Namespace, err)
+		return &proto.KokaqStatsResponse{Status: &proto.StatusResponse{Success: false, Error: proto.ErrorCode_ERROR_DEPENDENCY_FAILURE}}, err
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	stats := map[string]uint64{
+		"queue_count":             uint64(len(queues)),
+		"unreachable_queue_count": 0,
+	}
+	for _, queue := range queues {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			queueStats, err := map[string]uint64(nil), fmt.Errorf("no data plane address")
+			if _, internalAddress, found := d.store.GetDataPlaneAddress(c, p.Namespace, queue); found {
+				queueStats, err = d.getStatsFromShard(c, internalAddress, p.Namespace, queue)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				logger.ConsoleLog("WARN", "Failed to get stats for Namespace=%s, Queue=%s: %v", p.Namespace, queue, err)
+				stats["unreachable_queue_count"]++
+				return
+			}
+			mergeStats(stats, queueStats)
+		}()
+	}
+	wg.Wait()
+	return &proto.KokaqStatsResponse{Stats: stats, Status: &proto.StatusResponse{Success: true}}, nil
+}
+
+// mergeStats adds the stats of one queue to the namespace totals. Depths,
+// counters and per-minute rates add up across queues; the oldest message age
+// of a namespace is that of its oldest queue.
+func mergeStats(stats map[string]uint64, queueStats map[string]uint64) {
+	for key, value := range queueStats {
+		switch key {
+		case "oldest_message_age_ms":
+			stats[key] = max(stats[key], value)
+		default:
+			stats[key] += value
+		}
+	}
+}
+
+func (d *ControlPlane) getStatsFromShard(ctx context.Context, shardDataAddress string, namespace string, queue string) (map[string]uint64, error) {
+	conn, err := grpc.NewClient(shardDataAddress, internals.DialOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to data server: %v", err)
+	}
+	defer conn.Close()
+
+	dataClient := proto.NewKokaqDataPlaneClient(conn)
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	res, err := dataClient.GetStats(ctx, &proto.KokaqQueueRequest{Namespace: namespace, Queue: queue})
+	if err != nil {
+		return nil, fmt.Errorf("getStats rpc failed: %v", err)
+	}
+	return res.Stats, nil
 }
 
-func (d *ControlPlane) newQueueFromShard(shardDataAddress string, namespace string, queue string, shardId uint64) (*proto.KokaqQueueResponse, error) {
+func (d *ControlPlane) newQueueFromShard(ctx context.Context, shardDataAddress string, request *proto.KokaqQueueRequest, shardId uint64) (*proto.KokaqQueueResponse, error) {
+	namespace, queue := request.Namespace, request.Queue
 	// Attempt to connect to the data server
-	conn, err := grpc.NewClient(shardDataAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.NewClient(shardDataAddress, internals.DialOptions()...)
 	if err != nil {
 		logger.ConsoleLog("ERROR", "Failed to connect to data server at %s: %v", shardDataAddress, err)
 		return nil, fmt.Errorf("failed to connect to data server: %v", err)
@@ -143,12 +224,12 @@ func (d *ControlPlane) newQueueFromShard(shardDataAddress string, namespace stri
 
 	// Set up gRPC client and timeout context
 	dataClient := proto.NewKokaqDataPlaneClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
 	defer cancel()
 
 	// Prepare request to create a new queue on the shard
 	req := &proto.KokaqNewQueueRequest{
-		Request: &proto.KokaqQueueRequest{Queue: queue, Namespace: namespace},
+		Request: request,
 		ShardId: shardId,
 	}
 
@@ -163,10 +244,10 @@ func (d *ControlPlane) newQueueFromShard(shardDataAddress string, namespace stri
 	logger.ConsoleLog("INFO", "New queue successfully created: Namespace=%s, Queue=%s, ShardId=%x", namespace, queue, shardId)
 	return res, nil
 }
-func (d *ControlPlane) getQueueFromShard(shardDataAddress string, namespace string, queue string) (*proto.KokaqQueueResponse, error) {
+func (d *ControlPlane) getQueueFromShard(ctx context.Context, shardDataAddress string, namespace string, queue string) (*proto.KokaqQueueResponse, error) {
 
 	// Attempt to connect to the data server at the given shard address
-	conn, err := grpc.NewClient(shardDataAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.NewClient(shardDataAddress, internals.DialOptions()...)
 	if err != nil {
 		logger.ConsoleLog("ERROR", "Failed to connect to data server at %s: %v", shardDataAddress, err)
 		return nil, fmt.Errorf("failed to connect to data server: %v", err)
@@ -175,7 +256,7 @@ func (d *ControlPlane) getQueueFromShard(shardDataAddress string, namespace stri
 
 	// Create data plane client and context with timeout
 	dataClient := proto.NewKokaqDataPlaneClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
 	defer cancel()
 
 	// Prepare request to retrieve existing queue
@@ -196,9 +277,9 @@ func (d *ControlPlane) getQueueFromShard(shardDataAddress string, namespace stri
 	logger.ConsoleLog("INFO", "Queue successfully retrieved from shard: Namespace=%s, Queue=%s", namespace, queue)
 	return res, nil
 }
-func (d *ControlPlane) deleteQueueFromShards(shardDataAddress string, namespace string, queue string) (bool, error) {
+func (d *ControlPlane) deleteQueueFromShards(ctx context.Context, shardDataAddress string, namespace string, queue string) (bool, error) {
 	// Attempt to connect to the shard data server
-	conn, err := grpc.NewClient(shardDataAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.NewClient(shardDataAddress, internals.DialOptions()...)
 	if err != nil {
 		logger.ConsoleLog("ERROR", "Failed to connect to data server at %s: %v", shardDataAddress, err)
 		return false, fmt.Errorf("failed to connect to data server: %v", err)
@@ -207,7 +288,7 @@ func (d *ControlPlane) deleteQueueFromShards(shardDataAddress string, namespace
 
 	// Create the gRPC client and context
 	dataClient := proto.NewKokaqDataPlaneClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
 	defer cancel()
 
 	// Prepare the request for deletion
@@ -228,9 +309,9 @@ func (d *ControlPlane) deleteQueueFromShards(shardDataAddress string, namespace
 	logger.ConsoleLog("INFO", "Queue deleted successfully from shard: Namespace=%s, Queue=%s", namespace, queue)
 	return true, nil
 }
-func (d *ControlPlane) clearQueueFromShards(shardDataAddress string, namespace string, queue string) (bool, error) {
+func (d *ControlPlane) clearQueueFromShards(ctx context.Context, shardDataAddress string, namespace string, queue string) (bool, error) {
 	// Establish connection to the shard data server
-	conn, err := grpc.NewClient(shardDataAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.NewClient(shardDataAddress, internals.DialOptions()...)
 	if err != nil {
 		logger.ConsoleLog("ERROR", "Failed to connect to data server at %s: %v", shardDataAddress, err)
 		return false, fmt.Errorf("failed to connect to data server: %v", err)
@@ -239,7 +320,7 @@ func (d *ControlPlane) clearQueueFromShards(shardDataAddress string, namespace s
 
 	// Prepare gRPC client and context
 	dataClient := proto.NewKokaqDataPlaneClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
 	defer cancel()
 
 	// Construct request
@@ -0,0 +1,50 @@
+package control
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestMergeStats(t *testing.T) {
+	tests := []struct {
+		name   string
+		queues []map[string]uint64
+		want   map[string]uint64
+	}{
+		{
+			name: "no queues",
+			want: map[string]uint64{},
+		},
+		{
+			name:   "one queue",
+			queues: []map[string]uint64{{"depth": 3, "enqueued_total": 5, "oldest_message_age_ms": 900}},
+			want:   map[string]uint64{"depth": 3, "enqueued_total": 5, "oldest_message_age_ms": 900},
+		},
+		{
+			name: "several queues",
+			queues: []map[string]uint64{
+				{"depth": 3, "in_flight": 1, "enqueued_total": 5, "enqueued_per_minute": 2, "oldest_message_age_ms": 900},
+				{"depth": 0, "in_flight": 0, "enqueued_total": 1, "enqueued_per_minute": 0, "oldest_message_age_ms": 0},
+				{"depth": 4, "in_flight": 2, "enqueued_total": 7, "enqueued_per_minute": 3, "oldest_message_age_ms": 12000},
+			},
+			want: map[string]uint64{"depth": 7, "in_flight": 3, "enqueued_total": 13, "enqueued_per_minute": 5, "oldest_message_age_ms": 12000},
+		},
+		{
+			name: "oldest queue first",
+			queues: []map[string]uint64{
+				{"depth": 1, "oldest_message_age_ms": 12000},
+				{"depth": 1, "oldest_message_age_ms": 900},
+			},
+			want: map[string]uint64{"depth": 2, "oldest_message_age_ms": 12000},
+		},
+	}
+	for _, tt := range tests {
+		stats := make(map[string]uint64)
+		for _, queueStats := range tt.queues {
+			mergeStats(stats, queueStats)
+		}
+		if !maps.Equal(stats, tt.want) {
+			t.Errorf("%s: mergeStats() = %v; want %v", tt.name, stats, tt.want)
+		}
+	}
+}
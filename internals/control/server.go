@@ -2,6 +2,7 @@ package control
 
 import (
 	"context"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
@@ -14,49 +15,137 @@ import (
 )
 
 type ControlServer struct {
-	server *internals.KokaqServer
+	server  *internals.KokaqServer
+	gateway *gateway
+	rest    *internals.Gateway
+	amqp    *internals.AMQPServer
+	sqs     *internals.Gateway
 }
 
+// ControlServerConfig configures a control server. RestAddress, AmqpAddress
+// and SqsAddress, when set, also serve the REST gateway, the AMQP listener
+// and the SQS-compatible API there, over TLS when TLS is configured.
 type ControlServerConfig struct {
 	RootDirectory       string
 	Address             string
 	ShardManagerAddress string
+	RestAddress         string
+	AmqpAddress         string
+	SqsAddress          string
+	TLS                 internals.TLSConfig
 }
 
-func NewControlServer(telemetryLogger internals.TelemetryLogger, requestTimeout time.Duration) (*ControlServer, error) {
+func NewControlServer(telemetryLogger internals.TelemetryLogger, requestTimeout time.Duration, options ...internals.ServerOption) (*ControlServer, error) {
 	cleanup := func() {
 		logger.ConsoleLog("INFO", "control server cleanup called")
 	}
-	kokaqServer, err := internals.NewKokaqServer(cleanup, telemetryLogger, requestTimeout)
+	kokaqServer, err := internals.NewKokaqServer(cleanup, telemetryLogger, requestTimeout, options...)
 	return &ControlServer{
 		server: kokaqServer,
 	}, err
 }
 
 func (ds *ControlServer) Start(config ControlServerConfig) error {
+	srv, _ := NewControlPlane(config.RootDirectory, config.ShardManagerAddress)
 	register := func(server *grpc.Server) {
-		srv, _ := NewControlPlane(config.RootDirectory, config.ShardManagerAddress)
 		proto.RegisterKokaqControlPlaneServer(server, srv)
 	}
-	err := ds.server.Start(config.Address, register)
-	return err
+	if err := ds.server.Start(config.Address, register); err != nil {
+		return err
+	}
+	if config.RestAddress == "" && config.AmqpAddress == "" && config.SqsAddress == "" {
+		return nil
+	}
+	return ds.startGateway(srv.store, config)
+}
+
+func (ds *ControlServer) startGateway(store *ControlStore, config ControlServerConfig) error {
+	// The gateway calls the control plane through its listener, so every
+	// REST, AMQP and SQS call passes the same authentication, authorization and
+	// timeouts.
+	target := config.Address
+	if host, port, err := net.SplitHostPort(target); err == nil && host == "" {
+		target = net.JoinHostPort("localhost", port)
+	}
+	routes, err := newGateway(store, target)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "Failed to connect REST gateway to %s: %v", target, err)
+		return err
+	}
+	ds.gateway = routes
+	if config.RestAddress != "" {
+		rest, err := internals.NewGateway(config.TLS)
+		if err != nil {
+			return err
+		}
+		routes.register(rest)
+		if err := rest.Start(config.RestAddress); err != nil {
+			logger.ConsoleLog("ERROR", "Failed to serve REST gateway on %s: %v", config.RestAddress, err)
+			return err
+		}
+		ds.rest = rest
+	}
+	if config.AmqpAddress != "" {
+		amqp, err := internals.NewAMQPServer(&amqpBroker{gateway: routes}, config.TLS)
+		if err != nil {
+			return err
+		}
+		if err := amqp.Start(config.AmqpAddress); err != nil {
+			logger.ConsoleLog("ERROR", "Failed to serve AMQP on %s: %v", config.AmqpAddress, err)
+			return err
+		}
+		ds.amqp = amqp
+	}
+	if config.SqsAddress != "" {
+		sqs, err := internals.NewGateway(config.TLS)
+		if err != nil {
+			return err
+		}
+		sqs.Handle("/", internals.NewSQSHandler(&sqsBroker{gateway: routes}))
+		if err := sqs.Start(config.SqsAddress); err != nil {
+			logger.ConsoleLog("ERROR", "Failed to serve SQS API on %s: %v", config.SqsAddress, err)
+			return err
+		}
+		ds.sqs = sqs
+	}
+	return nil
 }
 
 func (ds *ControlServer) Stop(ctx context.Context) error {
+	if ds.rest != nil {
+		ds.rest.Stop(ctx)
+	}
+	if ds.amqp != nil {
+		ds.amqp.Stop(ctx)
+	}
+	if ds.sqs != nil {
+		ds.sqs.Stop(ctx)
+	}
+	if ds.gateway != nil {
+		ds.gateway.Close()
+	}
 	err := ds.server.Stop(ctx)
 	return err
 }
 
-func StartControlServer(address string, shardManagerAddress string) {
-	telemetryLogger := &DummyTelemetryLogger{}
-	requestTimeout := 0 * time.Second
+func StartControlServer(address string, shardManagerAddress string, security internals.SecurityConfig, timeouts internals.TimeoutConfig, metricsAddress string, restAddress string, amqpAddress string, sqsAddress string, telemetryLogger internals.TelemetryLogger) {
+	timeouts = timeouts.OrDefault(30 * time.Second)
 
-	cs, err := NewControlServer(telemetryLogger, requestTimeout)
+	options, err := internals.SecurityOptions(security)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "Failed to configure security: %v", err)
+		return
+	}
+	cs, err := NewControlServer(telemetryLogger, timeouts.Default, append(options, internals.WithMethodTimeouts(timeouts.Overrides), internals.WithMetrics(metricsAddress))...)
 	if err == nil {
 		cs.Start(ControlServerConfig{
 			RootDirectory:       "",
 			Address:             address,
 			ShardManagerAddress: shardManagerAddress,
+			RestAddress:         restAddress,
+			AmqpAddress:         amqpAddress,
+			SqsAddress:          sqsAddress,
+			TLS:                 security.TLS,
 		})
 	}
 	// Wait for interrupt signal to gracefully shutdown
@@ -69,9 +158,3 @@ func StartControlServer(address string, shardManagerAddress string) {
 		logger.ConsoleLog("ERROR", "Error stopping control server: %v", err)
 	}
 }
-
-type DummyTelemetryLogger struct{}
-
-func (d *DummyTelemetryLogger) LogEvent(event string, data map[string]interface{}) {
-	logger.ConsoleLog("INFO", "Telemetry event: %s, data: %v", event, data)
-}
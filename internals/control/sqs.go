@@ -0,0 +1,122 @@
+package control
+
+import (
+	"context"
+	"time"
+
+	"github.com/kokaq/protocol/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// sqsBroker maps the SQS API onto the cluster for the SQS listener. Like the
+// REST gateway it goes through the gRPC servers, so the client's credentials
+// are checked there.
+type sqsBroker struct {
+	gateway *gateway
+}
+
+func (b *sqsBroker) CreateQueue(ctx context.Context, config *proto.KokaqQueueRequest) error {
+	_, err := b.gateway.control.GetQueue(ctx, &proto.KokaqQueueRequest{Namespace: config.Namespace, Queue: config.Queue})
+	if status.Code(err) == codes.NotFound {
+		_, err = b.gateway.control.AddQueue(ctx, config)
+	}
+	return err
+}
+
+func (b *sqsBroker) GetQueue(ctx context.Context, namespace string, queue string) (*proto.KokaqQueueRequest, error) {
+	resp, err := b.gateway.control.GetQueue(ctx, &proto.KokaqQueueRequest{Namespace: namespace, Queue: queue})
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetRequest(), nil
+}
+
+func (b *sqsBroker) DeleteQueue(ctx context.Context, namespace string, queue string) error {
+	_, err := b.gateway.control.DeleteQueue(ctx, &proto.KokaqQueueRequest{Namespace: namespace, Queue: queue})
+	return err
+}
+
+func (b *sqsBroker) PurgeQueue(ctx context.Context, namespace string, queue string) error {
+	_, err := b.gateway.control.ClearQueue(ctx, &proto.KokaqQueueRequest{Namespace: namespace, Queue: queue})
+	return err
+}
+
+func (b *sqsBroker) QueueStats(ctx context.Context, namespace string, queue string) (map[string]uint64, error) {
+	data, err := b.gateway.dataPlane(ctx, namespace, queue)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := data.GetStats(ctx, &proto.KokaqQueueRequest{Namespace: namespace, Queue: queue})
+	if err != nil {
+		return nil, err
+	}
+	return stats.GetStats(), nil
+}
+
+func (b *sqsBroker) Send(ctx context.Context, message *proto.KokaqMessageRequest) (string, error) {
+	data, err := b.gateway.dataPlane(ctx, message.Namespace, message.Queue)
+	if err != nil {
+		return "", err
+	}
+	resp, err := data.Enqueue(ctx, &proto.EnqueueRequest{Message: message})
+	if err != nil {
+		return "", err
+	}
+	return resp.GetMessageId(), nil
+}
+
+func (b *sqsBroker) Receive(ctx context.Context, namespace string, queue string, count int, visibilityTimeout uint32, wait time.Duration) ([]*proto.LockedMessage, error) {
+	data, err := b.gateway.dataPlane(ctx, namespace, queue)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := data.PeekLock(ctx, &proto.PeekLockRequest{
+		Namespace:    namespace,
+		Queue:        queue,
+		LockDuration: visibilityTimeout,
+		WaitTimeMs:   uint32(wait.Milliseconds()),
+		MaxCount:     uint32(count),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetLocked(), nil
+}
+
+func (b *sqsBroker) Delete(ctx context.Context, namespace string, queue string, lockId string, messageId string) error {
+	data, err := b.gateway.dataPlane(ctx, namespace, queue)
+	if err != nil {
+		return err
+	}
+	_, err = data.Ack(ctx, &proto.AckRequest{Namespace: namespace, Queue: queue, MessageId: messageId, LockId: lockId})
+	return lockError(err)
+}
+
+func (b *sqsBroker) ChangeVisibility(ctx context.Context, namespace string, queue string, lockId string, messageId string, timeout time.Duration) error {
+	data, err := b.gateway.dataPlane(ctx, namespace, queue)
+	if err != nil {
+		return err
+	}
+	if timeout == 0 {
+		_, err = data.ReleaseLock(ctx, &proto.ReleaseLockRequest{Namespace: namespace, Queue: queue, MessageId: messageId, LockId: lockId, MakeVisibleNow: true})
+		return lockError(err)
+	}
+	_, err = data.SetVisibilityTimeout(ctx, &proto.SetVisibilityTimeoutRequest{
+		Namespace:    namespace,
+		Queue:        queue,
+		MessageId:    messageId,
+		NewTimeoutMs: uint32(timeout.Milliseconds()),
+		LockId:       lockId,
+	})
+	return lockError(err)
+}
+
+// lockError reports an unknown lock like an expired one. The queue was found
+// before the call, so NotFound from the data plane is about the lock.
+func lockError(err error) error {
+	if status.Code(err) == codes.NotFound {
+		return status.Error(codes.FailedPrecondition, status.Convert(err).Message())
+	}
+	return err
+}
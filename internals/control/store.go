@@ -3,17 +3,27 @@ package control
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/kokaq/core/internals/logger"
 	"github.com/kokaq/protocol/proto"
+	"github.com/kokaq/server/internals"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+var tracer = otel.Tracer("github.com/kokaq/server/internals/control")
+
 type ControlStore struct {
 	ShardManagerAddress string
-	AddressIndex        map[string]map[string][]string
+	// mutex guards AddressIndex, which concurrent requests fill and read.
+	mutex        sync.RWMutex
+	AddressIndex map[string]map[string][]string
 }
 
 func NewControlStore(rootDirectory string, shardManagerAddress string) *ControlStore {
@@ -23,10 +33,12 @@ func NewControlStore(rootDirectory string, shardManagerAddress string) *ControlS
 	}
 }
 
-func (d *ControlStore) GetDataPlaneAddress(namespace string, queue string) (string, string, bool) {
+func (d *ControlStore) GetDataPlaneAddress(ctx context.Context, namespace string, queue string) (string, string, bool) {
 	logger.ConsoleLog("INFO", "Resolving shard address: Namespace=%s, Queue=%s", namespace, queue)
 	// Check if address is already cached
-	if shardAddress, exists := d.AddressIndex[namespace][queue]; exists {
+	shardAddress, exists := d.cachedAddress(namespace, queue)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("kokaq.address_cached", exists))
+	if exists {
 		logger.ConsoleLog("INFO", "Shard address found in cache: Namespace=%s, Queue=%s, Address=%s", namespace, queue, shardAddress[0])
 		return shardAddress[0], shardAddress[1], true
 	}
@@ -34,25 +46,23 @@ func (d *ControlStore) GetDataPlaneAddress(namespace string, queue string) (stri
 	logger.ConsoleLog("INFO", "Shard address not found in cache: Namespace=%s, Queue=%s", namespace, queue)
 
 	var err error
-	address, internalAddress, _, _, err := d.getOrAddDataPlaneAddressFromShardManager(namespace, queue, false)
+	address, internalAddress, _, _, err := d.getOrAddDataPlaneAddressFromShardManager(ctx, namespace, queue, false)
 	if err == nil {
 		// Update address cache
-		// Initialize map if needed and cache address
-		if _, ok := d.AddressIndex[namespace]; !ok {
-			d.AddressIndex[namespace] = make(map[string][]string)
-		}
-		d.AddressIndex[namespace][queue] = append(d.AddressIndex[namespace][queue], address, internalAddress)
-		return d.AddressIndex[namespace][queue][0], d.AddressIndex[namespace][queue][1], true
+		d.cacheAddress(namespace, queue, address, internalAddress)
+		return address, internalAddress, true
 	} else {
 		logger.ConsoleLog("ERROR", "Cannot get data plane from shard manager: Namespace=%s, Queue=%s", namespace, queue)
 		return "", "", false
 	}
 }
 
-func (d *ControlStore) GetOrAddDataPlaneAddress(namespace string, queue string) (dataPlaneAddress string, dataPlaneInternalAddress string, success bool, newQueue bool, shardId uint64) {
+func (d *ControlStore) GetOrAddDataPlaneAddress(ctx context.Context, namespace string, queue string) (dataPlaneAddress string, dataPlaneInternalAddress string, success bool, newQueue bool, shardId uint64) {
 	logger.ConsoleLog("INFO", "Resolving shard address: Namespace=%s, Queue=%s", namespace, queue)
 	// Check if address is already cached
-	if shardAddress, exists := d.AddressIndex[namespace][queue]; exists {
+	shardAddress, exists := d.cachedAddress(namespace, queue)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("kokaq.address_cached", exists))
+	if exists {
 		logger.ConsoleLog("INFO", "Shard address found in cache: Namespace=%s, Queue=%s, Address=%s", namespace, queue, shardAddress[0])
 		return shardAddress[0], shardAddress[1], true, false, 0
 	}
@@ -61,28 +71,55 @@ func (d *ControlStore) GetOrAddDataPlaneAddress(namespace string, queue string)
 
 	var created bool
 	var err error
-	address, internalAddress, created, newShardId, err := d.getOrAddDataPlaneAddressFromShardManager(namespace, queue, true)
+	address, internalAddress, created, newShardId, err := d.getOrAddDataPlaneAddressFromShardManager(ctx, namespace, queue, true)
 	if err == nil {
 		// Update address cache
-		// Initialize map if needed and cache address
-		if _, ok := d.AddressIndex[namespace]; !ok {
-			d.AddressIndex[namespace] = make(map[string][]string, 0)
-		}
-		d.AddressIndex[namespace][queue] = append(d.AddressIndex[namespace][queue], address, internalAddress)
-		return d.AddressIndex[namespace][queue][0], d.AddressIndex[namespace][queue][1], true, created, newShardId
+		d.cacheAddress(namespace, queue, address, internalAddress)
+		return address, internalAddress, true, created, newShardId
 	} else {
 		logger.ConsoleLog("ERROR", "Cannot get data plane from shard manager: Namespace=%s, Queue=%s", namespace, queue)
 		return "", "", false, false, 0
 	}
 }
 
-func (d *ControlStore) RemoveDataPlaneAddress(namespace string, queue string) (success bool) {
+// cachedAddress returns the cached address and internal address of a queue.
+func (d *ControlStore) cachedAddress(namespace string, queue string) ([]string, bool) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	shardAddress, exists := d.AddressIndex[namespace][queue]
+	return shardAddress, exists
+}
+
+func (d *ControlStore) cacheAddress(namespace string, queue string, address string, internalAddress string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	// Initialize map if needed and cache address
+	if _, ok := d.AddressIndex[namespace]; !ok {
+		d.AddressIndex[namespace] = make(map[string][]string)
+	}
+	d.AddressIndex[namespace][queue] = []string{address, internalAddress}
+}
+
+// ForgetDataPlaneAddress drops a cached address, e.g. after the shard failed
+// over to another node, so the next lookup asks the shard manager again.
+func (d *ControlStore) ForgetDataPlaneAddress(namespace string, queue string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, exists := d.AddressIndex[namespace][queue]; exists {
+		logger.ConsoleLog("INFO", "Forgetting cached shard address: Namespace=%s, Queue=%s", namespace, queue)
+		delete(d.AddressIndex[namespace], queue)
+	}
+}
+
+func (d *ControlStore) RemoveDataPlaneAddress(ctx context.Context, namespace string, queue string) (success bool) {
 	logger.ConsoleLog("INFO", "Cleaing shard address: Namespace=%s, Queue=%s", namespace, queue)
 	// Check if address is already cached
+	d.mutex.Lock()
 	if shardAddress, exists := d.AddressIndex[namespace][queue]; exists {
 		logger.ConsoleLog("INFO", "Shard address found in cache: Namespace=%s, Queue=%s, Address=%s", namespace, queue, shardAddress[0])
 		delete(d.AddressIndex[namespace], queue)
 	}
+	d.mutex.Unlock()
 
 	conn, err := d.getShardManagerConnection()
 	if err != nil {
@@ -92,7 +129,7 @@ func (d *ControlStore) RemoveDataPlaneAddress(namespace string, queue string) (s
 	defer conn.Close()
 
 	shardManagerClient := proto.NewKokaqShardManagerClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
 	defer cancel()
 
 	// Build GetShard request
@@ -110,8 +147,10 @@ func (d *ControlStore) RemoveDataPlaneAddress(namespace string, queue string) (s
 	return true
 }
 
-func (d *ControlStore) getOrAddDataPlaneAddressFromShardManager(namespace string, queue string, createIfNotFound bool) (string, string, bool, uint64, error) {
+func (d *ControlStore) getOrAddDataPlaneAddressFromShardManager(ctx context.Context, namespace string, queue string, createIfNotFound bool) (address string, internalAddress string, created bool, shardId uint64, err error) {
 	logger.ConsoleLog("INFO", "Shard address not found in cache: Namespace=%s, Queue=%s. Contacting shard manager...", namespace, queue)
+	ctx, span := tracer.Start(ctx, "ControlStore.resolveShard", internals.QueueAttributes(namespace, queue))
+	defer func() { internals.EndSpan(span, err) }()
 
 	conn, err := d.getShardManagerConnection()
 	if err != nil {
@@ -120,7 +159,7 @@ func (d *ControlStore) getOrAddDataPlaneAddressFromShardManager(namespace string
 	defer conn.Close()
 
 	shardManagerClient := proto.NewKokaqShardManagerClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
 	defer cancel()
 
 	// Build GetShard request
@@ -147,11 +186,47 @@ func (d *ControlStore) getOrAddDataPlaneAddressFromShardManager(namespace string
 
 		return res.GrpcAddress, res.InternalAddress, res.IsNew, res.NewShardId, nil
 	}
-	return "", "", false, 0, nil
+	// A shard without an address has no node serving it right now, so the
+	// lookup fails rather than caching an address nobody can dial
+	logger.ConsoleLog("ERROR", "Shard manager returned no address: Namespace=%s, Queue=%s", namespace, queue)
+	return "", "", false, 0, status.Errorf(codes.Unavailable, "no data plane serves namespace=%s, queue=%s", namespace, queue)
+}
+
+// ListQueues asks the shard manager for every queue of namespace.
+func (d *ControlStore) ListQueues(ctx context.Context, namespace string) (queues []string, err error) {
+	ctx, span := tracer.Start(ctx, "ControlStore.ListQueues", trace.WithAttributes(attribute.String("kokaq.namespace", namespace)))
+	defer func() { internals.EndSpan(span, err) }()
+	conn, err := d.getShardManagerConnection()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	shardManagerClient := proto.NewKokaqShardManagerClient(conn)
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	queues = make([]string, 0)
+	pageToken := ""
+	for {
+		res, err := shardManagerClient.ListShards(ctx, &proto.ListShardsRequest{Namespace: namespace, PageToken: pageToken})
+		if err != nil {
+			logger.ConsoleLog("ERROR", "ListShards RPC failed: Namespace=%s: %v", namespace, err)
+			return nil, fmt.Errorf("shardmanager.listShards rpc failed: %v", err)
+		}
+		for _, detail := range res.Details {
+			queues = append(queues, detail.Queue)
+		}
+		if res.NextPageToken == "" {
+			break
+		}
+		pageToken = res.NextPageToken
+	}
+	return queues, nil
 }
 
 func (d *ControlStore) getShardManagerConnection() (*grpc.ClientConn, error) {
-	if conn, err := grpc.NewClient(d.ShardManagerAddress, grpc.WithTransportCredentials(insecure.NewCredentials())); err != nil {
+	if conn, err := grpc.NewClient(d.ShardManagerAddress, internals.DialOptions()...); err != nil {
 		logger.ConsoleLog("ERROR", "Failed to connect to shard manager at %s: %v", d.ShardManagerAddress, err)
 		return conn, fmt.Errorf("failed to connect to shard manager: %v", err)
 	} else {
@@ -0,0 +1,158 @@
+package data
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/kokaq/core/utils"
+	"github.com/kokaq/protocol/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// dedupEntry remembers the message first enqueued with a deduplication key
+// until the queue deduplication window has passed.
+type dedupEntry struct {
+	Key        string    `json:"key"`
+	MessageId  string    `json:"messageId"`
+	EnqueuedAt time.Time `json:"enqueuedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// response answers an enqueue that duplicates the message of the entry.
+func (entry *dedupEntry) response() *proto.EnqueueResponse {
+	return &proto.EnqueueResponse{
+		MessageId:  entry.MessageId,
+		EnqueuedAt: timestamppb.New(entry.EnqueuedAt),
+		Duplicate:  true,
+	}
+}
+
+// DedupIndex maps the deduplication keys producers enqueue with to the
+// messages they produced. Entries are kept next to the queue, one file per
+// key named after its hash since keys are free-form, and loaded in memory when
+// the queue opens. Lapsed entries are ignored and pruned by the reaper.
+type DedupIndex struct {
+	mutex   sync.RWMutex
+	dir     string
+	entries map[string]*dedupEntry
+}
+
+func NewDedupIndex(queueDirectory string) (*DedupIndex, error) {
+	dir := filepath.Join(queueDirectory, "dedup")
+	if err := utils.EnsureDirectoryCreated(dir); err != nil {
+		return nil, fmt.Errorf("failed to create deduplication directory %s: %w", dir, err)
+	}
+	index := &DedupIndex{dir: dir, entries: make(map[string]*dedupEntry)}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deduplication directory %s: %w", dir, err)
+	}
+	for _, file := range files {
+		// Leftover temporary files from an interrupted write are ignored
+		if file.IsDir() || filepath.Ext(file.Name()) != "" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read deduplication entry %s: %w", file.Name(), err)
+		}
+		entry := &dedupEntry{}
+		if err := json.Unmarshal(data, entry); err != nil {
+			return nil, fmt.Errorf("failed to decode deduplication entry %s: %w", file.Name(), err)
+		}
+		index.entries[entry.Key] = entry
+	}
+	return index, nil
+}
+
+// Lookup returns the entry of key unless there is none or it lapsed by now.
+func (d *DedupIndex) Lookup(key string, now time.Time) (*dedupEntry, bool) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	entry, exist := d.entries[key]
+	if !exist || now.After(entry.ExpiresAt) {
+		return nil, false
+	}
+	return entry, true
+}
+
+func (d *DedupIndex) Put(entry *dedupEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode deduplication entry %s: %w", entry.Key, err)
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	path := d.path(entry.Key)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write deduplication entry %s: %w", entry.Key, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to commit deduplication entry %s: %w", entry.Key, err)
+	}
+	d.entries[entry.Key] = entry
+	return nil
+}
+
+func (d *DedupIndex) Delete(key string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := os.Remove(d.path(key)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete deduplication entry %s: %w", key, err)
+	}
+	delete(d.entries, key)
+	return nil
+}
+
+// List returns a copy of every entry, lapsed or not.
+func (d *DedupIndex) List() []dedupEntry {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	entries := make([]dedupEntry, 0, len(d.entries))
+	for _, entry := range d.entries {
+		entries = append(entries, *entry)
+	}
+	return entries
+}
+
+// Prune deletes the entries that lapsed by now.
+func (d *DedupIndex) Prune(now time.Time) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for key, entry := range d.entries {
+		if !now.After(entry.ExpiresAt) {
+			continue
+		}
+		if err := os.Remove(d.path(key)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete deduplication entry %s: %w", key, err)
+		}
+		delete(d.entries, key)
+	}
+	return nil
+}
+
+// Clear deletes every entry.
+func (d *DedupIndex) Clear() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := utils.EnsureDirectoryDeleted(d.dir); err != nil {
+		return fmt.Errorf("failed to clear deduplication directory %s: %w", d.dir, err)
+	}
+	if err := utils.EnsureDirectoryCreated(d.dir); err != nil {
+		return fmt.Errorf("failed to recreate deduplication directory %s: %w", d.dir, err)
+	}
+	d.entries = make(map[string]*dedupEntry)
+	return nil
+}
+
+func (d *DedupIndex) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:]))
+}
@@ -0,0 +1,846 @@
+package data
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/internals/logger"
+	"github.com/kokaq/core/queue"
+	"github.com/kokaq/protocol/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const defaultVisibilityTimeout = 30 * time.Second
+
+// defaultDedupWindow is how long deduplication keys are remembered on queues
+// that do not set a window.
+const defaultDedupWindow = 5 * time.Minute
+
+const (
+	// waitRecheck bounds how long waiting consumers sleep between looks at
+	// the queue when no lock is about to lapse.
+	waitRecheck = time.Second
+	// waitMargin is left between the end of a wait and the request deadline
+	// for the empty answer to get back.
+	waitMargin = 100 * time.Millisecond
+)
+
+// hostedQueue is the state a data node keeps next to each queue heap: message
+// bodies, dead-lettered and scheduled messages, deduplication keys,
+// outstanding locks, operation counters and the queue policy.
+type hostedQueue struct {
+	mutex       sync.RWMutex
+	dir         string
+	manifest    queueManifest
+	messages    *MessageStore
+	deadLetters *MessageStore
+	scheduled   *MessageStore
+	dedup       *DedupIndex
+	locks       *LockTable
+	counters    *queueStats
+	// deliveries holds the delivery time of every scheduled message.
+	deliveries map[uuid.UUID]time.Time
+	// stale counts, by message id, the heap entries that no longer stand for
+	// a visible message: those of expired messages and of messages a follower
+	// took off by id. The heap cannot give up anything but its top item, so
+	// they are skipped when they come up.
+	stale map[uuid.UUID]int
+	// changes is closed and replaced whenever the queue changes, waking the
+	// consumers waiting on it.
+	changes chan struct{}
+}
+
+func openHostedQueue(queueDirectory string, manifest *queueManifest) (*hostedQueue, error) {
+	messages, err := NewMessageStore(queueDirectory)
+	if err != nil {
+		return nil, err
+	}
+	deadLetters, err := NewDeadLetterStore(queueDirectory)
+	if err != nil {
+		return nil, err
+	}
+	scheduled, err := NewScheduledStore(queueDirectory)
+	if err != nil {
+		return nil, err
+	}
+	dedup, err := NewDedupIndex(queueDirectory)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := scheduled.List()
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make(map[uuid.UUID]time.Time, len(pending))
+	for _, message := range pending {
+		mId, err := messageKey(message.GetMessage().GetMessageId())
+		if err != nil {
+			continue
+		}
+		// A crash half way through a promotion leaves the message in both
+		// stores; the live copy wins.
+		if messages.Exists(mId) {
+			if err := scheduled.Delete(mId); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		deliveries[mId] = message.GetMessage().GetDeliverAt().AsTime()
+	}
+	return &hostedQueue{
+		dir:         queueDirectory,
+		manifest:    *manifest,
+		messages:    messages,
+		deadLetters: deadLetters,
+		scheduled:   scheduled,
+		dedup:       dedup,
+		locks:       NewLockTable(),
+		counters:    newQueueStats(),
+		deliveries:  deliveries,
+		stale:       make(map[uuid.UUID]int),
+		changes:     make(chan struct{}),
+	}, nil
+}
+
+func (h *hostedQueue) policy() queueManifest {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.manifest
+}
+
+// config describes the queue the way followers need it to create their copy.
+func (h *hostedQueue) config() *proto.KokaqQueueRequest {
+	policy := h.policy()
+	return &proto.KokaqQueueRequest{
+		Namespace:                policy.Namespace,
+		Queue:                    policy.Queue,
+		EnableDeadLetter:         policy.EnableDeadLetter,
+		MaxDequeueCount:          policy.MaxDeliveryCount,
+		DefaultVisibilityTimeout: policy.VisibilityTimeout,
+		DefaultTtlMs:             policy.DefaultTTL,
+		DeadLetterExpired:        policy.DeadLetterExpired,
+		DeduplicationWindowMs:    policy.DedupWindow,
+	}
+}
+
+// changed returns a channel closed at the next change of the queue.
+func (h *hostedQueue) changed() <-chan struct{} {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.changes
+}
+
+func (h *hostedQueue) notify() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	close(h.changes)
+	h.changes = make(chan struct{})
+}
+
+// recheckAfter is how long a waiting consumer sleeps before it looks at the
+// queue again: until the next lock lapses or scheduled message is due, at
+// most waitRecheck.
+func (h *hostedQueue) recheckAfter() time.Duration {
+	wait := waitRecheck
+	if expiry, held := h.locks.NextExpiry(); held {
+		wait = min(wait, time.Until(expiry)+time.Millisecond)
+	}
+	if delivery, pending := h.nextDelivery(); pending {
+		wait = min(wait, time.Until(delivery)+time.Millisecond)
+	}
+	return max(wait, time.Millisecond)
+}
+
+// setPolicy changes dead-lettering for the queue and persists it in the
+// queue manifest.
+func (h *hostedQueue) setPolicy(enableDeadLetter bool, maxDeliveryCount uint32) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	manifest := h.manifest
+	manifest.EnableDeadLetter = enableDeadLetter
+	manifest.MaxDeliveryCount = maxDeliveryCount
+	if err := writeQueueManifest(h.dir, &manifest); err != nil {
+		return err
+	}
+	h.manifest = manifest
+	return nil
+}
+
+// lockDuration picks the requested lock duration in seconds, falling back to
+// the queue default and then to defaultVisibilityTimeout.
+func (h *hostedQueue) lockDuration(seconds uint32) time.Duration {
+	if seconds == 0 {
+		seconds = h.policy().VisibilityTimeout
+	}
+	if seconds == 0 {
+		return defaultVisibilityTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// drained reports whether every stored message is locked, leaving nothing on
+// the heap but stale entries. The core heap cannot be dequeued
+// or peeked once it is empty, so callers check this first.
+func (h *hostedQueue) drained() bool {
+	return h.messages.Count() <= h.locks.Count()
+}
+
+// pop takes the top message off the heap, discarding stale entries on the
+// way.
+func (h *hostedQueue) pop(q *queue.Queue) (*queue.QueueItem, error) {
+	for {
+		qi, err := q.Dequeue()
+		if err != nil || !h.discard(qi.MessageId) {
+			return qi, err
+		}
+	}
+}
+
+// peek returns the top message of the heap, discarding stale entries on the
+// way.
+func (h *hostedQueue) peek(q *queue.Queue) (*queue.QueueItem, error) {
+	for {
+		qi, err := q.Peek()
+		if err != nil || !h.isStale(qi.MessageId) {
+			return qi, err
+		}
+		if _, err := q.Dequeue(); err != nil {
+			return nil, err
+		}
+		h.discard(qi.MessageId)
+	}
+}
+
+func (h *hostedQueue) isStale(messageId uuid.UUID) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.stale[messageId] > 0
+}
+
+func (h *hostedQueue) staleEntries() int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	var entries int
+	for _, count := range h.stale {
+		entries += count
+	}
+	return entries
+}
+
+// markStale leaves the heap entry of a message that is no longer visible to
+// be discarded when it comes up.
+func (h *hostedQueue) markStale(messageId uuid.UUID) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.stale[messageId]++
+}
+
+// discard forgets a stale heap entry that has just come off the heap,
+// reporting false for the entry of a visible message.
+func (h *hostedQueue) discard(messageId uuid.UUID) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.stale[messageId] == 0 {
+		return false
+	}
+	h.stale[messageId]--
+	if h.stale[messageId] == 0 {
+		delete(h.stale, messageId)
+	}
+	return true
+}
+
+// take removes a visible message from the heap by id, as a follower does to
+// apply what its leader dequeued or locked. An entry below the top is marked
+// stale instead. A message that is not visible here means the follower has
+// diverged from its leader.
+func (h *hostedQueue) take(q *queue.Queue, messageId uuid.UUID) error {
+	if !h.messages.Exists(messageId) || h.locks.HoldsMessage(messageId) || h.drained() {
+		return status.Errorf(codes.FailedPrecondition, "message %s is not visible", messageId)
+	}
+	top, err := h.peek(q)
+	if err != nil {
+		return err
+	}
+	if top.MessageId != messageId {
+		h.markStale(messageId)
+		return nil
+	}
+	_, err = q.Dequeue()
+	return err
+}
+
+// lockMessage takes a visible message off the heap by id and holds it under
+// lockId until expiresAt.
+func (h *hostedQueue) lockMessage(q *queue.Queue, messageId uuid.UUID, lockId string, expiresAt time.Time) error {
+	message, err := h.messages.Get(messageId)
+	if err != nil {
+		return status.Errorf(codes.FailedPrecondition, "message %s is not visible: %v", messageId, err)
+	}
+	if err := h.take(q, messageId); err != nil {
+		return err
+	}
+	h.locks.Add(&messageLock{
+		lockId:    lockId,
+		messageId: messageId,
+		priority:  message.GetMessage().GetPriority(),
+		expiresAt: expiresAt,
+		duration:  time.Until(expiresAt),
+	})
+	return nil
+}
+
+// expiry returns when a message enqueued at now expires: after its own ttl,
+// else after the queue default, else never.
+func (h *hostedQueue) expiry(message *proto.KokaqMessageRequest, now time.Time) *timestamppb.Timestamp {
+	ttl := message.GetTtlMs()
+	if ttl == 0 {
+		ttl = h.policy().DefaultTTL
+	}
+	if ttl == 0 {
+		return nil
+	}
+	return timestamppb.New(now.Add(time.Duration(ttl) * time.Millisecond))
+}
+
+// expirable lists the messages whose expiry is before now, visible or
+// scheduled. Locked messages are left to their consumer.
+func (h *hostedQueue) expirable(now time.Time) []uuid.UUID {
+	locked := h.locks.Locked()
+	expirable := h.scheduled.Expired(now)
+	for _, messageId := range h.messages.Expired(now) {
+		if !locked[messageId] {
+			expirable = append(expirable, messageId)
+		}
+	}
+	return expirable
+}
+
+// expire drops an expired message, or dead-letters it when the queue says
+// so. It reports whether the message was found and whether it went to the
+// dead-letter queue.
+func (h *hostedQueue) expire(messageId uuid.UUID) (bool, bool, error) {
+	store := h.messages
+	if h.scheduled.Exists(messageId) {
+		store = h.scheduled
+	} else if !h.messages.Exists(messageId) {
+		return false, false, nil
+	}
+	message, err := store.Get(messageId)
+	if err != nil {
+		return false, false, err
+	}
+	if store == h.scheduled {
+		h.mutex.Lock()
+		delete(h.deliveries, messageId)
+		h.mutex.Unlock()
+	} else {
+		h.markStale(messageId)
+	}
+	policy := h.policy()
+	if policy.DeadLetterExpired && policy.EnableDeadLetter {
+		if err := h.deadLetter(messageId, message, proto.FailureReason_EXPIRED); err != nil {
+			return true, false, err
+		}
+		return true, true, store.Delete(messageId)
+	}
+	return true, false, store.Delete(messageId)
+}
+
+// expireTop expires the messages on top of the heap whose time to live has
+// passed, as expire does, so they are not delivered in the time before the
+// reaper gets to them. It stops at the first live message, counts what it
+// expired and returns the message ids for followers.
+func (h *hostedQueue) expireTop(q *queue.Queue, now time.Time) ([]string, error) {
+	expired := make([]string, 0)
+	for !h.drained() {
+		qi, err := h.peek(q)
+		if err != nil {
+			return expired, err
+		}
+		if !h.messages.IsExpired(qi.MessageId, now) {
+			return expired, nil
+		}
+		_, deadLettered, err := h.expire(qi.MessageId)
+		if err != nil {
+			return expired, err
+		}
+		expired = append(expired, qi.MessageId.String())
+		h.counters.record(statExpired, 1)
+		if deadLettered {
+			h.counters.record(statDeadLettered, 1)
+		}
+	}
+	return expired, nil
+}
+
+// lock takes the top message off the heap and holds it under lockId until
+// expiresAt.
+func (h *hostedQueue) lock(q *queue.Queue, lockId string, expiresAt time.Time) (*queue.QueueItem, *proto.KokaqMessageResponse, error) {
+	qi, err := h.pop(q)
+	if err != nil {
+		return nil, nil, err
+	}
+	h.locks.Add(&messageLock{
+		lockId:    lockId,
+		messageId: qi.MessageId,
+		priority:  qi.Priority,
+		expiresAt: expiresAt,
+		duration:  time.Until(expiresAt),
+	})
+	message := loadMessage(h.messages, qi)
+	message.LastDequeued = timestamppb.Now()
+	return qi, message, nil
+}
+
+// exists reports whether a message is stored under this id, visible, locked
+// or scheduled.
+func (h *hostedQueue) exists(messageId uuid.UUID) bool {
+	return h.messages.Exists(messageId) || h.scheduled.Exists(messageId)
+}
+
+// enqueue stores a new message, on the heap or, when it carries a delivery
+// time, with the scheduled messages until promote moves it.
+func (h *hostedQueue) enqueue(q *queue.Queue, messageId uuid.UUID, message *proto.KokaqMessageResponse) error {
+	return h.enqueueBatch(q, []uuid.UUID{messageId}, []*proto.KokaqMessageResponse{message})
+}
+
+// enqueueBatch stores new messages all or none. Every deduplication key and
+// body is written before any message reaches the heap, and the ones written
+// are deleted again when a write fails. Should the heap fail part way, the
+// entries already pushed are left stale.
+func (h *hostedQueue) enqueueBatch(q *queue.Queue, messageIds []uuid.UUID, messages []*proto.KokaqMessageResponse) error {
+	for i, message := range messages {
+		if err := h.stage(messageIds[i], message); err != nil {
+			h.unstage(messageIds[:i], messages[:i])
+			return err
+		}
+	}
+	for i, message := range messages {
+		if message.GetMessage().GetDeliverAt() != nil {
+			continue
+		}
+		err := q.Enqueue(&queue.QueueItem{MessageId: messageIds[i], Priority: message.GetMessage().GetPriority()})
+		if err != nil {
+			for j, pushed := range messages[:i] {
+				if pushed.GetMessage().GetDeliverAt() == nil {
+					h.markStale(messageIds[j])
+				}
+			}
+			h.unstage(messageIds, messages)
+			return err
+		}
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, message := range messages {
+		if deliverAt := message.GetMessage().GetDeliverAt(); deliverAt != nil {
+			h.deliveries[messageIds[i]] = deliverAt.AsTime()
+		}
+	}
+	return nil
+}
+
+// stage writes the deduplication key and the body of a new message, the
+// body with the visible or the scheduled messages. The key is remembered
+// first so a message is never stored without it.
+func (h *hostedQueue) stage(messageId uuid.UUID, message *proto.KokaqMessageResponse) error {
+	key := message.GetMessage().GetDeduplicationKey()
+	if key != "" {
+		enqueuedAt := message.GetCreatedOn().AsTime()
+		err := h.dedup.Put(&dedupEntry{
+			Key:        key,
+			MessageId:  messageId.String(),
+			EnqueuedAt: enqueuedAt,
+			ExpiresAt:  enqueuedAt.Add(h.dedupWindow()),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	store := h.messages
+	if message.GetMessage().GetDeliverAt() != nil {
+		store = h.scheduled
+	}
+	err := store.Put(messageId, message)
+	if err != nil && key != "" {
+		if err := h.dedup.Delete(key); err != nil {
+			logger.ConsoleLog("WARN", "Failed to forget deduplication key of message %s: %v", messageId, err)
+		}
+	}
+	return err
+}
+
+// unstage deletes what stage wrote for messages that are not enqueued after
+// all.
+func (h *hostedQueue) unstage(messageIds []uuid.UUID, messages []*proto.KokaqMessageResponse) {
+	for i, message := range messages {
+		store := h.messages
+		if message.GetMessage().GetDeliverAt() != nil {
+			store = h.scheduled
+		}
+		if err := store.Delete(messageIds[i]); err != nil {
+			logger.ConsoleLog("WARN", "Failed to delete staged message %s: %v", messageIds[i], err)
+		}
+		if key := message.GetMessage().GetDeduplicationKey(); key != "" {
+			if err := h.dedup.Delete(key); err != nil {
+				logger.ConsoleLog("WARN", "Failed to forget deduplication key of message %s: %v", messageIds[i], err)
+			}
+		}
+	}
+}
+
+// dedupWindow is how long the queue remembers deduplication keys.
+func (h *hostedQueue) dedupWindow() time.Duration {
+	if window := h.policy().DedupWindow; window > 0 {
+		return time.Duration(window) * time.Millisecond
+	}
+	return defaultDedupWindow
+}
+
+// original returns the message enqueued with key within the deduplication
+// window, if any.
+func (h *hostedQueue) original(key string, now time.Time) (*dedupEntry, bool) {
+	if key == "" {
+		return nil, false
+	}
+	return h.dedup.Lookup(key, now)
+}
+
+// due lists the scheduled messages whose delivery time has come, earliest
+// first.
+func (h *hostedQueue) due(now time.Time) []uuid.UUID {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	due := make([]uuid.UUID, 0)
+	for messageId, delivery := range h.deliveries {
+		if !delivery.After(now) {
+			due = append(due, messageId)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return h.deliveries[due[i]].Before(h.deliveries[due[j]])
+	})
+	return due
+}
+
+// nextDelivery returns the earliest delivery time of the scheduled messages.
+func (h *hostedQueue) nextDelivery() (time.Time, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	var next time.Time
+	for _, delivery := range h.deliveries {
+		if next.IsZero() || delivery.Before(next) {
+			next = delivery
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// promote moves a scheduled message onto the heap, reporting false when no
+// message is scheduled under this id.
+func (h *hostedQueue) promote(q *queue.Queue, messageId uuid.UUID) (bool, error) {
+	if !h.scheduled.Exists(messageId) {
+		return false, nil
+	}
+	message, err := h.scheduled.Get(messageId)
+	if err != nil {
+		return false, err
+	}
+	if err := enqueueMessage(q, h.messages, messageId, message); err != nil {
+		return false, err
+	}
+	return true, h.unschedule(messageId)
+}
+
+// cancel drops a scheduled message, reporting false when no message is
+// scheduled under this id.
+func (h *hostedQueue) cancel(messageId uuid.UUID) (bool, error) {
+	if !h.scheduled.Exists(messageId) {
+		return false, nil
+	}
+	return true, h.unschedule(messageId)
+}
+
+func (h *hostedQueue) unschedule(messageId uuid.UUID) error {
+	h.mutex.Lock()
+	delete(h.deliveries, messageId)
+	h.mutex.Unlock()
+	return h.scheduled.Delete(messageId)
+}
+
+func (h *hostedQueue) ack(lock *messageLock) error {
+	return h.messages.Delete(lock.messageId)
+}
+
+// nack counts a failed delivery of a locked message. The message goes back on
+// the heap, or to the dead-letter queue once it has failed the queue's max
+// delivery count.
+func (h *hostedQueue) nack(q *queue.Queue, lock *messageLock, reason proto.FailureReason) (bool, error) {
+	message, err := h.messages.Get(lock.messageId)
+	if err != nil {
+		message = &proto.KokaqMessageResponse{
+			Message: &proto.KokaqMessageRequest{MessageId: lock.messageId.String(), Priority: lock.priority},
+		}
+	}
+	message.RetryCount++
+	policy := h.policy()
+	if policy.EnableDeadLetter && policy.MaxDeliveryCount > 0 && message.RetryCount >= policy.MaxDeliveryCount {
+		if reason == proto.FailureReason_MESSAGE_FAILURE_UNSPECIFIED {
+			reason = proto.FailureReason_MAX_RETRY_EXCEEDED
+		}
+		return true, h.deadLetter(lock.messageId, message, reason)
+	}
+	if err := h.messages.Put(lock.messageId, message); err != nil {
+		return false, err
+	}
+	return false, q.Enqueue(&queue.QueueItem{MessageId: lock.messageId, Priority: lock.priority})
+}
+
+// release puts a locked message back on the heap without counting a failed
+// delivery.
+func (h *hostedQueue) release(q *queue.Queue, lock *messageLock) error {
+	return q.Enqueue(&queue.QueueItem{MessageId: lock.messageId, Priority: lock.priority})
+}
+
+// deadLetter moves a message that is off the heap into the dead-letter queue.
+func (h *hostedQueue) deadLetter(messageId uuid.UUID, message *proto.KokaqMessageResponse, reason proto.FailureReason) error {
+	if !h.policy().EnableDeadLetter {
+		return status.Errorf(codes.FailedPrecondition, "dead-lettering is not enabled for queue %s", h.policy().Queue)
+	}
+	message.DeadLetteredAt = timestamppb.Now()
+	if message.Message.Headers == nil {
+		message.Message.Headers = &proto.KokaqMessageHeaders{}
+	}
+	message.Message.Headers.FailureReason = reason
+	if err := h.deadLetters.Put(messageId, message); err != nil {
+		return err
+	}
+	return h.messages.Delete(messageId)
+}
+
+// deadLettered returns up to count dead-lettered messages, oldest first. A
+// count of zero returns all of them.
+func (h *hostedQueue) deadLettered(count uint32) ([]*proto.KokaqMessageResponse, error) {
+	messages, err := h.deadLetters.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].GetDeadLetteredAt().AsTime().Before(messages[j].GetDeadLetteredAt().AsTime())
+	})
+	if count > 0 && int(count) < len(messages) {
+		messages = messages[:count]
+	}
+	return messages, nil
+}
+
+func (h *hostedQueue) dropMessages(messageIds []string) error {
+	return dropAll(h.messages, messageIds)
+}
+
+func (h *hostedQueue) dropDeadLetters(messageIds []string) error {
+	return dropAll(h.deadLetters, messageIds)
+}
+
+func dropAll(store *MessageStore, messageIds []string) error {
+	for _, messageId := range messageIds {
+		mId, err := messageKey(messageId)
+		if err != nil {
+			return err
+		}
+		if err := store.Delete(mId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redrive moves dead-lettered messages back onto the heap with a fresh
+// delivery count and a time to live starting over.
+func (h *hostedQueue) redrive(q *queue.Queue, messageIds []string) (uint32, error) {
+	var redriven uint32
+	for _, messageId := range messageIds {
+		mId, err := messageKey(messageId)
+		if err != nil {
+			return redriven, err
+		}
+		message, err := h.deadLetters.Get(mId)
+		if err != nil {
+			return redriven, err
+		}
+		message.RetryCount = 0
+		message.DeadLetteredAt = nil
+		message.Expiry = h.expiry(message.Message, time.Now())
+		if err := enqueueMessage(q, h.messages, mId, message); err != nil {
+			return redriven, err
+		}
+		if err := h.deadLetters.Delete(mId); err != nil {
+			return redriven, err
+		}
+		redriven++
+	}
+	return redriven, nil
+}
+
+// snapshot captures the queue for a follower to restore: its visible, locked,
+// scheduled and dead-lettered messages and its deduplication keys.
+func (h *hostedQueue) snapshot() (*proto.ReplicateRequest, error) {
+	policy := h.policy()
+	snapshot := &proto.ReplicateRequest{
+		Namespace: policy.Namespace,
+		Queue:     policy.Queue,
+		Op:        proto.ReplicationOp_REPLICATION_OP_SNAPSHOT,
+		Config:    h.config(),
+	}
+	locked := make(map[uuid.UUID]bool)
+	for _, lock := range h.locks.List() {
+		locked[lock.messageId] = true
+		message, err := h.messages.Get(lock.messageId)
+		if err != nil {
+			message = &proto.KokaqMessageResponse{
+				Message: &proto.KokaqMessageRequest{MessageId: lock.messageId.String(), Priority: lock.priority},
+			}
+		}
+		snapshot.Locks = append(snapshot.Locks, &proto.LockedMessage{
+			Message:       message,
+			LockId:        lock.lockId,
+			LockExpiresAt: timestamppb.New(lock.expiresAt),
+		})
+	}
+	stored, err := h.messages.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, message := range stored {
+		mId, err := messageKey(message.GetMessage().GetMessageId())
+		if err != nil {
+			return nil, err
+		}
+		if !locked[mId] {
+			snapshot.Messages = append(snapshot.Messages, message)
+		}
+	}
+	if snapshot.Scheduled, err = h.scheduled.List(); err != nil {
+		return nil, err
+	}
+	if snapshot.DeadLetters, err = h.deadLetters.List(); err != nil {
+		return nil, err
+	}
+	for _, entry := range h.dedup.List() {
+		snapshot.DeduplicationKeys = append(snapshot.DeduplicationKeys, &proto.DeduplicationEntry{
+			Key:        entry.Key,
+			MessageId:  entry.MessageId,
+			EnqueuedAt: timestamppb.New(entry.EnqueuedAt),
+			ExpiresAt:  timestamppb.New(entry.ExpiresAt),
+		})
+	}
+	return snapshot, nil
+}
+
+// restore fills a freshly created queue from its leader's snapshot. Visible
+// messages go on the heap in the order they were created, like on recovery.
+func (h *hostedQueue) restore(q *queue.Queue, snapshot *proto.ReplicateRequest) error {
+	visible := append([]*proto.KokaqMessageResponse(nil), snapshot.GetMessages()...)
+	sort.SliceStable(visible, func(i, j int) bool {
+		return visible[i].GetCreatedOn().AsTime().Before(visible[j].GetCreatedOn().AsTime())
+	})
+	for _, message := range visible {
+		mId, err := messageKey(message.GetMessage().GetMessageId())
+		if err != nil {
+			return err
+		}
+		if err := enqueueMessage(q, h.messages, mId, message); err != nil {
+			return err
+		}
+	}
+	for _, locked := range snapshot.GetLocks() {
+		mId, err := messageKey(locked.GetMessage().GetMessage().GetMessageId())
+		if err != nil {
+			return err
+		}
+		if err := h.messages.Put(mId, locked.GetMessage()); err != nil {
+			return err
+		}
+		expiresAt := locked.GetLockExpiresAt().AsTime()
+		h.locks.Add(&messageLock{
+			lockId:    locked.GetLockId(),
+			messageId: mId,
+			priority:  locked.GetMessage().GetMessage().GetPriority(),
+			expiresAt: expiresAt,
+			duration:  time.Until(expiresAt),
+		})
+	}
+	for _, message := range snapshot.GetScheduled() {
+		mId, err := messageKey(message.GetMessage().GetMessageId())
+		if err != nil {
+			return err
+		}
+		if err := h.scheduled.Put(mId, message); err != nil {
+			return err
+		}
+		h.mutex.Lock()
+		h.deliveries[mId] = message.GetMessage().GetDeliverAt().AsTime()
+		h.mutex.Unlock()
+	}
+	for _, message := range snapshot.GetDeadLetters() {
+		mId, err := messageKey(message.GetMessage().GetMessageId())
+		if err != nil {
+			return err
+		}
+		if err := h.deadLetters.Put(mId, message); err != nil {
+			return err
+		}
+	}
+	for _, entry := range snapshot.GetDeduplicationKeys() {
+		err := h.dedup.Put(&dedupEntry{
+			Key:        entry.GetKey(),
+			MessageId:  entry.GetMessageId(),
+			EnqueuedAt: entry.GetEnqueuedAt().AsTime(),
+			ExpiresAt:  entry.GetExpiresAt().AsTime(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clear drops every message of the queue, and the deduplication keys that
+// would otherwise answer for them, leaving the dead-letter queue to ClearDLQ.
+// The core heap cannot be cleared, so the visible messages are dequeued off it
+// one by one first.
+func (h *hostedQueue) clear(q *queue.Queue) error {
+	for !h.drained() {
+		qi, err := h.pop(q)
+		if err != nil {
+			return err
+		}
+		if err := h.messages.Delete(qi.MessageId); err != nil {
+			return err
+		}
+	}
+	// Whatever is left on the heap is stale
+	for h.staleEntries() > 0 {
+		qi, err := q.Dequeue()
+		if err != nil {
+			return err
+		}
+		h.discard(qi.MessageId)
+	}
+	h.locks.Clear()
+	h.mutex.Lock()
+	h.deliveries = make(map[uuid.UUID]time.Time)
+	h.mutex.Unlock()
+	if err := h.scheduled.Clear(); err != nil {
+		return err
+	}
+	if err := h.dedup.Clear(); err != nil {
+		return err
+	}
+	return h.messages.Clear()
+}
@@ -0,0 +1,151 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/queue"
+	"github.com/kokaq/protocol/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func newTestQueue(t *testing.T, request *proto.KokaqQueueRequest) (*queue.Queue, *hostedQueue) {
+	t.Helper()
+	request.Namespace, request.Queue = "ns", "q"
+	store := NewDataStore()
+	store.initializeNamespaceIfNotExists(request.Namespace, 1, t.TempDir())
+	if _, _, err := store.createQueue(request, 1<<32|1); err != nil {
+		t.Fatalf("createQueue() error = %v", err)
+	}
+	q, err := store.getQueue(request.Namespace, request.Queue)
+	if err != nil {
+		t.Fatalf("getQueue() error = %v", err)
+	}
+	hosted, err := store.getHosted(request.Namespace, request.Queue)
+	if err != nil {
+		t.Fatalf("getHosted() error = %v", err)
+	}
+	return q, hosted
+}
+
+// enqueueTestMessage enqueues a message created at createdAt that expires
+// after ttl, or never when ttl is zero.
+func enqueueTestMessage(t *testing.T, q *queue.Queue, hosted *hostedQueue, createdAt time.Time, ttl time.Duration, key string) uuid.UUID {
+	t.Helper()
+	mId := uuid.New()
+	message := &proto.KokaqMessageResponse{
+		Message: &proto.KokaqMessageRequest{
+			MessageId:        mId.String(),
+			Namespace:        "ns",
+			Queue:            "q",
+			Priority:         1,
+			DeduplicationKey: key,
+		},
+		CreatedOn: timestamppb.New(createdAt),
+	}
+	if ttl > 0 {
+		message.Expiry = timestamppb.New(createdAt.Add(ttl))
+	}
+	if err := hosted.enqueue(q, mId, message); err != nil {
+		t.Fatalf("enqueue() error = %v", err)
+	}
+	return mId
+}
+
+func TestHostedQueueExpireTop(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name              string
+		deadLetterExpired bool
+		// ttls of the messages, in enqueue order; zero never expires
+		ttls         []time.Duration
+		expired      int
+		deadLettered int
+	}{
+		{"nothing enqueued", false, nil, 0, 0},
+		{"live top", false, []time.Duration{time.Hour, -time.Second}, 0, 0},
+		{"expired top", false, []time.Duration{-time.Second, 0}, 1, 0},
+		{"expired top, dead-lettered", true, []time.Duration{-time.Second, time.Hour}, 1, 1},
+		{"every message expired", false, []time.Duration{-time.Second, -time.Minute}, 2, 0},
+	}
+	for _, tt := range tests {
+		q, hosted := newTestQueue(t, &proto.KokaqQueueRequest{
+			EnableDeadLetter:  tt.deadLetterExpired,
+			DeadLetterExpired: tt.deadLetterExpired,
+		})
+		ids := make([]uuid.UUID, len(tt.ttls))
+		for i, ttl := range tt.ttls {
+			// expiry is set against a creation time an hour ago for the
+			// negative ttls
+			createdAt := now
+			if ttl < 0 {
+				createdAt, ttl = now.Add(-time.Hour), time.Hour+ttl
+			}
+			ids[i] = enqueueTestMessage(t, q, hosted, createdAt, ttl, "")
+		}
+		expired, err := hosted.expireTop(q, now)
+		if err != nil {
+			t.Errorf("%s: expireTop() error = %v", tt.name, err)
+			continue
+		}
+		if len(expired) != tt.expired {
+			t.Errorf("%s: expireTop() expired %v; want %d messages", tt.name, expired, tt.expired)
+		}
+		for i, messageId := range expired {
+			if messageId != ids[i].String() {
+				t.Errorf("%s: expireTop() expired %s at %d; want %s", tt.name, messageId, i, ids[i])
+			}
+		}
+		if got := hosted.deadLetters.Count(); got != tt.deadLettered {
+			t.Errorf("%s: %d dead-lettered messages; want %d", tt.name, got, tt.deadLettered)
+		}
+		if tt.expired == len(tt.ttls) {
+			if !hosted.drained() {
+				t.Errorf("%s: queue not drained after every message expired", tt.name)
+			}
+			continue
+		}
+		qi, err := hosted.pop(q)
+		if err != nil || qi.MessageId != ids[tt.expired] {
+			t.Errorf("%s: pop() = %v, %v; want %s", tt.name, qi, err, ids[tt.expired])
+		}
+	}
+}
+
+func TestHostedQueueClear(t *testing.T) {
+	q, hosted := newTestQueue(t, &proto.KokaqQueueRequest{EnableDeadLetter: true})
+	now := time.Now()
+	for _, key := range []string{"a", "b", ""} {
+		enqueueTestMessage(t, q, hosted, now, 0, key)
+	}
+	deadLettered := enqueueTestMessage(t, q, hosted, now, 0, "c")
+	if _, _, err := hosted.expire(deadLettered); err != nil {
+		t.Fatalf("expire() error = %v", err)
+	}
+	hosted.setPolicy(true, 0)
+	if err := hosted.clear(q); err != nil {
+		t.Fatalf("clear() error = %v", err)
+	}
+	if !hosted.drained() || hosted.messages.Count() != 0 || hosted.staleEntries() != 0 {
+		t.Errorf("clear() left %d messages and %d stale entries", hosted.messages.Count(), hosted.staleEntries())
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if entry, seen := hosted.original(key, now); seen {
+			t.Errorf("original(%q) after clear = %s; want none", key, entry.MessageId)
+		}
+	}
+	if got := len(hosted.dedup.List()); got != 0 {
+		t.Errorf("%d deduplication entries after clear; want 0", got)
+	}
+
+	// A key used before the clear enqueues a new message
+	mId := enqueueTestMessage(t, q, hosted, now, 0, "a")
+	if entry, seen := hosted.original("a", now); !seen || entry.MessageId != mId.String() {
+		t.Errorf("original(%q) = %v, %v; want %s", "a", entry, seen, mId)
+	}
+	qi, err := hosted.pop(q)
+	if err != nil || qi.MessageId != mId {
+		t.Errorf("pop() = %v, %v; want %s", qi, err, mId)
+	}
+}
@@ -0,0 +1,173 @@
+package data
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// messageLock is a message handed out by PeekLock. The heap can only give up
+// its top item, so locked messages are taken off the heap and tracked here
+// until they are acked, nacked or their lock expires. Locks live in memory
+// only: after a restart every locked message is visible again.
+type messageLock struct {
+	lockId    string
+	messageId uuid.UUID
+	priority  uint64
+	expiresAt time.Time
+	// duration is the visibility timeout the lock runs for, which a refresh
+	// starts over.
+	duration time.Duration
+}
+
+type LockTable struct {
+	mutex sync.Mutex
+	locks map[string]*messageLock
+}
+
+func NewLockTable() *LockTable {
+	return &LockTable{locks: make(map[string]*messageLock)}
+}
+
+func (t *LockTable) Add(lock *messageLock) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.locks[lock.lockId] = lock
+}
+
+// Take removes and returns the lock, failing for unknown or expired locks.
+// Expired locks are left in place for the expiry sweep to reclaim.
+func (t *LockTable) Take(lockId string) (*messageLock, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	lock, exist := t.locks[lockId]
+	if !exist {
+		return nil, status.Errorf(codes.NotFound, "lock %s not found", lockId)
+	}
+	if time.Now().After(lock.expiresAt) {
+		return nil, status.Errorf(codes.FailedPrecondition, "lock %s expired", lockId)
+	}
+	delete(t.locks, lockId)
+	return lock, nil
+}
+
+// Renew moves the expiry of a live lock to what expiry computes from it and
+// returns the new expiry, failing like Take for unknown or expired locks.
+func (t *LockTable) Renew(lockId string, expiry func(lock *messageLock) time.Time) (time.Time, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	lock, exist := t.locks[lockId]
+	if !exist {
+		return time.Time{}, status.Errorf(codes.NotFound, "lock %s not found", lockId)
+	}
+	if time.Now().After(lock.expiresAt) {
+		return time.Time{}, status.Errorf(codes.FailedPrecondition, "lock %s expired", lockId)
+	}
+	lock.expiresAt = expiry(lock)
+	return lock.expiresAt, nil
+}
+
+// SetExpiry sets the expiry of the lock whatever it was, as a follower
+// replaying its leader does.
+func (t *LockTable) SetExpiry(lockId string, expiresAt time.Time) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	lock, exist := t.locks[lockId]
+	if exist {
+		lock.expiresAt = expiresAt
+	}
+	return exist
+}
+
+// Remove drops the lock whatever its expiry, as needed when a follower
+// replays what its leader already decided.
+func (t *LockTable) Remove(lockId string) (*messageLock, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	lock, exist := t.locks[lockId]
+	delete(t.locks, lockId)
+	return lock, exist
+}
+
+// Has reports whether the lock is still held, expired or not.
+func (t *LockTable) Has(lockId string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	_, exist := t.locks[lockId]
+	return exist
+}
+
+// NextExpiry returns the earliest expiry of the locks held.
+func (t *LockTable) NextExpiry() (time.Time, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var next time.Time
+	for _, lock := range t.locks {
+		if next.IsZero() || lock.expiresAt.Before(next) {
+			next = lock.expiresAt
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// Expired lists the ids of locks whose expiry is before now.
+func (t *LockTable) Expired(now time.Time) []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	expired := make([]string, 0)
+	for lockId, lock := range t.locks {
+		if now.After(lock.expiresAt) {
+			expired = append(expired, lockId)
+		}
+	}
+	return expired
+}
+
+// Locked returns the ids of the locked messages.
+func (t *LockTable) Locked() map[uuid.UUID]bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	locked := make(map[uuid.UUID]bool, len(t.locks))
+	for _, lock := range t.locks {
+		locked[lock.messageId] = true
+	}
+	return locked
+}
+
+// HoldsMessage reports whether the message is locked.
+func (t *LockTable) HoldsMessage(messageId uuid.UUID) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, lock := range t.locks {
+		if lock.messageId == messageId {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns a copy of every lock held, expired or not.
+func (t *LockTable) List() []messageLock {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	locks := make([]messageLock, 0, len(t.locks))
+	for _, lock := range t.locks {
+		locks = append(locks, *lock)
+	}
+	return locks
+}
+
+func (t *LockTable) Count() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.locks)
+}
+
+func (t *LockTable) Clear() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.locks = make(map[string]*messageLock)
+}
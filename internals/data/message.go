@@ -0,0 +1,206 @@
+package data
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/utils"
+	"github.com/kokaq/protocol/proto"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// MessageStore keeps message bodies next to the queue heap. The heap only
+// tracks message ids and priorities, so payload, headers and attributes are
+// stored here, one file per message, keyed by message id. The creation time
+// of every stored message is indexed in memory for queue stats, and the
+// expiry of those that have one for the reaper.
+type MessageStore struct {
+	mutex   sync.RWMutex
+	dir     string
+	created map[uuid.UUID]time.Time
+	expires map[uuid.UUID]time.Time
+}
+
+func NewMessageStore(queueDirectory string) (*MessageStore, error) {
+	return openMessageStore(filepath.Join(queueDirectory, "messages"))
+}
+
+// NewDeadLetterStore keeps the bodies of dead-lettered messages, which are no
+// longer on the heap, apart from the live ones.
+func NewDeadLetterStore(queueDirectory string) (*MessageStore, error) {
+	return openMessageStore(filepath.Join(queueDirectory, "deadletter"))
+}
+
+// NewScheduledStore keeps the bodies of messages that are not yet due, which
+// are not on the heap either.
+func NewScheduledStore(queueDirectory string) (*MessageStore, error) {
+	return openMessageStore(filepath.Join(queueDirectory, "scheduled"))
+}
+
+func openMessageStore(dir string) (*MessageStore, error) {
+	if err := utils.EnsureDirectoryCreated(dir); err != nil {
+		return nil, fmt.Errorf("failed to create message directory %s: %w", dir, err)
+	}
+	m := &MessageStore{dir: dir, created: make(map[uuid.UUID]time.Time), expires: make(map[uuid.UUID]time.Time)}
+	messages, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, message := range messages {
+		if mId, err := messageKey(message.GetMessage().GetMessageId()); err == nil {
+			m.index(mId, message)
+		}
+	}
+	return m, nil
+}
+
+func (m *MessageStore) index(messageId uuid.UUID, message *proto.KokaqMessageResponse) {
+	m.created[messageId] = message.GetCreatedOn().AsTime()
+	if message.GetExpiry() != nil {
+		m.expires[messageId] = message.GetExpiry().AsTime()
+	} else {
+		delete(m.expires, messageId)
+	}
+}
+
+func (m *MessageStore) Put(messageId uuid.UUID, message *proto.KokaqMessageResponse) error {
+	data, err := protobuf.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to encode message %s: %w", messageId, err)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// Write to a temporary file first so a crash never leaves a torn message behind
+	path := m.path(messageId)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write message %s: %w", messageId, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to commit message %s: %w", messageId, err)
+	}
+	m.index(messageId, message)
+	return nil
+}
+
+func (m *MessageStore) Get(messageId uuid.UUID) (*proto.KokaqMessageResponse, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	data, err := os.ReadFile(m.path(messageId))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message %s: %w", messageId, err)
+	}
+	message := &proto.KokaqMessageResponse{}
+	if err := protobuf.Unmarshal(data, message); err != nil {
+		return nil, fmt.Errorf("failed to decode message %s: %w", messageId, err)
+	}
+	return message, nil
+}
+
+func (m *MessageStore) Exists(messageId uuid.UUID) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return utils.FileExists(m.path(messageId))
+}
+
+func (m *MessageStore) Delete(messageId uuid.UUID) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := os.Remove(m.path(messageId)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete message %s: %w", messageId, err)
+	}
+	delete(m.created, messageId)
+	delete(m.expires, messageId)
+	return nil
+}
+
+func (m *MessageStore) Count() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return len(m.created)
+}
+
+// Oldest returns the creation time of the oldest stored message.
+func (m *MessageStore) Oldest() (time.Time, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var oldest time.Time
+	for _, created := range m.created {
+		if oldest.IsZero() || created.Before(oldest) {
+			oldest = created
+		}
+	}
+	return oldest, !oldest.IsZero()
+}
+
+// Expired lists the stored messages whose expiry is before now.
+func (m *MessageStore) Expired(now time.Time) []uuid.UUID {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	expired := make([]uuid.UUID, 0)
+	for messageId, expiry := range m.expires {
+		if now.After(expiry) {
+			expired = append(expired, messageId)
+		}
+	}
+	return expired
+}
+
+// IsExpired reports whether the message stored under messageId expired
+// before now.
+func (m *MessageStore) IsExpired(messageId uuid.UUID, now time.Time) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	expiry, expires := m.expires[messageId]
+	return expires && now.After(expiry)
+}
+
+// List returns every stored message. Leftover temporary files from an
+// interrupted write are ignored.
+func (m *MessageStore) List() ([]*proto.KokaqMessageResponse, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list message directory %s: %w", m.dir, err)
+	}
+	messages := make([]*proto.KokaqMessageResponse, 0, len(entries))
+	for _, entry := range entries {
+		messageId, err := uuid.Parse(entry.Name())
+		if entry.IsDir() || err != nil {
+			continue
+		}
+		data, err := os.ReadFile(m.path(messageId))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read message %s: %w", messageId, err)
+		}
+		message := &proto.KokaqMessageResponse{}
+		if err := protobuf.Unmarshal(data, message); err != nil {
+			return nil, fmt.Errorf("failed to decode message %s: %w", messageId, err)
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+func (m *MessageStore) Clear() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := utils.EnsureDirectoryDeleted(m.dir); err != nil {
+		return fmt.Errorf("failed to clear message directory %s: %w", m.dir, err)
+	}
+	if err := utils.EnsureDirectoryCreated(m.dir); err != nil {
+		return fmt.Errorf("failed to recreate message directory %s: %w", m.dir, err)
+	}
+	m.created = make(map[uuid.UUID]time.Time)
+	m.expires = make(map[uuid.UUID]time.Time)
+	return nil
+}
+
+func (m *MessageStore) path(messageId uuid.UUID) string {
+	return filepath.Join(m.dir, messageId.String())
+}
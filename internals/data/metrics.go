@@ -0,0 +1,56 @@
+package data
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	queueDepthDesc = prometheus.NewDesc("kokaq_queue_depth",
+		"Messages ready to be dequeued.", []string{"namespace", "queue"}, nil)
+	queueInFlightDesc = prometheus.NewDesc("kokaq_queue_in_flight",
+		"Messages dequeued and locked, awaiting ack.", []string{"namespace", "queue"}, nil)
+	queueDeadLetterDepthDesc = prometheus.NewDesc("kokaq_queue_dead_letter_depth",
+		"Messages in the dead-letter queue.", []string{"namespace", "queue"}, nil)
+	queueScheduledDesc = prometheus.NewDesc("kokaq_queue_scheduled",
+		"Messages waiting for their delivery time.", []string{"namespace", "queue"}, nil)
+	queueOldestMessageAgeDesc = prometheus.NewDesc("kokaq_queue_oldest_message_age_seconds",
+		"Age of the oldest stored message.", []string{"namespace", "queue"}, nil)
+	queueOperationsDesc = prometheus.NewDesc("kokaq_queue_operations_total",
+		"Queue operations since the node started, by operation.", []string{"namespace", "queue", "operation"}, nil)
+)
+
+// metricsCollector reports the depth, in-flight and operation counts of the
+// queues hosted by a node, read from the store on every scrape.
+type metricsCollector struct {
+	store *DataStore
+}
+
+func (c *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+	ch <- queueInFlightDesc
+	ch <- queueDeadLetterDepthDesc
+	ch <- queueScheduledDesc
+	ch <- queueOldestMessageAgeDesc
+	ch <- queueOperationsDesc
+}
+
+func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, queue := range c.store.hostedQueues() {
+		policy := queue.policy()
+		stats := queue.stats()
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue,
+			float64(stats["depth"]), policy.Namespace, policy.Queue)
+		ch <- prometheus.MustNewConstMetric(queueInFlightDesc, prometheus.GaugeValue,
+			float64(stats["in_flight"]), policy.Namespace, policy.Queue)
+		ch <- prometheus.MustNewConstMetric(queueDeadLetterDepthDesc, prometheus.GaugeValue,
+			float64(stats["dead_letter_depth"]), policy.Namespace, policy.Queue)
+		ch <- prometheus.MustNewConstMetric(queueScheduledDesc, prometheus.GaugeValue,
+			float64(stats["scheduled"]), policy.Namespace, policy.Queue)
+		ch <- prometheus.MustNewConstMetric(queueOldestMessageAgeDesc, prometheus.GaugeValue,
+			float64(stats["oldest_message_age_ms"])/1000, policy.Namespace, policy.Queue)
+		for _, event := range statEvents {
+			ch <- prometheus.MustNewConstMetric(queueOperationsDesc, prometheus.CounterValue,
+				float64(stats[event+"_total"]), policy.Namespace, policy.Queue, event)
+		}
+	}
+}
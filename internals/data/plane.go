@@ -9,20 +9,73 @@ import (
 	"github.com/kokaq/core/internals/logger"
 	"github.com/kokaq/core/queue"
 	"github.com/kokaq/protocol/proto"
+	"github.com/kokaq/server/internals"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+var tracer = otel.Tracer("github.com/kokaq/server/internals/data")
+
+// maxBatch caps the messages or locks one batch call may carry, and the
+// messages one Dequeue or PeekLock hands out.
+const maxBatch = 100
+
+// maxDedupKey caps the length of message deduplication keys.
+const maxDedupKey = 128
+
+// reapInterval is how often the reaper looks for expired messages.
+const reapInterval = time.Second
+
 type DataPlane struct {
 	proto.UnimplementedKokaqDataPlaneServer
-	RootDir string
-	store   *DataStore
+	RootDir    string
+	store      *DataStore
+	replicator *Replicator
+	telemetry  internals.TelemetryLogger
+	stop       chan struct{}
 }
 
-func NewDataPlane(rootDirectory string) (*DataPlane, error) {
-	return &DataPlane{
-		RootDir: rootDirectory,
-		store:   NewDataStore(),
-	}, nil
+func NewDataPlane(rootDirectory string, ackMode AckMode, telemetryLogger internals.TelemetryLogger) (*DataPlane, error) {
+	store := NewDataStore()
+	if err := store.recoverQueues(rootDirectory); err != nil {
+		return nil, err
+	}
+	d := &DataPlane{
+		RootDir:   rootDirectory,
+		store:     store,
+		telemetry: telemetryLogger,
+		stop:      make(chan struct{}),
+	}
+	d.replicator = NewReplicator(ackMode, d.snapshot)
+	go d.reap()
+	return d, nil
+}
+
+// SetAssignments updates which shards this node leads and where they are
+// replicated, from the shard manager's answer to a request sent at
+// requestedAt.
+func (d *DataPlane) SetAssignments(assignments []*proto.ShardAssignment, requestedAt time.Time) {
+	d.replicator.SetAssignments(assignments, requestedAt)
+}
+
+// Synced lists the shards this node follows and is in sync with, for the
+// shard manager to pick leaders from.
+func (d *DataPlane) Synced() []uint64 {
+	return d.replicator.Synced()
+}
+
+func (d *DataPlane) Close() {
+	close(d.stop)
+	d.replicator.Close()
+}
+
+// Inventory lists the queues hosted by this node for shard manager registration.
+func (d *DataPlane) Inventory() []*proto.ShardItem {
+	return d.store.inventory()
 }
 
 func (d *DataPlane) New(c context.Context, p *proto.KokaqNewQueueRequest) (*proto.KokaqQueueResponse, error) {
@@ -36,11 +89,14 @@ func (d *DataPlane) New(c context.Context, p *proto.KokaqNewQueueRequest) (*prot
 		// Queue not found — create a new one using lower 32 bits of shard ID
 		logger.ConsoleLog("WARN", "Queue not found: %s. Creating new queue...", p.Request.Queue)
 		queueId := uint32(p.ShardId & 0xFFFFFFFF)
-		_, _, err := d.store.createQueue(p.Request.Namespace, p.Request.Queue, p.ShardId, false)
+		_, span := tracer.Start(c, "DataStore.createQueue", internals.QueueAttributes(p.Request.Namespace, p.Request.Queue))
+		_, _, err := d.store.createQueue(p.Request, p.ShardId)
+		internals.EndSpan(span, err)
 		if err != nil {
 			logger.ConsoleLog("ERROR", "%v", err)
 			return &proto.KokaqQueueResponse{ShardId: p.ShardId}, err
 		}
+		d.replicator.Claim(p.ShardId)
 		logger.ConsoleLog("INFO", "Successfully created queue: %s (ID=%x)", p.Request.Queue, queueId)
 		return &proto.KokaqQueueResponse{
 			ShardId:        p.ShardId,
@@ -60,13 +116,14 @@ func (d *DataPlane) Get(c context.Context, p *proto.KokaqQueueRequest) (*proto.K
 	var err error
 	var res *proto.KokaqQueueResponse
 	exists, shardId := d.store.queueExist(p.Namespace, p.Queue)
-	if exists {
+	hosted, hostedErr := d.store.getHosted(p.Namespace, p.Queue)
+	if exists && hostedErr == nil {
 		logger.ConsoleLog("INFO", "Successfully resolved queue: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
 		res = &proto.KokaqQueueResponse{
 			TotalNodeCount: 0,
 			TotalPageCount: 0,
 			CreatedOn:      timestamppb.Now(),
-			Request:        p,
+			Request:        hosted.config(),
 			ShardId:        shardId,
 		}
 		err = nil
@@ -78,29 +135,45 @@ func (d *DataPlane) Get(c context.Context, p *proto.KokaqQueueRequest) (*proto.K
 }
 
 func (d *DataPlane) GetStats(c context.Context, p *proto.KokaqQueueRequest) (*proto.KokaqStatsResponse, error) {
-	return &proto.KokaqStatsResponse{Stats: nil, Status: &proto.StatusResponse{}}, fmt.Errorf("cannot get stats")
+	logger.ConsoleLog("INFO", "Received stats request: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
+	hosted, err := d.store.getHosted(p.Namespace, p.Queue)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "GetStats - queue not found: %v", err)
+		return &proto.KokaqStatsResponse{Status: &proto.StatusResponse{Success: false, Error: proto.ErrorCode_ERROR_NOT_FOUND}}, err
+	}
+	return &proto.KokaqStatsResponse{Stats: hosted.stats(), Status: &proto.StatusResponse{Success: true}}, nil
 }
 
 func (d *DataPlane) Delete(c context.Context, p *proto.KokaqQueueRequest) (*proto.StatusResponse, error) {
 	logger.ConsoleLog("INFO", "Received queue delete request: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
-	deleted, err := d.store.deleteQueue(p.Namespace, p.Queue)
-	if !deleted {
+	var deleted bool
+	err := d.mutate(c, p.Namespace, p.Queue, func() (*proto.ReplicateRequest, error) {
+		var err error
+		deleted, err = d.store.deleteQueue(p.Namespace, p.Queue)
+		return &proto.ReplicateRequest{Namespace: p.Namespace, Queue: p.Queue, Op: proto.ReplicationOp_REPLICATION_OP_DELETE}, err
+	})
+	if !deleted || err != nil {
 		logger.ConsoleLog("ERROR", "Delete - failed to delete: %v", err)
 		return &proto.StatusResponse{}, err
 	}
 	logger.ConsoleLog("INFO", "Successfully deleted queue: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
-	return &proto.StatusResponse{}, nil
+	return &proto.StatusResponse{Success: true}, nil
 }
 
 func (d *DataPlane) Clear(c context.Context, p *proto.KokaqQueueRequest) (*proto.StatusResponse, error) {
 	logger.ConsoleLog("INFO", "Received queue clear request: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
-	deleted, err := d.store.clearQueue(p.Namespace, p.Queue)
-	if !deleted {
+	var deleted bool
+	err := d.mutate(c, p.Namespace, p.Queue, func() (*proto.ReplicateRequest, error) {
+		var err error
+		deleted, err = d.store.clearQueue(p.Namespace, p.Queue)
+		return &proto.ReplicateRequest{Namespace: p.Namespace, Queue: p.Queue, Op: proto.ReplicationOp_REPLICATION_OP_CLEAR}, err
+	})
+	if !deleted || err != nil {
 		logger.ConsoleLog("ERROR", "CLEAR - failed to clear: %v", err)
 		return &proto.StatusResponse{}, err
 	}
 	logger.ConsoleLog("INFO", "Successfully cleared queue: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
-	return &proto.StatusResponse{}, nil
+	return &proto.StatusResponse{Success: true}, nil
 }
 
 func (d *DataPlane) Enqueue(c context.Context, p *proto.EnqueueRequest) (*proto.EnqueueResponse, error) {
@@ -110,12 +183,218 @@ func (d *DataPlane) Enqueue(c context.Context, p *proto.EnqueueRequest) (*proto.
 		logger.ConsoleLog("ERROR", "Enqueue - queue not found: %v", err)
 		return &proto.EnqueueResponse{}, err
 	}
-	mId := uuid.New()
-	if err := q.Enqueue(&queue.QueueItem{MessageId: mId, Priority: p.Message.Priority}); err != nil {
+	hosted, err := d.store.getHosted(p.Message.Namespace, p.Message.Queue)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "Enqueue - message store not found: %v", err)
+		return &proto.EnqueueResponse{}, err
+	}
+	mId, err := messageKey(p.Message.MessageId)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "Enqueue - invalid message id: %v", err)
+		return &proto.EnqueueResponse{}, err
+	}
+	if p.Message.Priority == 0 {
+		return &proto.EnqueueResponse{}, status.Error(codes.InvalidArgument, "priority cannot be zero")
+	}
+	if len(p.Message.DeduplicationKey) > maxDedupKey {
+		return &proto.EnqueueResponse{}, status.Errorf(codes.InvalidArgument, "deduplication keys are at most %d bytes", maxDedupKey)
+	}
+	enqueuedAt := timestamppb.Now()
+	message := &proto.KokaqMessageResponse{
+		Message:   p.Message,
+		CreatedOn: enqueuedAt,
+		Expiry:    hosted.expiry(p.Message, enqueuedAt.AsTime()),
+	}
+	if message.Message.MessageId == "" {
+		message.Message.MessageId = mId.String()
+	}
+	visibleAt := deliveryTime(message.Message, enqueuedAt.AsTime())
+	var original *dedupEntry
+	err = d.mutate(c, p.Message.Namespace, p.Message.Queue, func() (*proto.ReplicateRequest, error) {
+		if entry, seen := hosted.original(p.Message.DeduplicationKey, time.Now()); seen {
+			original = entry
+			return nil, nil
+		}
+		if hosted.exists(mId) {
+			return nil, fmt.Errorf("message %s already exists", p.Message.MessageId)
+		}
+		if err := hosted.enqueue(q, mId, message); err != nil {
+			return nil, err
+		}
+		return &proto.ReplicateRequest{
+			Namespace: p.Message.Namespace,
+			Queue:     p.Message.Queue,
+			Op:        proto.ReplicationOp_REPLICATION_OP_ENQUEUE,
+			Message:   message,
+		}, nil
+	})
+	if err != nil {
 		logger.ConsoleLog("ERROR", "Enqueue - failed to enqueue: %v", err)
 		return &proto.EnqueueResponse{}, err
 	}
-	return &proto.EnqueueResponse{}, nil
+	if original != nil {
+		logger.ConsoleLog("INFO", "Enqueue - duplicate of message %s", original.MessageId)
+		return original.response(), nil
+	}
+	hosted.counters.record(statEnqueued, 1)
+	return &proto.EnqueueResponse{
+		MessageId:  message.Message.MessageId,
+		EnqueuedAt: enqueuedAt,
+		VisibleAt:  timestamppb.New(visibleAt),
+	}, nil
+}
+
+// EnqueueBatch stores several messages as one replicated mutation. The whole
+// batch is checked before anything is stored, so a bad message or a message id
+// used twice rejects all of them. Messages whose deduplication key was seen,
+// in the window or earlier in the batch, are not stored and report the
+// original message instead. Storing is all or nothing as well: a write that
+// fails drops the messages written before it, and nothing is replicated.
+func (d *DataPlane) EnqueueBatch(c context.Context, p *proto.EnqueueBatchRequest) (*proto.EnqueueBatchResponse, error) {
+	logger.ConsoleLog("INFO", "Received enqueue batch request: Namespace=%s, Queue=%s, Count=%d", p.Namespace, p.Queue, len(p.Messages))
+	if len(p.Messages) == 0 || len(p.Messages) > maxBatch {
+		return &proto.EnqueueBatchResponse{}, status.Errorf(codes.InvalidArgument, "a batch carries 1 to %d messages", maxBatch)
+	}
+	q, err := d.store.getQueue(p.Namespace, p.Queue)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "EnqueueBatch - queue not found: %v", err)
+		return &proto.EnqueueBatchResponse{}, err
+	}
+	hosted, err := d.store.getHosted(p.Namespace, p.Queue)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "EnqueueBatch - message store not found: %v", err)
+		return &proto.EnqueueBatchResponse{}, err
+	}
+	enqueuedAt := timestamppb.Now()
+	ids := make([]uuid.UUID, len(p.Messages))
+	messages := make([]*proto.KokaqMessageResponse, len(p.Messages))
+	visibleAt := make([]time.Time, len(p.Messages))
+	seen := make(map[uuid.UUID]int, len(p.Messages))
+	for i, request := range p.Messages {
+		if request == nil {
+			return &proto.EnqueueBatchResponse{}, status.Errorf(codes.InvalidArgument, "message %d is empty", i)
+		}
+		mId, err := messageKey(request.MessageId)
+		if err != nil {
+			return &proto.EnqueueBatchResponse{}, status.Errorf(codes.InvalidArgument, "message %d: %v", i, err)
+		}
+		if request.Priority == 0 {
+			return &proto.EnqueueBatchResponse{}, status.Errorf(codes.InvalidArgument, "message %d: priority cannot be zero", i)
+		}
+		if len(request.DeduplicationKey) > maxDedupKey {
+			return &proto.EnqueueBatchResponse{}, status.Errorf(codes.InvalidArgument, "message %d: deduplication keys are at most %d bytes", i, maxDedupKey)
+		}
+		if first, duplicate := seen[mId]; duplicate {
+			return &proto.EnqueueBatchResponse{}, status.Errorf(codes.InvalidArgument, "messages %d and %d have the same id", first, i)
+		}
+		seen[mId] = i
+		request.Namespace, request.Queue = p.Namespace, p.Queue
+		if request.MessageId == "" {
+			request.MessageId = mId.String()
+		}
+		ids[i] = mId
+		messages[i] = &proto.KokaqMessageResponse{
+			Message:   request,
+			CreatedOn: enqueuedAt,
+			Expiry:    hosted.expiry(request, enqueuedAt.AsTime()),
+		}
+		visibleAt[i] = deliveryTime(request, enqueuedAt.AsTime())
+	}
+	var fresh []*proto.KokaqMessageResponse
+	originals := make([]*dedupEntry, len(ids))
+	err = d.mutate(c, p.Namespace, p.Queue, func() (*proto.ReplicateRequest, error) {
+		fresh = make([]*proto.KokaqMessageResponse, 0, len(ids))
+		freshIds := make([]uuid.UUID, 0, len(ids))
+		keys := make(map[string]*dedupEntry)
+		for i, mId := range ids {
+			key := messages[i].Message.DeduplicationKey
+			if entry, seen := hosted.original(key, time.Now()); seen {
+				originals[i] = entry
+				continue
+			}
+			if entry, seen := keys[key]; seen {
+				originals[i] = entry
+				continue
+			}
+			if key != "" {
+				keys[key] = &dedupEntry{Key: key, MessageId: mId.String(), EnqueuedAt: enqueuedAt.AsTime()}
+			}
+			if hosted.exists(mId) {
+				return nil, status.Errorf(codes.AlreadyExists, "message %s already exists", messages[i].Message.MessageId)
+			}
+			fresh = append(fresh, messages[i])
+			freshIds = append(freshIds, mId)
+		}
+		if len(fresh) == 0 {
+			return nil, nil
+		}
+		if err := hosted.enqueueBatch(q, freshIds, fresh); err != nil {
+			return nil, err
+		}
+		return &proto.ReplicateRequest{
+			Namespace: p.Namespace,
+			Queue:     p.Queue,
+			Op:        proto.ReplicationOp_REPLICATION_OP_ENQUEUE_BATCH,
+			Messages:  fresh,
+		}, nil
+	})
+	if err != nil {
+		logger.ConsoleLog("ERROR", "EnqueueBatch - failed to enqueue: %v", err)
+		return &proto.EnqueueBatchResponse{}, err
+	}
+	hosted.counters.record(statEnqueued, uint64(len(fresh)))
+	results := make([]*proto.EnqueueResponse, 0, len(messages))
+	for i, message := range messages {
+		if originals[i] != nil {
+			results = append(results, originals[i].response())
+			continue
+		}
+		results = append(results, &proto.EnqueueResponse{
+			MessageId:  message.Message.MessageId,
+			EnqueuedAt: enqueuedAt,
+			VisibleAt:  timestamppb.New(visibleAt[i]),
+		})
+	}
+	return &proto.EnqueueBatchResponse{Results: results}, nil
+}
+
+// CancelScheduled drops a scheduled message before it becomes visible. A
+// message that is already visible has to be consumed instead.
+func (d *DataPlane) CancelScheduled(c context.Context, p *proto.CancelScheduledRequest) (*proto.StatusResponse, error) {
+	logger.ConsoleLog("INFO", "Received cancel scheduled request: Namespace=%s, Queue=%s, MessageId=%s", p.Namespace, p.Queue, p.MessageId)
+	hosted, err := d.store.getHosted(p.Namespace, p.Queue)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "CancelScheduled - queue not found: %v", err)
+		return &proto.StatusResponse{Success: false, Error: proto.ErrorCode_ERROR_NOT_FOUND}, err
+	}
+	mId, err := messageKey(p.MessageId)
+	if err != nil || p.MessageId == "" {
+		return &proto.StatusResponse{Success: false, Error: proto.ErrorCode_ERROR_INVALID_ARGUMENT}, status.Errorf(codes.InvalidArgument, "invalid message id %q", p.MessageId)
+	}
+	var cancelled bool
+	err = d.mutate(c, p.Namespace, p.Queue, func() (*proto.ReplicateRequest, error) {
+		cancelled, err = hosted.cancel(mId)
+		if err != nil || !cancelled {
+			return nil, err
+		}
+		return &proto.ReplicateRequest{
+			Namespace:  p.Namespace,
+			Queue:      p.Queue,
+			Op:         proto.ReplicationOp_REPLICATION_OP_CANCEL_SCHEDULED,
+			MessageIds: []string{mId.String()},
+		}, nil
+	})
+	if err != nil {
+		logger.ConsoleLog("ERROR", "CancelScheduled - failed: %v", err)
+		return &proto.StatusResponse{Success: false, Error: proto.ErrorCode_ERROR_INTERNAL}, err
+	}
+	if !cancelled {
+		if hosted.messages.Exists(mId) {
+			return &proto.StatusResponse{Success: false, Error: proto.ErrorCode_ERROR_INVALID_ARGUMENT}, status.Errorf(codes.FailedPrecondition, "message %s is already visible", p.MessageId)
+		}
+		return &proto.StatusResponse{Success: false, Error: proto.ErrorCode_ERROR_NOT_FOUND}, status.Errorf(codes.NotFound, "no scheduled message %s", p.MessageId)
+	}
+	return &proto.StatusResponse{Success: true}, nil
 }
 
 func (d *DataPlane) Dequeue(c context.Context, p *proto.DequeueRequest) (*proto.DequeueResponse, error) {
@@ -125,22 +404,83 @@ func (d *DataPlane) Dequeue(c context.Context, p *proto.DequeueRequest) (*proto.
 		logger.ConsoleLog("ERROR", "Dequeue - queue not found: %v", err)
 		return &proto.DequeueResponse{}, err
 	}
-	qi, err := q.Dequeue()
+	hosted, err := d.store.getHosted(p.Namespace, p.Queue)
 	if err != nil {
-		logger.ConsoleLog("ERROR", "Dequeue - failed: %v", err)
+		logger.ConsoleLog("ERROR", "Dequeue - message store not found: %v", err)
 		return &proto.DequeueResponse{}, err
 	}
-	var messages = make([]*proto.KokaqMessageResponse, 0)
-	var message = &proto.KokaqMessageResponse{
-		Message: &proto.KokaqMessageRequest{
-			MessageId: qi.MessageId.String(),
-			Priority:  qi.Priority,
-		},
+	count := batchCount(p.MaxCount)
+	var messages = make([]*proto.KokaqMessageResponse, 0, count)
+	err = d.await(c, hosted, p.WaitTimeMs, func() (bool, error) {
+		d.reclaimExpired(c, p.Namespace, p.Queue, q, hosted)
+		d.promoteDue(c, p.Namespace, p.Queue, q, hosted)
+		for len(messages) < count {
+			message, err := d.dequeueNext(c, p.Namespace, p.Queue, q, hosted)
+			if err != nil || message == nil {
+				return len(messages) > 0, err
+			}
+			messages = append(messages, message)
+		}
+		return true, nil
+	})
+	if err != nil {
+		logger.ConsoleLog("ERROR", "Dequeue - failed: %v", err)
+		// Messages already taken off the queue are handed out regardless.
+		if len(messages) == 0 {
+			return &proto.DequeueResponse{}, err
+		}
 	}
-	messages = append(messages, message)
 	return &proto.DequeueResponse{Messages: messages}, nil
 }
 
+// dequeueNext removes the top message of the queue, returning nil when no
+// message is visible. A message whose removal did not replicate to a quorum
+// is put back for another delivery rather than lost; followers that removed
+// it anyway fall out of sync on its next mutation and are resynced.
+func (d *DataPlane) dequeueNext(c context.Context, namespace string, queueName string, q *queue.Queue, hosted *hostedQueue) (*proto.KokaqMessageResponse, error) {
+	var message *proto.KokaqMessageResponse
+	var messageId uuid.UUID
+	err := d.mutate(c, namespace, queueName, func() (*proto.ReplicateRequest, error) {
+		expired, err := hosted.expireTop(q, time.Now())
+		if err != nil {
+			logger.ConsoleLog("WARN", "Dequeue - failed to expire message: %v", err)
+		}
+		if err != nil || hosted.drained() {
+			return expireRequest(namespace, queueName, expired), nil
+		}
+		qi, err := hosted.pop(q)
+		if err != nil {
+			return expireRequest(namespace, queueName, expired), err
+		}
+		messageId = qi.MessageId
+		message = loadMessage(hosted.messages, qi)
+		if err := hosted.messages.Delete(qi.MessageId); err != nil {
+			logger.ConsoleLog("WARN", "Dequeue - failed to remove message body: %v", err)
+		}
+		return &proto.ReplicateRequest{
+			Namespace:  namespace,
+			Queue:      queueName,
+			Op:         proto.ReplicationOp_REPLICATION_OP_DEQUEUE,
+			Message:    message,
+			MessageIds: expired,
+		}, nil
+	})
+	if err != nil && message != nil {
+		putBack := d.mutate(context.WithoutCancel(c), namespace, queueName, func() (*proto.ReplicateRequest, error) {
+			return nil, enqueueMessage(q, hosted.messages, messageId, message)
+		})
+		if putBack != nil {
+			logger.ConsoleLog("ERROR", "Dequeue - failed to put message %s back: %v", messageId, putBack)
+		}
+		return nil, err
+	}
+	if err != nil || message == nil {
+		return nil, err
+	}
+	hosted.counters.record(statDequeued, 1)
+	return message, nil
+}
+
 func (d *DataPlane) Peek(c context.Context, p *proto.PeekRequest) (*proto.PeekResponse, error) {
 	logger.ConsoleLog("INFO", "Received peek request: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
 	q, err := d.store.getQueue(p.Namespace, p.Queue)
@@ -148,19 +488,36 @@ func (d *DataPlane) Peek(c context.Context, p *proto.PeekRequest) (*proto.PeekRe
 		logger.ConsoleLog("ERROR", "Peek - queue not found: %v", err)
 		return &proto.PeekResponse{}, err
 	}
-	qi, err := q.Peek()
+	hosted, err := d.store.getHosted(p.Namespace, p.Queue)
 	if err != nil {
-		logger.ConsoleLog("ERROR", "Peek - failed: %v", err)
+		logger.ConsoleLog("ERROR", "Peek - message store not found: %v", err)
 		return &proto.PeekResponse{}, err
 	}
+	d.reclaimExpired(c, p.Namespace, p.Queue, q, hosted)
+	d.promoteDue(c, p.Namespace, p.Queue, q, hosted)
 	var messages = make([]*proto.KokaqMessageResponse, 0)
-	var message = &proto.KokaqMessageResponse{
-		Message: &proto.KokaqMessageRequest{
-			MessageId: qi.MessageId.String(),
-			Priority:  qi.Priority,
-		},
+	// Peeking can discard stale entries off the heap and expire the messages
+	// on top, so it takes the shard lock like a mutation; only the expired
+	// messages are replicated.
+	err = d.mutate(c, p.Namespace, p.Queue, func() (*proto.ReplicateRequest, error) {
+		expired, err := hosted.expireTop(q, time.Now())
+		if err != nil {
+			logger.ConsoleLog("WARN", "Peek - failed to expire message: %v", err)
+		}
+		if err != nil || hosted.drained() {
+			return expireRequest(p.Namespace, p.Queue, expired), nil
+		}
+		qi, err := hosted.peek(q)
+		if err != nil {
+			return expireRequest(p.Namespace, p.Queue, expired), err
+		}
+		messages = append(messages, loadMessage(hosted.messages, qi))
+		return expireRequest(p.Namespace, p.Queue, expired), nil
+	})
+	if err != nil {
+		logger.ConsoleLog("ERROR", "Peek - failed: %v", err)
+		return &proto.PeekResponse{}, err
 	}
-	messages = append(messages, message)
 	return &proto.PeekResponse{Messages: messages}, nil
 }
 
@@ -171,39 +528,186 @@ func (d *DataPlane) PeekLock(c context.Context, p *proto.PeekLockRequest) (*prot
 		logger.ConsoleLog("ERROR", "PeekLock - queue not found: %v", err)
 		return &proto.PeekLockResponse{}, err
 	}
-	qi, lockId, err := q.PeekLock()
+	hosted, err := d.store.getHosted(p.Namespace, p.Queue)
 	if err != nil {
-		logger.ConsoleLog("ERROR", "PeekLock - failed: %v", err)
+		logger.ConsoleLog("ERROR", "PeekLock - message store not found: %v", err)
 		return &proto.PeekLockResponse{}, err
 	}
-	var messages = make([]*proto.LockedMessage, 0)
-	var message = &proto.LockedMessage{
-		Message: &proto.KokaqMessageResponse{
-			Message: &proto.KokaqMessageRequest{
-				MessageId: qi.MessageId.String(),
-				Priority:  qi.Priority,
-			},
-		},
-		LockId: lockId,
+	count := batchCount(p.MaxCount)
+	var messages = make([]*proto.LockedMessage, 0, count)
+	err = d.await(c, hosted, p.WaitTimeMs, func() (bool, error) {
+		d.reclaimExpired(c, p.Namespace, p.Queue, q, hosted)
+		d.promoteDue(c, p.Namespace, p.Queue, q, hosted)
+		for len(messages) < count {
+			message, err := d.lockNext(c, p.Namespace, p.Queue, q, hosted, p.LockDuration)
+			if err != nil || message == nil {
+				return len(messages) > 0, err
+			}
+			messages = append(messages, message)
+		}
+		return true, nil
+	})
+	if err != nil {
+		logger.ConsoleLog("ERROR", "PeekLock - failed: %v", err)
+		// Locks already taken are handed out regardless; they would only
+		// expire otherwise.
+		if len(messages) == 0 {
+			return &proto.PeekLockResponse{}, err
+		}
 	}
-	messages = append(messages, message)
 	return &proto.PeekLockResponse{Locked: messages}, nil
 }
 
+// Receive streams locked messages to a consumer as they become available,
+// until the consumer goes away. max_in_flight is the consumer's credit: while
+// it holds that many locks, the next message waits for one of them to be
+// acked, nacked, released or to expire.
+func (d *DataPlane) Receive(p *proto.ReceiveRequest, stream proto.KokaqDataPlane_ReceiveServer) error {
+	logger.ConsoleLog("INFO", "Received receive request: Namespace=%s, Queue=%s, MaxInFlight=%d", p.Namespace, p.Queue, p.MaxInFlight)
+	ctx := stream.Context()
+	q, err := d.store.getQueue(p.Namespace, p.Queue)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "Receive - queue not found: %v", err)
+		return err
+	}
+	hosted, err := d.store.getHosted(p.Namespace, p.Queue)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "Receive - message store not found: %v", err)
+		return err
+	}
+	credit := int(max(p.MaxInFlight, 1))
+	held := make(map[string]struct{}, credit)
+	for {
+		changed := hosted.changed()
+		d.reclaimExpired(ctx, p.Namespace, p.Queue, q, hosted)
+		d.promoteDue(ctx, p.Namespace, p.Queue, q, hosted)
+		for lockId := range held {
+			if !hosted.locks.Has(lockId) {
+				delete(held, lockId)
+			}
+		}
+		if len(held) < credit {
+			message, err := d.lockNext(ctx, p.Namespace, p.Queue, q, hosted, p.LockDuration)
+			if err != nil {
+				logger.ConsoleLog("ERROR", "Receive - failed: %v", err)
+				return err
+			}
+			if message != nil {
+				if err := stream.Send(message); err != nil {
+					return err
+				}
+				held[message.LockId] = struct{}{}
+				continue
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		case <-time.After(hosted.recheckAfter()):
+		}
+	}
+}
+
+// lockNext locks the top message of the queue, returning nil when no message
+// is visible.
+func (d *DataPlane) lockNext(c context.Context, namespace string, queueName string, q *queue.Queue, hosted *hostedQueue, lockDuration uint32) (*proto.LockedMessage, error) {
+	var message *proto.LockedMessage
+	err := d.mutate(c, namespace, queueName, func() (*proto.ReplicateRequest, error) {
+		expired, err := hosted.expireTop(q, time.Now())
+		if err != nil {
+			logger.ConsoleLog("WARN", "PeekLock - failed to expire message: %v", err)
+		}
+		if err != nil || hosted.drained() {
+			return expireRequest(namespace, queueName, expired), nil
+		}
+		lockId := uuid.NewString()
+		expiresAt := time.Now().Add(hosted.lockDuration(lockDuration))
+		_, locked, err := hosted.lock(q, lockId, expiresAt)
+		if err != nil {
+			return expireRequest(namespace, queueName, expired), err
+		}
+		message = &proto.LockedMessage{
+			Message:       locked,
+			LockId:        lockId,
+			LockExpiresAt: timestamppb.New(expiresAt),
+		}
+		return &proto.ReplicateRequest{
+			Namespace:     namespace,
+			Queue:         queueName,
+			Op:            proto.ReplicationOp_REPLICATION_OP_LOCK,
+			Message:       locked,
+			LockId:        lockId,
+			LockExpiresAt: message.LockExpiresAt,
+			MessageIds:    expired,
+		}, nil
+	})
+	if err != nil || message == nil {
+		return nil, err
+	}
+	hosted.counters.record(statDequeued, 1)
+	return message, nil
+}
+
+// await calls take until it finds a message or waitTimeMs runs out, waking
+// whenever the queue changes. The wait ends early enough for an empty answer
+// to reach the caller before the request deadline.
+func (d *DataPlane) await(c context.Context, hosted *hostedQueue, waitTimeMs uint32, take func() (bool, error)) error {
+	deadline := time.Now().Add(time.Duration(waitTimeMs) * time.Millisecond)
+	if requestDeadline, bounded := c.Deadline(); bounded && requestDeadline.Add(-waitMargin).Before(deadline) {
+		deadline = requestDeadline.Add(-waitMargin)
+	}
+	for {
+		changed := hosted.changed()
+		found, err := take()
+		if err != nil || found || !time.Now().Before(deadline) {
+			return err
+		}
+		select {
+		case <-c.Done():
+			return nil
+		case <-changed:
+		case <-time.After(min(time.Until(deadline), hosted.recheckAfter())):
+		}
+	}
+}
+
 func (d *DataPlane) Ack(c context.Context, p *proto.AckRequest) (*proto.AckResponse, error) {
 	logger.ConsoleLog("INFO", "Received ack request: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
-	q, err := d.store.getQueue(p.Namespace, p.Queue)
+	hosted, err := d.store.getHosted(p.Namespace, p.Queue)
 	if err != nil {
 		logger.ConsoleLog("ERROR", "Ack - queue not found: %v", err)
 		return &proto.AckResponse{Acknowledged: false}, err
 	}
-	if err := q.Ack(p.LockId); err != nil {
+	if err := d.ackLock(c, p.Namespace, p.Queue, hosted, p.LockId); err != nil {
 		logger.ConsoleLog("ERROR", "Ack - failed: %v", err)
 		return &proto.AckResponse{Acknowledged: false}, err
 	}
 	return &proto.AckResponse{Acknowledged: true}, nil
 }
 
+// ackLock settles one lock by dropping its message.
+func (d *DataPlane) ackLock(c context.Context, namespace string, queueName string, hosted *hostedQueue, lockId string) error {
+	err := d.mutate(c, namespace, queueName, func() (*proto.ReplicateRequest, error) {
+		lock, err := hosted.locks.Take(lockId)
+		if err != nil {
+			return nil, err
+		}
+		return &proto.ReplicateRequest{
+			Namespace:  namespace,
+			Queue:      queueName,
+			Op:         proto.ReplicationOp_REPLICATION_OP_ACK,
+			LockId:     lockId,
+			MessageIds: []string{lock.messageId.String()},
+		}, hosted.ack(lock)
+	})
+	if err != nil {
+		return err
+	}
+	hosted.counters.record(statAcked, 1)
+	return nil
+}
+
 func (d *DataPlane) Nack(c context.Context, p *proto.NackRequest) (*proto.NackResponse, error) {
 	logger.ConsoleLog("INFO", "Received nack request: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
 	q, err := d.store.getQueue(p.Namespace, p.Queue)
@@ -211,55 +715,179 @@ func (d *DataPlane) Nack(c context.Context, p *proto.NackRequest) (*proto.NackRe
 		logger.ConsoleLog("ERROR", "Nack - queue not found: %v", err)
 		return &proto.NackResponse{}, err
 	}
-	if err := q.Nack(p.LockId); err != nil {
+	hosted, err := d.store.getHosted(p.Namespace, p.Queue)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "Nack - message store not found: %v", err)
+		return &proto.NackResponse{}, err
+	}
+	deadLettered, err := d.nackLock(c, p.Namespace, p.Queue, q, hosted, p.LockId, p.FailureReason)
+	if err != nil {
 		logger.ConsoleLog("ERROR", "Nack - failed: %v", err)
 		return &proto.NackResponse{}, err
 	}
-	return &proto.NackResponse{Requeued: true}, nil
+	return &proto.NackResponse{DeadLettered: deadLettered, Requeued: !deadLettered}, nil
+}
+
+// nackLock settles one lock as a failed delivery, reporting whether the
+// message went to the dead-letter queue rather than back on the heap.
+func (d *DataPlane) nackLock(c context.Context, namespace string, queueName string, q *queue.Queue, hosted *hostedQueue, lockId string, reason proto.FailureReason) (bool, error) {
+	var deadLettered bool
+	err := d.mutate(c, namespace, queueName, func() (*proto.ReplicateRequest, error) {
+		lock, err := hosted.locks.Take(lockId)
+		if err != nil {
+			return nil, err
+		}
+		deadLettered, err = hosted.nack(q, lock, reason)
+		return &proto.ReplicateRequest{
+			Namespace:     namespace,
+			Queue:         queueName,
+			Op:            proto.ReplicationOp_REPLICATION_OP_NACK,
+			LockId:        lockId,
+			MessageIds:    []string{lock.messageId.String()},
+			FailureReason: reason,
+		}, err
+	})
+	if err != nil {
+		return false, err
+	}
+	hosted.counters.record(statNacked, 1)
+	if deadLettered {
+		logger.ConsoleLog("WARN", "Nack - message dead-lettered after max delivery count: Namespace=%s, Queue=%s", namespace, queueName)
+		hosted.counters.record(statDeadLettered, 1)
+	}
+	return deadLettered, nil
 }
 
 func (d *DataPlane) Extend(c context.Context, p *proto.ExtendVisibilityTimeoutRequest) (*proto.VisibilityTimeoutResponse, error) {
 	logger.ConsoleLog("INFO", "Received extend request: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
-	q, err := d.store.getQueue(p.Namespace, p.Queue)
+	resp, err := d.renewLock(c, p.Namespace, p.Queue, p.LockId, func(lock *messageLock) time.Time {
+		return lock.expiresAt.Add(time.Duration(p.AdditionalMs) * time.Millisecond)
+	})
 	if err != nil {
-		logger.ConsoleLog("ERROR", "Extend - queue not found: %v", err)
-		return &proto.VisibilityTimeoutResponse{Applied: false}, err
-	}
-	if err := q.Extend(p.LockId, time.Duration(p.AdditionalMs)*time.Millisecond); err != nil {
 		logger.ConsoleLog("ERROR", "Extend - failed: %v", err)
-		return &proto.VisibilityTimeoutResponse{Applied: false}, err
 	}
-	return &proto.VisibilityTimeoutResponse{Applied: true}, nil
+	return resp, err
 }
 
 func (d *DataPlane) SetVisibilityTimeout(c context.Context, p *proto.SetVisibilityTimeoutRequest) (*proto.VisibilityTimeoutResponse, error) {
 	logger.ConsoleLog("INFO", "Received SetVisibilityTimeout request: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
-	q, err := d.store.getQueue(p.Namespace, p.Queue)
+	resp, err := d.renewLock(c, p.Namespace, p.Queue, p.LockId, func(lock *messageLock) time.Time {
+		lock.duration = time.Duration(p.NewTimeoutMs) * time.Millisecond
+		return time.Now().Add(lock.duration)
+	})
 	if err != nil {
-		logger.ConsoleLog("ERROR", "SetVisibilityTimeout - queue not found: %v", err)
-		return &proto.VisibilityTimeoutResponse{Applied: false}, err
-	}
-	if err := q.SetVisibilityTimeout(time.Duration(p.NewTimeoutMs) * time.Millisecond); err != nil {
 		logger.ConsoleLog("ERROR", "SetVisibilityTimeout - failed: %v", err)
-		return &proto.VisibilityTimeoutResponse{Applied: false}, err
 	}
-	return &proto.VisibilityTimeoutResponse{Applied: true}, nil
+	return resp, err
 }
 
 func (d *DataPlane) RefreshVisibilityTimeout(c context.Context, p *proto.RefreshVisibilityTimeoutRequest) (*proto.VisibilityTimeoutResponse, error) {
 	logger.ConsoleLog("INFO", "Received RefreshVisibilityTimeout request: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
+	resp, err := d.renewLock(c, p.Namespace, p.Queue, p.LockId, func(lock *messageLock) time.Time {
+		return time.Now().Add(lock.duration)
+	})
+	if err != nil {
+		logger.ConsoleLog("ERROR", "RefreshVisibilityTimeout - failed: %v", err)
+	}
+	return resp, err
+}
+
+// AckBatch acks each lock in turn. A lock that fails does not stop the rest;
+// its result carries the error.
+func (d *DataPlane) AckBatch(c context.Context, p *proto.AckBatchRequest) (*proto.LockBatchResponse, error) {
+	logger.ConsoleLog("INFO", "Received ack batch request: Namespace=%s, Queue=%s, Count=%d", p.Namespace, p.Queue, len(p.LockIds))
+	if err := checkLockBatch(p.LockIds); err != nil {
+		return &proto.LockBatchResponse{}, err
+	}
+	hosted, err := d.store.getHosted(p.Namespace, p.Queue)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "AckBatch - queue not found: %v", err)
+		return &proto.LockBatchResponse{}, err
+	}
+	results := make([]*proto.LockResult, 0, len(p.LockIds))
+	for _, lockId := range p.LockIds {
+		results = append(results, lockResult(lockId, d.ackLock(c, p.Namespace, p.Queue, hosted, lockId)))
+	}
+	return &proto.LockBatchResponse{Results: results}, nil
+}
+
+// NackBatch nacks each lock in turn with the same failure reason.
+func (d *DataPlane) NackBatch(c context.Context, p *proto.NackBatchRequest) (*proto.LockBatchResponse, error) {
+	logger.ConsoleLog("INFO", "Received nack batch request: Namespace=%s, Queue=%s, Count=%d", p.Namespace, p.Queue, len(p.LockIds))
+	if err := checkLockBatch(p.LockIds); err != nil {
+		return &proto.LockBatchResponse{}, err
+	}
 	q, err := d.store.getQueue(p.Namespace, p.Queue)
 	if err != nil {
-		logger.ConsoleLog("ERROR", "RefreshVisibilityTimeout - queue not found: %v", err)
+		logger.ConsoleLog("ERROR", "NackBatch - queue not found: %v", err)
+		return &proto.LockBatchResponse{}, err
+	}
+	hosted, err := d.store.getHosted(p.Namespace, p.Queue)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "NackBatch - message store not found: %v", err)
+		return &proto.LockBatchResponse{}, err
+	}
+	results := make([]*proto.LockResult, 0, len(p.LockIds))
+	for _, lockId := range p.LockIds {
+		deadLettered, err := d.nackLock(c, p.Namespace, p.Queue, q, hosted, lockId, p.FailureReason)
+		result := lockResult(lockId, err)
+		result.DeadLettered = deadLettered
+		results = append(results, result)
+	}
+	return &proto.LockBatchResponse{Results: results}, nil
+}
+
+// ExtendBatch pushes back the expiry of each lock by the same amount.
+func (d *DataPlane) ExtendBatch(c context.Context, p *proto.ExtendBatchRequest) (*proto.LockBatchResponse, error) {
+	logger.ConsoleLog("INFO", "Received extend batch request: Namespace=%s, Queue=%s, Count=%d", p.Namespace, p.Queue, len(p.LockIds))
+	if err := checkLockBatch(p.LockIds); err != nil {
+		return &proto.LockBatchResponse{}, err
+	}
+	if _, err := d.store.getHosted(p.Namespace, p.Queue); err != nil {
+		logger.ConsoleLog("ERROR", "ExtendBatch - queue not found: %v", err)
+		return &proto.LockBatchResponse{}, err
+	}
+	results := make([]*proto.LockResult, 0, len(p.LockIds))
+	for _, lockId := range p.LockIds {
+		resp, err := d.renewLock(c, p.Namespace, p.Queue, lockId, func(lock *messageLock) time.Time {
+			return lock.expiresAt.Add(time.Duration(p.AdditionalMs) * time.Millisecond)
+		})
+		result := lockResult(lockId, err)
+		result.LockExpiresAt = resp.GetLockExpiresAt()
+		results = append(results, result)
+	}
+	return &proto.LockBatchResponse{Results: results}, nil
+}
+
+// renewLock moves the expiry of a live lock and replicates the new expiry.
+func (d *DataPlane) renewLock(c context.Context, namespace string, queueName string, lockId string, expiry func(lock *messageLock) time.Time) (*proto.VisibilityTimeoutResponse, error) {
+	hosted, err := d.store.getHosted(namespace, queueName)
+	if err != nil {
 		return &proto.VisibilityTimeoutResponse{Applied: false}, err
 	}
-	if err := q.RefreshVisibilityTimeout(p.LockId); err != nil {
-		logger.ConsoleLog("ERROR", "RefreshVisibilityTimeout - failed: %v", err)
+	var expiresAt time.Time
+	err = d.mutate(c, namespace, queueName, func() (*proto.ReplicateRequest, error) {
+		expiresAt, err = hosted.locks.Renew(lockId, expiry)
+		if err != nil {
+			return nil, err
+		}
+		return &proto.ReplicateRequest{
+			Namespace:     namespace,
+			Queue:         queueName,
+			Op:            proto.ReplicationOp_REPLICATION_OP_RENEW_LOCK,
+			LockId:        lockId,
+			LockExpiresAt: timestamppb.New(expiresAt),
+		}, nil
+	})
+	if err != nil {
 		return &proto.VisibilityTimeoutResponse{Applied: false}, err
 	}
-	return &proto.VisibilityTimeoutResponse{Applied: true}, nil
+	return &proto.VisibilityTimeoutResponse{Applied: true, LockExpiresAt: timestamppb.New(expiresAt)}, nil
 }
 
+// ReleaseLock gives a locked message back to the queue without counting a
+// failed delivery. The message is visible again straight away whether or not
+// make_visible_now is set: the request carries no delay to schedule it by.
 func (d *DataPlane) ReleaseLock(c context.Context, p *proto.ReleaseLockRequest) (*proto.ReleaseLockResponse, error) {
 	logger.ConsoleLog("INFO", "Received ReleaseLock request: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
 	q, err := d.store.getQueue(p.Namespace, p.Queue)
@@ -267,59 +895,708 @@ func (d *DataPlane) ReleaseLock(c context.Context, p *proto.ReleaseLockRequest)
 		logger.ConsoleLog("ERROR", "ReleaseLock - queue not found: %v", err)
 		return &proto.ReleaseLockResponse{Released: false}, err
 	}
-	if err := q.ReleaseLock(p.LockId); err != nil {
+	hosted, err := d.store.getHosted(p.Namespace, p.Queue)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "ReleaseLock - message store not found: %v", err)
+		return &proto.ReleaseLockResponse{Released: false}, err
+	}
+	err = d.mutate(c, p.Namespace, p.Queue, func() (*proto.ReplicateRequest, error) {
+		lock, err := hosted.locks.Take(p.LockId)
+		if err != nil {
+			return nil, err
+		}
+		return &proto.ReplicateRequest{
+			Namespace:  p.Namespace,
+			Queue:      p.Queue,
+			Op:         proto.ReplicationOp_REPLICATION_OP_RELEASE_LOCK,
+			LockId:     p.LockId,
+			MessageIds: []string{lock.messageId.String()},
+		}, hosted.release(q, lock)
+	})
+	if err != nil {
 		logger.ConsoleLog("ERROR", "ReleaseLock - failed: %v", err)
 		return &proto.ReleaseLockResponse{Released: false}, err
 	}
-	return &proto.ReleaseLockResponse{Released: true}, nil
+	return &proto.ReleaseLockResponse{Released: true, VisibleAt: timestamppb.Now()}, nil
+}
+
+func (d *DataPlane) MoveToDLQ(c context.Context, p *proto.MoveToDLQRequest) (*proto.MoveToDLQResponse, error) {
+	logger.ConsoleLog("INFO", "Received MoveToDLQ request: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
+	hosted, err := d.store.getHosted(p.Namespace, p.Queue)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "MoveToDLQ - queue not found: %v", err)
+		return &proto.MoveToDLQResponse{}, err
+	}
+	if !hosted.policy().EnableDeadLetter {
+		logger.ConsoleLog("ERROR", "MoveToDLQ - dead-lettering is not enabled for %s/%s", p.Namespace, p.Queue)
+		return &proto.MoveToDLQResponse{}, status.Errorf(codes.FailedPrecondition, "dead-lettering is not enabled for queue %s", p.Queue)
+	}
+	var message *proto.KokaqMessageResponse
+	err = d.mutate(c, p.Namespace, p.Queue, func() (*proto.ReplicateRequest, error) {
+		lock, err := hosted.locks.Take(p.LockId)
+		if err != nil {
+			return nil, err
+		}
+		message = loadMessage(hosted.messages, &queue.QueueItem{MessageId: lock.messageId, Priority: lock.priority})
+		return &proto.ReplicateRequest{
+			Namespace:     p.Namespace,
+			Queue:         p.Queue,
+			Op:            proto.ReplicationOp_REPLICATION_OP_DEAD_LETTER,
+			LockId:        p.LockId,
+			MessageIds:    []string{lock.messageId.String()},
+			FailureReason: p.FailureReason,
+		}, hosted.deadLetter(lock.messageId, message, p.FailureReason)
+	})
+	if err != nil {
+		logger.ConsoleLog("ERROR", "MoveToDLQ - failed: %v", err)
+		return &proto.MoveToDLQResponse{}, err
+	}
+	hosted.counters.record(statDeadLettered, 1)
+	return &proto.MoveToDLQResponse{DeadLettered: true, MessageId: message.Message.MessageId}, nil
+}
+
+// AutoMoveToDLQ sets how many failed deliveries a message gets before it is
+// dead-lettered. A non-zero count also enables the queue's dead-letter queue.
+func (d *DataPlane) AutoMoveToDLQ(c context.Context, p *proto.AutoMoveToDLQRequest) (*proto.StatusResponse, error) {
+	logger.ConsoleLog("INFO", "Received AutoMoveToDLQ request: Namespace=%s, Queue=%s, MaxDeliveryCount=%d", p.Namespace, p.Queue, p.MaxDeliveryCount)
+	hosted, err := d.store.getHosted(p.Namespace, p.Queue)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "AutoMoveToDLQ - queue not found: %v", err)
+		return &proto.StatusResponse{Success: false, Error: proto.ErrorCode_ERROR_NOT_FOUND}, err
+	}
+	err = d.mutate(c, p.Namespace, p.Queue, func() (*proto.ReplicateRequest, error) {
+		enableDeadLetter := hosted.policy().EnableDeadLetter || p.MaxDeliveryCount > 0
+		return &proto.ReplicateRequest{
+			Namespace: p.Namespace,
+			Queue:     p.Queue,
+			Op:        proto.ReplicationOp_REPLICATION_OP_SET_POLICY,
+		}, hosted.setPolicy(enableDeadLetter, p.MaxDeliveryCount)
+	})
+	if err != nil {
+		logger.ConsoleLog("ERROR", "AutoMoveToDLQ - failed: %v", err)
+		return &proto.StatusResponse{Success: false}, err
+	}
+	return &proto.StatusResponse{Success: true}, nil
+}
+
+func (d *DataPlane) PeekDLQ(c context.Context, p *proto.DLQRequest) (*proto.DLQMessagesResponse, error) {
+	logger.ConsoleLog("INFO", "Received PeekDLQ request: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
+	hosted, err := d.store.getHosted(p.Namespace, p.Queue)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "PeekDLQ - queue not found: %v", err)
+		return &proto.DLQMessagesResponse{}, err
+	}
+	messages, err := hosted.deadLettered(max(p.Count, 1))
+	if err != nil {
+		logger.ConsoleLog("ERROR", "PeekDLQ - failed: %v", err)
+		return &proto.DLQMessagesResponse{}, err
+	}
+	return &proto.DLQMessagesResponse{Messages: messages}, nil
+}
+
+func (d *DataPlane) DequeueDLQ(c context.Context, p *proto.DLQRequest) (*proto.DLQMessagesResponse, error) {
+	logger.ConsoleLog("INFO", "Received DequeueDLQ request: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
+	hosted, err := d.store.getHosted(p.Namespace, p.Queue)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "DequeueDLQ - queue not found: %v", err)
+		return &proto.DLQMessagesResponse{}, err
+	}
+	var messages []*proto.KokaqMessageResponse
+	err = d.mutate(c, p.Namespace, p.Queue, func() (*proto.ReplicateRequest, error) {
+		messages, err = hosted.deadLettered(max(p.Count, 1))
+		if err != nil {
+			return nil, err
+		}
+		ids := messageIds(messages)
+		return &proto.ReplicateRequest{
+			Namespace:  p.Namespace,
+			Queue:      p.Queue,
+			Op:         proto.ReplicationOp_REPLICATION_OP_DEQUEUE_DEAD_LETTER,
+			MessageIds: ids,
+		}, hosted.dropDeadLetters(ids)
+	})
+	if err != nil {
+		logger.ConsoleLog("ERROR", "DequeueDLQ - failed: %v", err)
+		return &proto.DLQMessagesResponse{}, err
+	}
+	return &proto.DLQMessagesResponse{Messages: messages}, nil
+}
+
+// MoveFromDLQ redrives the given dead-lettered messages, or all of them when
+// no ids are given, back onto the queue.
+func (d *DataPlane) MoveFromDLQ(c context.Context, p *proto.MoveFromDLQRequest) (*proto.MoveFromDLQResponse, error) {
+	logger.ConsoleLog("INFO", "Received MoveFromDLQ request: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
+	q, err := d.store.getQueue(p.Namespace, p.Queue)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "MoveFromDLQ - queue not found: %v", err)
+		return &proto.MoveFromDLQResponse{}, err
+	}
+	hosted, err := d.store.getHosted(p.Namespace, p.Queue)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "MoveFromDLQ - message store not found: %v", err)
+		return &proto.MoveFromDLQResponse{}, err
+	}
+	var redriven uint32
+	var redriveErr error
+	err = d.mutate(c, p.Namespace, p.Queue, func() (*proto.ReplicateRequest, error) {
+		ids := p.MessageIds
+		if len(ids) == 0 {
+			messages, err := hosted.deadLettered(0)
+			if err != nil {
+				return nil, err
+			}
+			ids = messageIds(messages)
+		}
+		// Replicate whatever made it back so followers match a partial redrive
+		redriven, redriveErr = hosted.redrive(q, ids)
+		if redriven == 0 {
+			return nil, redriveErr
+		}
+		return &proto.ReplicateRequest{
+			Namespace:  p.Namespace,
+			Queue:      p.Queue,
+			Op:         proto.ReplicationOp_REPLICATION_OP_REDRIVE,
+			MessageIds: ids[:redriven],
+		}, nil
+	})
+	if err == nil {
+		err = redriveErr
+	}
+	if err != nil {
+		logger.ConsoleLog("ERROR", "MoveFromDLQ - failed after %d messages: %v", redriven, err)
+		return &proto.MoveFromDLQResponse{Redriven: redriven}, err
+	}
+	return &proto.MoveFromDLQResponse{Redriven: redriven}, nil
+}
+
+func (d *DataPlane) ClearDLQ(c context.Context, p *proto.DLQRequest) (*proto.StatusResponse, error) {
+	logger.ConsoleLog("INFO", "Received ClearDLQ request: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
+	hosted, err := d.store.getHosted(p.Namespace, p.Queue)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "ClearDLQ - queue not found: %v", err)
+		return &proto.StatusResponse{Success: false, Error: proto.ErrorCode_ERROR_NOT_FOUND}, err
+	}
+	err = d.mutate(c, p.Namespace, p.Queue, func() (*proto.ReplicateRequest, error) {
+		return &proto.ReplicateRequest{
+			Namespace: p.Namespace,
+			Queue:     p.Queue,
+			Op:        proto.ReplicationOp_REPLICATION_OP_CLEAR_DEAD_LETTER,
+		}, hosted.deadLetters.Clear()
+	})
+	if err != nil {
+		logger.ConsoleLog("ERROR", "ClearDLQ - failed: %v", err)
+		return &proto.StatusResponse{Success: false}, err
+	}
+	return &proto.StatusResponse{Success: true}, nil
+}
+
+func (d *DataPlane) ListDLQMessages(c context.Context, p *proto.DLQRequest) (*proto.DLQMessagesResponse, error) {
+	logger.ConsoleLog("INFO", "Received ListDLQMessages request: Namespace=%s, Queue=%s", p.Namespace, p.Queue)
+	hosted, err := d.store.getHosted(p.Namespace, p.Queue)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "ListDLQMessages - queue not found: %v", err)
+		return &proto.DLQMessagesResponse{}, err
+	}
+	messages, err := hosted.deadLettered(p.Count)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "ListDLQMessages - failed: %v", err)
+		return &proto.DLQMessagesResponse{}, err
+	}
+	return &proto.DLQMessagesResponse{Messages: messages}, nil
+}
+
+// Replicate applies a mutation streamed by the leader of a shard this node
+// follows. Queues are created on first use, so followers need no separate
+// provisioning.
+func (d *DataPlane) Replicate(c context.Context, p *proto.ReplicateRequest) (*proto.ReplicateResponse, error) {
+	_, span := tracer.Start(c, "DataStore.applyReplicated", internals.QueueAttributes(p.Namespace, p.Queue),
+		trace.WithAttributes(attribute.String("kokaq.op", p.Op.String()), attribute.Int64("kokaq.seq", int64(p.Seq))))
+	lastSeq, err := d.replicator.Follow(p, func() error {
+		return d.applyReplicated(p)
+	})
+	internals.EndSpan(span, err)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "Replicate - failed to apply seq=%d for shardId=%x: %v", p.Seq, p.ShardId, err)
+		return &proto.ReplicateResponse{Applied: false, LastSeq: lastSeq}, err
+	}
+	return &proto.ReplicateResponse{Applied: true, LastSeq: lastSeq}, nil
+}
+
+func (d *DataPlane) applyReplicated(p *proto.ReplicateRequest) error {
+	switch p.Op {
+	case proto.ReplicationOp_REPLICATION_OP_DELETE:
+		_, err := d.store.deleteQueue(p.Namespace, p.Queue)
+		return err
+	case proto.ReplicationOp_REPLICATION_OP_SNAPSHOT:
+		return d.restore(p)
+	}
+	if exists, _ := d.store.queueExist(p.Namespace, p.Queue); !exists {
+		config := p.Config
+		if config == nil {
+			config = &proto.KokaqQueueRequest{Namespace: p.Namespace, Queue: p.Queue}
+		}
+		namespaceId, _ := splitShard(p.ShardId)
+		d.store.initializeNamespaceIfNotExists(p.Namespace, namespaceId, d.RootDir)
+		if _, _, err := d.store.createQueue(config, p.ShardId); err != nil {
+			return err
+		}
+	}
+	q, err := d.store.getQueue(p.Namespace, p.Queue)
+	if err != nil {
+		return err
+	}
+	hosted, err := d.store.getHosted(p.Namespace, p.Queue)
+	if err != nil {
+		return err
+	}
+	switch p.Op {
+	case proto.ReplicationOp_REPLICATION_OP_ENQUEUE:
+		mId, err := messageKey(p.Message.GetMessage().GetMessageId())
+		if err != nil {
+			return err
+		}
+		if hosted.exists(mId) {
+			return nil
+		}
+		return hosted.enqueue(q, mId, p.Message)
+	case proto.ReplicationOp_REPLICATION_OP_ENQUEUE_BATCH:
+		ids := make([]uuid.UUID, 0, len(p.Messages))
+		messages := make([]*proto.KokaqMessageResponse, 0, len(p.Messages))
+		for _, message := range p.Messages {
+			mId, err := messageKey(message.GetMessage().GetMessageId())
+			if err != nil {
+				return err
+			}
+			if hosted.exists(mId) {
+				continue
+			}
+			ids = append(ids, mId)
+			messages = append(messages, message)
+		}
+		return hosted.enqueueBatch(q, ids, messages)
+	case proto.ReplicationOp_REPLICATION_OP_PROMOTE:
+		for _, messageId := range p.MessageIds {
+			mId, err := messageKey(messageId)
+			if err != nil {
+				return err
+			}
+			if _, err := hosted.promote(q, mId); err != nil {
+				return err
+			}
+		}
+		return nil
+	case proto.ReplicationOp_REPLICATION_OP_CANCEL_SCHEDULED:
+		for _, messageId := range p.MessageIds {
+			mId, err := messageKey(messageId)
+			if err != nil {
+				return err
+			}
+			if _, err := hosted.cancel(mId); err != nil {
+				return err
+			}
+		}
+		return nil
+	case proto.ReplicationOp_REPLICATION_OP_EXPIRE:
+		return expireAll(hosted, p.MessageIds)
+	case proto.ReplicationOp_REPLICATION_OP_DEQUEUE:
+		if err := expireAll(hosted, p.MessageIds); err != nil {
+			return err
+		}
+		mId, err := messageKey(p.Message.GetMessage().GetMessageId())
+		if err != nil {
+			return err
+		}
+		if err := hosted.take(q, mId); err != nil {
+			return err
+		}
+		return hosted.messages.Delete(mId)
+	case proto.ReplicationOp_REPLICATION_OP_LOCK:
+		if err := expireAll(hosted, p.MessageIds); err != nil {
+			return err
+		}
+		mId, err := messageKey(p.Message.GetMessage().GetMessageId())
+		if err != nil {
+			return err
+		}
+		return hosted.lockMessage(q, mId, p.LockId, p.LockExpiresAt.AsTime())
+	case proto.ReplicationOp_REPLICATION_OP_ACK:
+		if lock, exist := hosted.locks.Remove(p.LockId); exist {
+			return hosted.ack(lock)
+		}
+		logger.ConsoleLog("WARN", "Replicate - ack for unknown lock %s, dropping message bodies %v", p.LockId, p.MessageIds)
+		return hosted.dropMessages(p.MessageIds)
+	case proto.ReplicationOp_REPLICATION_OP_NACK:
+		lock, exist := hosted.locks.Remove(p.LockId)
+		if !exist {
+			logger.ConsoleLog("WARN", "Replicate - nack for unknown lock %s", p.LockId)
+			return nil
+		}
+		_, err := hosted.nack(q, lock, p.FailureReason)
+		return err
+	case proto.ReplicationOp_REPLICATION_OP_RENEW_LOCK:
+		if !hosted.locks.SetExpiry(p.LockId, p.LockExpiresAt.AsTime()) {
+			logger.ConsoleLog("WARN", "Replicate - renew for unknown lock %s", p.LockId)
+		}
+		return nil
+	case proto.ReplicationOp_REPLICATION_OP_RELEASE_LOCK:
+		lock, exist := hosted.locks.Remove(p.LockId)
+		if !exist {
+			logger.ConsoleLog("WARN", "Replicate - release for unknown lock %s", p.LockId)
+			return nil
+		}
+		return hosted.release(q, lock)
+	case proto.ReplicationOp_REPLICATION_OP_DEAD_LETTER:
+		lock, exist := hosted.locks.Remove(p.LockId)
+		if !exist {
+			logger.ConsoleLog("WARN", "Replicate - dead-letter for unknown lock %s", p.LockId)
+			return nil
+		}
+		return hosted.deadLetter(lock.messageId, loadMessage(hosted.messages, &queue.QueueItem{MessageId: lock.messageId, Priority: lock.priority}), p.FailureReason)
+	case proto.ReplicationOp_REPLICATION_OP_REDRIVE:
+		_, err := hosted.redrive(q, p.MessageIds)
+		return err
+	case proto.ReplicationOp_REPLICATION_OP_DEQUEUE_DEAD_LETTER:
+		return hosted.dropDeadLetters(p.MessageIds)
+	case proto.ReplicationOp_REPLICATION_OP_CLEAR_DEAD_LETTER:
+		return hosted.deadLetters.Clear()
+	case proto.ReplicationOp_REPLICATION_OP_SET_POLICY:
+		return hosted.setPolicy(p.Config.GetEnableDeadLetter(), p.Config.GetMaxDequeueCount())
+	case proto.ReplicationOp_REPLICATION_OP_CLEAR:
+		_, err := d.store.clearQueue(p.Namespace, p.Queue)
+		return err
+	}
+	return fmt.Errorf("unknown replication op %v", p.Op)
 }
 
-// func (d *DataPlane) IsExpired(c context.Context, p *proto.LockIdRequest) (*proto.IsExpiredResponse, error) {
-// 	var err error
-// 	if q, err := d.forQueue(p.NamespaceId, p.QueueId); err == nil {
-// 		if expired, err := q.IsExpired(p.LockId); err == nil {
-// 			return &proto.IsExpiredResponse{IsExpired: expired, Error: nil}, nil
-// 		}
-// 	}
-// 	return &proto.IsExpiredResponse{Error: &proto.Error{Message: d.errString(err), Code: 0}, IsExpired: false}, err
-// }
+// snapshot captures the queue of a shard this node leads for an out of sync
+// follower, or returns nil once the queue is gone.
+func (d *DataPlane) snapshot(shardId uint64) (*proto.ReplicateRequest, error) {
+	hosted, exists := d.store.hostedShard(shardId)
+	if !exists {
+		return nil, nil
+	}
+	return hosted.snapshot()
+}
 
-// func (d *DataPlane) GetLockedMessages(c context.Context, p *proto.QueueIdRequest) (*proto.QueueItemsResponse, error) {
-// 	panic("unimplemented")
-// }
+// restore replaces this node's copy of a queue with the snapshot its leader
+// sent to bring it back in sync.
+func (d *DataPlane) restore(p *proto.ReplicateRequest) error {
+	if _, err := d.store.deleteQueue(p.Namespace, p.Queue); err != nil {
+		return err
+	}
+	namespaceId, _ := splitShard(p.ShardId)
+	d.store.initializeNamespaceIfNotExists(p.Namespace, namespaceId, d.RootDir)
+	if _, _, err := d.store.createQueue(p.Config, p.ShardId); err != nil {
+		return err
+	}
+	q, err := d.store.getQueue(p.Namespace, p.Queue)
+	if err != nil {
+		return err
+	}
+	hosted, err := d.store.getHosted(p.Namespace, p.Queue)
+	if err != nil {
+		return err
+	}
+	return hosted.restore(q, p)
+}
 
-// func (d *DataPlane) MoveToDLQ(c context.Context, p *proto.MoveToDLQRequest) (*proto.EmptyResponse, error) {
-// 	panic("unimplemented")
-// }
+// mutate applies a queue mutation through the replicator so the followers of
+// the queue's shard see it in the order it was applied here. The queue config
+// travels with every mutation so followers can create the queue on demand.
+// Only the leader of the shard mutates it; a follower would diverge from it.
+func (d *DataPlane) mutate(ctx context.Context, namespace string, queueName string, apply func() (*proto.ReplicateRequest, error)) error {
+	exists, shardId := d.store.queueExist(namespace, queueName)
+	if !exists {
+		return fmt.Errorf("queue does not exist")
+	}
+	if !d.replicator.Leads(shardId) {
+		return status.Errorf(codes.FailedPrecondition, "this node does not lead shardId=%x of queue %s", shardId, queueName)
+	}
+	hosted, err := d.store.getHosted(namespace, queueName)
+	if err != nil {
+		return err
+	}
+	ctx, span := tracer.Start(ctx, "DataStore.mutate", internals.QueueAttributes(namespace, queueName))
+	var changed bool
+	err = d.replicator.Replicate(ctx, shardId, func() (*proto.ReplicateRequest, error) {
+		request, err := apply()
+		if request != nil {
+			request.Config = hosted.config()
+			span.SetAttributes(attribute.String("kokaq.op", request.Op.String()))
+			changed = true
+		}
+		return request, err
+	})
+	internals.EndSpan(span, err)
+	if changed {
+		hosted.notify()
+	}
+	return err
+}
 
-// func (d *DataPlane) AutoMoveToDLQ(c context.Context, p *proto.AutoMoveToDLQRequest) (*proto.EmptyResponse, error) {
-// 	panic("unimplemented")
-// }
+// reclaimExpired puts messages whose lock ran out back on the heap, counting
+// the lapsed lock as a failed delivery.
+func (d *DataPlane) reclaimExpired(ctx context.Context, namespace string, queueName string, q *queue.Queue, hosted *hostedQueue) {
+	for _, lockId := range hosted.locks.Expired(time.Now()) {
+		err := d.mutate(ctx, namespace, queueName, func() (*proto.ReplicateRequest, error) {
+			lock, exist := hosted.locks.Remove(lockId)
+			if !exist {
+				return nil, nil
+			}
+			deadLettered, err := hosted.nack(q, lock, proto.FailureReason_VISIBILITY_TIMEOUT_EXCEEDED)
+			hosted.counters.record(statNacked, 1)
+			if deadLettered {
+				hosted.counters.record(statDeadLettered, 1)
+			}
+			return &proto.ReplicateRequest{
+				Namespace:     namespace,
+				Queue:         queueName,
+				Op:            proto.ReplicationOp_REPLICATION_OP_NACK,
+				LockId:        lockId,
+				MessageIds:    []string{lock.messageId.String()},
+				FailureReason: proto.FailureReason_VISIBILITY_TIMEOUT_EXCEEDED,
+			}, err
+		})
+		if err != nil {
+			logger.ConsoleLog("WARN", "Failed to reclaim expired lock %s: %v", lockId, err)
+		}
+	}
+}
 
-// func (d *DataPlane) PeekDLQ(c context.Context, p *proto.QueueIdRequest) (*proto.QueueItemsResponse, error) {
-// 	panic("unimplemented")
-// }
+// promoteDue moves scheduled messages whose delivery time has come onto the
+// heap. Followers promote exactly the messages the leader did, so clock skew
+// between nodes cannot make them disagree.
+func (d *DataPlane) promoteDue(ctx context.Context, namespace string, queueName string, q *queue.Queue, hosted *hostedQueue) {
+	due := hosted.due(time.Now())
+	if len(due) == 0 {
+		return
+	}
+	err := d.mutate(ctx, namespace, queueName, func() (*proto.ReplicateRequest, error) {
+		promoted := make([]string, 0, len(due))
+		for _, mId := range due {
+			moved, err := hosted.promote(q, mId)
+			if err != nil {
+				logger.ConsoleLog("WARN", "Failed to promote scheduled message %s: %v", mId, err)
+				break
+			}
+			if moved {
+				promoted = append(promoted, mId.String())
+			}
+		}
+		if len(promoted) == 0 {
+			return nil, nil
+		}
+		return &proto.ReplicateRequest{
+			Namespace:  namespace,
+			Queue:      queueName,
+			Op:         proto.ReplicationOp_REPLICATION_OP_PROMOTE,
+			MessageIds: promoted,
+		}, nil
+	})
+	if err != nil {
+		logger.ConsoleLog("WARN", "Failed to promote scheduled messages: %v", err)
+	}
+}
 
-// func (d *DataPlane) DequeueDLQ(c context.Context, p *proto.QueueIdRequest) (*proto.QueueItemResponse, error) {
-// 	panic("unimplemented")
-// }
+// reap expires messages on the queues this node leads, every reapInterval
+// until the plane is closed. Followers expire what their leader replicates.
+// Lapsed deduplication keys are pruned on every hosted queue, and out of sync
+// followers of the shards led here are sent a snapshot.
+func (d *DataPlane) reap() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+		d.replicator.Resync()
+		for shardId, hosted := range d.store.hostedQueues() {
+			if err := hosted.dedup.Prune(time.Now()); err != nil {
+				logger.ConsoleLog("WARN", "Failed to prune deduplication keys: %v", err)
+			}
+			if d.replicator.Leads(shardId) {
+				policy := hosted.policy()
+				d.expireDue(context.Background(), policy.Namespace, policy.Queue, hosted)
+			}
+		}
+	}
+}
 
-// func (d *DataPlane) MoveFromDLQ(c context.Context, p *proto.MoveToDLQRequest) (*proto.EmptyResponse, error) {
-// 	panic("unimplemented")
-// }
+// expireDue drops or dead-letters the messages whose time to live has run
+// out, counting them and reporting them as telemetry.
+func (d *DataPlane) expireDue(ctx context.Context, namespace string, queueName string, hosted *hostedQueue) {
+	if len(hosted.expirable(time.Now())) == 0 {
+		return
+	}
+	var expired, deadLettered uint64
+	err := d.mutate(ctx, namespace, queueName, func() (*proto.ReplicateRequest, error) {
+		// Listed again under the shard lock, since a consumer may have locked
+		// some of them meanwhile
+		messageIds := make([]string, 0)
+		for _, mId := range hosted.expirable(time.Now()) {
+			found, toDeadLetter, err := hosted.expire(mId)
+			if err != nil {
+				logger.ConsoleLog("WARN", "Failed to expire message %s: %v", mId, err)
+				break
+			}
+			if !found {
+				continue
+			}
+			messageIds = append(messageIds, mId.String())
+			expired++
+			if toDeadLetter {
+				deadLettered++
+			}
+		}
+		if len(messageIds) == 0 {
+			return nil, nil
+		}
+		return &proto.ReplicateRequest{
+			Namespace:  namespace,
+			Queue:      queueName,
+			Op:         proto.ReplicationOp_REPLICATION_OP_EXPIRE,
+			MessageIds: messageIds,
+		}, nil
+	})
+	if err != nil {
+		logger.ConsoleLog("WARN", "Failed to expire messages: %v", err)
+	}
+	if expired == 0 {
+		return
+	}
+	logger.ConsoleLog("INFO", "Expired %d messages: Namespace=%s, Queue=%s, DeadLettered=%d", expired, namespace, queueName, deadLettered)
+	hosted.counters.record(statExpired, expired)
+	hosted.counters.record(statDeadLettered, deadLettered)
+	if d.telemetry != nil {
+		d.telemetry.LogEvent(internals.EventMessagesExpired, map[string]interface{}{
+			"namespace":     namespace,
+			"queue":         queueName,
+			"expired":       expired,
+			"dead_lettered": deadLettered,
+		})
+	}
+}
 
-// func (d *DataPlane) ClearDLQ(c context.Context, p *proto.QueueIdRequest) (*proto.EmptyResponse, error) {
-// 	panic("unimplemented")
-// }
+// expireRequest replicates the messages a consumer found expired on top of
+// the heap, or is nil when there were none. Dequeues and locks carry them
+// along instead, in MessageIds, for followers to expire first.
+func expireRequest(namespace string, queueName string, messageIds []string) *proto.ReplicateRequest {
+	if len(messageIds) == 0 {
+		return nil
+	}
+	return &proto.ReplicateRequest{
+		Namespace:  namespace,
+		Queue:      queueName,
+		Op:         proto.ReplicationOp_REPLICATION_OP_EXPIRE,
+		MessageIds: messageIds,
+	}
+}
 
-// func (d *DataPlane) ListMessages(c context.Context, p *proto.QueueIdRequest) (*proto.QueueItemsResponse, error) {
-// 	panic("unimplemented")
-// }
+// expireAll applies the expiry of messages on a follower.
+func expireAll(hosted *hostedQueue, messageIds []string) error {
+	for _, messageId := range messageIds {
+		mId, err := messageKey(messageId)
+		if err != nil {
+			return err
+		}
+		if _, _, err := hosted.expire(mId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-// func (d *DataPlane) ListLockedMessages(c context.Context, p *proto.QueueIdRequest) (*proto.QueueItemsResponse, error) {
-// 	panic("unimplemented")
-// }
+// deliveryTime settles when a new message becomes visible. A delay becomes a
+// deliver_at so followers and restarts see the same time, and a deliver_at
+// that has already passed is dropped so the message goes straight onto the
+// heap.
+func deliveryTime(message *proto.KokaqMessageRequest, now time.Time) time.Time {
+	visibleAt := now.Add(time.Duration(message.DelayMs) * time.Millisecond)
+	if message.DeliverAt != nil {
+		visibleAt = message.DeliverAt.AsTime()
+	}
+	message.DelayMs = 0
+	message.DeliverAt = nil
+	if !visibleAt.After(now) {
+		return now
+	}
+	message.DeliverAt = timestamppb.New(visibleAt)
+	return visibleAt
+}
 
-// func (d *DataPlane) ListDLQMessages(c context.Context, p *proto.QueueIdRequest) (*proto.QueueItemsResponse, error) {
-// 	panic("unimplemented")
-// }
+// enqueueMessage persists the body before the heap entry so a visible item
+// always has one, and drops the body again when the heap rejects the item.
+func enqueueMessage(q *queue.Queue, messages *MessageStore, mId uuid.UUID, message *proto.KokaqMessageResponse) error {
+	if err := messages.Put(mId, message); err != nil {
+		return err
+	}
+	if err := q.Enqueue(&queue.QueueItem{MessageId: mId, Priority: message.GetMessage().GetPriority()}); err != nil {
+		messages.Delete(mId)
+		return err
+	}
+	return nil
+}
+
+// messageKey maps a message id onto the uuid the heap stores. An empty id gets
+// a fresh uuid, a uuid is used as-is and any other client supplied id is hashed
+// into a stable uuid so the original string can be kept on the message body.
+func messageKey(messageId string) (uuid.UUID, error) {
+	if messageId == "" {
+		return uuid.New(), nil
+	}
+	if len(messageId) > 256 {
+		return uuid.Nil, fmt.Errorf("message id longer than 256 characters")
+	}
+	if id, err := uuid.Parse(messageId); err == nil {
+		return id, nil
+	}
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(messageId)), nil
+}
+
+// batchCount is how many messages a Dequeue or PeekLock asking for count
+// hands out: at least one and at most maxBatch.
+func batchCount(count uint32) int {
+	return int(min(max(count, 1), maxBatch))
+}
+
+func checkLockBatch(lockIds []string) error {
+	if len(lockIds) == 0 || len(lockIds) > maxBatch {
+		return status.Errorf(codes.InvalidArgument, "a batch carries 1 to %d lock ids", maxBatch)
+	}
+	return nil
+}
+
+// lockResult reports how one lock of a batch call fared.
+func lockResult(lockId string, err error) *proto.LockResult {
+	if err != nil {
+		s := status.Convert(err)
+		return &proto.LockResult{LockId: lockId, Code: uint32(s.Code()), Error: s.Message()}
+	}
+	return &proto.LockResult{LockId: lockId, Success: true}
+}
+
+func messageIds(messages []*proto.KokaqMessageResponse) []string {
+	ids := make([]string, 0, len(messages))
+	for _, message := range messages {
+		ids = append(ids, message.GetMessage().GetMessageId())
+	}
+	return ids
+}
+
+// loadMessage returns the stored body for a heap item, falling back to the id
+// and priority carried by the heap itself when no body was persisted.
+func loadMessage(store *MessageStore, qi *queue.QueueItem) *proto.KokaqMessageResponse {
+	message, err := store.Get(qi.MessageId)
+	if err != nil {
+		logger.ConsoleLog("WARN", "Message body not found for %s: %v", qi.MessageId, err)
+		return &proto.KokaqMessageResponse{
+			Message: &proto.KokaqMessageRequest{
+				MessageId: qi.MessageId.String(),
+				Priority:  qi.Priority,
+			},
+		}
+	}
+	return message
+}
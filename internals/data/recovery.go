@@ -0,0 +1,131 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/kokaq/core/internals/logger"
+	"github.com/kokaq/core/queue"
+	"github.com/kokaq/core/utils"
+)
+
+const queueManifestFile = "queue.json"
+
+// queueManifest is written next to every queue so a restarted data node can
+// rebuild its name indexes by scanning RootDir.
+type queueManifest struct {
+	Namespace         string `json:"namespace"`
+	Queue             string `json:"queue"`
+	ShardId           uint64 `json:"shardId"`
+	EnableDeadLetter  bool   `json:"enableDeadLetter"`
+	MaxDeliveryCount  uint32 `json:"maxDeliveryCount"`
+	VisibilityTimeout uint32 `json:"visibilityTimeout"`
+	DefaultTTL        uint32 `json:"defaultTtlMs,omitempty"`
+	DeadLetterExpired bool   `json:"deadLetterExpired,omitempty"`
+	DedupWindow       uint32 `json:"deduplicationWindowMs,omitempty"`
+}
+
+func writeQueueManifest(queueDirectory string, manifest *queueManifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to encode queue manifest: %w", err)
+	}
+	path := filepath.Join(queueDirectory, queueManifestFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write queue manifest %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to commit queue manifest %s: %w", path, err)
+	}
+	return nil
+}
+
+func readQueueManifest(path string) (*queueManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue manifest %s: %w", path, err)
+	}
+	manifest := &queueManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode queue manifest %s: %w", path, err)
+	}
+	return manifest, nil
+}
+
+// recoverQueues reloads every queue found under rootDir, laid out as
+// <rootDir>/<namespaceId>/<namespace>-<namespaceId>/<queueId>/queue.json.
+// Queues with unreadable manifests are skipped and logged so one bad queue
+// cannot keep the node from serving the rest.
+func (store *DataStore) recoverQueues(rootDir string) error {
+	paths, err := filepath.Glob(filepath.Join(rootDir, "*", "*", "*", queueManifestFile))
+	if err != nil {
+		return fmt.Errorf("failed to scan root directory %s: %w", rootDir, err)
+	}
+	for _, path := range paths {
+		manifest, err := readQueueManifest(path)
+		if err != nil {
+			logger.ConsoleLog("ERROR", "Recover - skipping queue: %v", err)
+			continue
+		}
+		// The heap only flushes a page when it moves to another one, so its files
+		// cannot be trusted after a crash. Message bodies are written atomically
+		// and carry everything needed to rebuild it, so start from an empty heap.
+		queueDir := filepath.Dir(path)
+		if err := utils.EnsureDirectoryDeleted(filepath.Join(queueDir, "main")); err != nil {
+			logger.ConsoleLog("ERROR", "Recover - skipping queue %s/%s: %v", manifest.Namespace, manifest.Queue, err)
+			continue
+		}
+		namespaceId, queueId := splitShard(manifest.ShardId)
+		store.initializeNamespaceIfNotExists(manifest.Namespace, namespaceId, rootDir)
+		q, err := store.Namespaces[namespaceId].LoadQueue(&queue.QueueConfiguration{
+			QueueId:   queueId,
+			QueueName: manifest.Queue,
+			EnableDLQ: manifest.EnableDeadLetter,
+		})
+		if err != nil {
+			logger.ConsoleLog("ERROR", "Recover - failed to load queue %s/%s: %v", manifest.Namespace, manifest.Queue, err)
+			continue
+		}
+		hosted, err := openHostedQueue(q.RootDir, manifest)
+		if err != nil {
+			logger.ConsoleLog("ERROR", "Recover - failed to load messages for %s/%s: %v", manifest.Namespace, manifest.Queue, err)
+			continue
+		}
+		count, err := rebuildHeap(q, hosted.messages)
+		if err != nil {
+			logger.ConsoleLog("ERROR", "Recover - failed to rebuild %s/%s: %v", manifest.Namespace, manifest.Queue, err)
+			continue
+		}
+		store.Queues[manifest.ShardId] = hosted
+		store.ShardIdIndex[manifest.Namespace][manifest.Queue] = manifest.ShardId
+		logger.ConsoleLog("INFO", "Recovered queue: Namespace=%s, Queue=%s, ShardId=%x, Messages=%d", manifest.Namespace, manifest.Queue, manifest.ShardId, count)
+	}
+	return nil
+}
+
+// rebuildHeap re-enqueues every stored message in the order it was created so
+// messages of equal priority keep their FIFO order. Locks are not persisted,
+// so messages that were locked before the restart become visible again.
+func rebuildHeap(q *queue.Queue, messages *MessageStore) (int, error) {
+	stored, err := messages.List()
+	if err != nil {
+		return 0, err
+	}
+	sort.SliceStable(stored, func(i, j int) bool {
+		return stored[i].GetCreatedOn().AsTime().Before(stored[j].GetCreatedOn().AsTime())
+	})
+	for _, message := range stored {
+		mId, err := messageKey(message.GetMessage().GetMessageId())
+		if err != nil {
+			return 0, err
+		}
+		if err := q.Enqueue(&queue.QueueItem{MessageId: mId, Priority: message.GetMessage().GetPriority()}); err != nil {
+			return 0, err
+		}
+	}
+	return len(stored), nil
+}
@@ -0,0 +1,556 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kokaq/core/internals/logger"
+	"github.com/kokaq/protocol/proto"
+	"github.com/kokaq/server/internals"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AckMode decides when a leader acknowledges a mutation to the client.
+type AckMode int
+
+const (
+	// AckLeader acknowledges once the leader applied the mutation and ships it
+	// to followers in the background.
+	AckLeader AckMode = iota
+	// AckQuorum waits until a majority of the shard's replicas, counting the
+	// leader, applied the mutation.
+	AckQuorum
+)
+
+const (
+	replicaBufferSize     = 1024
+	replicaRetries        = 3
+	replicaRetryDelay     = 200 * time.Millisecond
+	replicaRequestTimeout = 5 * time.Second
+	replicaQuorumTimeout  = 10 * time.Second
+)
+
+// leaderLease is how long a node keeps leading its shards after asking the
+// shard manager for its assignments without hearing back. It stays below the
+// time the shard manager waits before it fails the shards of a silent node
+// over, so a leader cut off from it stops taking writes before another node
+// takes over.
+const leaderLease = 8 * time.Second
+
+func ParseAckMode(mode string) (AckMode, error) {
+	switch strings.ToLower(mode) {
+	case "", "leader":
+		return AckLeader, nil
+	case "quorum":
+		return AckQuorum, nil
+	}
+	return AckLeader, fmt.Errorf("unknown replication ack mode %q, expected leader or quorum", mode)
+}
+
+func (m AckMode) String() string {
+	if m == AckQuorum {
+		return "quorum"
+	}
+	return "leader"
+}
+
+// Replicator streams queue mutations of the shards this node leads to the
+// followers picked by the shard manager, and tracks what it has applied of
+// the shards it follows. A follower that misses a mutation, whether it was
+// dropped, failed or came in out of order, is out of sync: it refuses further
+// mutations until its leader sent it a snapshot of the queue, and the shard
+// manager does not promote it meanwhile.
+type Replicator struct {
+	mutex     sync.Mutex
+	mode      AckMode
+	leading   map[uint64]*leaderShard
+	following map[uint64]*followerShard
+	// assigned holds the shards this node leads: those the shard manager
+	// assigned it, and those created here since.
+	assigned map[uint64]bool
+	// claimed holds when the queues created here were, until assignments
+	// from the shard manager cover them. Each claim is a lease of its own,
+	// since the shard manager asked for the queue at that time.
+	claimed map[uint64]time.Time
+	// lease is when the assignments last heard of lapse.
+	lease time.Time
+	peers map[string]*replicaPeer
+	// snapshot captures a led shard for its out of sync followers, or
+	// returns nil once its queue is gone.
+	snapshot func(shardId uint64) (*proto.ReplicateRequest, error)
+}
+
+type leaderShard struct {
+	id        uint64
+	mutex     sync.Mutex
+	seq       uint64
+	followers []string
+	// synced and resyncing track, by follower, those that applied everything
+	// queued to them so far and those with a snapshot on the way. They have
+	// their own lock, since deliveries settle while Replicate holds the shard
+	// lock waiting on a full buffer.
+	syncMutex sync.Mutex
+	synced    map[string]bool
+	resyncing map[string]bool
+}
+
+type followerShard struct {
+	mutex   sync.Mutex
+	lastSeq uint64
+	// synced is set by a snapshot and cleared by a missed mutation.
+	synced atomic.Bool
+}
+
+// replicaPeer sends entries to one follower, in order, over a single
+// connection.
+type replicaPeer struct {
+	address string
+	conn    *grpc.ClientConn
+	client  proto.KokaqDataPlaneClient
+	entries chan *replicaEntry
+	stop    chan struct{}
+}
+
+type replicaEntry struct {
+	request *proto.ReplicateRequest
+	shard   *leaderShard
+	done    chan error
+}
+
+func NewReplicator(mode AckMode, snapshot func(shardId uint64) (*proto.ReplicateRequest, error)) *Replicator {
+	return &Replicator{
+		mode:      mode,
+		leading:   make(map[uint64]*leaderShard),
+		following: make(map[uint64]*followerShard),
+		assigned:  make(map[uint64]bool),
+		claimed:   make(map[uint64]time.Time),
+		peers:     make(map[string]*replicaPeer),
+		snapshot:  snapshot,
+	}
+}
+
+// SetAssignments replaces the follower sets of the shards led by this node
+// with the ones reported by the shard manager in answer to a request sent at
+// requestedAt, which also renews the lease on them. Shards missing from
+// assignments are no longer led, unless their queue was created here after
+// the request, and peers nobody uses are closed.
+func (r *Replicator) SetAssignments(assignments []*proto.ShardAssignment, requestedAt time.Time) {
+	r.mutex.Lock()
+	assigned := make(map[uint64][]string, len(assignments))
+	used := make(map[string]bool)
+	for _, assignment := range assignments {
+		assigned[assignment.ShardId] = assignment.Followers
+		for _, follower := range assignment.Followers {
+			used[follower] = true
+		}
+	}
+	for address := range used {
+		if _, exist := r.peers[address]; exist {
+			continue
+		}
+		peer, err := newReplicaPeer(address)
+		if err != nil {
+			logger.ConsoleLog("ERROR", "Failed to connect to follower %s: %v", address, err)
+			continue
+		}
+		r.peers[address] = peer
+	}
+	for address, peer := range r.peers {
+		if !used[address] {
+			peer.close()
+			delete(r.peers, address)
+		}
+	}
+	shards := make(map[*leaderShard][]string, len(r.leading))
+	r.lease = requestedAt.Add(leaderLease)
+	r.assigned = make(map[uint64]bool, len(assigned))
+	for shardId := range assigned {
+		r.leaderShard(shardId)
+		r.assigned[shardId] = true
+		delete(r.following, shardId)
+	}
+	for shardId, claimedAt := range r.claimed {
+		if _, covered := assigned[shardId]; covered || claimedAt.Before(requestedAt) {
+			delete(r.claimed, shardId)
+			continue
+		}
+		r.assigned[shardId] = true
+	}
+	for shardId, shard := range r.leading {
+		shards[shard] = assigned[shardId]
+	}
+	r.mutex.Unlock()
+
+	// Replicate takes the shard lock before the replicator lock, so shard
+	// locks are only taken here once the replicator lock is released
+	for shard, followers := range shards {
+		shard.mutex.Lock()
+		shard.followers = followers
+		shard.mutex.Unlock()
+	}
+}
+
+// Replicate applies a mutation of shardId locally and ships the request
+// returned by apply to the shard's followers. The shard lock is held while
+// applying and queueing, so followers see mutations in the order the leader
+// applied them. Out of sync followers get a snapshot taken after the mutation
+// instead. In quorum mode an error is returned when too few followers
+// confirmed in time; the mutation is then applied on the leader but may be
+// lost if the leader's disk is.
+func (r *Replicator) Replicate(ctx context.Context, shardId uint64, apply func() (*proto.ReplicateRequest, error)) error {
+	r.mutex.Lock()
+	shard := r.leaderShard(shardId)
+	r.mutex.Unlock()
+
+	shard.mutex.Lock()
+	request, err := apply()
+	if err != nil || request == nil {
+		shard.mutex.Unlock()
+		return err
+	}
+	shard.seq++
+	request.ShardId = shardId
+	request.Seq = shard.seq
+	results := make(chan error, len(shard.followers))
+	for _, follower := range shard.followers {
+		r.mutex.Lock()
+		peer, exist := r.peers[follower]
+		r.mutex.Unlock()
+		if !exist {
+			err := fmt.Errorf("no connection to follower %s", follower)
+			shard.settle(follower, request, err)
+			results <- err
+			continue
+		}
+		entry, resync := r.resyncEntry(shard, follower, results)
+		if !resync {
+			entry = &replicaEntry{request: request, shard: shard, done: results}
+		}
+		if r.mode == AckQuorum {
+			select {
+			case peer.entries <- entry:
+			case <-peer.stop:
+				err := fmt.Errorf("follower %s was removed", follower)
+				shard.settle(follower, entry.request, err)
+				results <- err
+			}
+			continue
+		}
+		select {
+		case peer.entries <- entry:
+		default:
+			logger.ConsoleLog("WARN", "Replication buffer to %s full, dropping seq=%d of shardId=%x", follower, request.Seq, shardId)
+			shard.settle(follower, entry.request, fmt.Errorf("replication buffer to %s full", follower))
+		}
+	}
+	followers := len(shard.followers)
+	shard.mutex.Unlock()
+
+	if r.mode != AckQuorum {
+		return nil
+	}
+	// A majority of leader plus followers, the leader already counted
+	needed := (1 + followers) / 2
+	timeout := time.After(replicaQuorumTimeout)
+	for acked, failed := 0, 0; acked < needed; {
+		select {
+		case err := <-results:
+			if err != nil {
+				failed++
+				if followers-failed < needed {
+					return fmt.Errorf("replication quorum not reached for shardId=%x: %v", shardId, err)
+				}
+				continue
+			}
+			acked++
+		case <-timeout:
+			return fmt.Errorf("replication quorum not reached for shardId=%x: timed out", shardId)
+		case <-ctx.Done():
+			return fmt.Errorf("replication quorum not reached for shardId=%x: %v", shardId, ctx.Err())
+		}
+	}
+	return nil
+}
+
+// Resync sends a snapshot to the out of sync followers of the shards this
+// node leads that have none on the way, so followers of idle shards catch up
+// too.
+func (r *Replicator) Resync() {
+	r.mutex.Lock()
+	shards := make([]*leaderShard, 0, len(r.assigned))
+	for shardId := range r.assigned {
+		shards = append(shards, r.leaderShard(shardId))
+	}
+	r.mutex.Unlock()
+
+	for _, shard := range shards {
+		shard.mutex.Lock()
+		for _, follower := range shard.followers {
+			r.mutex.Lock()
+			peer, exist := r.peers[follower]
+			r.mutex.Unlock()
+			if !exist {
+				continue
+			}
+			entry, resync := r.resyncEntry(shard, follower, nil)
+			if !resync {
+				continue
+			}
+			select {
+			case peer.entries <- entry:
+			default:
+				shard.settle(follower, entry.request, fmt.Errorf("replication buffer to %s full", follower))
+			}
+		}
+		shard.mutex.Unlock()
+	}
+}
+
+// resyncEntry returns a snapshot of the shard for follower when it is out of
+// sync and has none on the way. The snapshot carries the sequence number of
+// the last mutation applied, so the follower carries on from there. Callers
+// hold the shard lock.
+func (r *Replicator) resyncEntry(shard *leaderShard, follower string, done chan error) (*replicaEntry, bool) {
+	if !shard.startResync(follower) {
+		return nil, false
+	}
+	snapshot, err := r.snapshot(shard.id)
+	if err != nil || snapshot == nil {
+		if err != nil {
+			logger.ConsoleLog("ERROR", "Failed to snapshot shardId=%x for %s: %v", shard.id, follower, err)
+		}
+		shard.abortResync(follower)
+		return nil, false
+	}
+	snapshot.ShardId = shard.id
+	snapshot.Seq = shard.seq
+	return &replicaEntry{request: snapshot, shard: shard, done: done}, true
+}
+
+// Follow serializes replicated mutations of one shard on a follower. apply
+// is skipped for sequence numbers already seen, which happens when the
+// leader retries a request whose response was lost. A mutation that does not
+// follow the last one applied, or that fails to apply, leaves the follower
+// out of sync until a snapshot; deletes are applied regardless.
+func (r *Replicator) Follow(request *proto.ReplicateRequest, apply func() error) (uint64, error) {
+	r.mutex.Lock()
+	shard, exist := r.following[request.ShardId]
+	if !exist {
+		shard = &followerShard{}
+		r.following[request.ShardId] = shard
+	}
+	r.mutex.Unlock()
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if request.Seq <= shard.lastSeq {
+		return shard.lastSeq, nil
+	}
+	switch request.Op {
+	case proto.ReplicationOp_REPLICATION_OP_SNAPSHOT, proto.ReplicationOp_REPLICATION_OP_DELETE:
+	default:
+		if !shard.synced.Load() || request.Seq != shard.lastSeq+1 {
+			if shard.synced.Swap(false) {
+				logger.ConsoleLog("WARN", "Replication gap on shardId=%x: expected seq=%d, got seq=%d", request.ShardId, shard.lastSeq+1, request.Seq)
+			}
+			return shard.lastSeq, status.Errorf(codes.FailedPrecondition, "shardId=%x is out of sync at seq=%d", request.ShardId, shard.lastSeq)
+		}
+	}
+	if err := apply(); err != nil {
+		// What a failed mutation left behind is unknown
+		shard.synced.Store(false)
+		return shard.lastSeq, err
+	}
+	shard.lastSeq = request.Seq
+	if request.Op == proto.ReplicationOp_REPLICATION_OP_SNAPSHOT {
+		shard.synced.Store(true)
+	}
+	return shard.lastSeq, nil
+}
+
+// Synced lists the shards this node follows and is in sync with.
+func (r *Replicator) Synced() []uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	synced := make([]uint64, 0, len(r.following))
+	for shardId, shard := range r.following {
+		if shard.synced.Load() {
+			synced = append(synced, shardId)
+		}
+	}
+	return synced
+}
+
+// Claim makes this node lead shardId, whose queue it has just created at the
+// request of the shard manager, before the next assignments confirm it.
+func (r *Replicator) Claim(shardId uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.assigned[shardId] = true
+	r.claimed[shardId] = time.Now()
+	delete(r.following, shardId)
+}
+
+// Leads reports whether this node leads shardId. It stops doing so when the
+// lease of its last assignments, or of its claim on the shard, lapses without
+// word from the shard manager; a node that cannot reach the shard manager,
+// standalone ones included, takes writes for leaderLease at most.
+func (r *Replicator) Leads(shardId uint64) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.assigned[shardId] {
+		return false
+	}
+	now := time.Now()
+	if claimedAt, claimed := r.claimed[shardId]; claimed && now.Before(claimedAt.Add(leaderLease)) {
+		return true
+	}
+	return now.Before(r.lease)
+}
+
+func (r *Replicator) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for address, peer := range r.peers {
+		peer.close()
+		delete(r.peers, address)
+	}
+}
+
+func (r *Replicator) leaderShard(shardId uint64) *leaderShard {
+	shard, exist := r.leading[shardId]
+	if !exist {
+		// Start from the clock so a restarted or newly promoted leader never
+		// reuses sequence numbers its followers have already seen
+		shard = &leaderShard{
+			id:        shardId,
+			seq:       uint64(time.Now().UnixNano()),
+			synced:    make(map[string]bool),
+			resyncing: make(map[string]bool),
+		}
+		r.leading[shardId] = shard
+	}
+	return shard
+}
+
+// startResync reports whether follower needs a snapshot, and if so counts
+// one as on the way.
+func (s *leaderShard) startResync(follower string) bool {
+	s.syncMutex.Lock()
+	defer s.syncMutex.Unlock()
+	if s.synced[follower] || s.resyncing[follower] {
+		return false
+	}
+	s.resyncing[follower] = true
+	return true
+}
+
+// lagging reports whether request is a mutation follower cannot apply, being
+// out of sync. Snapshots and deletes are applied regardless.
+func (s *leaderShard) lagging(follower string, request *proto.ReplicateRequest) bool {
+	switch request.Op {
+	case proto.ReplicationOp_REPLICATION_OP_SNAPSHOT, proto.ReplicationOp_REPLICATION_OP_DELETE:
+		return false
+	}
+	s.syncMutex.Lock()
+	defer s.syncMutex.Unlock()
+	return !s.synced[follower]
+}
+
+func (s *leaderShard) abortResync(follower string) {
+	s.syncMutex.Lock()
+	defer s.syncMutex.Unlock()
+	delete(s.resyncing, follower)
+}
+
+// settle records the outcome of shipping request to follower: a follower
+// missing a request is out of sync, one that applied a snapshot is in sync.
+func (s *leaderShard) settle(follower string, request *proto.ReplicateRequest, err error) {
+	s.syncMutex.Lock()
+	defer s.syncMutex.Unlock()
+	snapshot := request.Op == proto.ReplicationOp_REPLICATION_OP_SNAPSHOT
+	if snapshot {
+		delete(s.resyncing, follower)
+	}
+	if err != nil {
+		if s.synced[follower] {
+			logger.ConsoleLog("WARN", "Follower %s of shardId=%x missed seq=%d, resyncing: %v", follower, s.id, request.Seq, err)
+		}
+		delete(s.synced, follower)
+		return
+	}
+	if snapshot {
+		s.synced[follower] = true
+	}
+}
+
+func newReplicaPeer(address string) (*replicaPeer, error) {
+	conn, err := grpc.NewClient(address, internals.DialOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	peer := &replicaPeer{
+		address: address,
+		conn:    conn,
+		client:  proto.NewKokaqDataPlaneClient(conn),
+		entries: make(chan *replicaEntry, replicaBufferSize),
+		stop:    make(chan struct{}),
+	}
+	go peer.run()
+	return peer, nil
+}
+
+func (p *replicaPeer) run() {
+	for {
+		select {
+		case entry := <-p.entries:
+			var err error
+			if entry.shard.lagging(p.address, entry.request) {
+				// The follower would refuse it until its snapshot
+				err = fmt.Errorf("follower %s is out of sync", p.address)
+			} else {
+				err = p.send(entry.request)
+			}
+			entry.shard.settle(p.address, entry.request, err)
+			if entry.done != nil {
+				entry.done <- err
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *replicaPeer) send(request *proto.ReplicateRequest) error {
+	var err error
+	for attempt := 1; attempt <= replicaRetries; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), replicaRequestTimeout)
+		var res *proto.ReplicateResponse
+		res, err = p.client.Replicate(ctx, request)
+		cancel()
+		if err == nil && res.Applied {
+			return nil
+		}
+		if err == nil {
+			err = fmt.Errorf("follower %s did not apply seq=%d", p.address, request.Seq)
+		}
+		select {
+		case <-time.After(replicaRetryDelay):
+		case <-p.stop:
+			return err
+		}
+	}
+	logger.ConsoleLog("ERROR", "Replication of seq=%d for shardId=%x to %s failed: %v", request.Seq, request.ShardId, p.address, err)
+	return err
+}
+
+func (p *replicaPeer) close() {
+	close(p.stop)
+	p.conn.Close()
+}
@@ -0,0 +1,61 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kokaq/protocol/proto"
+)
+
+func TestReplicatorLeads(t *testing.T) {
+	const assignedShard, claimedShard, otherShard = 1, 2, 3
+	tests := []struct {
+		name       string
+		assignedAt time.Time
+		claimedAt  time.Time
+		want       map[uint64]bool
+	}{
+		{
+			name:       "fresh assignments",
+			assignedAt: time.Now(),
+			want:       map[uint64]bool{assignedShard: true, claimedShard: false, otherShard: false},
+		},
+		{
+			name:       "lapsed assignments",
+			assignedAt: time.Now().Add(-leaderLease),
+			want:       map[uint64]bool{assignedShard: false, claimedShard: false, otherShard: false},
+		},
+		{
+			name:       "fresh claim, lapsed assignments",
+			assignedAt: time.Now().Add(-leaderLease),
+			claimedAt:  time.Now(),
+			want:       map[uint64]bool{assignedShard: false, claimedShard: true, otherShard: false},
+		},
+		{
+			name:       "lapsed claim, fresh assignments",
+			assignedAt: time.Now(),
+			claimedAt:  time.Now().Add(-leaderLease),
+			want:       map[uint64]bool{assignedShard: true, claimedShard: true, otherShard: false},
+		},
+		{
+			name:       "lapsed claim and assignments",
+			assignedAt: time.Now().Add(-2 * leaderLease),
+			claimedAt:  time.Now().Add(-leaderLease),
+			want:       map[uint64]bool{assignedShard: false, claimedShard: false, otherShard: false},
+		},
+	}
+	for _, tt := range tests {
+		r := NewReplicator(AckLeader, nil)
+		r.SetAssignments([]*proto.ShardAssignment{{ShardId: assignedShard}}, tt.assignedAt)
+		if !tt.claimedAt.IsZero() {
+			r.Claim(claimedShard)
+			r.claimed[claimedShard] = tt.claimedAt
+		}
+		for shardId, want := range tt.want {
+			if got := r.Leads(shardId); got != want {
+				t.Errorf("%s: Leads(%d) = %v; want %v", tt.name, shardId, got, want)
+			}
+		}
+		r.Close()
+	}
+}
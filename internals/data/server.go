@@ -11,31 +11,44 @@ import (
 	"github.com/kokaq/protocol/proto"
 	"github.com/kokaq/server/internals"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 type DataServer struct {
-	server *internals.KokaqServer
+	server    *internals.KokaqServer
+	plane     *DataPlane
+	telemetry internals.TelemetryLogger
 }
 
 type DataServerConfig struct {
 	RootDirectory string
 	Address       string
+	AckMode       AckMode
 }
 
-func NewDataServer(telemetryLogger internals.TelemetryLogger, requestTimeout time.Duration) (*DataServer, error) {
+func NewDataServer(telemetryLogger internals.TelemetryLogger, requestTimeout time.Duration, options ...internals.ServerOption) (*DataServer, error) {
+	ds := &DataServer{telemetry: telemetryLogger}
 	cleanup := func() {
 		logger.ConsoleLog("INFO", "data server cleanup called")
+		if ds.plane != nil {
+			ds.plane.Close()
+		}
 	}
-	kokaqServer, err := internals.NewKokaqServer(cleanup, telemetryLogger, requestTimeout)
-	return &DataServer{
-		server: kokaqServer,
-	}, err
+	kokaqServer, err := internals.NewKokaqServer(cleanup, telemetryLogger, requestTimeout, options...)
+	ds.server = kokaqServer
+	return ds, err
 }
 
 func (ds *DataServer) Start(config DataServerConfig) error {
+	srv, err := NewDataPlane(config.RootDirectory, config.AckMode, ds.telemetry)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "Failed to load data plane from %s: %v", config.RootDirectory, err)
+		return err
+	}
+	ds.plane = srv
+	if err := ds.server.RegisterMetrics(&metricsCollector{store: srv.store}); err != nil {
+		return err
+	}
 	register := func(server *grpc.Server) {
-		srv, _ := NewDataPlane(config.RootDirectory)
 		proto.RegisterKokaqDataPlaneServer(server, srv)
 	}
 	ds.server.Start(config.Address, register)
@@ -47,18 +60,41 @@ func (ds *DataServer) Stop(ctx context.Context) error {
 	return nil
 }
 
-func StartNode(rootDirectory string, address string) {
-	telemetryLogger := &DummyTelemetryLogger{}
-	requestTimeout := 15 * time.Second
+// Inventory lists the queues hosted by this node, or nothing before Start.
+func (ds *DataServer) Inventory() []*proto.ShardItem {
+	if ds.plane == nil {
+		return make([]*proto.ShardItem, 0)
+	}
+	return ds.plane.Inventory()
+}
+
+func StartNode(rootDirectory string, address string, shardManagerAddress string, internalAddress string, ackMode AckMode, security internals.SecurityConfig, timeouts internals.TimeoutConfig, metricsAddress string, telemetryLogger internals.TelemetryLogger) {
+	timeouts = timeouts.OrDefault(15 * time.Second)
 
-	ds, err := NewDataServer(telemetryLogger, requestTimeout)
+	options, err := internals.SecurityOptions(security)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "Failed to configure security: %v", err)
+		return
+	}
+	ds, err := NewDataServer(telemetryLogger, timeouts.Default, append(options, internals.WithMethodTimeouts(timeouts.Overrides), internals.WithMetrics(metricsAddress))...)
 	if err == nil {
-		ds.Start(DataServerConfig{RootDirectory: rootDirectory, Address: address})
+		err = ds.Start(DataServerConfig{RootDirectory: rootDirectory, Address: address, AckMode: ackMode})
 	}
+	if err != nil {
+		logger.ConsoleLog("ERROR", "Failed to start data server: %v", err)
+		return
+	}
+	// Register after loading so the shard manager learns about recovered queues
+	registeredAt := time.Now()
+	ds.SetAssignments(RegisterNode(shardManagerAddress, address, internalAddress, ds.Inventory()), registeredAt)
+	heartbeatStop := make(chan struct{})
+	go ds.Heartbeat(shardManagerAddress, address, internalAddress, 3*time.Second, heartbeatStop)
 	// Wait for interrupt signal to gracefully shutdown
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 	<-stop
+	close(heartbeatStop)
+	UnregisterNode(shardManagerAddress, address, internalAddress)
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	if err := ds.Stop(ctx); err != nil {
@@ -66,7 +102,70 @@ func StartNode(rootDirectory string, address string) {
 	}
 }
 
-func RegisterNode(shardManagerAddress string, shardAddress string, shardInternalAddress string) {
+// Synced lists the followed shards this node is in sync with, or nothing
+// before Start.
+func (ds *DataServer) Synced() []uint64 {
+	if ds.plane == nil {
+		return make([]uint64, 0)
+	}
+	return ds.plane.Synced()
+}
+
+// SetAssignments hands the shard manager's answer to a request sent at
+// requestedAt to the replicator, or does nothing before Start.
+func (ds *DataServer) SetAssignments(assignments []*proto.ShardAssignment, requestedAt time.Time) {
+	if ds.plane == nil {
+		return
+	}
+	ds.plane.SetAssignments(assignments, requestedAt)
+}
+
+// Heartbeat reports liveness, and the followed shards this node is in sync
+// with, to the shard manager every interval until stop is closed. When the shard manager no longer knows this node, for example
+// after it lost its state, the node registers again with its inventory.
+func (ds *DataServer) Heartbeat(shardManagerAddress string, shardAddress string, shardInternalAddress string, interval time.Duration, stop <-chan struct{}) {
+	conn, err := grpc.NewClient(shardManagerAddress, internals.DialOptions()...)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "Failed to connect to shard manager for heartbeats: %v", err)
+		return
+	}
+	defer conn.Close()
+	shardManagerClient := proto.NewKokaqShardManagerClient(conn)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sentAt := time.Now()
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			res, err := shardManagerClient.Heartbeat(ctx, &proto.RegisterNodeRequest{
+				GrpcAddress:     shardAddress,
+				InternalAddress: shardInternalAddress,
+				SyncedShards:    ds.Synced(),
+			})
+			cancel()
+			if err != nil {
+				logger.ConsoleLog("WARN", "Heartbeat RPC failed: %v", err)
+				continue
+			}
+			if !res.Accepted {
+				logger.ConsoleLog("WARN", "Shard manager does not know this node, registering again")
+				ds.SetAssignments(RegisterNode(shardManagerAddress, shardAddress, shardInternalAddress, ds.Inventory()), sentAt)
+				continue
+			}
+			ds.SetAssignments(res.Assignments, sentAt)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// RegisterNode registers the node and its hosted shards with the shard
+// manager and returns where the shards it leads should be replicated. A
+// registration with conflicts is not accepted, but the node is still
+// registered for the shards nobody else holds and gets their assignments.
+func RegisterNode(shardManagerAddress string, shardAddress string, shardInternalAddress string, shards []*proto.ShardItem) []*proto.ShardAssignment {
 	maxRetries := 10
 	retryDelay := 2 * time.Second
 
@@ -76,7 +175,7 @@ func RegisterNode(shardManagerAddress string, shardAddress string, shardInternal
 	for attempt := 1; attempt <= maxRetries; attempt++ {
 		logger.ConsoleLog("INFO", "Attempt %d: Connecting to shard manager at %s", attempt, shardManagerAddress)
 		logger.ConsoleLog("INFO", "Dialing gRPC target: %s", shardManagerAddress)
-		conn, err = grpc.NewClient(shardManagerAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		conn, err = grpc.NewClient(shardManagerAddress, internals.DialOptions()...)
 		if err == nil {
 			logger.ConsoleLog("INFO", "Connected to shard manager")
 			break
@@ -88,7 +187,7 @@ func RegisterNode(shardManagerAddress string, shardAddress string, shardInternal
 
 	if conn == nil {
 		logger.ConsoleLog("ERROR", "Failed to connect to shard manager after %d attempts", maxRetries)
-		return
+		return nil
 	}
 	defer conn.Close()
 
@@ -99,7 +198,7 @@ func RegisterNode(shardManagerAddress string, shardAddress string, shardInternal
 	req := &proto.RegisterNodeRequest{
 		GrpcAddress:     shardAddress,
 		InternalAddress: shardInternalAddress,
-		Shard:           make([]*proto.ShardItem, 0),
+		Shard:           shards,
 	}
 	var res *proto.RegisterNodeResponse
 	res, err = shardManagerClient.RegisterNode(ctx, req)
@@ -108,11 +207,17 @@ func RegisterNode(shardManagerAddress string, shardAddress string, shardInternal
 	}
 	if res != nil && res.Accepted {
 		logger.ConsoleLog("INFO", "Node Registered")
+	} else if len(res.GetConflicts()) > 0 {
+		logger.ConsoleLog("WARN", "Node registered without %d conflicting shards", len(res.GetConflicts()))
 	}
+	for _, conflict := range res.GetConflicts() {
+		logger.ConsoleLog("ERROR", "Shard manager rejected ownership of shardId=%x (queue %s): held by another node", conflict.ShardId, conflict.Queue)
+	}
+	return res.GetAssignments()
 }
 
 func UnregisterNode(shardManagerAddress string, shardAddress string, shardInternalAddress string) {
-	conn, err := grpc.NewClient(shardManagerAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.NewClient(shardManagerAddress, internals.DialOptions()...)
 
 	if err != nil {
 		logger.ConsoleLog("INFO", "Failed to connect to shard manager: %v", err)
@@ -138,9 +243,3 @@ func UnregisterNode(shardManagerAddress string, shardAddress string, shardIntern
 		logger.ConsoleLog("INFO", "Node Unregistered")
 	}
 }
-
-type DummyTelemetryLogger struct{}
-
-func (d *DummyTelemetryLogger) LogEvent(event string, data map[string]interface{}) {
-	logger.ConsoleLog("INFO", "Telemetry event: %s, data: %v", event, data)
-}
@@ -0,0 +1,99 @@
+package data
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	statEnqueued     = "enqueued"
+	statDequeued     = "dequeued"
+	statAcked        = "acked"
+	statNacked       = "nacked"
+	statDeadLettered = "dead_lettered"
+	statExpired      = "expired"
+)
+
+var statEvents = []string{statEnqueued, statDequeued, statAcked, statNacked, statDeadLettered, statExpired}
+
+// rateWindow counts events over the last minute in one-second buckets.
+type rateWindow struct {
+	counts  [60]uint64
+	seconds [60]int64
+}
+
+func (w *rateWindow) add(now time.Time, n uint64) {
+	second := now.Unix()
+	slot := second % 60
+	if w.seconds[slot] != second {
+		w.seconds[slot] = second
+		w.counts[slot] = 0
+	}
+	w.counts[slot] += n
+}
+
+func (w *rateWindow) perMinute(now time.Time) uint64 {
+	var total uint64
+	for slot, second := range w.seconds {
+		if now.Unix()-second < 60 {
+			total += w.counts[slot]
+		}
+	}
+	return total
+}
+
+// queueStats keeps operation counters for one queue. They live in memory and
+// start from zero when the node restarts.
+type queueStats struct {
+	mutex   sync.Mutex
+	totals  map[string]uint64
+	windows map[string]*rateWindow
+}
+
+func newQueueStats() *queueStats {
+	stats := &queueStats{
+		totals:  make(map[string]uint64, len(statEvents)),
+		windows: make(map[string]*rateWindow, len(statEvents)),
+	}
+	for _, event := range statEvents {
+		stats.windows[event] = &rateWindow{}
+	}
+	return stats
+}
+
+func (s *queueStats) record(event string, n uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.totals[event] += n
+	s.windows[event].add(time.Now(), n)
+}
+
+// snapshot returns <event>_total and <event>_per_minute for every event.
+func (s *queueStats) snapshot() map[string]uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	stats := make(map[string]uint64, 2*len(statEvents))
+	for _, event := range statEvents {
+		stats[event+"_total"] = s.totals[event]
+		stats[event+"_per_minute"] = s.windows[event].perMinute(now)
+	}
+	return stats
+}
+
+// stats reports depth, in-flight, dead-letter and scheduled counts, the age
+// of the oldest message and the operation counters of the queue.
+func (h *hostedQueue) stats() map[string]uint64 {
+	stats := h.counters.snapshot()
+	inFlight := uint64(h.locks.Count())
+	stored := uint64(h.messages.Count())
+	stats["depth"] = stored - min(stored, inFlight)
+	stats["in_flight"] = inFlight
+	stats["dead_letter_depth"] = uint64(h.deadLetters.Count())
+	stats["scheduled"] = uint64(h.scheduled.Count())
+	stats["oldest_message_age_ms"] = 0
+	if oldest, ok := h.messages.Oldest(); ok {
+		stats["oldest_message_age_ms"] = uint64(max(time.Since(oldest).Milliseconds(), 0))
+	}
+	return stats
+}
@@ -3,15 +3,22 @@ package data
 import (
 	"fmt"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/kokaq/core/internals/logger"
 	"github.com/kokaq/core/queue"
+	"github.com/kokaq/protocol/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type DataStore struct {
+	mutex            sync.RWMutex
 	Namespaces       map[uint32]*queue.Namespace
 	NamespaceIdIndex map[string]uint32
 	ShardIdIndex     map[string]map[string]uint64
+	Queues           map[uint64]*hostedQueue
 }
 
 func NewDataStore() *DataStore {
@@ -19,16 +26,21 @@ func NewDataStore() *DataStore {
 		Namespaces:       make(map[uint32]*queue.Namespace, 0),
 		NamespaceIdIndex: make(map[string]uint32, 0),
 		ShardIdIndex:     make(map[string]map[string]uint64, 0),
+		Queues:           make(map[uint64]*hostedQueue, 0),
 	}
 }
 
 func (store *DataStore) initializeNamespaceIfNotExists(namespaceName string, namespaceId uint32, rootDir string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
 	if _, exists := store.ShardIdIndex[namespaceName]; !exists {
 		store.ShardIdIndex[namespaceName] = make(map[string]uint64)
 	}
 
-	if nsId, exists := store.NamespaceIdIndex[namespaceName]; exists {
-		logger.ConsoleLog("INFO", "Found existing namespace: %s (ID=%x)", namespaceName, nsId)
+	// The shard manager gives a namespace a new id once its last queue is
+	// gone, so a known name can come back under another id.
+	if _, exists := store.Namespaces[namespaceId]; exists {
+		logger.ConsoleLog("INFO", "Found existing namespace: %s (ID=%x)", namespaceName, namespaceId)
 	} else {
 		// Namespace not found
 		logger.ConsoleLog("WARN", "Namespace not found: %s. Creating new namespace %x...", namespaceName, namespaceId)
@@ -43,6 +55,8 @@ func (store *DataStore) initializeNamespaceIfNotExists(namespaceName string, nam
 }
 
 func (store *DataStore) queueExist(namespaceName string, queueName string) (bool, uint64) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
 	if shardId, exists := store.ShardIdIndex[namespaceName][queueName]; exists {
 		return true, shardId
 	} else {
@@ -50,47 +64,92 @@ func (store *DataStore) queueExist(namespaceName string, queueName string) (bool
 	}
 }
 
-func (store *DataStore) createQueue(namespaceName string, queueName string, shardId uint64, enableDeadLetter bool) (bool, uint64, error) {
+func (store *DataStore) createQueue(request *proto.KokaqQueueRequest, shardId uint64) (bool, uint64, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	// Checked again under the write lock, since callers look the queue up
+	// before and two of them may race to create it
+	if _, exists := store.ShardIdIndex[request.Namespace][request.Queue]; exists {
+		return false, shardId, status.Errorf(codes.AlreadyExists, "queue %s already exists in namespace %s", request.Queue, request.Namespace)
+	}
+	if _, exists := store.Queues[shardId]; exists {
+		return false, shardId, status.Errorf(codes.AlreadyExists, "shardId=%x is already hosted", shardId)
+	}
 	namespaceId, queueId := splitShard(shardId)
-	if _, err := store.Namespaces[namespaceId].AddQueue(&queue.QueueConfiguration{
+	q, err := store.Namespaces[namespaceId].AddQueue(&queue.QueueConfiguration{
 		QueueId:   queueId,
-		QueueName: queueName,
-		EnableDLQ: enableDeadLetter,
-	}); err != nil {
+		QueueName: request.Queue,
+		EnableDLQ: request.EnableDeadLetter,
+	})
+	if err != nil {
+		return false, shardId, fmt.Errorf("failed to add new queue:%v", err)
+	}
+	manifest := &queueManifest{
+		Namespace:         request.Namespace,
+		Queue:             request.Queue,
+		ShardId:           shardId,
+		EnableDeadLetter:  request.EnableDeadLetter,
+		MaxDeliveryCount:  request.MaxDequeueCount,
+		VisibilityTimeout: request.DefaultVisibilityTimeout,
+		DefaultTTL:        request.DefaultTtlMs,
+		DeadLetterExpired: request.DeadLetterExpired,
+		DedupWindow:       request.DeduplicationWindowMs,
+	}
+	hosted, err := openHostedQueue(q.RootDir, manifest)
+	if err != nil {
 		return false, shardId, fmt.Errorf("failed to add new queue:%v", err)
 	}
-	store.ShardIdIndex[namespaceName][queueName] = shardId
+	if err := writeQueueManifest(q.RootDir, manifest); err != nil {
+		return false, shardId, fmt.Errorf("failed to add new queue:%v", err)
+	}
+	store.Queues[shardId] = hosted
+	store.ShardIdIndex[request.Namespace][request.Queue] = shardId
 	return true, shardId, nil
 }
 
 func (store *DataStore) deleteQueue(namespaceName string, queueName string) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
 	shardId, exist := store.ShardIdIndex[namespaceName][queueName]
 	namespaceId, queueId := splitShard(shardId)
 	if exist {
 		delete(store.ShardIdIndex[namespaceName], queueName)
+		delete(store.Queues, shardId)
 		store.Namespaces[namespaceId].DeleteQueue(queueId)
 	}
 	return true, nil
 }
 
 func (store *DataStore) clearQueue(namespaceName string, queueName string) (bool, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
 	shardId, exist := store.ShardIdIndex[namespaceName][queueName]
 	namespaceId, queueId := splitShard(shardId)
 	if exist {
-		store.Namespaces[namespaceId].ClearQueue(queueId)
+		q, err := store.Namespaces[namespaceId].GetQueue(queueId)
+		if err != nil {
+			return false, err
+		}
+		if hosted, ok := store.Queues[shardId]; ok {
+			if err := hosted.clear(q); err != nil {
+				return false, err
+			}
+		}
 	}
 	return true, nil
 }
 
 func (store *DataStore) getQueue(namespace string, queue string) (*queue.Queue, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
 	shardId, exists := store.ShardIdIndex[namespace][queue]
 	if !exists {
-		return nil, fmt.Errorf("queue does not exist")
+		return nil, status.Error(codes.NotFound, "queue does not exist")
 	}
 	namespaceId, queueId := splitShard(shardId)
 	ns, exists := store.Namespaces[namespaceId]
 	if !exists {
-		return nil, fmt.Errorf("namespace does not exist")
+		return nil, status.Error(codes.NotFound, "namespace does not exist")
 	}
 	var err error = nil
 	if q, err := ns.GetQueue(queueId); err == nil {
@@ -99,6 +158,62 @@ func (store *DataStore) getQueue(namespace string, queue string) (*queue.Queue,
 	return nil, err
 }
 
+func (store *DataStore) getHosted(namespace string, queue string) (*hostedQueue, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	shardId, exists := store.ShardIdIndex[namespace][queue]
+	if !exists {
+		return nil, status.Error(codes.NotFound, "queue does not exist")
+	}
+	hosted, exists := store.Queues[shardId]
+	if !exists {
+		return nil, status.Error(codes.NotFound, "message store does not exist")
+	}
+	return hosted, nil
+}
+
+// hostedQueues returns the hosted queues by shard id.
+func (store *DataStore) hostedQueues() map[uint64]*hostedQueue {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	hosted := make(map[uint64]*hostedQueue, len(store.Queues))
+	for shardId, queue := range store.Queues {
+		hosted[shardId] = queue
+	}
+	return hosted
+}
+
+func (store *DataStore) hostedShard(shardId uint64) (*hostedQueue, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	hosted, exists := store.Queues[shardId]
+	return hosted, exists
+}
+
+// inventory lists every hosted queue grouped by namespace, in the shape the
+// shard manager expects on node registration.
+func (store *DataStore) inventory() []*proto.ShardItem {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	items := make([]*proto.ShardItem, 0, len(store.ShardIdIndex))
+	checkin := uint64(time.Now().UTC().Unix())
+	for namespaceName, queues := range store.ShardIdIndex {
+		if len(queues) == 0 {
+			continue
+		}
+		item := &proto.ShardItem{
+			Namespaces:  map[uint32]string{store.NamespaceIdIndex[namespaceName]: namespaceName},
+			Queues:      make(map[uint64]string, len(queues)),
+			LastCheckin: checkin,
+		}
+		for queueName, shardId := range queues {
+			item.Queues[shardId] = queueName
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
 func splitShard(shardId uint64) (uint32, uint32) {
 	namespaceId := uint32(shardId >> 32)
 	queueId := uint32(shardId & 0xFFFFFFFF)
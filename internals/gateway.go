@@ -0,0 +1,295 @@
+package internals
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kokaq/core/internals/logger"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const maxGatewayBody = 4 << 20
+
+// Headers the gateway passes on to the gRPC call, so callers authenticate
+// exactly as they would over gRPC.
+var gatewayHeaders = []string{"authorization", apiKeyHeader}
+
+// Gateway serves HTTP/JSON routes that translate into gRPC calls. Routes go
+// through GatewayRoute, so requests and responses are the protocol messages
+// in their canonical JSON encoding and gRPC status codes become HTTP ones.
+type Gateway struct {
+	mux    *http.ServeMux
+	server *http.Server
+	certs  *certReloader
+}
+
+// NewGateway creates a gateway serving HTTPS with the certificates of config
+// when TLS is configured, plain HTTP otherwise.
+func NewGateway(config TLSConfig) (*Gateway, error) {
+	g := &Gateway{mux: http.NewServeMux()}
+	if config.Enabled() {
+		certs, err := newCertReloader(config)
+		if err != nil {
+			return nil, err
+		}
+		g.certs = certs
+	}
+	return g, nil
+}
+
+func (g *Gateway) Handle(pattern string, handler http.Handler) {
+	g.mux.Handle(pattern, handler)
+}
+
+func (g *Gateway) Start(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	if g.certs != nil {
+		config, err := g.certs.serverConfig("h2", "http/1.1")
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, config)
+		logger.ConsoleLog("INFO", "REST gateway listening with %s on %s", g.certs.config.Mode(), address)
+	} else {
+		logger.ConsoleLog("INFO", "REST gateway listening without TLS on %s", address)
+	}
+	g.server = &http.Server{Handler: g.mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := g.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.ConsoleLog("ERROR", "REST gateway stopped with error: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (g *Gateway) Stop(ctx context.Context) error {
+	var err error
+	if g.server != nil {
+		err = g.server.Shutdown(ctx)
+	}
+	if g.certs != nil {
+		g.certs.Close()
+	}
+	return err
+}
+
+// GatewayContext carries the caller's credentials and trace context from r
+// into the outgoing gRPC call.
+func GatewayContext(r *http.Request) context.Context {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	pairs := make([]string, 0, 2*len(gatewayHeaders))
+	for _, header := range gatewayHeaders {
+		if value := r.Header.Get(header); value != "" {
+			pairs = append(pairs, header, value)
+		}
+	}
+	return metadata.NewOutgoingContext(ctx, metadata.Pairs(pairs...))
+}
+
+// GatewayRoute adapts a gRPC call to an HTTP handler. The request message is
+// read from the JSON body, when there is one, and from query parameters named
+// after its fields; call then sets the path parameters and makes the call.
+// Successful responses are written as JSON with successStatus.
+func GatewayRoute[Req, Resp protobuf.Message](successStatus int, call func(ctx context.Context, r *http.Request, req Req) (Resp, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var zero Req
+		req := zero.ProtoReflect().New().Interface().(Req)
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxGatewayBody))
+		if err != nil {
+			writeGatewayError(w, status.Errorf(codes.InvalidArgument, "cannot read body: %v", err))
+			return
+		}
+		if len(strings.TrimSpace(string(body))) > 0 {
+			if err := protojson.Unmarshal(body, req); err != nil {
+				writeGatewayError(w, status.Errorf(codes.InvalidArgument, "invalid body: %v", err))
+				return
+			}
+		}
+		if err := decodeQuery(req.ProtoReflect(), r.URL.Query()); err != nil {
+			writeGatewayError(w, status.Error(codes.InvalidArgument, err.Error()))
+			return
+		}
+		resp, err := call(GatewayContext(r), r, req)
+		if err != nil {
+			writeGatewayError(w, err)
+			return
+		}
+		encoded, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(resp)
+		if err != nil {
+			writeGatewayError(w, status.Errorf(codes.Internal, "cannot encode response: %v", err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(successStatus)
+		w.Write(encoded)
+	}
+}
+
+// GatewayCustomMethods serves custom methods on a resource, routes ending in
+// /{wildcard} whose last segment is name:verb such as messages/42:ack. The
+// handler of verb sees the name alone as the wildcard's path value.
+func GatewayCustomMethods(wildcard string, methods map[string]http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, verb, found := strings.Cut(r.PathValue(wildcard), ":")
+		handler, known := methods[verb]
+		if !found || !known {
+			writeGatewayError(w, status.Errorf(codes.NotFound, "no method %q on %s", verb, r.URL.Path))
+			return
+		}
+		r.SetPathValue(wildcard, name)
+		handler.ServeHTTP(w, r)
+	}
+}
+
+// decodeQuery sets the scalar fields of message named, in JSON or proto
+// form, by query parameters. Repeated fields take every value given.
+func decodeQuery(message protoreflect.Message, query url.Values) error {
+	fields := message.Descriptor().Fields()
+	for key, values := range query {
+		field := fields.ByJSONName(key)
+		if field == nil {
+			field = fields.ByTextName(key)
+		}
+		if field == nil {
+			return fmt.Errorf("unknown query parameter %q", key)
+		}
+		if field.IsMap() || field.Kind() == protoreflect.MessageKind || field.Kind() == protoreflect.GroupKind {
+			return fmt.Errorf("query parameter %q cannot set a message, send it in the body", key)
+		}
+		if field.IsList() {
+			list := message.Mutable(field).List()
+			for _, value := range values {
+				parsed, err := scalarValue(field, value)
+				if err != nil {
+					return err
+				}
+				list.Append(parsed)
+			}
+			continue
+		}
+		parsed, err := scalarValue(field, values[len(values)-1])
+		if err != nil {
+			return err
+		}
+		message.Set(field, parsed)
+	}
+	return nil
+}
+
+func scalarValue(field protoreflect.FieldDescriptor, value string) (protoreflect.Value, error) {
+	var err error
+	switch field.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(value), nil
+	case protoreflect.BoolKind:
+		var parsed bool
+		if parsed, err = strconv.ParseBool(value); err == nil {
+			return protoreflect.ValueOfBool(parsed), nil
+		}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		var parsed int64
+		if parsed, err = strconv.ParseInt(value, 10, 32); err == nil {
+			return protoreflect.ValueOfInt32(int32(parsed)), nil
+		}
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		var parsed int64
+		if parsed, err = strconv.ParseInt(value, 10, 64); err == nil {
+			return protoreflect.ValueOfInt64(parsed), nil
+		}
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		var parsed uint64
+		if parsed, err = strconv.ParseUint(value, 10, 32); err == nil {
+			return protoreflect.ValueOfUint32(uint32(parsed)), nil
+		}
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		var parsed uint64
+		if parsed, err = strconv.ParseUint(value, 10, 64); err == nil {
+			return protoreflect.ValueOfUint64(parsed), nil
+		}
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		var parsed float64
+		if parsed, err = strconv.ParseFloat(value, 64); err == nil {
+			if field.Kind() == protoreflect.FloatKind {
+				return protoreflect.ValueOfFloat32(float32(parsed)), nil
+			}
+			return protoreflect.ValueOfFloat64(parsed), nil
+		}
+	case protoreflect.EnumKind:
+		if number := field.Enum().Values().ByName(protoreflect.Name(value)); number != nil {
+			return protoreflect.ValueOfEnum(number.Number()), nil
+		}
+		var parsed int64
+		if parsed, err = strconv.ParseInt(value, 10, 32); err == nil {
+			return protoreflect.ValueOfEnum(protoreflect.EnumNumber(parsed)), nil
+		}
+	case protoreflect.BytesKind:
+		var parsed []byte
+		if parsed, err = base64.StdEncoding.DecodeString(value); err == nil {
+			return protoreflect.ValueOfBytes(parsed), nil
+		}
+	default:
+		err = fmt.Errorf("unsupported type %s", field.Kind())
+	}
+	return protoreflect.Value{}, fmt.Errorf("query parameter %q: %v", field.JSONName(), err)
+}
+
+// httpStatusFromCode maps gRPC status codes the way other gRPC gateways do.
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func writeGatewayError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatusFromCode(st.Code()))
+	json.NewEncoder(w).Encode(map[string]string{
+		"code":    st.Code().String(),
+		"message": st.Message(),
+	})
+}
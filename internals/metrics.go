@@ -0,0 +1,123 @@
+package internals
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kokaq/core/internals/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// rpcMetrics counts the RPCs a server handles by service, method and status
+// code.
+type rpcMetrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	inFlight *prometheus.GaugeVec
+}
+
+// newMetricsRegistry creates the registry of one server, holding its RPC
+// metrics and the Go runtime and process collectors.
+func newMetricsRegistry() (*prometheus.Registry, *rpcMetrics) {
+	metrics := &rpcMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kokaq_rpc_requests_total",
+			Help: "RPCs handled, by service, method and status code.",
+		}, []string{"service", "method", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "kokaq_rpc_duration_seconds",
+			Help:    "RPC latency, by service, method and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"service", "method", "code"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kokaq_rpc_in_flight",
+			Help: "RPCs being handled, by service and method.",
+		}, []string{"service", "method"}),
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metrics.requests,
+		metrics.duration,
+		metrics.inFlight,
+	)
+	return registry, metrics
+}
+
+// splitMethod turns /proto.KokaqDataPlane/Enqueue into its service and method.
+func splitMethod(fullMethod string) (string, string) {
+	service, method, found := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	if !found {
+		return "unknown", fullMethod
+	}
+	return service, method
+}
+
+func (m *rpcMetrics) observe(fullMethod string) func(err error) {
+	service, method := splitMethod(fullMethod)
+	m.inFlight.WithLabelValues(service, method).Inc()
+	start := time.Now()
+	return func(err error) {
+		code := status.Code(err).String()
+		m.inFlight.WithLabelValues(service, method).Dec()
+		m.requests.WithLabelValues(service, method, code).Inc()
+		m.duration.WithLabelValues(service, method, code).Observe(time.Since(start).Seconds())
+	}
+}
+
+// metricsUnaryInterceptor runs first so that calls rejected by timeouts,
+// authentication or authorization are counted with their status code.
+func metricsUnaryInterceptor(metrics *rpcMetrics) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		done := metrics.observe(info.FullMethod)
+		resp, err := handler(ctx, req)
+		done(err)
+		return resp, err
+	}
+}
+
+func metricsStreamInterceptor(metrics *rpcMetrics) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		done := metrics.observe(info.FullMethod)
+		err := handler(srv, stream)
+		done(err)
+		return err
+	}
+}
+
+// serveMetrics exposes registry at /metrics on address over plain HTTP.
+func serveMetrics(address string, registry *prometheus.Registry) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry}))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.ConsoleLog("ERROR", "Metrics server stopped with error: %v", err)
+		}
+	}()
+	logger.ConsoleLog("INFO", "Metrics served on http://%s/metrics", listener.Addr())
+	return server, nil
+}
@@ -0,0 +1,274 @@
+package internals
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/kokaq/core/internals/logger"
+	"github.com/kokaq/protocol/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Action is what an RPC does to the namespace or queue it targets.
+type Action string
+
+const (
+	ActionRead    Action = "read"    // peek, stats and lookups
+	ActionProduce Action = "produce" // enqueue
+	ActionConsume Action = "consume" // dequeue, lock, ack and nack
+	ActionManage  Action = "manage"  // create, delete, clear and dead-letter administration
+	ActionCluster Action = "cluster" // node registration, shard placement and replication
+)
+
+// Built-in roles. A policy file may add roles or redefine these.
+var defaultRoles = map[string][]Action{
+	"reader":   {ActionRead},
+	"producer": {ActionRead, ActionProduce},
+	"consumer": {ActionRead, ActionConsume},
+	"admin":    {ActionRead, ActionProduce, ActionConsume, ActionManage},
+	"cluster":  {ActionRead, ActionProduce, ActionConsume, ActionManage, ActionCluster},
+}
+
+// methodActions maps every RPC of the three planes to the action it needs.
+// Methods missing here are denied.
+var methodActions = map[string]Action{
+	"/proto.KokaqControlPlane/GetDataplane":    ActionRead,
+	"/proto.KokaqControlPlane/GetNamespace":    ActionRead,
+	"/proto.KokaqControlPlane/AddNamespace":    ActionManage,
+	"/proto.KokaqControlPlane/DeleteNamespace": ActionManage,
+	"/proto.KokaqControlPlane/AddQueue":        ActionManage,
+	"/proto.KokaqControlPlane/GetQueue":        ActionRead,
+	"/proto.KokaqControlPlane/DeleteQueue":     ActionManage,
+	"/proto.KokaqControlPlane/ClearQueue":      ActionManage,
+	"/proto.KokaqControlPlane/GetStats":        ActionRead,
+
+	"/proto.KokaqDataPlane/New":                      ActionManage,
+	"/proto.KokaqDataPlane/Get":                      ActionRead,
+	"/proto.KokaqDataPlane/GetStats":                 ActionRead,
+	"/proto.KokaqDataPlane/Delete":                   ActionManage,
+	"/proto.KokaqDataPlane/Clear":                    ActionManage,
+	"/proto.KokaqDataPlane/Enqueue":                  ActionProduce,
+	"/proto.KokaqDataPlane/EnqueueBatch":             ActionProduce,
+	"/proto.KokaqDataPlane/CancelScheduled":          ActionProduce,
+	"/proto.KokaqDataPlane/Dequeue":                  ActionConsume,
+	"/proto.KokaqDataPlane/Peek":                     ActionRead,
+	"/proto.KokaqDataPlane/PeekLock":                 ActionConsume,
+	"/proto.KokaqDataPlane/Receive":                  ActionConsume,
+	"/proto.KokaqDataPlane/Ack":                      ActionConsume,
+	"/proto.KokaqDataPlane/Nack":                     ActionConsume,
+	"/proto.KokaqDataPlane/Extend":                   ActionConsume,
+	"/proto.KokaqDataPlane/AckBatch":                 ActionConsume,
+	"/proto.KokaqDataPlane/NackBatch":                ActionConsume,
+	"/proto.KokaqDataPlane/ExtendBatch":              ActionConsume,
+	"/proto.KokaqDataPlane/SetVisibilityTimeout":     ActionConsume,
+	"/proto.KokaqDataPlane/RefreshVisibilityTimeout": ActionConsume,
+	"/proto.KokaqDataPlane/ReleaseLock":              ActionConsume,
+	"/proto.KokaqDataPlane/Replicate":                ActionCluster,
+	"/proto.KokaqDataPlane/MoveToDLQ":                ActionConsume,
+	"/proto.KokaqDataPlane/AutoMoveToDLQ":            ActionManage,
+	"/proto.KokaqDataPlane/PeekDLQ":                  ActionRead,
+	"/proto.KokaqDataPlane/DequeueDLQ":               ActionConsume,
+	"/proto.KokaqDataPlane/MoveFromDLQ":              ActionManage,
+	"/proto.KokaqDataPlane/ClearDLQ":                 ActionManage,
+	"/proto.KokaqDataPlane/ListDLQMessages":          ActionRead,
+
+	"/proto.KokaqShardManager/RegisterNode":   ActionCluster,
+	"/proto.KokaqShardManager/UnregisterNode": ActionCluster,
+	"/proto.KokaqShardManager/Heartbeat":      ActionCluster,
+	"/proto.KokaqShardManager/RequestShard":   ActionCluster,
+	"/proto.KokaqShardManager/GetShard":       ActionCluster,
+	"/proto.KokaqShardManager/DeleteShard":    ActionCluster,
+	"/proto.KokaqShardManager/ListShards":     ActionRead,
+}
+
+// Binding grants a role to a principal, either by subject or by one of the
+// roles its credentials carry (group), on the namespaces and queues matching
+// the patterns. Patterns use path.Match syntax; empty patterns match all.
+type Binding struct {
+	Subject   string `json:"subject"`
+	Group     string `json:"group"`
+	Role      string `json:"role"`
+	Namespace string `json:"namespace"`
+	Queue     string `json:"queue"`
+}
+
+// Policy decides which principal may perform which action where.
+type Policy struct {
+	Roles    map[string][]Action `json:"roles"`
+	Bindings []Binding           `json:"bindings"`
+}
+
+// LoadPolicy reads a policy of roles and bindings from a JSON file. Roles in
+// the file extend the built-in reader, producer, consumer, admin and cluster
+// roles.
+func LoadPolicy(policyPath string) (*Policy, error) {
+	data, err := os.ReadFile(policyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy from %s: %v", policyPath, err)
+	}
+	policy := &Policy{}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("failed to parse policy from %s: %v", policyPath, err)
+	}
+	roles := make(map[string][]Action, len(defaultRoles)+len(policy.Roles))
+	for role, actions := range defaultRoles {
+		roles[role] = actions
+	}
+	for role, actions := range policy.Roles {
+		roles[role] = actions
+	}
+	policy.Roles = roles
+	for _, binding := range policy.Bindings {
+		if _, exist := policy.Roles[binding.Role]; !exist {
+			return nil, fmt.Errorf("policy %s binds unknown role %q", policyPath, binding.Role)
+		}
+		if binding.Subject == "" && binding.Group == "" {
+			return nil, fmt.Errorf("policy %s has a %q binding without subject or group", policyPath, binding.Role)
+		}
+		for _, pattern := range []string{binding.Namespace, binding.Queue} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("policy %s has a bad pattern %q: %v", policyPath, pattern, err)
+			}
+		}
+	}
+	logger.ConsoleLog("INFO", "Loaded %d role bindings from %s", len(policy.Bindings), policyPath)
+	return policy, nil
+}
+
+// Allowed reports whether principal may perform action on queue of
+// namespace. Requests that target no namespace or queue are only allowed
+// through bindings that match everything.
+func (p *Policy) Allowed(principal *Principal, action Action, namespace string, queue string) bool {
+	if principal == nil {
+		return false
+	}
+	if principal.Subject == ClusterSubject && principal.Method == AuthMethodAPIKey {
+		return true
+	}
+	for _, binding := range p.Bindings {
+		if binding.Subject != "" && binding.Subject != principal.Subject {
+			continue
+		}
+		if binding.Subject == "" && !slices.Contains(principal.Roles, binding.Group) {
+			continue
+		}
+		if !slices.Contains(p.Roles[binding.Role], action) {
+			continue
+		}
+		if scopeMatches(binding.Namespace, namespace) && scopeMatches(binding.Queue, queue) {
+			return true
+		}
+	}
+	return false
+}
+
+func scopeMatches(pattern string, name string) bool {
+	if pattern == "" || pattern == "*" {
+		return true
+	}
+	if name == "" {
+		return false
+	}
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
+
+// requestScope returns the namespace and queue an RPC request targets.
+func requestScope(req interface{}) (string, string) {
+	switch r := req.(type) {
+	case *proto.EnqueueRequest:
+		return r.GetMessage().GetNamespace(), r.GetMessage().GetQueue()
+	case *proto.KokaqNewQueueRequest:
+		return r.GetRequest().GetNamespace(), r.GetRequest().GetQueue()
+	}
+	var namespace, queue string
+	if r, ok := req.(interface{ GetNamespace() string }); ok {
+		namespace = r.GetNamespace()
+	}
+	if r, ok := req.(interface{ GetQueue() string }); ok {
+		queue = r.GetQueue()
+	}
+	return namespace, queue
+}
+
+func authorize(ctx context.Context, policy *Policy, fullMethod string, req interface{}, telemetryLogger TelemetryLogger) error {
+	principal, _ := PrincipalFromContext(ctx)
+	action, known := methodActions[fullMethod]
+	namespace, queue := requestScope(req)
+	if known && policy.Allowed(principal, action, namespace, queue) {
+		return nil
+	}
+	subject := ""
+	if principal != nil {
+		subject = principal.Subject
+	}
+	logger.ConsoleLog("WARN", "Denied %s to %q on namespace=%s, queue=%s", fullMethod, subject, namespace, queue)
+	if telemetryLogger != nil {
+		telemetryLogger.LogEvent(EventAuthzDenied, map[string]interface{}{
+			"method":    fullMethod,
+			"subject":   subject,
+			"action":    string(action),
+			"namespace": namespace,
+			"queue":     queue,
+		})
+	}
+	return status.Errorf(codes.PermissionDenied, "%s is not allowed here", fullMethod)
+}
+
+func authzUnaryInterceptor(policy *Policy, telemetryLogger TelemetryLogger) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if authExempt(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		if err := authorize(ctx, policy, info.FullMethod, req, telemetryLogger); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// authzStreamInterceptor checks every message a client streams in, since the
+// scope of a stream is only known from its messages.
+func authzStreamInterceptor(policy *Policy, telemetryLogger TelemetryLogger) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		if authExempt(info.FullMethod) {
+			return handler(srv, stream)
+		}
+		return handler(srv, &authorizedStream{
+			ServerStream:    stream,
+			policy:          policy,
+			fullMethod:      info.FullMethod,
+			telemetryLogger: telemetryLogger,
+		})
+	}
+}
+
+type authorizedStream struct {
+	grpc.ServerStream
+	policy          *Policy
+	fullMethod      string
+	telemetryLogger TelemetryLogger
+}
+
+func (s *authorizedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return authorize(s.Context(), s.policy, s.fullMethod, m, s.telemetryLogger)
+}
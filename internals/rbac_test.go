@@ -0,0 +1,143 @@
+package internals
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kokaq/protocol/proto"
+)
+
+func writeTestPolicy(t *testing.T, policy string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(policy), 0644); err != nil {
+		t.Fatalf("failed to write policy: %v", err)
+	}
+	return path
+}
+
+func TestScopeMatches(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"", "orders", true},
+		{"", "", true},
+		{"*", "orders", true},
+		{"*", "", true},
+		{"orders", "orders", true},
+		{"orders", "orders-eu", false},
+		{"orders-*", "orders-eu", true},
+		{"orders-*", "orders-", true},
+		{"orders-*", "orders", false},
+		{"orders-??", "orders-eu", true},
+		{"orders-??", "orders-asia", false},
+		{"orders-[ae]*", "orders-eu", true},
+		{"orders-[ae]*", "orders-us", false},
+		{"orders-*", "", false},
+		{"orders", "", false},
+		// path.Match does not let * cross a separator
+		{"team-*", "team-a/orders", false},
+	}
+	for _, tt := range tests {
+		if got := scopeMatches(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("scopeMatches(%q, %q) = %v; want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyAllowed(t *testing.T) {
+	policy, err := LoadPolicy(writeTestPolicy(t, `{
+		"roles": {"auditor": ["read"], "producer": ["produce"]},
+		"bindings": [
+			{"subject": "alice", "role": "admin", "namespace": "sales"},
+			{"subject": "bob", "role": "producer", "namespace": "sales", "queue": "orders-*"},
+			{"group": "ops", "role": "consumer", "namespace": "team-?"},
+			{"group": "auditors", "role": "auditor"}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("LoadPolicy() error = %v", err)
+	}
+	alice := &Principal{Subject: "alice", Method: AuthMethodJWT}
+	bob := &Principal{Subject: "bob", Method: AuthMethodAPIKey}
+	carol := &Principal{Subject: "carol", Method: AuthMethodJWT, Roles: []string{"ops"}}
+	dave := &Principal{Subject: "dave", Method: AuthMethodJWT, Roles: []string{"auditors"}}
+	tests := []struct {
+		name      string
+		principal *Principal
+		action    Action
+		namespace string
+		queue     string
+		want      bool
+	}{
+		{"subject on any queue of its namespace", alice, ActionManage, "sales", "orders", true},
+		{"subject on the namespace itself", alice, ActionManage, "sales", "", true},
+		{"subject outside its namespace", alice, ActionManage, "billing", "orders", false},
+		{"subject without a namespace", alice, ActionRead, "", "", false},
+		{"subject beyond its role", alice, ActionCluster, "sales", "orders", false},
+		{"queue pattern match", bob, ActionProduce, "sales", "orders-eu", true},
+		{"queue pattern miss", bob, ActionProduce, "sales", "invoices", false},
+		{"queue pattern on the namespace itself", bob, ActionProduce, "sales", "", false},
+		{"redefined built-in role", bob, ActionRead, "sales", "orders-eu", false},
+		{"group namespace pattern match", carol, ActionConsume, "team-a", "jobs", true},
+		{"group namespace pattern miss", carol, ActionConsume, "team-ab", "jobs", false},
+		{"group beyond its role", carol, ActionProduce, "team-a", "jobs", false},
+		{"group bound everywhere", dave, ActionRead, "anything", "at-all", true},
+		{"group bound everywhere, no scope", dave, ActionRead, "", "", true},
+		{"custom role beyond its actions", dave, ActionConsume, "sales", "orders", false},
+		{"subject named like a group", &Principal{Subject: "ops"}, ActionConsume, "team-a", "jobs", false},
+		{"unbound principal", &Principal{Subject: "eve", Roles: []string{"admins"}}, ActionRead, "sales", "orders", false},
+		{"no principal", nil, ActionRead, "sales", "orders", false},
+		{"cluster key", &Principal{Subject: ClusterSubject, Method: AuthMethodAPIKey}, ActionCluster, "", "", true},
+		{"cluster subject from a token", &Principal{Subject: ClusterSubject, Method: AuthMethodJWT}, ActionCluster, "", "", false},
+	}
+	for _, tt := range tests {
+		if got := policy.Allowed(tt.principal, tt.action, tt.namespace, tt.queue); got != tt.want {
+			t.Errorf("%s: Allowed(%v, %s, %q, %q) = %v; want %v", tt.name, tt.principal, tt.action, tt.namespace, tt.queue, got, tt.want)
+		}
+	}
+}
+
+func TestLoadPolicyRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		want   string
+	}{
+		{"unknown role", `{"bindings": [{"subject": "alice", "role": "owner"}]}`, "unknown role"},
+		{"no subject or group", `{"bindings": [{"role": "admin", "namespace": "sales"}]}`, "without subject or group"},
+		{"bad namespace pattern", `{"bindings": [{"subject": "alice", "role": "admin", "namespace": "sales["}]}`, "bad pattern"},
+		{"bad queue pattern", `{"bindings": [{"group": "ops", "role": "admin", "queue": "[a-"}]}`, "bad pattern"},
+		{"not json", `bindings: []`, "failed to parse"},
+	}
+	for _, tt := range tests {
+		_, err := LoadPolicy(writeTestPolicy(t, tt.policy))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: LoadPolicy() error = %v; want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestRequestScope(t *testing.T) {
+	tests := []struct {
+		name      string
+		req       interface{}
+		namespace string
+		queue     string
+	}{
+		{"queue request", &proto.KokaqQueueRequest{Namespace: "sales", Queue: "orders"}, "sales", "orders"},
+		{"enqueue", &proto.EnqueueRequest{Message: &proto.KokaqMessageRequest{Namespace: "sales", Queue: "orders"}}, "sales", "orders"},
+		{"new queue", &proto.KokaqNewQueueRequest{Request: &proto.KokaqQueueRequest{Namespace: "sales", Queue: "orders"}}, "sales", "orders"},
+		{"namespace request", &proto.KokaqNamespaceRequest{Namespace: "sales"}, "sales", ""},
+		{"unscoped", &proto.ListShardsRequest{}, "", ""},
+	}
+	for _, tt := range tests {
+		namespace, queue := requestScope(tt.req)
+		if namespace != tt.namespace || queue != tt.queue {
+			t.Errorf("%s: requestScope() = %q, %q; want %q, %q", tt.name, namespace, queue, tt.namespace, tt.queue)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package internals
+
+import (
+	"github.com/kokaq/core/internals/logger"
+)
+
+// SecurityConfig gathers how a node authenticates callers and encrypts its
+// traffic, for its listener and for the connections it opens to other nodes.
+type SecurityConfig struct {
+	Auth AuthConfig
+	TLS  TLSConfig
+}
+
+func (config SecurityConfig) WithEnvDefaults() SecurityConfig {
+	return SecurityConfig{
+		Auth: config.Auth.WithEnvDefaults(),
+		TLS:  config.TLS.WithEnvDefaults(),
+	}
+}
+
+// SecurityOptions returns the server options enforcing config: transport
+// security, the authenticator and, when a policy file is set, the policy.
+func SecurityOptions(config SecurityConfig) ([]ServerOption, error) {
+	options := make([]ServerOption, 0, 3)
+	if config.TLS.Enabled() {
+		certs, err := newCertReloader(config.TLS)
+		if err != nil {
+			return nil, err
+		}
+		creds, err := certs.serverCredentials()
+		if err != nil {
+			certs.Close()
+			return nil, err
+		}
+		options = append(options, withTLS(certs, creds))
+	}
+	authenticator, err := NewAuthenticator(config.Auth)
+	if err != nil {
+		return nil, err
+	}
+	options = append(options, WithAuthenticator(authenticator))
+	if config.Auth.PolicyFile != "" {
+		policy, err := LoadPolicy(config.Auth.PolicyFile)
+		if err != nil {
+			return nil, err
+		}
+		if authenticator == nil {
+			logger.ConsoleLog("WARN", "Policy %s is set without any credentials, every request will be denied", config.Auth.PolicyFile)
+		}
+		options = append(options, WithPolicy(policy))
+	}
+	return options, nil
+}
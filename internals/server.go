@@ -3,11 +3,16 @@ package internals
 import (
 	"context"
 	"net"
+	"net/http"
 	"sync"
 	"time"
 
 	"github.com/kokaq/core/internals/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc/filters"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
 )
@@ -28,6 +33,8 @@ const (
 	EventHealthCheckResponded    = "health_check_responded"
 	EventRequestTimeout          = "request_timeout"
 	EventAuthFailedInvalidOIDC   = "auth_failed_invalid_oidc"
+	EventAuthzDenied             = "authz_denied"
+	EventMessagesExpired         = "messages_expired"
 )
 
 type KokaqServer struct {
@@ -37,17 +44,95 @@ type KokaqServer struct {
 	telemetryLogger TelemetryLogger
 	healthServer    *health.Server
 	requestTimeout  time.Duration
+	authenticator   Authenticator
+	policy          *Policy
+	certs           *certReloader
+	creds           credentials.TransportCredentials
+	methodTimeouts  map[string]time.Duration
+	metricsAddress  string
+	metrics         *prometheus.Registry
+	metricsServer   *http.Server
 }
 
-func NewKokaqServer(cleanup func(), telemetryLogger TelemetryLogger, requestTimeout time.Duration) (*KokaqServer, error) {
-	var unaryInterceptors []grpc.UnaryServerInterceptor
-	// if requestTimeout > 0 {
-	// 	unaryInterceptors = append(unaryInterceptors, requestTimeoutUnaryInterceptor(requestTimeout, telemetryLogger))
-	// }
-	opts := []grpc.ServerOption{}
+// ServerOption configures optional behaviour of a KokaqServer.
+type ServerOption func(*KokaqServer)
+
+// WithAuthenticator requires every RPC but health checks to authenticate with
+// authenticator. A nil authenticator leaves the server open.
+func WithAuthenticator(authenticator Authenticator) ServerOption {
+	return func(s *KokaqServer) {
+		s.authenticator = authenticator
+	}
+}
+
+// withTLS serves over TLS with certificates kept current by certs.
+func withTLS(certs *certReloader, creds credentials.TransportCredentials) ServerOption {
+	return func(s *KokaqServer) {
+		s.certs = certs
+		s.creds = creds
+	}
+}
+
+// WithMethodTimeouts overrides the request timeout of single methods, see
+// TimeoutConfig.
+func WithMethodTimeouts(overrides map[string]time.Duration) ServerOption {
+	return func(s *KokaqServer) {
+		s.methodTimeouts = overrides
+	}
+}
+
+// WithMetrics serves the metrics of the server at /metrics on address. An
+// empty address still collects metrics but serves none.
+func WithMetrics(address string) ServerOption {
+	return func(s *KokaqServer) {
+		s.metricsAddress = address
+	}
+}
+
+// WithPolicy checks every authenticated RPC but health checks against policy.
+func WithPolicy(policy *Policy) ServerOption {
+	return func(s *KokaqServer) {
+		s.policy = policy
+	}
+}
+
+func NewKokaqServer(cleanup func(), telemetryLogger TelemetryLogger, requestTimeout time.Duration, options ...ServerOption) (*KokaqServer, error) {
+	s := &KokaqServer{
+		cleanup:         cleanup,
+		telemetryLogger: telemetryLogger,
+		requestTimeout:  requestTimeout,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	registry, rpcMetrics := newMetricsRegistry()
+	s.metrics = registry
+	unaryInterceptors := []grpc.UnaryServerInterceptor{metricsUnaryInterceptor(rpcMetrics)}
+	streamInterceptors := []grpc.StreamServerInterceptor{metricsStreamInterceptor(rpcMetrics)}
+	timeouts := TimeoutConfig{Default: requestTimeout, Overrides: s.methodTimeouts}
+	unaryInterceptors = append(unaryInterceptors, requestTimeoutUnaryInterceptor(timeouts, telemetryLogger))
+	streamInterceptors = append(streamInterceptors, requestTimeoutStreamInterceptor(timeouts, telemetryLogger))
+	if s.authenticator != nil {
+		unaryInterceptors = append(unaryInterceptors, authUnaryInterceptor(s.authenticator, telemetryLogger))
+		streamInterceptors = append(streamInterceptors, authStreamInterceptor(s.authenticator, telemetryLogger))
+	}
+	if s.policy != nil {
+		unaryInterceptors = append(unaryInterceptors, authzUnaryInterceptor(s.policy, telemetryLogger))
+		streamInterceptors = append(streamInterceptors, authzStreamInterceptor(s.policy, telemetryLogger))
+	}
+	unaryInterceptors = append(unaryInterceptors, statusUnaryInterceptor())
+	opts := []grpc.ServerOption{
+		grpc.StatsHandler(otelgrpc.NewServerHandler(otelgrpc.WithFilter(filters.Not(filters.HealthCheck())))),
+	}
+	if s.creds != nil {
+		opts = append(opts, grpc.Creds(s.creds))
+	}
 	if len(unaryInterceptors) > 0 {
 		opts = append(opts, grpc.ChainUnaryInterceptor(unaryInterceptors...))
 	}
+	if len(streamInterceptors) > 0 {
+		opts = append(opts, grpc.ChainStreamInterceptor(streamInterceptors...))
+	}
 	grpcSrv := grpc.NewServer(opts...)
 	// pb.RegisterQueueDataServer(grpcSrv, )
 	healthSrv := health.NewServer()
@@ -55,13 +140,19 @@ func NewKokaqServer(cleanup func(), telemetryLogger TelemetryLogger, requestTime
 		HealthServer:    healthSrv,
 		telemetryLogger: telemetryLogger,
 	})
-	return &KokaqServer{
-		grpcServer:      grpcSrv,
-		cleanup:         cleanup,
-		telemetryLogger: telemetryLogger,
-		healthServer:    healthSrv,
-		requestTimeout:  requestTimeout,
-	}, nil
+	s.grpcServer = grpcSrv
+	s.healthServer = healthSrv
+	return s, nil
+}
+
+// RegisterMetrics adds collectors to the metrics the server exposes.
+func (s *KokaqServer) RegisterMetrics(collectors ...prometheus.Collector) error {
+	for _, collector := range collectors {
+		if err := s.metrics.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *KokaqServer) Start(address string, register func(server *grpc.Server)) error {
@@ -80,13 +171,23 @@ func (s *KokaqServer) Start(address string, register func(server *grpc.Server))
 		}
 		return err
 	}
-	logger.ConsoleLog("INFO", "gRPC server listening without TLS on %s", address)
+	if s.certs != nil {
+		logger.ConsoleLog("INFO", "gRPC server listening with %s on %s", s.certs.config.Mode(), address)
+	} else {
+		logger.ConsoleLog("INFO", "gRPC server listening without TLS on %s", address)
+	}
 	if s.telemetryLogger != nil {
 		s.telemetryLogger.LogEvent(EventServerStarted, map[string]interface{}{
 			"address": address,
 		})
 	}
 
+	if s.metricsAddress != "" {
+		if s.metricsServer, err = serveMetrics(s.metricsAddress, s.metrics); err != nil {
+			logger.ConsoleLog("ERROR", "failed to serve metrics on %s: %v", s.metricsAddress, err)
+		}
+	}
+
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	go func() {
@@ -138,6 +239,12 @@ func (s *KokaqServer) Stop(ctx context.Context) error {
 		}
 		return ctx.Err()
 	}
+	if s.certs != nil {
+		s.certs.Close()
+	}
+	if s.metricsServer != nil {
+		s.metricsServer.Shutdown(ctx)
+	}
 	// Do cleanup
 	if s.cleanup != nil {
 		logger.ConsoleLog("INFO", "performing cleanup before shutdown")
@@ -0,0 +1,61 @@
+package shard
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	nodeAliveDesc = prometheus.NewDesc("kokaq_node_alive",
+		"Whether a registered data node is heartbeating.", []string{"node"}, nil)
+	nodeLastSeenDesc = prometheus.NewDesc("kokaq_node_last_seen_timestamp_seconds",
+		"Unix time of the last heartbeat of a registered data node.", []string{"node"}, nil)
+	nodeShardsDesc = prometheus.NewDesc("kokaq_node_shards",
+		"Shards a data node leads or follows, by role.", []string{"node", "role"}, nil)
+	shardsDesc = prometheus.NewDesc("kokaq_shards",
+		"Shards in the shard map, by namespace.", []string{"namespace"}, nil)
+)
+
+// metricsCollector reports node liveness and shard counts of a ShardStore,
+// read on every scrape.
+type metricsCollector struct {
+	store *ShardStore
+}
+
+func (c *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- nodeAliveDesc
+	ch <- nodeLastSeenDesc
+	ch <- nodeShardsDesc
+	ch <- shardsDesc
+}
+
+func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	store := c.store
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	leading := make(map[string]int, len(store.nodes))
+	following := make(map[string]int, len(store.nodes))
+	namespaces := make(map[string]int)
+	for _, ns := range store.shards {
+		for _, shard := range ns {
+			namespaces[shard.namespace]++
+			leading[shard.address]++
+			for _, follower := range shard.followers {
+				following[follower]++
+			}
+		}
+	}
+	for address, node := range store.nodes {
+		alive := 0.0
+		if node.IsAlive {
+			alive = 1
+		}
+		ch <- prometheus.MustNewConstMetric(nodeAliveDesc, prometheus.GaugeValue, alive, address)
+		ch <- prometheus.MustNewConstMetric(nodeLastSeenDesc, prometheus.GaugeValue,
+			float64(node.LastSeen.UnixNano())/1e9, address)
+		ch <- prometheus.MustNewConstMetric(nodeShardsDesc, prometheus.GaugeValue, float64(leading[address]), address, "leader")
+		ch <- prometheus.MustNewConstMetric(nodeShardsDesc, prometheus.GaugeValue, float64(following[address]), address, "follower")
+	}
+	for namespace, count := range namespaces {
+		ch <- prometheus.MustNewConstMetric(shardsDesc, prometheus.GaugeValue, float64(count), namespace)
+	}
+}
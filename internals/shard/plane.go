@@ -1,29 +1,99 @@
 package shard
 
 import (
+	"cmp"
 	"context"
 	"fmt"
+	"slices"
+	"strconv"
+	"time"
 
 	"github.com/kokaq/core/internals/logger"
 	"github.com/kokaq/protocol/proto"
+	"github.com/kokaq/server/internals"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+var tracer = otel.Tracer("github.com/kokaq/server/internals/shard")
+
 type ShardPlane struct {
 	proto.UnimplementedKokaqShardManagerServer
 	store *ShardStore
+	stop  chan struct{}
 }
 
-func NewShardPlane(rootDirectory string) (*ShardPlane, error) {
-	return &ShardPlane{
-		store: NewShardStore(),
-	}, nil
+func NewShardPlane(rootDirectory string, followers int) (*ShardPlane, error) {
+	store, err := LoadShardStore(rootDirectory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load shard map from %s: %v", rootDirectory, err)
+	}
+	store.SetFollowerCount(followers)
+	plane := &ShardPlane{
+		store: store,
+		stop:  make(chan struct{}),
+	}
+	go store.SnapshotLoop(time.Minute, plane.stop)
+	// Data nodes stop leading 8s after their last answered heartbeat, before
+	// their shards can fail over
+	go store.NodeMonitor(5*time.Second, 10*time.Second, plane.stop)
+	return plane, nil
+}
+
+// Close stops background work and flushes the shard map to disk.
+func (d *ShardPlane) Close() error {
+	close(d.stop)
+	return d.store.Close()
 }
 
 func (d *ShardPlane) RegisterNode(c context.Context, p *proto.RegisterNodeRequest) (*proto.RegisterNodeResponse, error) {
 	logger.ConsoleLog("INFO", "Registering shard at address: %s", p.GrpcAddress)
-	d.store.RegisterNode(p.GrpcAddress, p.InternalAddress)
-	logger.ConsoleLog("INFO", "Shard registration successful for address: %s", p.GrpcAddress)
-	return &proto.RegisterNodeResponse{Accepted: true}, nil
+	reported := make([]ReportedShard, 0)
+	for _, item := range p.Shard {
+		for shardId, queue := range item.Queues {
+			nsId, _ := splitShardId(shardId)
+			namespace, ok := item.Namespaces[nsId]
+			if !ok {
+				logger.ConsoleLog("WARN", "Ignoring shardId=%x from %s: namespace %x not reported", shardId, p.GrpcAddress, nsId)
+				continue
+			}
+			reported = append(reported, ReportedShard{ShardId: shardId, Namespace: namespace, Queue: queue})
+		}
+	}
+	_, span := tracer.Start(c, "ShardStore.MergeInventory")
+	span.SetAttributes(attribute.String("kokaq.node", p.GrpcAddress), attribute.Int("kokaq.shards", len(reported)))
+	conflicts, err := d.store.MergeInventory(p.GrpcAddress, p.InternalAddress, reported)
+	internals.EndSpan(span, err)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "Shard registration failed for address: %s: %v", p.GrpcAddress, err)
+		return &proto.RegisterNodeResponse{
+			Accepted: false,
+			Status:   &proto.StatusResponse{Success: false, Error: proto.ErrorCode_ERROR_INTERNAL},
+		}, err
+	}
+	if len(conflicts) > 0 {
+		grains := make([]*proto.ShardGrain, 0, len(conflicts))
+		for _, conflict := range conflicts {
+			logger.ConsoleLog("ERROR", "Shard conflict: shardId=%x (%s/%s) claimed by %s but held by %s",
+				conflict.ShardId, conflict.Namespace, conflict.Queue, conflict.Claimant, conflict.Owner)
+			grains = append(grains, &proto.ShardGrain{ShardId: conflict.ShardId, Queue: conflict.Queue})
+		}
+		// The node stays registered for the shards it does own, so the
+		// response still carries their assignments
+		return &proto.RegisterNodeResponse{
+			Accepted:    false,
+			Status:      &proto.StatusResponse{Success: false, Error: proto.ErrorCode_ERROR_INVALID_ARGUMENT},
+			Conflicts:   grains,
+			Assignments: d.assignments(p.GrpcAddress),
+		}, nil
+	}
+	logger.ConsoleLog("INFO", "Shard registration successful for address: %s (%d shards reported)", p.GrpcAddress, len(reported))
+	return &proto.RegisterNodeResponse{
+		Accepted:    true,
+		Status:      &proto.StatusResponse{Success: true},
+		Assignments: d.assignments(p.GrpcAddress),
+	}, nil
 }
 
 func (d *ShardPlane) UnregisterNode(c context.Context, p *proto.RegisterNodeRequest) (*proto.RegisterNodeResponse, error) {
@@ -33,26 +103,68 @@ func (d *ShardPlane) UnregisterNode(c context.Context, p *proto.RegisterNodeRequ
 	return &proto.RegisterNodeResponse{Accepted: true}, nil
 }
 
+func (d *ShardPlane) Heartbeat(c context.Context, p *proto.RegisterNodeRequest) (*proto.RegisterNodeResponse, error) {
+	if err := d.store.Heartbeat(p.GrpcAddress, p.SyncedShards); err != nil {
+		logger.ConsoleLog("WARN", "Heartbeat from unknown node %s, asking it to register", p.GrpcAddress)
+		return &proto.RegisterNodeResponse{
+			Accepted: false,
+			Status:   &proto.StatusResponse{Success: false, Error: proto.ErrorCode_ERROR_NOT_FOUND},
+		}, nil
+	}
+	return &proto.RegisterNodeResponse{
+		Accepted:    true,
+		Status:      &proto.StatusResponse{Success: true},
+		Assignments: d.assignments(p.GrpcAddress),
+	}, nil
+}
+
+// assignments tells a leader node where to replicate each of its shards.
+func (d *ShardPlane) assignments(address string) []*proto.ShardAssignment {
+	assignments := make([]*proto.ShardAssignment, 0)
+	for _, assignment := range d.store.Assignments(address) {
+		assignments = append(assignments, &proto.ShardAssignment{
+			ShardId:   assignment.ShardId,
+			Followers: assignment.Followers,
+		})
+	}
+	return assignments
+}
+
+// shardResponse describes an existing shard, flagging it unhealthy while its
+// leader is down and no follower has taken over yet.
+func (s *ShardPlane) shardResponse(sh *Shard) (*proto.GetShardResponse, error) {
+	if !s.store.IsAvailable(sh) {
+		logger.ConsoleLog("WARN", "ShardId=%x is unavailable, leader %s is down", sh.GetShardId(), sh.GetAddress())
+		return &proto.GetShardResponse{
+			GrpcAddress:     sh.GetAddress(),
+			InternalAddress: sh.GetInternalAddress(),
+			IsNew:           false,
+			Status: &proto.StatusResponse{
+				Success: false,
+				Error:   proto.ErrorCode_ERROR_SHARD_UNHEALTHY,
+			},
+		}, fmt.Errorf("shard %x is unavailable", sh.GetShardId())
+	}
+	return &proto.GetShardResponse{
+		GrpcAddress:     sh.GetAddress(),
+		InternalAddress: sh.GetInternalAddress(),
+		IsNew:           false,
+		Status:          &proto.StatusResponse{Success: true},
+	}, nil
+}
+
 func (s *ShardPlane) GetShard(ctx context.Context, p *proto.GetShardRequest) (*proto.GetShardResponse, error) {
 	// Combine NamespaceId and QueueId to form a unique shardId
 	shardId := (uint64(p.NamespaceId) << 32) | uint64(p.QueueId)
 	sh, found := s.store.GetShardById(shardId)
 	if found {
 		logger.ConsoleLog("DEBUG", "Found existing shardId=%x with address=%s", sh.GetShardId(), sh.GetAddress())
-		return &proto.GetShardResponse{
-			GrpcAddress:     sh.GetAddress(),
-			InternalAddress: sh.GetInternalAddress(),
-			IsNew:           false,
-		}, nil
+		return s.shardResponse(sh)
 	} else {
 		sh, found = s.store.GetShard(p.Namespace, p.Queue)
 		if found {
 			logger.ConsoleLog("DEBUG", "Found existing shardId=%x with address=%s", sh.GetShardId(), sh.GetAddress())
-			return &proto.GetShardResponse{
-				GrpcAddress:     sh.GetAddress(),
-				InternalAddress: sh.GetInternalAddress(),
-				IsNew:           false,
-			}, nil
+			return s.shardResponse(sh)
 		}
 	}
 
@@ -67,7 +179,7 @@ func (s *ShardPlane) GetShard(ctx context.Context, p *proto.GetShardRequest) (*p
 	}
 
 	// Find an available shard address
-	shrd, _, err := s.store.AllocateShard(p.Namespace, p.Queue)
+	shrd, _, err := s.allocateShard(ctx, p.Namespace, p.Queue)
 	if err != nil {
 		logger.ConsoleLog("ERROR", "Could not allocate shard to queue: %v", err)
 		return &proto.GetShardResponse{
@@ -92,7 +204,16 @@ func (s *ShardPlane) DeleteShard(ctx context.Context, p *proto.GetShardRequest)
 	sh, found := s.store.GetShard(p.Namespace, p.Queue)
 	if found {
 		logger.ConsoleLog("DEBUG", "Found existing shardId=%x with address=%s", sh.GetShardId(), sh.GetAddress())
-		s.store.DeleteShard(p.Namespace, p.Queue)
+		_, span := tracer.Start(ctx, "ShardStore.DeleteShard", internals.QueueAttributes(p.Namespace, p.Queue))
+		err := s.store.DeleteShard(p.Namespace, p.Queue)
+		internals.EndSpan(span, err)
+		if err != nil {
+			logger.ConsoleLog("ERROR", "Failed to delete shardId=%x: %v", sh.GetShardId(), err)
+			return &proto.StatusResponse{
+				Success: false,
+				Error:   proto.ErrorCode_ERROR_INTERNAL,
+			}, err
+		}
 		return &proto.StatusResponse{
 			Success: true,
 		}, nil
@@ -102,9 +223,20 @@ func (s *ShardPlane) DeleteShard(ctx context.Context, p *proto.GetShardRequest)
 	}, fmt.Errorf("shard for this queue does not exist")
 }
 
+// allocateShard places a queue on a node, tracing the placement.
+func (s *ShardPlane) allocateShard(ctx context.Context, namespace string, queue string) (*Shard, bool, error) {
+	_, span := tracer.Start(ctx, "ShardStore.AllocateShard", internals.QueueAttributes(namespace, queue))
+	shrd, allocated, err := s.store.AllocateShard(namespace, queue)
+	if err == nil {
+		span.SetAttributes(attribute.String("kokaq.node", shrd.GetAddress()), attribute.Bool("kokaq.allocated", allocated))
+	}
+	internals.EndSpan(span, err)
+	return shrd, allocated, err
+}
+
 func (s *ShardPlane) RequestShard(ctx context.Context, p *proto.GetShardRequest) (*proto.GetShardResponse, error) {
 	// Check if shard already assigned for this namespace and queue
-	shrd, _, err := s.store.AllocateShard(p.Namespace, p.Queue)
+	shrd, _, err := s.allocateShard(ctx, p.Namespace, p.Queue)
 	if err != nil {
 		logger.ConsoleLog("WARN", "Cannot allocate shard for namespace=%s, queue=%s, %v", p.Namespace, p.Queue, err)
 		err = fmt.Errorf("cannot allocate shard for namespace=%s, queue=%s, %v", p.Namespace, p.Queue, err)
@@ -124,23 +256,91 @@ func (s *ShardPlane) RequestShard(ctx context.Context, p *proto.GetShardRequest)
 	}, nil
 }
 
+const (
+	defaultListPageSize = 100
+	maxListPageSize     = 1000
+)
+
+// ListShards pages through the shard map in shard id order. Details carry
+// one entry per shard with its leader's liveness; Shards groups the same page
+// into one item per namespace, in the shape data nodes register with.
 func (s *ShardPlane) ListShards(ctx context.Context, p *proto.ListShardsRequest) (*proto.ListShardsResponse, error) {
-	var shards []*proto.ShardItem
-	// for shardId, addr := range s.Shards {
-	// 	if s.AvailableAddrs[addr] {
-	// 		namespaceId := uint32(shardId >> 32)
-	// 		// queueId  := uint32(shardId & 0xFFFFFFFF)
-	// 		shards = append(shards, &proto.ShardItem{
-	// 			NamespaceId: namespaceId,
-	// 			QueueIds: make([]uint32, 0),
-	// 			LastCheckin: uint64(time.Now().UTC().Unix()),
-	// 			GrpcAddress: addr,
-	// 		})
-	// 	}
-	// }
+	logger.ConsoleLog("INFO", "Received ListShards request: Namespace=%s, Node=%s, PageSize=%d, PageToken=%s", p.Namespace, p.Node, p.PageSize, p.PageToken)
+	var after uint64
+	if p.PageToken != "" {
+		token, err := strconv.ParseUint(p.PageToken, 16, 64)
+		if err != nil {
+			return &proto.ListShardsResponse{
+				Status: &proto.StatusResponse{
+					Success: false,
+					Error:   proto.ErrorCode_ERROR_INVALID_ARGUMENT,
+				},
+			}, fmt.Errorf("invalid page token %q", p.PageToken)
+		}
+		after = token
+	}
+	pageSize := int(p.PageSize)
+	if pageSize == 0 {
+		pageSize = defaultListPageSize
+	}
+	pageSize = min(pageSize, maxListPageSize)
+
+	all := s.store.ListShards(p.Namespace, p.Node)
+	start := 0
+	if p.PageToken != "" {
+		start, _ = slices.BinarySearchFunc(all, after, func(info ShardInfo, id uint64) int {
+			return cmp.Compare(info.Shard.GetShardId(), id)
+		})
+		if start < len(all) && all[start].Shard.GetShardId() == after {
+			start++
+		}
+	}
+	page := all[start:min(start+pageSize, len(all))]
+	nextPageToken := ""
+	if start+len(page) < len(all) {
+		nextPageToken = strconv.FormatUint(page[len(page)-1].Shard.GetShardId(), 16)
+	}
 
+	items := make(map[uint32]*proto.ShardItem)
+	details := make([]*proto.ShardDetail, 0, len(page))
+	for _, info := range page {
+		sh := &info.Shard
+		detail := &proto.ShardDetail{
+			ShardId:         sh.GetShardId(),
+			Namespace:       sh.GetNamespace(),
+			Queue:           sh.GetQueue(),
+			Address:         sh.GetAddress(),
+			InternalAddress: sh.GetInternalAddress(),
+			Followers:       sh.GetFollowers(),
+			UpdatedAt:       timestamppb.New(sh.GetUpdatedAt()),
+			IsAlive:         info.IsAlive,
+		}
+		if !info.LastSeen.IsZero() {
+			detail.LastSeen = timestamppb.New(info.LastSeen)
+		}
+		details = append(details, detail)
+
+		nsId, _ := splitShardId(sh.GetShardId())
+		item, exist := items[nsId]
+		if !exist {
+			item = &proto.ShardItem{
+				Namespaces:  map[uint32]string{nsId: sh.GetNamespace()},
+				Queues:      make(map[uint64]string),
+				LastCheckin: uint64(sh.GetUpdatedAt().UTC().Unix()),
+			}
+			items[nsId] = item
+		}
+		item.Queues[sh.GetShardId()] = sh.GetQueue()
+		item.LastCheckin = max(item.LastCheckin, uint64(sh.GetUpdatedAt().UTC().Unix()))
+	}
+	shards := make([]*proto.ShardItem, 0, len(items))
+	for _, item := range items {
+		shards = append(shards, item)
+	}
 	return &proto.ListShardsResponse{
-		Status: &proto.StatusResponse{Success: false, Error: proto.ErrorCode_ERROR_DEPENDENCY_FAILURE},
-		Shards: shards,
+		Status:        &proto.StatusResponse{Success: true},
+		Shards:        shards,
+		Details:       details,
+		NextPageToken: nextPageToken,
 	}, nil
 }
@@ -15,29 +15,47 @@ import (
 
 type ShardServer struct {
 	server *internals.KokaqServer
+	plane  *ShardPlane
 }
 
 type ShardServerConfig struct {
 	RootDirectory string
 	Address       string
+	Followers     int
 }
 
-func NewShardServer(telemetryLogger internals.TelemetryLogger, requestTimeout time.Duration) (*ShardServer, error) {
+func NewShardServer(telemetryLogger internals.TelemetryLogger, requestTimeout time.Duration, options ...internals.ServerOption) (*ShardServer, error) {
+	ds := &ShardServer{}
 	cleanup := func() {
 		logger.ConsoleLog("INFO", "shard server cleanup called")
+		if ds.plane != nil {
+			if err := ds.plane.Close(); err != nil {
+				logger.ConsoleLog("ERROR", "Failed to flush shard map: %v", err)
+			}
+		}
 	}
-	kokaqServer, err := internals.NewKokaqServer(cleanup, telemetryLogger, requestTimeout)
-	return &ShardServer{
-		server: kokaqServer,
-	}, err
+	kokaqServer, err := internals.NewKokaqServer(cleanup, telemetryLogger, requestTimeout, options...)
+	ds.server = kokaqServer
+	return ds, err
 }
 
 func (ds *ShardServer) Start(config ShardServerConfig) error {
+	if config.RootDirectory == "" {
+		logger.ConsoleLog("WARN", "No shard manager root directory configured, shard map will not survive a restart")
+	}
+	srv, err := NewShardPlane(config.RootDirectory, config.Followers)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "Failed to load shard plane: %v", err)
+		return err
+	}
+	ds.plane = srv
+	if err := ds.server.RegisterMetrics(&metricsCollector{store: srv.store}); err != nil {
+		return err
+	}
 	register := func(server *grpc.Server) {
-		srv, _ := NewShardPlane(config.RootDirectory)
 		proto.RegisterKokaqShardManagerServer(server, srv)
 	}
-	err := ds.server.Start(config.Address, register)
+	err = ds.server.Start(config.Address, register)
 	return err
 }
 
@@ -46,15 +64,20 @@ func (ds *ShardServer) Stop(ctx context.Context) error {
 	return err
 }
 
-func StartShardManager(address string) {
-	telemetryLogger := &DummyTelemetryLogger{}
-	requestTimeout := 15 * time.Second
+func StartShardManager(address string, rootDirectory string, followers int, security internals.SecurityConfig, timeouts internals.TimeoutConfig, metricsAddress string, telemetryLogger internals.TelemetryLogger) {
+	timeouts = timeouts.OrDefault(15 * time.Second)
 
-	cs, err := NewShardServer(telemetryLogger, requestTimeout)
+	options, err := internals.SecurityOptions(security)
+	if err != nil {
+		logger.ConsoleLog("ERROR", "Failed to configure security: %v", err)
+		return
+	}
+	cs, err := NewShardServer(telemetryLogger, timeouts.Default, append(options, internals.WithMethodTimeouts(timeouts.Overrides), internals.WithMetrics(metricsAddress))...)
 	if err == nil {
 		cs.Start(ShardServerConfig{
-			RootDirectory: "",
+			RootDirectory: rootDirectory,
 			Address:       address,
+			Followers:     followers,
 		})
 	}
 	// Wait for interrupt signal to gracefully shutdown
@@ -67,9 +90,3 @@ func StartShardManager(address string) {
 		logger.ConsoleLog("ERROR", "Error stopping ahard server: %v", err)
 	}
 }
-
-type DummyTelemetryLogger struct{}
-
-func (d *DummyTelemetryLogger) LogEvent(event string, data map[string]interface{}) {
-	logger.ConsoleLog("INFO", "Telemetry event: %s, data: %v", event, data)
-}
@@ -1,15 +1,20 @@
 package shard
 
 import (
+	"cmp"
 	"fmt"
 	"math/rand"
+	"slices"
 	"sync"
 	"time"
 
+	"github.com/kokaq/core/internals/logger"
 	"github.com/kokaq/core/utils/murmur"
 )
 
 type Shard struct {
+	namespace       string
+	queue           string
 	shardId         uint64
 	address         string
 	internalAddress string
@@ -17,6 +22,12 @@ type Shard struct {
 	updatedAt       time.Time
 }
 
+func (s *Shard) GetNamespace() string {
+	return s.namespace
+}
+func (s *Shard) GetQueue() string {
+	return s.queue
+}
 func (s *Shard) GetShardId() uint64 {
 	return s.shardId
 }
@@ -38,6 +49,9 @@ type DataPlaneShardNode struct {
 	InternalAddress string
 	LastSeen        time.Time
 	IsAlive         bool
+	// Synced holds the followed shards the node reported in sync with at its
+	// last heartbeat. Only those it can take over as leader.
+	Synced map[uint64]bool
 }
 
 type ShardStore struct {
@@ -45,6 +59,8 @@ type ShardStore struct {
 	nameToShardIds map[string]map[string]uint64
 	shards         map[uint32]map[uint32]*Shard
 	nodes          map[string]*DataPlaneShardNode
+	wal            *ShardLog
+	followerCount  int
 }
 
 func NewShardStore() *ShardStore {
@@ -56,17 +72,33 @@ func NewShardStore() *ShardStore {
 	}
 }
 
+// LoadShardStore recovers the shard map persisted under rootDirectory and
+// logs every further mutation there. An empty rootDirectory keeps the map in
+// memory only.
+func LoadShardStore(rootDirectory string) (*ShardStore, error) {
+	store := NewShardStore()
+	if rootDirectory == "" {
+		return store, nil
+	}
+	wal, err := OpenShardLog(rootDirectory)
+	if err != nil {
+		return nil, err
+	}
+	if err := wal.Replay(store.restore, store.apply); err != nil {
+		wal.Close()
+		return nil, err
+	}
+	store.wal = wal
+	return store, nil
+}
+
 func (store *ShardStore) RegisterNode(address string, internalAddress string) error {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
-	store.nodes[address] = &DataPlaneShardNode{
-		Address:         address,
-		InternalAddress: internalAddress,
-		LastSeen:        time.Now(),
-		IsAlive:         true,
-	}
-
-	return nil
+	return store.commit(&walEntry{
+		Op:   walRegisterNode,
+		Node: &nodeRecord{Address: address, InternalAddress: internalAddress},
+	})
 }
 
 func (store *ShardStore) UnregisterNode(address string) error {
@@ -76,53 +108,229 @@ func (store *ShardStore) UnregisterNode(address string) error {
 	if _, exist := store.nodes[address]; !exist {
 		return fmt.Errorf("node not found")
 	}
-	delete(store.nodes, address)
-	// Optionally: remove this node from leader/follower lists of shards
-	for _, ns := range store.shards {
-		for _, shard := range ns {
-			if shard.address == address {
-				shard.address = ""
+	return store.commit(&walEntry{
+		Op:   walUnregisterNode,
+		Node: &nodeRecord{Address: address},
+	})
+}
+
+// ShardConflict describes a shard reported by a node while another live node
+// already owns it, or a queue name reported with a different shard id.
+type ShardConflict struct {
+	ShardId   uint64
+	Namespace string
+	Queue     string
+	Owner     string
+	Claimant  string
+}
+
+// ReportedShard is one queue a data node says it hosts.
+type ReportedShard struct {
+	ShardId   uint64
+	Namespace string
+	Queue     string
+}
+
+// MergeInventory registers a node together with the shards it hosts. Shards
+// the map does not know about, or whose owner is gone, are assigned to the
+// node; claims on shards held by another live node are returned as conflicts
+// and leave the map untouched.
+func (store *ShardStore) MergeInventory(address string, internalAddress string, reported []ReportedShard) ([]ShardConflict, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if err := store.commit(&walEntry{
+		Op:   walRegisterNode,
+		Node: &nodeRecord{Address: address, InternalAddress: internalAddress},
+	}); err != nil {
+		return nil, err
+	}
+
+	conflicts := make([]ShardConflict, 0)
+	for _, r := range reported {
+		nsId, qId := splitShardId(r.ShardId)
+		if shardId, exists := store.nameToShardIds[r.Namespace][r.Queue]; exists && shardId != r.ShardId {
+			owner := ""
+			if existing, ok := store.shardById(shardId); ok {
+				owner = existing.address
 			}
-			var updatedFollowers []string
-			for _, f := range shard.followers {
-				if f != address {
-					updatedFollowers = append(updatedFollowers, f)
-				}
+			conflicts = append(conflicts, ShardConflict{
+				ShardId:   r.ShardId,
+				Namespace: r.Namespace,
+				Queue:     r.Queue,
+				Owner:     owner,
+				Claimant:  address,
+			})
+			continue
+		}
+		if !store.namespaceMatches(r.Namespace, nsId) {
+			conflicts = append(conflicts, ShardConflict{
+				ShardId:   r.ShardId,
+				Namespace: r.Namespace,
+				Queue:     r.Queue,
+				Claimant:  address,
+			})
+			continue
+		}
+		existing, known := store.shards[nsId][qId]
+		if known && (existing.address == address || slices.Contains(existing.followers, address)) {
+			continue
+		}
+		if known && existing.address != "" {
+			if owner, alive := store.nodes[existing.address]; alive && owner.IsAlive {
+				conflicts = append(conflicts, ShardConflict{
+					ShardId:   r.ShardId,
+					Namespace: r.Namespace,
+					Queue:     r.Queue,
+					Owner:     existing.address,
+					Claimant:  address,
+				})
+				continue
 			}
-			shard.followers = updatedFollowers
+		}
+		op, followers := walAllocateShard, []string{}
+		if known {
+			op, followers = walUpdateShard, existing.followers
+		}
+		if err := store.commit(&walEntry{
+			Op: op,
+			Shard: &shardRecord{
+				Namespace:       r.Namespace,
+				Queue:           r.Queue,
+				ShardId:         r.ShardId,
+				Address:         address,
+				InternalAddress: internalAddress,
+				Followers:       followers,
+				UpdatedAt:       time.Now(),
+			},
+		}); err != nil {
+			return conflicts, err
 		}
 	}
+	return conflicts, nil
+}
 
-	return nil
+// namespaceMatches reports whether nsId is the id already used by the queues
+// of namespace, or the namespace has no queues yet.
+func (store *ShardStore) namespaceMatches(namespace string, nsId uint32) bool {
+	for _, shardId := range store.nameToShardIds[namespace] {
+		existing, _ := splitShardId(shardId)
+		return existing == nsId
+	}
+	return true
 }
 
-func (store *ShardStore) Heartbeat(address string) error {
+// Heartbeat refreshes the liveness of a registered node. Unknown nodes are
+// rejected so they re-register and report their shards.
+func (store *ShardStore) Heartbeat(address string, synced []uint64) error {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
-	if node, exist := store.nodes[address]; exist {
-		node.LastSeen = time.Now()
-		node.IsAlive = true
-		return nil
-	} else {
-		store.nodes[address] = &DataPlaneShardNode{
-			Address:  address,
-			LastSeen: time.Now(),
-			IsAlive:  true,
-		}
+	node, exist := store.nodes[address]
+	if !exist {
+		return fmt.Errorf("node not registered")
+	}
+	if !node.IsAlive {
+		logger.ConsoleLog("INFO", "Node %s is alive again", address)
+	}
+	node.LastSeen = time.Now()
+	node.IsAlive = true
+	node.Synced = make(map[uint64]bool, len(synced))
+	for _, shardId := range synced {
+		node.Synced[shardId] = true
 	}
 	return nil
 }
 
-func (store *ShardStore) NodeMonitor() {
-	time.Sleep(5 * time.Second)
+// NodeMonitor checks node liveness every interval until stop is closed. A
+// node not heard from within timeout is marked dead and the shards it leads
+// fail over to a live follower in sync with them. Shards without one stay
+// unavailable until their leader comes back, since their data lives only on
+// its disk.
+func (store *ShardStore) NodeMonitor(interval time.Duration, timeout time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			store.checkNodes(timeout)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (store *ShardStore) checkNodes(timeout time.Duration) {
 	store.mutex.Lock()
+	defer store.mutex.Unlock()
 	now := time.Now()
+	died := make(map[string]bool)
 	for _, node := range store.nodes {
-		if now.Sub(node.LastSeen) > 10*time.Second {
+		if node.IsAlive && now.Sub(node.LastSeen) > timeout {
+			logger.ConsoleLog("WARN", "Node %s missed heartbeats since %s, marking dead", node.Address, node.LastSeen.Format(time.RFC3339))
 			node.IsAlive = false
+			died[node.Address] = true
+		}
+	}
+	for _, ns := range store.shards {
+		for _, shard := range ns {
+			if store.isAvailable(shard) || store.failover(shard) {
+				continue
+			}
+			if died[shard.address] {
+				logger.ConsoleLog("WARN", "ShardId=%x is unavailable: leader %s is down and no live follower is in sync", shard.shardId, shard.address)
+			}
 		}
 	}
-	store.mutex.Unlock()
+}
+
+// failover promotes the first live follower of shard that is in sync with it
+// to leader and reports whether one was found. A follower that missed
+// mutations would lose them. The old leader becomes a follower, so the shard
+// keeps its replicas: the assignments it gets back no longer make it lead, and
+// the new leader resyncs it once it is back. Callers must hold the write lock.
+func (store *ShardStore) failover(shard *Shard) bool {
+	for i, follower := range shard.followers {
+		node, exist := store.nodes[follower]
+		if !exist || !node.IsAlive || !node.Synced[shard.shardId] {
+			continue
+		}
+		followers := make([]string, 0, len(shard.followers))
+		followers = append(followers, shard.followers[:i]...)
+		followers = append(followers, shard.followers[i+1:]...)
+		if shard.address != "" {
+			followers = append(followers, shard.address)
+		}
+		if err := store.commit(&walEntry{
+			Op: walUpdateShard,
+			Shard: &shardRecord{
+				Namespace:       shard.namespace,
+				Queue:           shard.queue,
+				ShardId:         shard.shardId,
+				Address:         node.Address,
+				InternalAddress: node.InternalAddress,
+				Followers:       followers,
+				UpdatedAt:       time.Now(),
+			},
+		}); err != nil {
+			logger.ConsoleLog("ERROR", "Failed to fail over shardId=%x to %s: %v", shard.shardId, node.Address, err)
+			return false
+		}
+		logger.ConsoleLog("WARN", "Failed over shardId=%x from %s to follower %s", shard.shardId, shard.address, node.Address)
+		return true
+	}
+	return false
+}
+
+// IsAvailable reports whether the leader of shard is a live node.
+func (store *ShardStore) IsAvailable(shard *Shard) bool {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.isAvailable(shard)
+}
+
+func (store *ShardStore) isAvailable(shard *Shard) bool {
+	node, exist := store.nodes[shard.address]
+	return exist && node.IsAlive
 }
 
 func (store *ShardStore) AllocateShard(namespace string, queue string) (shrd *Shard, allocated bool, err error) {
@@ -176,23 +384,27 @@ func (store *ShardStore) AllocateShard(namespace string, queue string) (shrd *Sh
 	if err != nil {
 		return nil, false, fmt.Errorf("nodes not available for namespace: %s and queue: %s", namespace, queue)
 	}
-	nsId, qId := splitShardId(shardId)
-	store.nameToShardIds[namespace][queue] = shardId
-	if _, nsIdExists := store.shards[nsId]; !nsIdExists {
-		store.shards[nsId] = make(map[uint32]*Shard)
-	}
-	store.shards[nsId][qId] = &Shard{
-		shardId:         shardId,
-		address:         address,
-		internalAddress: internalAddress,
-		followers:       []string{},
-		updatedAt:       time.Now(),
+	if err := store.commit(&walEntry{
+		Op: walAllocateShard,
+		Shard: &shardRecord{
+			Namespace:       namespace,
+			Queue:           queue,
+			ShardId:         shardId,
+			Address:         address,
+			InternalAddress: internalAddress,
+			Followers:       store.allocateFollowers(address),
+			UpdatedAt:       time.Now(),
+		},
+	}); err != nil {
+		return nil, false, err
 	}
-
+	nsId, qId := splitShardId(shardId)
 	return store.shards[nsId][qId], true, nil
 }
 
 func (store *ShardStore) GetShard(namespace string, queue string) (*Shard, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
 	if shardId, exist := store.nameToShardIds[namespace][queue]; !exist {
 		return nil, false
 	} else {
@@ -206,20 +418,78 @@ func (store *ShardStore) GetShard(namespace string, queue string) (*Shard, bool)
 }
 
 func (store *ShardStore) GetShards() []*Shard {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	shards := make([]*Shard, 0, len(store.shards))
+	for _, ns := range store.shards {
+		for _, shard := range ns {
+			shards = append(shards, shard)
+		}
+	}
+	return shards
+}
 
-	var shards []*Shard = make([]*Shard, len(store.shards))
-	i := 0
+// ShardInfo is a copy of a shard together with the liveness of its leader.
+type ShardInfo struct {
+	Shard    Shard
+	LastSeen time.Time
+	IsAlive  bool
+}
+
+// ListShards returns the shards of namespace that node leads or follows,
+// ordered by shard id. Empty namespace or node match every shard; node
+// matches either the grpc or the internal address of a node.
+func (store *ShardStore) ListShards(namespace string, node string) []ShardInfo {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	shards := make([]ShardInfo, 0)
 	for _, ns := range store.shards {
 		for _, shard := range ns {
-			shards[i] = shard
-			i++
+			if namespace != "" && shard.namespace != namespace {
+				continue
+			}
+			if node != "" && !store.involves(shard, node) {
+				continue
+			}
+			info := ShardInfo{Shard: *shard}
+			info.Shard.followers = slices.Clone(shard.followers)
+			if leader, exist := store.nodes[shard.address]; exist {
+				info.LastSeen = leader.LastSeen
+				info.IsAlive = leader.IsAlive
+			}
+			shards = append(shards, info)
 		}
 	}
+	slices.SortFunc(shards, func(a, b ShardInfo) int {
+		return cmp.Compare(a.Shard.shardId, b.Shard.shardId)
+	})
 	return shards
+}
 
+// involves reports whether node leads or follows shard. Callers must hold
+// the read lock.
+func (store *ShardStore) involves(shard *Shard, node string) bool {
+	if shard.address == node || shard.internalAddress == node {
+		return true
+	}
+	for _, follower := range shard.followers {
+		if follower == node {
+			return true
+		}
+		if n, exist := store.nodes[follower]; exist && n.InternalAddress == node {
+			return true
+		}
+	}
+	return false
 }
 
 func (store *ShardStore) GetShardById(shardId uint64) (*Shard, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.shardById(shardId)
+}
+
+func (store *ShardStore) shardById(shardId uint64) (*Shard, bool) {
 	nsId, qId := splitShardId(shardId)
 	if shard, exist := store.shards[nsId][qId]; !exist {
 		return nil, false
@@ -228,16 +498,22 @@ func (store *ShardStore) GetShardById(shardId uint64) (*Shard, bool) {
 	}
 }
 
-func (store *ShardStore) DeleteShard(namespace string, queue string) {
+func (store *ShardStore) DeleteShard(namespace string, queue string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
 	shardId, exist := store.nameToShardIds[namespace][queue]
-	if exist {
-		delete(store.nameToShardIds[namespace], queue)
+	if !exist {
+		return nil
 	}
-	nsId, qId := splitShardId(shardId)
-	delete(store.shards[nsId], qId)
+	return store.commit(&walEntry{
+		Op:    walDeleteShard,
+		Shard: &shardRecord{Namespace: namespace, Queue: queue, ShardId: shardId},
+	})
 }
 
 func (store *ShardStore) ShardExist(namespace string, queue string) bool {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
 	if shardId, exist := store.nameToShardIds[namespace][queue]; !exist {
 		return false
 	} else {
@@ -250,6 +526,207 @@ func (store *ShardStore) ShardExist(namespace string, queue string) bool {
 	}
 }
 
+// Snapshot compacts the write-ahead log into a fresh snapshot of the map.
+func (store *ShardStore) Snapshot() error {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if store.wal == nil {
+		return nil
+	}
+	return store.wal.Snapshot(store.snapshot())
+}
+
+// SnapshotLoop takes a snapshot every interval until stop is closed.
+func (store *ShardStore) SnapshotLoop(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := store.Snapshot(); err != nil {
+				logger.ConsoleLog("ERROR", "Failed to snapshot shard map: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Close takes a final snapshot and releases the write-ahead log.
+func (store *ShardStore) Close() error {
+	if store.wal == nil {
+		return nil
+	}
+	if err := store.Snapshot(); err != nil {
+		return err
+	}
+	return store.wal.Close()
+}
+
+// commit logs entry ahead of applying it, so every change visible in memory
+// survives a restart. Callers must hold the write lock.
+func (store *ShardStore) commit(entry *walEntry) error {
+	if store.wal != nil {
+		if err := store.wal.Append(entry); err != nil {
+			logger.ConsoleLog("ERROR", "Failed to log shard map change %s: %v", entry.Op, err)
+			return err
+		}
+	}
+	store.apply(entry)
+	if store.wal != nil && store.wal.NeedsSnapshot() {
+		if err := store.wal.Snapshot(store.snapshot()); err != nil {
+			logger.ConsoleLog("WARN", "Failed to compact shard log: %v", err)
+		}
+	}
+	return nil
+}
+
+// apply performs a logged mutation on the in-memory map. It is shared by the
+// live write path and log replay so both always agree.
+func (store *ShardStore) apply(entry *walEntry) {
+	switch entry.Op {
+	case walRegisterNode:
+		store.nodes[entry.Node.Address] = &DataPlaneShardNode{
+			Address:         entry.Node.Address,
+			InternalAddress: entry.Node.InternalAddress,
+			LastSeen:        time.Now(),
+			IsAlive:         true,
+		}
+	case walUnregisterNode:
+		address := entry.Node.Address
+		delete(store.nodes, address)
+		// Remove this node from leader/follower lists of shards
+		for _, ns := range store.shards {
+			for _, shard := range ns {
+				if shard.address == address {
+					shard.address = ""
+				}
+				var updatedFollowers []string
+				for _, f := range shard.followers {
+					if f != address {
+						updatedFollowers = append(updatedFollowers, f)
+					}
+				}
+				shard.followers = updatedFollowers
+			}
+		}
+	case walAllocateShard, walUpdateShard:
+		record := entry.Shard
+		if _, ok := store.nameToShardIds[record.Namespace]; !ok {
+			store.nameToShardIds[record.Namespace] = make(map[string]uint64)
+		}
+		store.nameToShardIds[record.Namespace][record.Queue] = record.ShardId
+		nsId, qId := splitShardId(record.ShardId)
+		if _, nsIdExists := store.shards[nsId]; !nsIdExists {
+			store.shards[nsId] = make(map[uint32]*Shard)
+		}
+		store.shards[nsId][qId] = &Shard{
+			namespace:       record.Namespace,
+			queue:           record.Queue,
+			shardId:         record.ShardId,
+			address:         record.Address,
+			internalAddress: record.InternalAddress,
+			followers:       record.Followers,
+			updatedAt:       record.UpdatedAt,
+		}
+	case walDeleteShard:
+		record := entry.Shard
+		delete(store.nameToShardIds[record.Namespace], record.Queue)
+		nsId, qId := splitShardId(record.ShardId)
+		delete(store.shards[nsId], qId)
+	}
+}
+
+func (store *ShardStore) snapshot() *shardSnapshot {
+	snapshot := &shardSnapshot{
+		Nodes:  make([]nodeRecord, 0, len(store.nodes)),
+		Shards: make([]shardRecord, 0),
+	}
+	for _, node := range store.nodes {
+		snapshot.Nodes = append(snapshot.Nodes, nodeRecord{
+			Address:         node.Address,
+			InternalAddress: node.InternalAddress,
+		})
+	}
+	for _, ns := range store.shards {
+		for _, shard := range ns {
+			snapshot.Shards = append(snapshot.Shards, shardRecord{
+				Namespace:       shard.namespace,
+				Queue:           shard.queue,
+				ShardId:         shard.shardId,
+				Address:         shard.address,
+				InternalAddress: shard.internalAddress,
+				Followers:       shard.followers,
+				UpdatedAt:       shard.updatedAt,
+			})
+		}
+	}
+	return snapshot
+}
+
+func (store *ShardStore) restore(snapshot *shardSnapshot) {
+	for i := range snapshot.Nodes {
+		store.apply(&walEntry{Op: walRegisterNode, Node: &snapshot.Nodes[i]})
+	}
+	for i := range snapshot.Shards {
+		store.apply(&walEntry{Op: walAllocateShard, Shard: &snapshot.Shards[i]})
+	}
+}
+
+// SetFollowerCount sets how many followers newly allocated shards get.
+func (store *ShardStore) SetFollowerCount(followers int) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.followerCount = followers
+}
+
+// ShardAssignment lists the followers, by internal address, of a shard led
+// by the node it is handed to.
+type ShardAssignment struct {
+	ShardId   uint64
+	Followers []string
+}
+
+// Assignments returns the follower sets of every shard led by address.
+func (store *ShardStore) Assignments(address string) []ShardAssignment {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	assignments := make([]ShardAssignment, 0)
+	for _, ns := range store.shards {
+		for _, shard := range ns {
+			if shard.address != address {
+				continue
+			}
+			followers := make([]string, 0, len(shard.followers))
+			for _, follower := range shard.followers {
+				if node, exist := store.nodes[follower]; exist {
+					followers = append(followers, node.InternalAddress)
+				}
+			}
+			assignments = append(assignments, ShardAssignment{ShardId: shard.shardId, Followers: followers})
+		}
+	}
+	return assignments
+}
+
+// allocateFollowers picks up to followerCount live nodes other than leader.
+func (store *ShardStore) allocateFollowers(leader string) []string {
+	candidates := make([]string, 0)
+	for address, node := range store.nodes {
+		if node.IsAlive && address != leader {
+			candidates = append(candidates, address)
+		}
+	}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	r.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > store.followerCount {
+		candidates = candidates[:store.followerCount]
+	}
+	return candidates
+}
+
 func (store *ShardStore) allocateShardAddress() (string, string, error) {
 	trueKeys := make([]string, 0)
 	for address, node := range store.nodes {
@@ -0,0 +1,215 @@
+package shard
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/kokaq/core/internals/logger"
+	"github.com/kokaq/core/utils"
+)
+
+const (
+	walFile           = "shards.wal"
+	snapshotFile      = "shards.snapshot"
+	snapshotThreshold = 1000
+)
+
+type walOp string
+
+const (
+	walRegisterNode   walOp = "register_node"
+	walUnregisterNode walOp = "unregister_node"
+	walAllocateShard  walOp = "allocate_shard"
+	walUpdateShard    walOp = "update_shard"
+	walDeleteShard    walOp = "delete_shard"
+)
+
+// walEntry is one mutation of the shard map. Entries are appended as JSON
+// lines and fsynced before the mutation is applied in memory.
+type walEntry struct {
+	Seq   uint64       `json:"seq"`
+	Op    walOp        `json:"op"`
+	Node  *nodeRecord  `json:"node,omitempty"`
+	Shard *shardRecord `json:"shard,omitempty"`
+}
+
+type nodeRecord struct {
+	Address         string `json:"address"`
+	InternalAddress string `json:"internalAddress"`
+}
+
+type shardRecord struct {
+	Namespace       string    `json:"namespace"`
+	Queue           string    `json:"queue"`
+	ShardId         uint64    `json:"shardId"`
+	Address         string    `json:"address"`
+	InternalAddress string    `json:"internalAddress"`
+	Followers       []string  `json:"followers"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+}
+
+// shardSnapshot is the full shard map as of Seq. Log entries with a sequence
+// number at or below Seq are already contained in it.
+type shardSnapshot struct {
+	Seq    uint64        `json:"seq"`
+	Nodes  []nodeRecord  `json:"nodes"`
+	Shards []shardRecord `json:"shards"`
+}
+
+// ShardLog persists the shard map as a snapshot plus a write-ahead log of
+// every mutation made since that snapshot.
+type ShardLog struct {
+	mutex   sync.Mutex
+	dir     string
+	file    *os.File
+	seq     uint64
+	pending int
+}
+
+func OpenShardLog(directory string) (*ShardLog, error) {
+	if err := utils.EnsureDirectoryCreated(directory); err != nil {
+		return nil, fmt.Errorf("failed to create shard log directory %s: %w", directory, err)
+	}
+	file, err := os.OpenFile(filepath.Join(directory, walFile), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open shard log: %w", err)
+	}
+	return &ShardLog{dir: directory, file: file}, nil
+}
+
+// Replay hands the latest snapshot to restore and then every newer log entry
+// to apply. A torn entry at the tail of the log, left by a crash mid-write,
+// ends replay and is cut off. An entry is torn when it does not decode or
+// lacks its newline, since Append writes both at once and only then syncs.
+func (l *ShardLog) Replay(restore func(snapshot *shardSnapshot), apply func(entry *walEntry)) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	snapshot := &shardSnapshot{}
+	if data, err := os.ReadFile(filepath.Join(l.dir, snapshotFile)); err == nil {
+		if err := json.Unmarshal(data, snapshot); err != nil {
+			return fmt.Errorf("failed to decode shard snapshot: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read shard snapshot: %w", err)
+	}
+	l.seq = snapshot.Seq
+
+	if _, err := l.file.Seek(0, 0); err != nil {
+		return fmt.Errorf("failed to rewind shard log: %w", err)
+	}
+	reader := bufio.NewReader(l.file)
+	var entries []*walEntry
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read shard log: %w", err)
+		}
+		if len(line) == 0 {
+			break
+		}
+		entry := &walEntry{}
+		if err == io.EOF {
+			err = fmt.Errorf("no newline after %d bytes", len(line))
+		} else {
+			err = json.Unmarshal(line, entry)
+		}
+		if err != nil {
+			// Cut the torn entry off so new entries are not appended behind it
+			logger.ConsoleLog("WARN", "Dropping torn shard log entry after seq=%d: %v", l.seq, err)
+			if err := l.file.Truncate(offset); err != nil {
+				return fmt.Errorf("failed to truncate shard log: %w", err)
+			}
+			break
+		}
+		offset += int64(len(line))
+		if entry.Seq <= snapshot.Seq {
+			continue
+		}
+		entries = append(entries, entry)
+		l.seq = entry.Seq
+	}
+	restore(snapshot)
+	for _, entry := range entries {
+		apply(entry)
+	}
+	l.pending = len(entries)
+	return nil
+}
+
+// Append assigns the next sequence number to entry and makes it durable.
+func (l *ShardLog) Append(entry *walEntry) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	entry.Seq = l.seq + 1
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode shard log entry: %w", err)
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write shard log entry: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync shard log: %w", err)
+	}
+	l.seq = entry.Seq
+	l.pending++
+	return nil
+}
+
+// NeedsSnapshot reports whether enough entries have piled up in the log
+// since the last snapshot to make compacting it worthwhile.
+func (l *ShardLog) NeedsSnapshot() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.pending >= snapshotThreshold
+}
+
+// Snapshot writes the full shard map and truncates the log. Callers must hold
+// the store lock so no entry is appended while the snapshot is taken. The
+// snapshot is renamed into place before truncation, so a crash in between
+// only leaves entries behind that replay will skip.
+func (l *ShardLog) Snapshot(snapshot *shardSnapshot) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	snapshot.Seq = l.seq
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode shard snapshot: %w", err)
+	}
+	path := filepath.Join(l.dir, snapshotFile)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create shard snapshot: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write shard snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync shard snapshot: %w", err)
+	}
+	tmp.Close()
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to commit shard snapshot: %w", err)
+	}
+	if err := l.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate shard log: %w", err)
+	}
+	l.pending = 0
+	return nil
+}
+
+func (l *ShardLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,153 @@
+package shard
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func openTestLog(t *testing.T, dir string) *ShardLog {
+	t.Helper()
+	log, err := OpenShardLog(dir)
+	if err != nil {
+		t.Fatalf("OpenShardLog(%s) error = %v", dir, err)
+	}
+	t.Cleanup(func() { log.Close() })
+	return log
+}
+
+func appendTestEntries(t *testing.T, log *ShardLog, addresses ...string) {
+	t.Helper()
+	for _, address := range addresses {
+		if err := log.Append(&walEntry{Op: walRegisterNode, Node: &nodeRecord{Address: address}}); err != nil {
+			t.Fatalf("Append(%s) error = %v", address, err)
+		}
+	}
+}
+
+func appendTestBytes(t *testing.T, dir string, data string) {
+	t.Helper()
+	file, err := os.OpenFile(filepath.Join(dir, walFile), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("failed to open the log: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(data); err != nil {
+		t.Fatalf("failed to write to the log: %v", err)
+	}
+}
+
+// replayTestLog replays log and returns the snapshot sequence number and the
+// addresses of the replayed entries.
+func replayTestLog(t *testing.T, log *ShardLog) (uint64, []string) {
+	t.Helper()
+	var snapshotSeq uint64
+	addresses := make([]string, 0)
+	err := log.Replay(func(snapshot *shardSnapshot) {
+		snapshotSeq = snapshot.Seq
+	}, func(entry *walEntry) {
+		addresses = append(addresses, entry.Node.Address)
+	})
+	if err != nil {
+		t.Fatalf("Replay() error = %v", err)
+	}
+	return snapshotSeq, addresses
+}
+
+func TestShardLogReplay(t *testing.T) {
+	tests := []struct {
+		name        string
+		setup       func(t *testing.T, dir string)
+		snapshotSeq uint64
+		replayed    []string
+	}{
+		{
+			name:     "empty log",
+			setup:    func(t *testing.T, dir string) {},
+			replayed: []string{},
+		},
+		{
+			name: "complete entries",
+			setup: func(t *testing.T, dir string) {
+				appendTestEntries(t, openTestLog(t, dir), "a", "b", "c")
+			},
+			replayed: []string{"a", "b", "c"},
+		},
+		{
+			name: "truncated tail",
+			setup: func(t *testing.T, dir string) {
+				appendTestEntries(t, openTestLog(t, dir), "a", "b")
+				appendTestBytes(t, dir, `{"seq":3,"op":"register_no`)
+			},
+			replayed: []string{"a", "b"},
+		},
+		{
+			name: "truncated tail ending in a newline",
+			setup: func(t *testing.T, dir string) {
+				appendTestEntries(t, openTestLog(t, dir), "a")
+				appendTestBytes(t, dir, "{\"seq\":2,\n")
+			},
+			replayed: []string{"a"},
+		},
+		{
+			name: "complete entry without its newline",
+			setup: func(t *testing.T, dir string) {
+				appendTestEntries(t, openTestLog(t, dir), "a")
+				appendTestBytes(t, dir, `{"seq":2,"op":"register_node","node":{"address":"b","internalAddress":""}}`)
+			},
+			replayed: []string{"a"},
+		},
+		{
+			name: "entries after a snapshot",
+			setup: func(t *testing.T, dir string) {
+				log := openTestLog(t, dir)
+				appendTestEntries(t, log, "a", "b")
+				if err := log.Snapshot(&shardSnapshot{}); err != nil {
+					t.Fatalf("Snapshot() error = %v", err)
+				}
+				appendTestEntries(t, log, "c")
+			},
+			snapshotSeq: 2,
+			replayed:    []string{"c"},
+		},
+		{
+			name: "entries left behind a snapshot",
+			setup: func(t *testing.T, dir string) {
+				appendTestEntries(t, openTestLog(t, dir), "a", "b", "c")
+				// A crash between committing a snapshot and truncating the log
+				if err := os.WriteFile(filepath.Join(dir, snapshotFile), []byte(`{"seq":2}`), 0644); err != nil {
+					t.Fatalf("failed to write the snapshot: %v", err)
+				}
+			},
+			snapshotSeq: 2,
+			replayed:    []string{"c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tt.setup(t, dir)
+
+			log := openTestLog(t, dir)
+			snapshotSeq, replayed := replayTestLog(t, log)
+			if snapshotSeq != tt.snapshotSeq || !reflect.DeepEqual(replayed, tt.replayed) {
+				t.Fatalf("Replay() = snapshot seq %d, entries %v; want %d, %v", snapshotSeq, replayed, tt.snapshotSeq, tt.replayed)
+			}
+
+			// New entries carry on from the last replayed one and replay
+			// again, the torn tail gone
+			entry := &walEntry{Op: walRegisterNode, Node: &nodeRecord{Address: "next"}}
+			if err := log.Append(entry); err != nil {
+				t.Fatalf("Append() after replay error = %v", err)
+			}
+			if want := tt.snapshotSeq + uint64(len(tt.replayed)) + 1; entry.Seq != want {
+				t.Errorf("Append() after replay seq = %d; want %d", entry.Seq, want)
+			}
+			_, replayed = replayTestLog(t, openTestLog(t, dir))
+			if want := append(tt.replayed, "next"); !reflect.DeepEqual(replayed, want) {
+				t.Errorf("Replay() after append = %v; want %v", replayed, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,483 @@
+package internals
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kokaq/core/internals/logger"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
+	otellog "go.opentelemetry.io/otel/log"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+)
+
+const (
+	defaultTelemetryBuffer      = 1024
+	defaultTelemetryFileMaxSize = 100 << 20
+	defaultTelemetryFileBackups = 3
+)
+
+// TelemetryConfig selects where telemetry events go. Sinks is a comma
+// separated list of console, file (JSON lines appended to File, rotated at
+// MaxFileBytes keeping MaxFileBackups old files) and otlp (OTLP logs over
+// gRPC to Endpoint, a local collector at localhost:4317 by default).
+//
+// Sampling keeps a fraction of each event, keyed by event name with "*" for
+// the rest, e.g. "health_check_requested=0.01,*=1". Buffer is the number of
+// events queued for the sinks before new ones are dropped; a negative buffer
+// delivers events synchronously.
+type TelemetryConfig struct {
+	Sinks          string
+	File           string
+	MaxFileBytes   int
+	MaxFileBackups int
+	Endpoint       string
+	Sampling       map[string]float64
+	Buffer         int
+	ServiceName    string
+}
+
+// ParseTelemetrySampling reads comma separated event=rate pairs with rates
+// between 0 and 1.
+func ParseTelemetrySampling(sampling string) (map[string]float64, error) {
+	parsed := make(map[string]float64)
+	for _, pair := range strings.Split(sampling, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		event, value, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("telemetry sampling %q is not event=rate", pair)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("telemetry sampling %q has a rate outside 0..1", pair)
+		}
+		parsed[strings.TrimSpace(event)] = rate
+	}
+	return parsed, nil
+}
+
+// WithEnvDefaults fills the fields left empty from the TELEMETRY_SINKS,
+// TELEMETRY_FILE, TELEMETRY_FILE_MAX_BYTES, TELEMETRY_FILE_BACKUPS,
+// TELEMETRY_OTLP_ENDPOINT, TELEMETRY_SAMPLING and TELEMETRY_BUFFER
+// environment variables, then applies the defaults: console only, 100MB
+// files with 3 backups and a buffer of 1024 events.
+func (config TelemetryConfig) WithEnvDefaults() (TelemetryConfig, error) {
+	fields := []struct {
+		value *string
+		env   string
+	}{
+		{&config.Sinks, "TELEMETRY_SINKS"},
+		{&config.File, "TELEMETRY_FILE"},
+		{&config.Endpoint, "TELEMETRY_OTLP_ENDPOINT"},
+	}
+	for _, field := range fields {
+		if *field.value == "" {
+			*field.value = os.Getenv(field.env)
+		}
+	}
+	counts := []struct {
+		value *int
+		env   string
+	}{
+		{&config.MaxFileBytes, "TELEMETRY_FILE_MAX_BYTES"},
+		{&config.MaxFileBackups, "TELEMETRY_FILE_BACKUPS"},
+		{&config.Buffer, "TELEMETRY_BUFFER"},
+	}
+	for _, count := range counts {
+		if value := os.Getenv(count.env); *count.value == 0 && value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return config, fmt.Errorf("bad %s %q: %v", count.env, value, err)
+			}
+			*count.value = parsed
+		}
+	}
+	sampling, err := ParseTelemetrySampling(os.Getenv("TELEMETRY_SAMPLING"))
+	if err != nil {
+		return config, err
+	}
+	maps.Copy(sampling, config.Sampling)
+	config.Sampling = sampling
+
+	if config.Sinks == "" {
+		config.Sinks = "console"
+	}
+	if config.MaxFileBytes == 0 {
+		config.MaxFileBytes = defaultTelemetryFileMaxSize
+	}
+	if config.MaxFileBackups == 0 {
+		config.MaxFileBackups = defaultTelemetryFileBackups
+	}
+	if config.Buffer == 0 {
+		config.Buffer = defaultTelemetryBuffer
+	}
+	return config, nil
+}
+
+func (config TelemetryConfig) sinks() []string {
+	sinks := make([]string, 0)
+	for _, sink := range strings.Split(config.Sinks, ",") {
+		if sink = strings.TrimSpace(sink); sink != "" && sink != "none" {
+			sinks = append(sinks, sink)
+		}
+	}
+	return sinks
+}
+
+// Mode describes the telemetry sinks for startup banners.
+func (config TelemetryConfig) Mode() string {
+	modes := make([]string, 0)
+	for _, sink := range config.sinks() {
+		switch sink {
+		case "file":
+			modes = append(modes, fmt.Sprintf("File [%s]", config.File))
+		case "otlp":
+			if config.Endpoint == "" {
+				modes = append(modes, "OTLP [localhost:4317]")
+			} else {
+				modes = append(modes, fmt.Sprintf("OTLP [%s]", config.Endpoint))
+			}
+		default:
+			modes = append(modes, "Console")
+		}
+	}
+	if len(modes) == 0 {
+		return "Disabled"
+	}
+	return strings.Join(modes, ", ")
+}
+
+// TelemetrySink is a TelemetryLogger holding resources, which Close flushes
+// and releases. Events logged after Close are dropped.
+type TelemetrySink interface {
+	TelemetryLogger
+	Close() error
+}
+
+type telemetryEvent struct {
+	at     time.Time
+	name   string
+	fields map[string]interface{}
+}
+
+// telemetryWriter is a sink of the fan-out, writing events already sampled
+// and timestamped.
+type telemetryWriter interface {
+	write(event telemetryEvent)
+	Close() error
+}
+
+// NewTelemetryLogger builds the sinks of config behind a fan-out that samples
+// and buffers events.
+func NewTelemetryLogger(ctx context.Context, config TelemetryConfig) (TelemetrySink, error) {
+	writers := make([]telemetryWriter, 0)
+	for _, sink := range config.sinks() {
+		var writer telemetryWriter
+		var err error
+		switch sink {
+		case "console":
+			writer = consoleTelemetryWriter{}
+		case "file":
+			writer, err = newFileTelemetryWriter(config.File, config.MaxFileBytes, config.MaxFileBackups)
+		case "otlp":
+			writer, err = newOTLPTelemetryWriter(ctx, config.Endpoint, config.ServiceName)
+		default:
+			err = fmt.Errorf("unknown telemetry sink %q, expected console, file or otlp", sink)
+		}
+		if err != nil {
+			for _, opened := range writers {
+				opened.Close()
+			}
+			return nil, err
+		}
+		writers = append(writers, writer)
+	}
+	return newTelemetryFanout(writers, config.Sampling, config.Buffer), nil
+}
+
+// telemetryFanout sends every sampled event to all its writers, from a
+// background goroutine when buffered.
+type telemetryFanout struct {
+	mutex    sync.RWMutex
+	writers  []telemetryWriter
+	sampling map[string]float64
+	events   chan telemetryEvent
+	done     chan struct{}
+	closed   bool
+	dropped  atomic.Uint64
+}
+
+func newTelemetryFanout(writers []telemetryWriter, sampling map[string]float64, buffer int) *telemetryFanout {
+	f := &telemetryFanout{
+		writers:  writers,
+		sampling: sampling,
+	}
+	if buffer > 0 {
+		f.events = make(chan telemetryEvent, buffer)
+		f.done = make(chan struct{})
+		go f.drain()
+	}
+	return f
+}
+
+func (f *telemetryFanout) sampled(event string) bool {
+	rate, exist := f.sampling[event]
+	if !exist {
+		rate, exist = f.sampling["*"]
+	}
+	return !exist || rate >= 1 || rand.Float64() < rate
+}
+
+func (f *telemetryFanout) LogEvent(event string, fields map[string]interface{}) {
+	if len(f.writers) == 0 || !f.sampled(event) {
+		return
+	}
+	e := telemetryEvent{at: time.Now(), name: event, fields: maps.Clone(fields)}
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if f.closed {
+		return
+	}
+	if f.events == nil {
+		f.write(e)
+		return
+	}
+	select {
+	case f.events <- e:
+	default:
+		// Keep the caller, usually an RPC, from waiting on a slow sink.
+		if dropped := f.dropped.Add(1); dropped%1000 == 1 {
+			logger.ConsoleLog("WARN", "Telemetry buffer full, %d events dropped so far", dropped)
+		}
+	}
+}
+
+func (f *telemetryFanout) write(event telemetryEvent) {
+	for _, writer := range f.writers {
+		writer.write(event)
+	}
+}
+
+func (f *telemetryFanout) drain() {
+	defer close(f.done)
+	for event := range f.events {
+		f.write(event)
+	}
+}
+
+// Close delivers the buffered events and closes every writer.
+func (f *telemetryFanout) Close() error {
+	f.mutex.Lock()
+	if f.closed {
+		f.mutex.Unlock()
+		return nil
+	}
+	f.closed = true
+	if f.events != nil {
+		close(f.events)
+	}
+	f.mutex.Unlock()
+	if f.done != nil {
+		<-f.done
+	}
+	var err error
+	for _, writer := range f.writers {
+		err = errors.Join(err, writer.Close())
+	}
+	if dropped := f.dropped.Load(); dropped > 0 {
+		logger.ConsoleLog("WARN", "Telemetry dropped %d events on a full buffer", dropped)
+	}
+	return err
+}
+
+// consoleTelemetryWriter prints events through the console logger.
+type consoleTelemetryWriter struct{}
+
+func (consoleTelemetryWriter) write(event telemetryEvent) {
+	logger.ConsoleLog("INFO", "Telemetry event: %s, data: %v", event.name, event.fields)
+}
+
+func (consoleTelemetryWriter) Close() error {
+	return nil
+}
+
+// fileTelemetryWriter appends events to path as JSON lines. Once the file
+// would grow past maxBytes it becomes path.1, older files shift up to
+// path.<backups> and the oldest is removed.
+type fileTelemetryWriter struct {
+	mutex    sync.Mutex
+	path     string
+	maxBytes int64
+	backups  int
+	file     *os.File
+	size     int64
+}
+
+func newFileTelemetryWriter(path string, maxBytes int, backups int) (*fileTelemetryWriter, error) {
+	if path == "" {
+		return nil, fmt.Errorf("file telemetry sink needs a file")
+	}
+	w := &fileTelemetryWriter{path: path, maxBytes: int64(maxBytes), backups: backups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *fileTelemetryWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open telemetry file %s: %v", w.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+func (w *fileTelemetryWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+	os.Remove(fmt.Sprintf("%s.%d", w.path, w.backups))
+	for i := w.backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+	}
+	if w.backups > 0 {
+		if err := os.Rename(w.path, w.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(w.path); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+func (w *fileTelemetryWriter) write(event telemetryEvent) {
+	line, err := json.Marshal(map[string]interface{}{
+		"time":   event.at.UTC().Format(time.RFC3339Nano),
+		"event":  event.name,
+		"fields": event.fields,
+	})
+	if err != nil {
+		logger.ConsoleLog("WARN", "Cannot encode telemetry event %s: %v", event.name, err)
+		return
+	}
+	line = append(line, '\n')
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.file == nil {
+		return
+	}
+	if w.size > 0 && w.size+int64(len(line)) > w.maxBytes {
+		if err := w.rotate(); err != nil {
+			logger.ConsoleLog("ERROR", "Failed to rotate telemetry file %s: %v", w.path, err)
+			if w.file == nil {
+				return
+			}
+		}
+	}
+	n, err := w.file.Write(line)
+	w.size += int64(n)
+	if err != nil {
+		logger.ConsoleLog("WARN", "Failed to write telemetry event %s: %v", event.name, err)
+	}
+}
+
+func (w *fileTelemetryWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// otlpTelemetryWriter exports events as OTLP log records named after the
+// event, with the fields as attributes.
+type otlpTelemetryWriter struct {
+	provider *sdklog.LoggerProvider
+	logger   otellog.Logger
+}
+
+func newOTLPTelemetryWriter(ctx context.Context, endpoint string, serviceName string) (*otlpTelemetryWriter, error) {
+	options := []otlploggrpc.Option{otlploggrpc.WithInsecure()}
+	if endpoint != "" {
+		options = append(options, otlploggrpc.WithEndpoint(endpoint))
+	}
+	exporter, err := otlploggrpc.New(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create otlp log exporter: %v", err)
+	}
+	res, err := serviceResource(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdklog.NewLoggerProvider(
+		sdklog.WithProcessor(sdklog.NewBatchProcessor(exporter)),
+		sdklog.WithResource(res),
+	)
+	return &otlpTelemetryWriter{
+		provider: provider,
+		logger:   provider.Logger("github.com/kokaq/server/internals"),
+	}, nil
+}
+
+func (w *otlpTelemetryWriter) write(event telemetryEvent) {
+	var record otellog.Record
+	record.SetTimestamp(event.at)
+	record.SetEventName(event.name)
+	record.SetBody(otellog.StringValue(event.name))
+	record.SetSeverity(otellog.SeverityInfo)
+	for key, value := range event.fields {
+		record.AddAttributes(otellog.KeyValue{Key: key, Value: telemetryValue(value)})
+	}
+	w.logger.Emit(context.Background(), record)
+}
+
+func telemetryValue(value interface{}) otellog.Value {
+	switch v := value.(type) {
+	case string:
+		return otellog.StringValue(v)
+	case bool:
+		return otellog.BoolValue(v)
+	case int:
+		return otellog.IntValue(v)
+	case int64:
+		return otellog.Int64Value(v)
+	case uint32:
+		return otellog.Int64Value(int64(v))
+	case float64:
+		return otellog.Float64Value(v)
+	case time.Duration:
+		return otellog.StringValue(v.String())
+	case error:
+		return otellog.StringValue(v.Error())
+	}
+	return otellog.StringValue(fmt.Sprint(value))
+}
+
+func (w *otlpTelemetryWriter) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return w.provider.Shutdown(ctx)
+}
@@ -0,0 +1,1005 @@
+package internals
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kokaq/core/internals/logger"
+	"github.com/kokaq/protocol/proto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	sqsJSONContentType = "application/x-amz-json-1.0"
+	sqsTargetPrefix    = "AmazonSQS."
+	sqsXMLNamespace    = "http://queue.amazonaws.com/doc/2012-11-05/"
+
+	sqsDefaultNamespace     = "default"
+	sqsMaxMessages          = 10
+	sqsMaxMessageSize       = 256 << 10
+	sqsMaxWait              = 20
+	sqsMaxVisibilityTimeout = 12 * 60 * 60
+	sqsMaxDelay             = 15 * 60
+	sqsMinRetention         = 60
+	sqsMaxRetention         = 14 * 24 * 60 * 60
+	sqsDefaultVisibility    = 30
+
+	// SQS messages have no priority, so they all go in at the same one.
+	sqsPriority = 1
+)
+
+// Prefix of the attributes recording the data type of SQS message
+// attributes other than String. The attributes themselves are stored under
+// their own names, so they are plain attributes to non-SQS clients.
+const sqsDataTypePrefix = "sqs.type."
+
+var sqsQueueName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,80}$`)
+
+// SQSBroker carries out what SQS clients ask of an SQSHandler. ctx carries
+// the credentials of the client. Errors are gRPC statuses; NotFound means
+// the queue does not exist.
+type SQSBroker interface {
+	// CreateQueue creates the queue config describes unless it exists.
+	CreateQueue(ctx context.Context, config *proto.KokaqQueueRequest) error
+	// GetQueue returns the configuration of a queue.
+	GetQueue(ctx context.Context, namespace string, queue string) (*proto.KokaqQueueRequest, error)
+	DeleteQueue(ctx context.Context, namespace string, queue string) error
+	PurgeQueue(ctx context.Context, namespace string, queue string) error
+	QueueStats(ctx context.Context, namespace string, queue string) (map[string]uint64, error)
+	Send(ctx context.Context, message *proto.KokaqMessageRequest) (string, error)
+	// Receive locks up to count messages of queue for visibilityTimeout
+	// seconds, the queue default when zero, waiting up to wait for the first
+	// to arrive. It returns none when the queue stays empty.
+	Receive(ctx context.Context, namespace string, queue string, count int, visibilityTimeout uint32, wait time.Duration) ([]*proto.LockedMessage, error)
+	// Delete acks a received message. It fails with FailedPrecondition when
+	// the lock is no longer held.
+	Delete(ctx context.Context, namespace string, queue string, lockId string, messageId string) error
+	// ChangeVisibility makes a received message visible again after timeout,
+	// straight away when timeout is zero. It fails with FailedPrecondition
+	// when the lock is no longer held.
+	ChangeVisibility(ctx context.Context, namespace string, queue string, lockId string, messageId string, timeout time.Duration) error
+}
+
+// SQSHandler serves the Amazon SQS API, in both its JSON and its query
+// protocol, on top of an SQSBroker. Queue URLs read
+// scheme://host/{namespace}/{queue}: the namespace takes the place of the
+// AWS account. Calls that name no queue URL, such as CreateQueue, use the
+// namespace in the first segment of the endpoint path, "default" when the
+// endpoint has none.
+//
+// Receipt handles carry the lock of the received message. AWS signatures are
+// not verified, since the cluster keeps no secret per access key, so signed
+// requests carry no credentials: callers authenticate with an x-api-key header
+// or a bearer token, which the gRPC servers check as usual.
+type SQSHandler struct {
+	broker  SQSBroker
+	actions map[string]func(ctx context.Context, call *sqsCall) (any, error)
+}
+
+func NewSQSHandler(broker SQSBroker) *SQSHandler {
+	h := &SQSHandler{broker: broker}
+	h.actions = map[string]func(ctx context.Context, call *sqsCall) (any, error){
+		"CreateQueue":             h.createQueue,
+		"GetQueueUrl":             h.getQueueUrl,
+		"GetQueueAttributes":      h.getQueueAttributes,
+		"DeleteQueue":             h.deleteQueue,
+		"PurgeQueue":              h.purgeQueue,
+		"SendMessage":             h.sendMessage,
+		"ReceiveMessage":          h.receiveMessage,
+		"DeleteMessage":           h.deleteMessage,
+		"ChangeMessageVisibility": h.changeMessageVisibility,
+	}
+	return h
+}
+
+// sqsCall is a request in either protocol. input holds its parameters as
+// the JSON protocol sends them; query protocol parameters are converted.
+type sqsCall struct {
+	action    string
+	json      bool
+	input     []byte
+	base      url.URL
+	path      string
+	requestId string
+}
+
+func (c *sqsCall) decode(v any) error {
+	if len(bytes.TrimSpace(c.input)) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(c.input, v); err != nil {
+		return sqsErrorf(sqsInvalidParameterValue, "cannot read %s parameters: %v", c.action, err)
+	}
+	return nil
+}
+
+// namespace is the namespace of calls that name no queue URL.
+func (c *sqsCall) namespace() string {
+	namespace, _, _ := strings.Cut(strings.Trim(c.path, "/"), "/")
+	if namespace == "" {
+		return sqsDefaultNamespace
+	}
+	return namespace
+}
+
+// queue resolves a queue URL, or the request path when the URL is empty as
+// query protocol clients post to the queue URL itself.
+func (c *sqsCall) queue(queueUrl string) (string, string, error) {
+	path := c.path
+	if queueUrl != "" {
+		parsed, err := url.Parse(queueUrl)
+		if err != nil {
+			return "", "", sqsErrorf(sqsQueueDoesNotExist, "invalid queue URL %q", queueUrl)
+		}
+		path = parsed.Path
+	}
+	namespace, queue, found := strings.Cut(strings.Trim(path, "/"), "/")
+	if !found || namespace == "" || queue == "" || strings.Contains(queue, "/") {
+		return "", "", sqsErrorf(sqsQueueDoesNotExist, "invalid queue URL %q", queueUrl)
+	}
+	return namespace, queue, nil
+}
+
+func (c *sqsCall) queueUrl(namespace string, queue string) string {
+	u := c.base
+	u.Path = "/" + namespace + "/" + queue
+	return u.String()
+}
+
+func (h *SQSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	call, err := readSQSCall(w, r)
+	if err != nil {
+		writeSQSError(w, call, err)
+		return
+	}
+	action, known := h.actions[call.action]
+	if !known {
+		code := sqsInvalidAction
+		if call.json {
+			code = sqsUnknownOperation
+		}
+		writeSQSError(w, call, sqsErrorf(code, "the action %s is not valid for this endpoint", call.action))
+		return
+	}
+	result, err := action(sqsContext(r), call)
+	if err != nil {
+		writeSQSError(w, call, err)
+		return
+	}
+	writeSQSResult(w, call, result)
+}
+
+func readSQSCall(w http.ResponseWriter, r *http.Request) (*sqsCall, error) {
+	call := &sqsCall{
+		path:      r.URL.Path,
+		requestId: uuid.NewString(),
+		base:      url.URL{Scheme: "http", Host: r.Host},
+	}
+	if r.TLS != nil {
+		call.base.Scheme = "https"
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxGatewayBody)
+	if target := r.Header.Get("X-Amz-Target"); target != "" {
+		call.json = true
+		call.action = strings.TrimPrefix(target, sqsTargetPrefix)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return call, sqsErrorf(sqsInvalidParameterValue, "cannot read body: %v", err)
+		}
+		call.input = body
+		return call, nil
+	}
+	if err := r.ParseForm(); err != nil {
+		return call, sqsErrorf(sqsInvalidParameterValue, "cannot read parameters: %v", err)
+	}
+	call.action = r.Form.Get("Action")
+	if call.action == "" {
+		return call, sqsErrorf(sqsMissingAction, "the request must contain the parameter Action")
+	}
+	input, err := sqsQueryInput(r.Form)
+	if err != nil {
+		return call, sqsErrorf(sqsInvalidParameterValue, "cannot read parameters: %v", err)
+	}
+	call.input = input
+	return call, nil
+}
+
+// sqsQueryInput turns the flattened parameters of the query protocol into
+// the JSON the JSON protocol sends for them. Lists come as Name.1, Name.2...
+// and maps as Name.N.Name, or Name.N.Key, with Name.N.Value or
+// Name.N.Value.Field; either becomes the field Names.
+func sqsQueryInput(form url.Values) ([]byte, error) {
+	input := make(map[string]any)
+	lists := make(map[string]map[int]string)
+	maps := make(map[string]map[int]map[string]string)
+	for key, values := range form {
+		value := values[len(values)-1]
+		parts := strings.SplitN(key, ".", 3)
+		index, err := 0, error(nil)
+		if len(parts) > 1 {
+			index, err = strconv.Atoi(parts[1])
+		}
+		switch {
+		case len(parts) == 1 || err != nil || index < 1:
+			input[key] = value
+		case len(parts) == 2:
+			if lists[parts[0]] == nil {
+				lists[parts[0]] = make(map[int]string)
+			}
+			lists[parts[0]][index] = value
+		default:
+			if maps[parts[0]] == nil {
+				maps[parts[0]] = make(map[int]map[string]string)
+			}
+			if maps[parts[0]][index] == nil {
+				maps[parts[0]][index] = make(map[string]string)
+			}
+			maps[parts[0]][index][parts[2]] = value
+		}
+	}
+	for name, items := range lists {
+		indexes := make([]int, 0, len(items))
+		for index := range items {
+			indexes = append(indexes, index)
+		}
+		sort.Ints(indexes)
+		list := make([]string, 0, len(items))
+		for _, index := range indexes {
+			list = append(list, items[index])
+		}
+		input[name+"s"] = list
+	}
+	for name, entries := range maps {
+		object := make(map[string]any)
+		for _, entry := range entries {
+			key, found := entry["Name"]
+			if !found {
+				key = entry["Key"]
+			}
+			if value, found := entry["Value"]; found {
+				object[key] = value
+				continue
+			}
+			value := make(map[string]string)
+			for field, v := range entry {
+				if field, found := strings.CutPrefix(field, "Value."); found {
+					value[field] = v
+				}
+			}
+			object[key] = value
+		}
+		input[name+"s"] = object
+	}
+	return json.Marshal(input)
+}
+
+// sqsContext carries the caller's credentials and trace context into the
+// broker's gRPC calls. Bearer tokens and API key headers pass as is; AWS
+// signatures are dropped, their access key id being no secret.
+func sqsContext(r *http.Request) context.Context {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	md := metadata.MD{}
+	if authorization := r.Header.Get(authorizationHeader); strings.HasPrefix(authorization, "Bearer ") {
+		md.Set(authorizationHeader, authorization)
+	}
+	if apiKey := r.Header.Get(apiKeyHeader); apiKey != "" {
+		md.Set(apiKeyHeader, apiKey)
+	}
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// sqsInt is a number sent as a JSON number by the JSON protocol and as a
+// string by the query protocol.
+type sqsInt struct {
+	value int64
+	set   bool
+}
+
+func (i *sqsInt) UnmarshalJSON(data []byte) error {
+	text := strings.Trim(string(data), `"`)
+	value, err := strconv.ParseInt(text, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%s is not an integer", data)
+	}
+	*i = sqsInt{value: value, set: true}
+	return nil
+}
+
+// in checks the number, when set, lies in [low, high].
+func (i sqsInt) in(name string, low int64, high int64) error {
+	if i.set && (i.value < low || i.value > high) {
+		return sqsErrorf(sqsInvalidParameterValue, "value %d for parameter %s is invalid, it must be between %d and %d", i.value, name, low, high)
+	}
+	return nil
+}
+
+func (i sqsInt) or(value int64) int64 {
+	if i.set {
+		return i.value
+	}
+	return value
+}
+
+type sqsMessageAttribute struct {
+	DataType    string
+	StringValue string `json:",omitempty"`
+	BinaryValue []byte `json:",omitempty"`
+}
+
+// sqsAttributes are written as Name/Value pairs in XML.
+type sqsAttributes map[string]string
+
+func (a sqsAttributes) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	names := make([]string, 0, len(a))
+	for name := range a {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entry := struct {
+			Name  string
+			Value string
+		}{name, a[name]}
+		if err := e.EncodeElement(entry, start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqsMessageAttributes are written as Name/Value pairs in XML, with binary
+// values in base64 as in JSON.
+type sqsMessageAttributes map[string]sqsMessageAttribute
+
+func (a sqsMessageAttributes) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	names := make([]string, 0, len(a))
+	for name := range a {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		attribute := a[name]
+		entry := struct {
+			Name  string
+			Value struct {
+				DataType    string
+				StringValue string `xml:",omitempty"`
+				BinaryValue string `xml:",omitempty"`
+			}
+		}{Name: name}
+		entry.Value.DataType = attribute.DataType
+		entry.Value.StringValue = attribute.StringValue
+		if attribute.BinaryValue != nil {
+			entry.Value.BinaryValue = base64.StdEncoding.EncodeToString(attribute.BinaryValue)
+		}
+		if err := e.EncodeElement(entry, start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type sqsMessage struct {
+	MessageId              string
+	ReceiptHandle          string
+	MD5OfBody              string
+	Body                   string
+	Attributes             sqsAttributes        `json:",omitempty" xml:"Attribute,omitempty"`
+	MD5OfMessageAttributes string               `json:",omitempty" xml:",omitempty"`
+	MessageAttributes      sqsMessageAttributes `json:",omitempty" xml:"MessageAttribute,omitempty"`
+}
+
+type sqsQueueUrlResult struct {
+	QueueUrl string
+}
+
+func (h *SQSHandler) createQueue(ctx context.Context, call *sqsCall) (any, error) {
+	var input struct {
+		QueueName  string
+		Attributes map[string]string
+	}
+	if err := call.decode(&input); err != nil {
+		return nil, err
+	}
+	if !sqsQueueName.MatchString(input.QueueName) {
+		return nil, sqsErrorf(sqsInvalidParameterValue, "queue names are 1 to 80 alphanumeric characters, hyphens and underscores")
+	}
+	config := &proto.KokaqQueueRequest{Namespace: call.namespace(), Queue: input.QueueName}
+	for name, value := range input.Attributes {
+		switch name {
+		case "VisibilityTimeout":
+			timeout, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || timeout > sqsMaxVisibilityTimeout {
+				return nil, sqsErrorf(sqsInvalidAttributeValue, "invalid value for the parameter VisibilityTimeout")
+			}
+			config.DefaultVisibilityTimeout = uint32(timeout)
+		case "RedrivePolicy":
+			var policy struct {
+				MaxReceiveCount sqsInt `json:"maxReceiveCount"`
+			}
+			if err := json.Unmarshal([]byte(value), &policy); err != nil || !policy.MaxReceiveCount.set || policy.MaxReceiveCount.in("maxReceiveCount", 1, 1000) != nil {
+				return nil, sqsErrorf(sqsInvalidAttributeValue, "invalid value for the parameter RedrivePolicy")
+			}
+			config.EnableDeadLetter = true
+			config.MaxDequeueCount = uint32(policy.MaxReceiveCount.value)
+		case "DelaySeconds", "ReceiveMessageWaitTimeSeconds":
+			if value != "0" {
+				return nil, sqsErrorf(sqsInvalidAttributeValue, "%s is not supported", name)
+			}
+		case "FifoQueue", "ContentBasedDeduplication":
+			if value != "false" {
+				return nil, sqsErrorf(sqsInvalidAttributeValue, "FIFO queues are not supported")
+			}
+		case "MessageRetentionPeriod":
+			retention, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || retention < sqsMinRetention || retention > sqsMaxRetention {
+				return nil, sqsErrorf(sqsInvalidAttributeValue, "invalid value for the parameter MessageRetentionPeriod")
+			}
+			config.DefaultTtlMs = uint32(retention * 1000)
+		case "MaximumMessageSize", "Policy", "KmsMasterKeyId", "KmsDataKeyReusePeriodSeconds", "SqsManagedSseEnabled":
+			// Accepted for compatibility, with no effect.
+		default:
+			return nil, sqsErrorf(sqsInvalidAttributeName, "unknown attribute %s", name)
+		}
+	}
+	if err := h.broker.CreateQueue(ctx, config); err != nil {
+		return nil, sqsBackendError(err)
+	}
+	return &sqsQueueUrlResult{QueueUrl: call.queueUrl(config.Namespace, config.Queue)}, nil
+}
+
+func (h *SQSHandler) getQueueUrl(ctx context.Context, call *sqsCall) (any, error) {
+	var input struct {
+		QueueName              string
+		QueueOwnerAWSAccountId string
+	}
+	if err := call.decode(&input); err != nil {
+		return nil, err
+	}
+	namespace := input.QueueOwnerAWSAccountId
+	if namespace == "" {
+		namespace = call.namespace()
+	}
+	if _, err := h.broker.GetQueue(ctx, namespace, input.QueueName); err != nil {
+		return nil, sqsBackendError(err)
+	}
+	return &sqsQueueUrlResult{QueueUrl: call.queueUrl(namespace, input.QueueName)}, nil
+}
+
+func (h *SQSHandler) getQueueAttributes(ctx context.Context, call *sqsCall) (any, error) {
+	var input struct {
+		QueueUrl       string
+		AttributeNames []string
+	}
+	if err := call.decode(&input); err != nil {
+		return nil, err
+	}
+	namespace, queue, err := call.queue(input.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+	config, err := h.broker.GetQueue(ctx, namespace, queue)
+	if err != nil {
+		return nil, sqsBackendError(err)
+	}
+	stats, err := h.broker.QueueStats(ctx, namespace, queue)
+	if err != nil {
+		return nil, sqsBackendError(err)
+	}
+	visibilityTimeout := config.GetDefaultVisibilityTimeout()
+	if visibilityTimeout == 0 {
+		visibilityTimeout = sqsDefaultVisibility
+	}
+	available := sqsAttributes{
+		"ApproximateNumberOfMessages":           strconv.FormatUint(stats["depth"], 10),
+		"ApproximateNumberOfMessagesNotVisible": strconv.FormatUint(stats["in_flight"], 10),
+		"ApproximateNumberOfMessagesDelayed":    strconv.FormatUint(stats["scheduled"], 10),
+		"VisibilityTimeout":                     strconv.FormatUint(uint64(visibilityTimeout), 10),
+		"DelaySeconds":                          "0",
+		"ReceiveMessageWaitTimeSeconds":         "0",
+		"MaximumMessageSize":                    strconv.Itoa(sqsMaxMessageSize),
+		"QueueArn":                              "arn:aws:sqs:kokaq:" + namespace + ":" + queue,
+	}
+	if config.GetDefaultTtlMs() > 0 {
+		available["MessageRetentionPeriod"] = strconv.FormatUint(uint64(config.GetDefaultTtlMs()/1000), 10)
+	}
+	if config.GetEnableDeadLetter() {
+		available["RedrivePolicy"] = fmt.Sprintf(`{"maxReceiveCount":%d}`, config.GetMaxDequeueCount())
+	}
+	attributes := sqsAttributes{}
+	for _, name := range input.AttributeNames {
+		if name == "All" {
+			attributes = available
+			break
+		}
+		value, known := available[name]
+		if !known {
+			return nil, sqsErrorf(sqsInvalidAttributeName, "unknown attribute %s", name)
+		}
+		attributes[name] = value
+	}
+	return &struct {
+		Attributes sqsAttributes `json:",omitempty" xml:"Attribute,omitempty"`
+	}{attributes}, nil
+}
+
+func (h *SQSHandler) deleteQueue(ctx context.Context, call *sqsCall) (any, error) {
+	var input struct{ QueueUrl string }
+	if err := call.decode(&input); err != nil {
+		return nil, err
+	}
+	namespace, queue, err := call.queue(input.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+	return nil, sqsBackendError(h.broker.DeleteQueue(ctx, namespace, queue))
+}
+
+func (h *SQSHandler) purgeQueue(ctx context.Context, call *sqsCall) (any, error) {
+	var input struct{ QueueUrl string }
+	if err := call.decode(&input); err != nil {
+		return nil, err
+	}
+	namespace, queue, err := call.queue(input.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+	return nil, sqsBackendError(h.broker.PurgeQueue(ctx, namespace, queue))
+}
+
+func (h *SQSHandler) sendMessage(ctx context.Context, call *sqsCall) (any, error) {
+	var input struct {
+		QueueUrl          string
+		MessageBody       string
+		DelaySeconds      sqsInt
+		MessageAttributes map[string]sqsMessageAttribute
+	}
+	if err := call.decode(&input); err != nil {
+		return nil, err
+	}
+	namespace, queue, err := call.queue(input.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+	if input.MessageBody == "" {
+		return nil, sqsErrorf(sqsMissingParameter, "the request must contain the parameter MessageBody")
+	}
+	if err := input.DelaySeconds.in("DelaySeconds", 0, sqsMaxDelay); err != nil {
+		return nil, err
+	}
+	message := &proto.KokaqMessageRequest{
+		Namespace:  namespace,
+		Queue:      queue,
+		Priority:   sqsPriority,
+		Payload:    []byte(input.MessageBody),
+		Attributes: make(map[string]string),
+		DelayMs:    uint32(input.DelaySeconds.or(0)) * 1000,
+	}
+	size := len(input.MessageBody)
+	for name, attribute := range input.MessageAttributes {
+		if err := storeSQSAttribute(message.Attributes, name, attribute); err != nil {
+			return nil, err
+		}
+		size += len(name) + len(attribute.DataType) + len(attribute.StringValue) + len(attribute.BinaryValue)
+	}
+	if size > sqsMaxMessageSize {
+		return nil, sqsErrorf(sqsInvalidParameterValue, "the message must be shorter than %d bytes", sqsMaxMessageSize)
+	}
+	messageId, err := h.broker.Send(ctx, message)
+	if err != nil {
+		return nil, sqsBackendError(err)
+	}
+	return &struct {
+		MessageId              string
+		MD5OfMessageBody       string
+		MD5OfMessageAttributes string `json:",omitempty" xml:",omitempty"`
+	}{messageId, sqsMD5(input.MessageBody), sqsAttributesMD5(input.MessageAttributes)}, nil
+}
+
+// storeSQSAttribute keeps an SQS message attribute as a kokaq attribute, its
+// data type alongside when it is not String.
+func storeSQSAttribute(attributes map[string]string, name string, attribute sqsMessageAttribute) error {
+	if name == "" || strings.HasPrefix(name, sqsDataTypePrefix) {
+		return sqsErrorf(sqsInvalidParameterValue, "invalid message attribute name %q", name)
+	}
+	dataType, _, _ := strings.Cut(attribute.DataType, ".")
+	switch dataType {
+	case "String", "Number":
+		attributes[name] = attribute.StringValue
+	case "Binary":
+		attributes[name] = base64.StdEncoding.EncodeToString(attribute.BinaryValue)
+	default:
+		return sqsErrorf(sqsInvalidParameterValue, "message attribute %s has invalid data type %q", name, attribute.DataType)
+	}
+	if attribute.DataType != "String" {
+		attributes[sqsDataTypePrefix+name] = attribute.DataType
+	}
+	return nil
+}
+
+// sqsAttributesOf recovers the SQS message attributes of a message, taking
+// attributes set by other clients as strings.
+func sqsAttributesOf(attributes map[string]string) map[string]sqsMessageAttribute {
+	result := make(map[string]sqsMessageAttribute)
+	for name, value := range attributes {
+		if strings.HasPrefix(name, sqsDataTypePrefix) {
+			continue
+		}
+		dataType, typed := attributes[sqsDataTypePrefix+name]
+		if !typed {
+			dataType = "String"
+		}
+		attribute := sqsMessageAttribute{DataType: dataType, StringValue: value}
+		if strings.HasPrefix(dataType, "Binary") {
+			binary, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				continue
+			}
+			attribute = sqsMessageAttribute{DataType: dataType, BinaryValue: binary}
+		}
+		result[name] = attribute
+	}
+	return result
+}
+
+func (h *SQSHandler) receiveMessage(ctx context.Context, call *sqsCall) (any, error) {
+	var input struct {
+		QueueUrl                    string
+		MaxNumberOfMessages         sqsInt
+		VisibilityTimeout           sqsInt
+		WaitTimeSeconds             sqsInt
+		AttributeNames              []string
+		MessageSystemAttributeNames []string
+		MessageAttributeNames       []string
+	}
+	if err := call.decode(&input); err != nil {
+		return nil, err
+	}
+	namespace, queue, err := call.queue(input.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+	for _, check := range []error{
+		input.MaxNumberOfMessages.in("MaxNumberOfMessages", 1, sqsMaxMessages),
+		input.VisibilityTimeout.in("VisibilityTimeout", 0, sqsMaxVisibilityTimeout),
+		input.WaitTimeSeconds.in("WaitTimeSeconds", 0, sqsMaxWait),
+	} {
+		if check != nil {
+			return nil, check
+		}
+	}
+	// Locks last at least a second, so a visibility timeout of zero still
+	// keeps the message from this very receive.
+	var visibilityTimeout uint32
+	if input.VisibilityTimeout.set {
+		visibilityTimeout = uint32(max(input.VisibilityTimeout.value, 1))
+	}
+	count := int(input.MaxNumberOfMessages.or(1))
+	wait := time.Duration(input.WaitTimeSeconds.or(0)) * time.Second
+	systemAttributes := append(input.AttributeNames, input.MessageSystemAttributeNames...)
+
+	received, err := h.broker.Receive(ctx, namespace, queue, count, visibilityTimeout, wait)
+	if err != nil {
+		return nil, sqsBackendError(err)
+	}
+	messages := make([]*sqsMessage, 0, len(received))
+	for _, locked := range received {
+		messages = append(messages, sqsReceived(locked, systemAttributes, input.MessageAttributeNames))
+	}
+	return &struct {
+		Messages []*sqsMessage `json:",omitempty" xml:"Message,omitempty"`
+	}{messages}, nil
+}
+
+// sqsReceived describes a locked message the way ReceiveMessage returns it,
+// with the system and message attributes asked for.
+func sqsReceived(locked *proto.LockedMessage, systemAttributes []string, attributeNames []string) *sqsMessage {
+	message := locked.GetMessage()
+	body := string(message.GetMessage().GetPayload())
+	received := &sqsMessage{
+		MessageId:     message.GetMessage().GetMessageId(),
+		ReceiptHandle: sqsReceiptHandle(locked.GetLockId(), message.GetMessage().GetMessageId()),
+		MD5OfBody:     sqsMD5(body),
+		Body:          body,
+	}
+	available := sqsAttributes{
+		"ApproximateReceiveCount": strconv.FormatUint(uint64(message.GetRetryCount())+1, 10),
+		"SentTimestamp":           strconv.FormatInt(message.GetCreatedOn().AsTime().UnixMilli(), 10),
+	}
+	if message.GetLastDequeued() != nil {
+		available["ApproximateFirstReceiveTimestamp"] = strconv.FormatInt(message.GetLastDequeued().AsTime().UnixMilli(), 10)
+	}
+	for _, name := range systemAttributes {
+		if name == "All" {
+			received.Attributes = available
+			break
+		}
+		if value, known := available[name]; known {
+			if received.Attributes == nil {
+				received.Attributes = sqsAttributes{}
+			}
+			received.Attributes[name] = value
+		}
+	}
+	attributes := make(map[string]sqsMessageAttribute)
+	for name, attribute := range sqsAttributesOf(message.GetMessage().GetAttributes()) {
+		for _, wanted := range attributeNames {
+			prefix, wildcard := strings.CutSuffix(wanted, ".*")
+			if wanted == "All" || wanted == ".*" || wanted == name || (wildcard && strings.HasPrefix(name, prefix+".")) {
+				attributes[name] = attribute
+				break
+			}
+		}
+	}
+	if len(attributes) > 0 {
+		received.MessageAttributes = attributes
+		received.MD5OfMessageAttributes = sqsAttributesMD5(attributes)
+	}
+	return received
+}
+
+func (h *SQSHandler) deleteMessage(ctx context.Context, call *sqsCall) (any, error) {
+	var input struct {
+		QueueUrl      string
+		ReceiptHandle string
+	}
+	if err := call.decode(&input); err != nil {
+		return nil, err
+	}
+	namespace, queue, err := call.queue(input.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+	lockId, messageId, err := parseSQSReceiptHandle(input.ReceiptHandle)
+	if err != nil {
+		return nil, err
+	}
+	// As on SQS, deleting with a stale receipt handle succeeds: the message
+	// is either gone already or out again under a newer handle.
+	err = h.broker.Delete(ctx, namespace, queue, lockId, messageId)
+	if status.Code(err) == codes.FailedPrecondition {
+		return nil, nil
+	}
+	return nil, sqsBackendError(err)
+}
+
+func (h *SQSHandler) changeMessageVisibility(ctx context.Context, call *sqsCall) (any, error) {
+	var input struct {
+		QueueUrl          string
+		ReceiptHandle     string
+		VisibilityTimeout sqsInt
+	}
+	if err := call.decode(&input); err != nil {
+		return nil, err
+	}
+	namespace, queue, err := call.queue(input.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+	if !input.VisibilityTimeout.set {
+		return nil, sqsErrorf(sqsMissingParameter, "the request must contain the parameter VisibilityTimeout")
+	}
+	if err := input.VisibilityTimeout.in("VisibilityTimeout", 0, sqsMaxVisibilityTimeout); err != nil {
+		return nil, err
+	}
+	lockId, messageId, err := parseSQSReceiptHandle(input.ReceiptHandle)
+	if err != nil {
+		return nil, err
+	}
+	err = h.broker.ChangeVisibility(ctx, namespace, queue, lockId, messageId, time.Duration(input.VisibilityTimeout.value)*time.Second)
+	if status.Code(err) == codes.FailedPrecondition {
+		return nil, sqsErrorf(sqsMessageNotInflight, "the message referred to is not in flight")
+	}
+	return nil, sqsBackendError(err)
+}
+
+func sqsReceiptHandle(lockId string, messageId string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(lockId + ":" + messageId))
+}
+
+func parseSQSReceiptHandle(handle string) (string, string, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(handle)
+	lockId, messageId, found := strings.Cut(string(decoded), ":")
+	if err != nil || !found || lockId == "" {
+		return "", "", sqsErrorf(sqsReceiptHandleIsInvalid, "the receipt handle %q is not valid", handle)
+	}
+	return lockId, messageId, nil
+}
+
+func sqsMD5(body string) string {
+	sum := md5.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// sqsAttributesMD5 digests message attributes the way SQS does, so SDKs
+// can check them: sorted by name, each length-prefixed name, data type,
+// transport type and value.
+func sqsAttributesMD5(attributes map[string]sqsMessageAttribute) string {
+	if len(attributes) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	digest := md5.New()
+	field := func(value []byte) {
+		binary.Write(digest, binary.BigEndian, uint32(len(value)))
+		digest.Write(value)
+	}
+	for _, name := range names {
+		attribute := attributes[name]
+		field([]byte(name))
+		field([]byte(attribute.DataType))
+		if strings.HasPrefix(attribute.DataType, "Binary") {
+			digest.Write([]byte{2})
+			field(attribute.BinaryValue)
+		} else {
+			digest.Write([]byte{1})
+			field([]byte(attribute.StringValue))
+		}
+	}
+	return hex.EncodeToString(digest.Sum(nil))
+}
+
+func writeSQSResult(w http.ResponseWriter, call *sqsCall, result any) {
+	w.Header().Set("x-amzn-RequestId", call.requestId)
+	if call.json {
+		if result == nil {
+			result = struct{}{}
+		}
+		w.Header().Set("Content-Type", sqsJSONContentType)
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+	var body bytes.Buffer
+	body.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&body)
+	response := xml.StartElement{Name: xml.Name{Space: sqsXMLNamespace, Local: call.action + "Response"}}
+	encoder.EncodeToken(response)
+	if result != nil {
+		if err := encoder.EncodeElement(result, xml.StartElement{Name: xml.Name{Local: call.action + "Result"}}); err != nil {
+			logger.ConsoleLog("ERROR", "SQS - cannot encode %s result: %v", call.action, err)
+			writeSQSError(w, call, sqsErrorf(sqsInternalError, "cannot encode response"))
+			return
+		}
+	}
+	encoder.EncodeElement(struct{ RequestId string }{call.requestId}, xml.StartElement{Name: xml.Name{Local: "ResponseMetadata"}})
+	encoder.EncodeToken(response.End())
+	encoder.Flush()
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(body.Bytes())
+}
+
+// sqsErrorCode is an SQS error. name is the error type of the JSON protocol
+// and queryCode, when set, the code of the query protocol.
+type sqsErrorCode struct {
+	name      string
+	queryCode string
+	status    int
+}
+
+var (
+	sqsQueueDoesNotExist      = sqsErrorCode{"QueueDoesNotExist", "AWS.SimpleQueueService.NonExistentQueue", http.StatusBadRequest}
+	sqsReceiptHandleIsInvalid = sqsErrorCode{"ReceiptHandleIsInvalid", "", http.StatusBadRequest}
+	sqsMessageNotInflight     = sqsErrorCode{"MessageNotInflight", "AWS.SimpleQueueService.MessageNotInflight", http.StatusBadRequest}
+	sqsInvalidParameterValue  = sqsErrorCode{"InvalidParameterValue", "", http.StatusBadRequest}
+	sqsInvalidAttributeName   = sqsErrorCode{"InvalidAttributeName", "", http.StatusBadRequest}
+	sqsInvalidAttributeValue  = sqsErrorCode{"InvalidAttributeValue", "", http.StatusBadRequest}
+	sqsMissingParameter       = sqsErrorCode{"MissingParameter", "", http.StatusBadRequest}
+	sqsMissingAction          = sqsErrorCode{"MissingAction", "", http.StatusBadRequest}
+	sqsInvalidAction          = sqsErrorCode{"InvalidAction", "", http.StatusBadRequest}
+	sqsUnknownOperation       = sqsErrorCode{"UnknownOperationException", "", http.StatusBadRequest}
+	sqsRequestThrottled       = sqsErrorCode{"RequestThrottled", "", http.StatusBadRequest}
+	sqsInvalidClientTokenId   = sqsErrorCode{"InvalidClientTokenId", "", http.StatusForbidden}
+	sqsAccessDenied           = sqsErrorCode{"AccessDenied", "", http.StatusForbidden}
+	sqsInternalError          = sqsErrorCode{"InternalError", "", http.StatusInternalServerError}
+	sqsServiceUnavailable     = sqsErrorCode{"ServiceUnavailable", "", http.StatusServiceUnavailable}
+)
+
+type sqsError struct {
+	code    sqsErrorCode
+	message string
+}
+
+func (e *sqsError) Error() string {
+	return e.code.name + ": " + e.message
+}
+
+func sqsErrorf(code sqsErrorCode, format string, args ...any) *sqsError {
+	return &sqsError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// sqsBackendError maps the gRPC status of a broker call to the SQS error
+// clients expect.
+func sqsBackendError(err error) error {
+	if err == nil {
+		return nil
+	}
+	st := status.Convert(err)
+	switch st.Code() {
+	case codes.NotFound:
+		return sqsErrorf(sqsQueueDoesNotExist, "%s", st.Message())
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange, codes.AlreadyExists:
+		return sqsErrorf(sqsInvalidParameterValue, "%s", st.Message())
+	case codes.Unauthenticated:
+		return sqsErrorf(sqsInvalidClientTokenId, "%s", st.Message())
+	case codes.PermissionDenied:
+		return sqsErrorf(sqsAccessDenied, "%s", st.Message())
+	case codes.ResourceExhausted:
+		return sqsErrorf(sqsRequestThrottled, "%s", st.Message())
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return sqsErrorf(sqsServiceUnavailable, "%s", st.Message())
+	}
+	return sqsErrorf(sqsInternalError, "%s", st.Message())
+}
+
+func writeSQSError(w http.ResponseWriter, call *sqsCall, err error) {
+	e, ok := err.(*sqsError)
+	if !ok {
+		e = sqsErrorf(sqsInternalError, "%v", err)
+	}
+	fault := "Sender"
+	if e.code.status >= http.StatusInternalServerError {
+		fault = "Receiver"
+	}
+	queryCode := e.code.queryCode
+	if queryCode == "" {
+		queryCode = e.code.name
+	}
+	w.Header().Set("x-amzn-RequestId", call.requestId)
+	if call.json {
+		w.Header().Set("Content-Type", sqsJSONContentType)
+		w.Header().Set("x-amzn-query-error", queryCode+";"+fault)
+		w.WriteHeader(e.code.status)
+		json.NewEncoder(w).Encode(map[string]string{
+			"__type":  "com.amazonaws.sqs#" + e.code.name,
+			"message": e.message,
+		})
+		return
+	}
+	var body bytes.Buffer
+	body.WriteString(xml.Header)
+	xml.NewEncoder(&body).Encode(struct {
+		XMLName xml.Name `xml:"ErrorResponse"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Error   struct {
+			Type    string
+			Code    string
+			Message string
+		}
+		RequestId string
+	}{
+		Xmlns: sqsXMLNamespace,
+		Error: struct {
+			Type    string
+			Code    string
+			Message string
+		}{fault, queryCode, e.message},
+		RequestId: call.requestId,
+	})
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(e.code.status)
+	w.Write(body.Bytes())
+}
@@ -0,0 +1,95 @@
+package internals
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func TestParseSQSReceiptHandle(t *testing.T) {
+	tests := []struct {
+		name      string
+		handle    string
+		lockId    string
+		messageId string
+		valid     bool
+	}{
+		{"round trip", sqsReceiptHandle("lock-1", "message-1"), "lock-1", "message-1", true},
+		{"message id with colon", sqsReceiptHandle("lock-1", "a:b"), "lock-1", "a:b", true},
+		{"empty message id", sqsReceiptHandle("lock-1", ""), "lock-1", "", true},
+		{"empty", "", "", "", false},
+		{"not base64", "not a handle!", "", "", false},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte("lock-1:message-1")), "", "", false},
+		{"no separator", base64.RawURLEncoding.EncodeToString([]byte("lock-1")), "", "", false},
+		{"empty lock id", base64.RawURLEncoding.EncodeToString([]byte(":message-1")), "", "", false},
+	}
+	for _, tt := range tests {
+		lockId, messageId, err := parseSQSReceiptHandle(tt.handle)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("%s: parseSQSReceiptHandle(%q) = %q, %q; want an error", tt.name, tt.handle, lockId, messageId)
+			} else if sqsErr, ok := err.(*sqsError); !ok || sqsErr.code != sqsReceiptHandleIsInvalid {
+				t.Errorf("%s: parseSQSReceiptHandle(%q) error = %v; want %s", tt.name, tt.handle, err, sqsReceiptHandleIsInvalid.name)
+			}
+			continue
+		}
+		if err != nil || lockId != tt.lockId || messageId != tt.messageId {
+			t.Errorf("%s: parseSQSReceiptHandle(%q) = %q, %q, %v; want %q, %q", tt.name, tt.handle, lockId, messageId, err, tt.lockId, tt.messageId)
+		}
+	}
+}
+
+func TestSQSQueryInput(t *testing.T) {
+	tests := []struct {
+		name string
+		form url.Values
+		want string
+	}{
+		{"scalars", url.Values{"QueueUrl": {"http://host/ns/q"}, "MaxNumberOfMessages": {"5"}}, `{"MaxNumberOfMessages":"5","QueueUrl":"http://host/ns/q"}`},
+		{"list in index order", url.Values{"AttributeName.2": {"b"}, "AttributeName.10": {"c"}, "AttributeName.1": {"a"}}, `{"AttributeNames":["a","b","c"]}`},
+		{"map of values", url.Values{"Attribute.1.Name": {"DelaySeconds"}, "Attribute.1.Value": {"5"}}, `{"Attributes":{"DelaySeconds":"5"}}`},
+		{"map of keys", url.Values{"Tag.1.Key": {"team"}, "Tag.1.Value": {"core"}}, `{"Tags":{"team":"core"}}`},
+		{"map of fields", url.Values{"MessageAttribute.1.Name": {"color"}, "MessageAttribute.1.Value.DataType": {"String"}, "MessageAttribute.1.Value.StringValue": {"red"}}, `{"MessageAttributes":{"color":{"DataType":"String","StringValue":"red"}}}`},
+		{"index below one", url.Values{"Name.0": {"x"}}, `{"Name.0":"x"}`},
+	}
+	for _, tt := range tests {
+		got, err := sqsQueryInput(tt.form)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: sqsQueryInput(%v) = %s, %v; want %s", tt.name, tt.form, got, err, tt.want)
+		}
+	}
+}
+
+func TestSQSContext(t *testing.T) {
+	tests := []struct {
+		name          string
+		header        http.Header
+		form          url.Values
+		apiKey        string
+		authorization string
+	}{
+		{"api key", http.Header{"X-Api-Key": {"key-1"}}, nil, "key-1", ""},
+		{"bearer token", http.Header{"Authorization": {"Bearer token-1"}}, nil, "", "Bearer token-1"},
+		{"sigv4 header", http.Header{"Authorization": {"AWS4-HMAC-SHA256 Credential=AKID/20260101/us-east-1/sqs/aws4_request, SignedHeaders=host, Signature=abc"}}, nil, "", ""},
+		{"sigv4 query", nil, url.Values{"X-Amz-Credential": {"AKID/20260101/us-east-1/sqs/aws4_request"}}, "", ""},
+		{"sigv2 query", nil, url.Values{"AWSAccessKeyId": {"AKID"}}, "", ""},
+		{"api key next to sigv4", http.Header{"X-Api-Key": {"key-1"}, "Authorization": {"AWS4-HMAC-SHA256 Credential=AKID/20260101/us-east-1/sqs/aws4_request"}}, nil, "key-1", ""},
+	}
+	for _, tt := range tests {
+		r := &http.Request{Header: tt.header, Form: tt.form}
+		if r.Header == nil {
+			r.Header = http.Header{}
+		}
+		md, _ := metadata.FromOutgoingContext(sqsContext(r))
+		if got := strings.Join(md.Get(apiKeyHeader), ","); got != tt.apiKey {
+			t.Errorf("%s: %s = %q; want %q", tt.name, apiKeyHeader, got, tt.apiKey)
+		}
+		if got := strings.Join(md.Get(authorizationHeader), ","); got != tt.authorization {
+			t.Errorf("%s: %s = %q; want %q", tt.name, authorizationHeader, got, tt.authorization)
+		}
+	}
+}
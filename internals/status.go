@@ -0,0 +1,65 @@
+package internals
+
+import (
+	"context"
+	"errors"
+
+	"github.com/kokaq/protocol/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorCodes maps the error codes handlers report in StatusResponse to gRPC
+// status codes.
+var errorCodes = map[proto.ErrorCode]codes.Code{
+	proto.ErrorCode_ERROR_NOT_FOUND:          codes.NotFound,
+	proto.ErrorCode_ERROR_UNAUTHORIZED:       codes.PermissionDenied,
+	proto.ErrorCode_ERROR_INTERNAL:           codes.Internal,
+	proto.ErrorCode_ERROR_QUEUE_DISABLED:     codes.FailedPrecondition,
+	proto.ErrorCode_ERROR_SHARD_UNHEALTHY:    codes.Unavailable,
+	proto.ErrorCode_ERROR_TIMEOUT:            codes.DeadlineExceeded,
+	proto.ErrorCode_ERROR_INVALID_ARGUMENT:   codes.InvalidArgument,
+	proto.ErrorCode_ERROR_DEPENDENCY_FAILURE: codes.Unavailable,
+}
+
+// statusError gives a plain handler error the status code its response
+// reports, so callers see NotFound rather than Unknown. Errors that already
+// carry a status are kept.
+func statusError(resp interface{}, err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	}
+	var reported *proto.StatusResponse
+	switch r := resp.(type) {
+	case *proto.StatusResponse:
+		reported = r
+	case interface{ GetStatus() *proto.StatusResponse }:
+		reported = r.GetStatus()
+	}
+	if code, known := errorCodes[reported.GetError()]; known {
+		return status.Error(code, err.Error())
+	}
+	return err
+}
+
+func statusUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		if err != nil {
+			err = statusError(resp, err)
+		}
+		return resp, err
+	}
+}
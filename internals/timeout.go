@@ -2,6 +2,10 @@ package internals
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
 	"time"
 
 	"google.golang.org/grpc"
@@ -9,33 +13,153 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-func requestTimeoutUnaryInterceptor(timeout time.Duration, telemetryLogger TelemetryLogger) grpc.UnaryServerInterceptor {
+// TimeoutConfig bounds how long RPCs may run. Overrides are keyed by full
+// method name (/proto.KokaqDataPlane/Dequeue) or bare method name (Dequeue),
+// the full name winning. A zero timeout leaves the method unbounded by the
+// server, though callers' own deadlines still apply. Server streams are only
+// bounded by an override.
+type TimeoutConfig struct {
+	Default   time.Duration
+	Overrides map[string]time.Duration
+}
+
+// For returns the timeout of fullMethod.
+func (config TimeoutConfig) For(fullMethod string) time.Duration {
+	if timeout, overridden := config.override(fullMethod); overridden {
+		return timeout
+	}
+	return config.Default
+}
+
+func (config TimeoutConfig) override(fullMethod string) (time.Duration, bool) {
+	if timeout, exist := config.Overrides[fullMethod]; exist {
+		return timeout, true
+	}
+	timeout, exist := config.Overrides[fullMethod[strings.LastIndex(fullMethod, "/")+1:]]
+	return timeout, exist
+}
+
+// ParseTimeoutOverrides reads comma separated method=duration pairs, e.g.
+// "Dequeue=60s,/proto.KokaqDataPlane/Peek=2s".
+func ParseTimeoutOverrides(overrides string) (map[string]time.Duration, error) {
+	parsed := make(map[string]time.Duration)
+	for _, pair := range strings.Split(overrides, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		method, value, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("timeout override %q is not method=duration", pair)
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("timeout override %q has a bad duration", pair)
+		}
+		parsed[strings.TrimSpace(method)] = timeout
+	}
+	return parsed, nil
+}
+
+// WithEnvDefaults fills a zero Default from REQUEST_TIMEOUT and adds the
+// overrides in REQUEST_TIMEOUT_OVERRIDES for methods not overridden yet.
+func (config TimeoutConfig) WithEnvDefaults() (TimeoutConfig, error) {
+	if value := os.Getenv("REQUEST_TIMEOUT"); config.Default == 0 && value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return config, fmt.Errorf("bad REQUEST_TIMEOUT %q: %v", value, err)
+		}
+		config.Default = timeout
+	}
+	overrides, err := ParseTimeoutOverrides(os.Getenv("REQUEST_TIMEOUT_OVERRIDES"))
+	if err != nil {
+		return config, err
+	}
+	merged := make(map[string]time.Duration, len(config.Overrides)+len(overrides))
+	for method, timeout := range overrides {
+		merged[method] = timeout
+	}
+	for method, timeout := range config.Overrides {
+		merged[method] = timeout
+	}
+	config.Overrides = merged
+	return config, nil
+}
+
+// OrDefault returns config with timeout as the default when none is set.
+func (config TimeoutConfig) OrDefault(timeout time.Duration) TimeoutConfig {
+	if config.Default == 0 {
+		config.Default = timeout
+	}
+	return config
+}
+
+func logTimeout(telemetryLogger TelemetryLogger, fullMethod string, err error) {
+	if telemetryLogger != nil {
+		telemetryLogger.LogEvent(EventRequestTimeout, map[string]interface{}{
+			"method": fullMethod,
+			"error":  err.Error(),
+		})
+	}
+}
+
+// requestTimeoutUnaryInterceptor bounds the context of a call by the method's
+// timeout, or the caller's earlier deadline. The handler runs inline so it
+// never outlives the call; its error is replaced once the deadline has passed,
+// while a result it still produced is returned as is.
+func requestTimeoutUnaryInterceptor(config TimeoutConfig, telemetryLogger TelemetryLogger) grpc.UnaryServerInterceptor {
 	return func(
 		ctx context.Context,
 		req interface{},
 		info *grpc.UnaryServerInfo,
 		handler grpc.UnaryHandler,
 	) (interface{}, error) {
-		ctx, cancel := context.WithTimeout(ctx, timeout)
-		defer cancel()
-		done := make(chan struct{})
-		var resp interface{}
-		var err error
-		go func() {
-			resp, err = handler(ctx, req)
-			close(done)
-		}()
-		select {
-		case <-done:
-			return resp, err
-		case <-ctx.Done():
-			if telemetryLogger != nil {
-				telemetryLogger.LogEvent(EventRequestTimeout, map[string]interface{}{
-					"method": info.FullMethod,
-					"error":  ctx.Err().Error(),
-				})
-			}
+		if timeout := config.For(info.FullMethod); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		resp, err := handler(ctx, req)
+		if err == nil {
+			return resp, nil
+		}
+		switch {
+		case errors.Is(ctx.Err(), context.Canceled):
+			return nil, status.Error(codes.Canceled, "request cancelled")
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			logTimeout(telemetryLogger, info.FullMethod, ctx.Err())
 			return nil, status.Error(codes.DeadlineExceeded, "request timed out")
 		}
+		return resp, err
+	}
+}
+
+// requestTimeoutStreamInterceptor bounds the context of a stream. Like for
+// unary calls the handler is waited for and its error replaced once the
+// deadline has passed.
+func requestTimeoutStreamInterceptor(config TimeoutConfig, telemetryLogger TelemetryLogger) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		// Server streams such as Receive deliver for as long as the client
+		// listens, so only an explicit override bounds them.
+		timeout, overridden := config.override(info.FullMethod)
+		if !overridden && !info.IsServerStream {
+			timeout = config.Default
+		}
+		if timeout <= 0 || authExempt(info.FullMethod) {
+			return handler(srv, stream)
+		}
+		ctx, cancel := context.WithTimeout(stream.Context(), timeout)
+		defer cancel()
+		err := handler(srv, &contextStream{ServerStream: stream, ctx: ctx})
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			logTimeout(telemetryLogger, info.FullMethod, ctx.Err())
+			return status.Error(codes.DeadlineExceeded, "request timed out")
+		}
+		return err
 	}
 }
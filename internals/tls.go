@@ -0,0 +1,239 @@
+package internals
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kokaq/core/internals/logger"
+	"google.golang.org/grpc/credentials"
+)
+
+const certReloadInterval = 10 * time.Second
+
+// TLSConfig locates the certificate a node serves and dials with, and the CA
+// that signs its peers. ClientAuth is one of none, request or require and
+// decides whether listeners ask callers for a certificate signed by CAFile.
+type TLSConfig struct {
+	CertFile   string
+	KeyFile    string
+	CAFile     string
+	ClientAuth string
+	ServerName string
+}
+
+// WithEnvDefaults fills the fields left empty from the TLS_CERT_FILE,
+// TLS_KEY_FILE, TLS_CA_FILE, TLS_CLIENT_AUTH and TLS_SERVER_NAME environment
+// variables.
+func (config TLSConfig) WithEnvDefaults() TLSConfig {
+	fields := []struct {
+		value *string
+		env   string
+	}{
+		{&config.CertFile, "TLS_CERT_FILE"},
+		{&config.KeyFile, "TLS_KEY_FILE"},
+		{&config.CAFile, "TLS_CA_FILE"},
+		{&config.ClientAuth, "TLS_CLIENT_AUTH"},
+		{&config.ServerName, "TLS_SERVER_NAME"},
+	}
+	for _, field := range fields {
+		if *field.value == "" {
+			*field.value = os.Getenv(field.env)
+		}
+	}
+	return config
+}
+
+func (config TLSConfig) Enabled() bool {
+	return config.CertFile != "" && config.KeyFile != ""
+}
+
+func (config TLSConfig) clientAuth() (tls.ClientAuthType, error) {
+	switch config.ClientAuth {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("unknown tls client auth %q, expected none, request or require", config.ClientAuth)
+}
+
+// Mode describes the transport security for startup banners.
+func (config TLSConfig) Mode() string {
+	if !config.Enabled() {
+		return "Disabled"
+	}
+	switch config.ClientAuth {
+	case "request":
+		return "TLS, optional client certificates"
+	case "require":
+		return "Mutual TLS"
+	}
+	return "TLS"
+}
+
+// certReloader serves the certificate and CA files of a TLSConfig and picks
+// up rotated files without a restart, checking their modification times
+// every certReloadInterval.
+type certReloader struct {
+	mutex    sync.RWMutex
+	config   TLSConfig
+	cert     *tls.Certificate
+	roots    *x509.CertPool
+	modTimes map[string]time.Time
+	stop     chan struct{}
+	once     sync.Once
+}
+
+func newCertReloader(config TLSConfig) (*certReloader, error) {
+	r := &certReloader{
+		config:   config,
+		modTimes: make(map[string]time.Time),
+		stop:     make(chan struct{}),
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	go r.watch()
+	return r, nil
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.config.CertFile, r.config.KeyFile}
+	if r.config.CAFile != "" {
+		files = append(files, r.config.CAFile)
+	}
+	return files
+}
+
+func (r *certReloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate %s: %v", r.config.CertFile, err)
+	}
+	var roots *x509.CertPool
+	if r.config.CAFile != "" {
+		pem, err := os.ReadFile(r.config.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read ca %s: %v", r.config.CAFile, err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in ca %s", r.config.CAFile)
+		}
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.cert = &cert
+	r.roots = roots
+	r.modTimes = modTimes
+	return nil
+}
+
+func (r *certReloader) changed() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err == nil && !info.ModTime().Equal(r.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the files when they change. A rotation caught half-written
+// fails to load and keeps the previous certificate until the next check.
+func (r *certReloader) watch() {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			if err := r.load(); err != nil {
+				logger.ConsoleLog("WARN", "Failed to reload certificate, keeping the previous one: %v", err)
+				continue
+			}
+			logger.ConsoleLog("INFO", "Reloaded certificate %s", r.config.CertFile)
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+func (r *certReloader) Close() {
+	r.once.Do(func() { close(r.stop) })
+}
+
+func (r *certReloader) certificate() *tls.Certificate {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.cert
+}
+
+func (r *certReloader) rootCAs() *x509.CertPool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.roots
+}
+
+// serverConfig builds a listener configuration that always presents the
+// latest certificate and verifies clients against the latest CA.
+func (r *certReloader) serverConfig(nextProtos ...string) (*tls.Config, error) {
+	clientAuth, err := r.config.clientAuth()
+	if err != nil {
+		return nil, err
+	}
+	if clientAuth != tls.NoClientCert && r.config.CAFile == "" {
+		return nil, fmt.Errorf("tls client auth %q needs a ca file", r.config.ClientAuth)
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.certificate()},
+				ClientAuth:   clientAuth,
+				ClientCAs:    r.rootCAs(),
+				NextProtos:   nextProtos,
+			}, nil
+		},
+	}, nil
+}
+
+func (r *certReloader) serverCredentials() (credentials.TransportCredentials, error) {
+	config, err := r.serverConfig("h2")
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// clientCredentials builds dial credentials that present the latest
+// certificate to peers and verify them against the CA current at dial time.
+func (r *certReloader) clientCredentials() credentials.TransportCredentials {
+	return credentials.NewTLS(&tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    r.rootCAs(),
+		ServerName: r.config.ServerName,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.certificate(), nil
+		},
+	})
+}
@@ -0,0 +1,144 @@
+package internals
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/kokaq/core/internals/logger"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingConfig selects where spans go. Exporter is one of none, otlp (gRPC
+// to Endpoint, a local collector at localhost:4317 by default), console or
+// file (JSON lines appended to File).
+type TracingConfig struct {
+	Exporter    string
+	Endpoint    string
+	File        string
+	ServiceName string
+}
+
+// WithEnvDefaults fills the fields left empty from the OTEL_TRACES_EXPORTER,
+// OTEL_EXPORTER_OTLP_ENDPOINT, OTEL_TRACES_FILE and OTEL_SERVICE_NAME
+// environment variables.
+func (config TracingConfig) WithEnvDefaults() TracingConfig {
+	fields := []struct {
+		value *string
+		env   string
+	}{
+		{&config.Exporter, "OTEL_TRACES_EXPORTER"},
+		{&config.Endpoint, "OTEL_EXPORTER_OTLP_ENDPOINT"},
+		{&config.File, "OTEL_TRACES_FILE"},
+		{&config.ServiceName, "OTEL_SERVICE_NAME"},
+	}
+	for _, field := range fields {
+		if *field.value == "" {
+			*field.value = os.Getenv(field.env)
+		}
+	}
+	return config
+}
+
+// Mode describes the trace exporter for startup banners.
+func (config TracingConfig) Mode() string {
+	switch config.Exporter {
+	case "", "none":
+		return "Disabled"
+	case "otlp":
+		if config.Endpoint == "" {
+			return "OTLP [localhost:4317]"
+		}
+		return fmt.Sprintf("OTLP [%s]", config.Endpoint)
+	case "file":
+		return fmt.Sprintf("File [%s]", config.File)
+	}
+	return "Console"
+}
+
+// StartTracing installs the W3C trace context propagator and, unless tracing
+// is disabled, a tracer provider exporting to the configured destination.
+// The returned function flushes pending spans and must run before exit.
+func StartTracing(ctx context.Context, config TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	var exporter sdktrace.SpanExporter
+	var closer io.Closer
+	var err error
+	switch config.Exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		options := []otlptracegrpc.Option{otlptracegrpc.WithInsecure()}
+		if config.Endpoint != "" {
+			options = append(options, otlptracegrpc.WithEndpoint(config.Endpoint))
+		}
+		exporter, err = otlptracegrpc.New(ctx, options...)
+	case "console":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "file":
+		if config.File == "" {
+			return nil, fmt.Errorf("file trace exporter needs a file")
+		}
+		file, openErr := os.OpenFile(config.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if openErr != nil {
+			return nil, fmt.Errorf("failed to open trace file %s: %v", config.File, openErr)
+		}
+		closer = file
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, expected none, otlp, console or file", config.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %v", config.Exporter, err)
+	}
+	res, err := serviceResource(config.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	logger.ConsoleLog("INFO", "Exporting traces of %s to %s", config.ServiceName, config.Mode())
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			err = errors.Join(err, closer.Close())
+		}
+		return err
+	}, nil
+}
+
+// serviceResource describes this process to exporters as serviceName.
+func serviceResource(serviceName string) (*resource.Resource, error) {
+	return resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(serviceName)))
+}
+
+// Queue span attributes shared by the planes.
+func QueueAttributes(namespace string, queue string) trace.SpanStartOption {
+	return trace.WithAttributes(
+		attribute.String("kokaq.namespace", namespace),
+		attribute.String("kokaq.queue", queue),
+	)
+}
+
+// EndSpan records err on span, if any, and ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}